@@ -0,0 +1,347 @@
+// Copyright (c) 2016 The MQPP Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package broker implements an embeddable MQTT 3.1.1 broker on top of mqpp packets.
+//
+// A Broker serves any number of net.Listeners, or single connections through
+// ServeConn, so it runs on loopback or over net.Pipe, see Dial, without external services:
+//
+//	b := broker.New(broker.Options{})
+//	l, _ := net.Listen("tcp", "127.0.0.1:1883")
+//	go b.Serve(l)
+//	...
+//	b.Close()
+package broker
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/abo/mqpp"
+	"github.com/abo/mqpp/store"
+	"github.com/abo/mqpp/trace"
+)
+
+// ErrClosed - broker has been closed
+var ErrClosed = errors.New("mqpp/broker: Broker Closed")
+
+// Authenticator decides whether a connection is accepted, it returns
+// mqpp.Accepted or one of the connect refused return codes.
+type Authenticator interface {
+	Authenticate(remote net.Addr, c *mqpp.Connect) byte
+}
+
+// AuthenticatorFunc is an adapter to use ordinary functions as Authenticator
+type AuthenticatorFunc func(remote net.Addr, c *mqpp.Connect) byte
+
+// Authenticate calls f(remote, c)
+func (f AuthenticatorFunc) Authenticate(remote net.Addr, c *mqpp.Connect) byte {
+	return f(remote, c)
+}
+
+// Options configures a Broker
+type Options struct {
+	// Authenticator checks every CONNECT, nil accepts all clients
+	Authenticator Authenticator
+	// ConnectTimeout is how long to wait for CONNECT after accepting, default 10s
+	ConnectTimeout time.Duration
+	// Retained keeps retained messages, default an unlimited in-memory store
+	Retained store.RetainedStore
+	// Sessions persists sessions without clean session flag, so they survive
+	// restarts, nil keeps them in memory only
+	Sessions store.SessionStore
+	// MaxQueued bounds messages kept for an offline persistent session, default 1000, oldest dropped first
+	MaxQueued int
+	// MaxPacketSize bounds packets read from a client, CONNECT included, default
+	// 1MiB, at most mqpp.MaxPacketSize. A client sending a larger one is disconnected.
+	MaxPacketSize int
+	// Hook traces packets read and written, a read span ends once the packet is handled,
+	// including routing of PUBLISH
+	Hook trace.Hook
+}
+
+// Broker routes publishes between connected clients, it is safe for concurrent use
+type Broker struct {
+	opts Options
+
+	mu        sync.Mutex
+	closed    bool
+	sessions  map[string]*session
+	listeners map[net.Listener]struct{}
+	conns     map[*conn]struct{}
+	nextAnon  uint64
+	wg        sync.WaitGroup
+
+	// persist holds the latest snapshot of each session waiting to be saved,
+	// nil for a session to delete. The persister saves them outside mu.
+	persist   map[string]*store.Session
+	persistC  chan struct{}
+	persisted chan struct{}
+}
+
+// New create a broker with options
+func New(opts Options) *Broker {
+	if opts.ConnectTimeout <= 0 {
+		opts.ConnectTimeout = 10 * time.Second
+	}
+	if opts.Retained == nil {
+		opts.Retained = store.NewMemoryRetained(store.RetainedLimits{})
+	}
+	if opts.MaxQueued <= 0 {
+		opts.MaxQueued = 1000
+	}
+	if opts.MaxPacketSize <= 0 {
+		opts.MaxPacketSize = 1 << 20
+	} else if opts.MaxPacketSize > mqpp.MaxPacketSize {
+		opts.MaxPacketSize = mqpp.MaxPacketSize
+	}
+	b := &Broker{
+		opts:      opts,
+		sessions:  make(map[string]*session),
+		listeners: make(map[net.Listener]struct{}),
+		conns:     make(map[*conn]struct{}),
+	}
+	if opts.Sessions != nil {
+		b.persist = make(map[string]*store.Session)
+		b.persistC = make(chan struct{}, 1)
+		b.persisted = make(chan struct{})
+		b.restore()
+		go b.persister(b.persistC)
+	}
+	return b
+}
+
+// restore loads stored sessions, those can't be loaded are skipped
+func (b *Broker) restore() {
+	ids, _ := b.opts.Sessions.ClientIDs()
+	for _, id := range ids {
+		if st, ok, err := b.opts.Sessions.Load(id); err == nil && ok {
+			b.sessions[id] = restoreSession(st)
+		}
+	}
+}
+
+// persistLocked queues the state of a persistent session to be saved. Persistence
+// is best effort, a failing or slow store doesn't stop routing.
+func (b *Broker) persistLocked(s *session) {
+	if s.clean {
+		return
+	}
+	b.queueLocked(s.clientID, s.snapshotLocked())
+}
+
+// unpersistLocked queues the stored session of clientID to be deleted
+func (b *Broker) unpersistLocked(clientID string) {
+	b.queueLocked(clientID, nil)
+}
+
+func (b *Broker) queueLocked(clientID string, st *store.Session) {
+	if b.persistC == nil {
+		return
+	}
+	b.persist[clientID] = st
+	select {
+	case b.persistC <- struct{}{}:
+	default:
+	}
+}
+
+// persister writes queued snapshots to the session store until c is closed,
+// a session changed several times meanwhile is saved once.
+func (b *Broker) persister(c chan struct{}) {
+	defer close(b.persisted)
+	for range c {
+		b.mu.Lock()
+		pending := b.persist
+		b.persist = make(map[string]*store.Session)
+		b.mu.Unlock()
+
+		for clientID, st := range pending {
+			if st == nil {
+				b.opts.Sessions.Delete(clientID)
+			} else {
+				b.opts.Sessions.Save(st)
+			}
+		}
+	}
+}
+
+// Serve accepts connections on l and serves each on its own goroutine, it
+// blocks until l fails or the broker is closed.
+func (b *Broker) Serve(l net.Listener) error {
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		return ErrClosed
+	}
+	b.listeners[l] = struct{}{}
+	b.mu.Unlock()
+
+	defer func() {
+		b.mu.Lock()
+		delete(b.listeners, l)
+		b.mu.Unlock()
+	}()
+
+	for {
+		nc, err := l.Accept()
+		if err != nil {
+			b.mu.Lock()
+			closed := b.closed
+			b.mu.Unlock()
+			if closed {
+				return ErrClosed
+			}
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				time.Sleep(10 * time.Millisecond)
+				continue
+			}
+			return err
+		}
+		go b.ServeConn(nc)
+	}
+}
+
+// Dial connects to b in process over net.Pipe, b.Dial fits client.Options.Dial
+func (b *Broker) Dial() (net.Conn, error) {
+	c, s := net.Pipe()
+	go b.ServeConn(s)
+	return c, nil
+}
+
+// ServeConn serves a single connection until it's closed
+func (b *Broker) ServeConn(nc net.Conn) {
+	c := newConn(b, nc)
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		nc.Close()
+		return
+	}
+	b.conns[c] = struct{}{}
+	b.wg.Add(1)
+	b.mu.Unlock()
+
+	defer b.wg.Done()
+	c.serve()
+
+	b.mu.Lock()
+	delete(b.conns, c)
+	b.mu.Unlock()
+}
+
+// Close closes all listeners and connections, waits for connections to finish,
+// and closes the retained and session stores.
+func (b *Broker) Close() error {
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		return nil
+	}
+	b.closed = true
+	for l := range b.listeners {
+		l.Close()
+	}
+	conns := make([]*conn, 0, len(b.conns))
+	for c := range b.conns {
+		conns = append(conns, c)
+	}
+	b.mu.Unlock()
+
+	for _, c := range conns {
+		c.close(ErrClosed)
+	}
+	b.wg.Wait()
+	err := b.opts.Retained.Close()
+	if b.opts.Sessions != nil {
+		// flush what's queued before closing the store
+		b.mu.Lock()
+		close(b.persistC)
+		b.persistC = nil
+		b.mu.Unlock()
+		<-b.persisted
+		if serr := b.opts.Sessions.Close(); err == nil {
+			err = serr
+		}
+	}
+	return err
+}
+
+// delivery is a publish ready to be written to a connection
+type delivery struct {
+	to  *conn
+	pkt mqpp.ControlPacket
+}
+
+// send queues ds on the connection serving the caller, waiting for room
+func send(ctx context.Context, ds []delivery) {
+	for _, d := range ds {
+		d.to.send(ctx, d.pkt)
+	}
+}
+
+// publish routes an application message to every matching subscription and
+// updates retained messages when retain flag set. ctx is the parent of the
+// write spans of the deliveries.
+func (b *Broker) publish(ctx context.Context, p *mqpp.Publish) {
+	if p.Retain() {
+		// a message over the store's limits is still delivered, just not retained
+		b.opts.Retained.Store(p)
+	}
+
+	b.mu.Lock()
+	var ds []delivery
+	for _, s := range b.sessions {
+		qos, ok := s.match(p.TopicName())
+		if !ok {
+			continue
+		}
+		if p.QoS() < qos {
+			qos = p.QoS()
+		}
+		if d, ok := s.deliverLocked(b.opts.MaxQueued, qos, false, p.TopicName(), p.Payload()); ok {
+			ds = append(ds, d)
+		}
+		if qos > mqpp.QosAtMostOnce {
+			b.persistLocked(s)
+		}
+	}
+	b.mu.Unlock()
+
+	for _, d := range ds {
+		d.to.deliver(ctx, d.pkt)
+	}
+}
+
+// retainedLocked returns deliveries of retained messages matching a new subscription
+func (b *Broker) retainedLocked(s *session, filter string, qos byte) []delivery {
+	msgs, err := b.opts.Retained.Match(filter)
+	if err != nil {
+		return nil
+	}
+	var ds []delivery
+	for _, p := range msgs {
+		q := p.QoS()
+		if qos < q {
+			q = qos
+		}
+		if d, ok := s.deliverLocked(b.opts.MaxQueued, q, true, p.TopicName(), p.Payload()); ok {
+			ds = append(ds, d)
+		}
+	}
+	return ds
+}
@@ -0,0 +1,471 @@
+// Copyright (c) 2016 The MQPP Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package broker
+
+import (
+	"context"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/abo/mqpp"
+	"github.com/abo/mqpp/client"
+	"github.com/abo/mqpp/mqpptest"
+	"github.com/abo/mqpp/store"
+	"github.com/abo/mqpp/trace"
+)
+
+// collect returns a handler sending received publishes to ch
+func collect(ch chan *mqpp.Publish) client.MessageHandler {
+	return func(c *client.Client, p *mqpp.Publish) { ch <- p }
+}
+
+func expectPublish(t *testing.T, ch chan *mqpp.Publish, topic, payload string, retain bool) {
+	select {
+	case p := <-ch:
+		if p.TopicName() != topic || string(p.Payload()) != payload || p.Retain() != retain {
+			t.Fatalf("expect %s:%s retain %v, actual %s:%s retain %v", topic, payload, retain, p.TopicName(), p.Payload(), p.Retain())
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("expect publish %s:%s", topic, payload)
+	}
+}
+
+func TestRouting(t *testing.T) {
+	b := New(Options{})
+	defer b.Close()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go b.Serve(l)
+	dial := func() (net.Conn, error) { return net.Dial("tcp", l.Addr().String()) }
+
+	ch := make(chan *mqpp.Publish, 8)
+	sub := mqpptest.Connect(t, client.Options{ClientID: "sub", Dial: dial})
+	defer sub.Disconnect()
+	if err := sub.Subscribe(collect(ch), mqpp.Subscription{TopicFilter: "a/+", RequestedQoS: mqpp.QosExactlyOnce}).Wait(); err != nil {
+		t.Fatal(err)
+	}
+
+	pub := mqpptest.Connect(t, client.Options{ClientID: "pub", Dial: dial})
+	defer pub.Disconnect()
+	for qos := byte(0); qos <= mqpp.QosExactlyOnce; qos++ {
+		if err := pub.Publish("a/b", qos, false, []byte{'0' + qos}).Wait(); err != nil {
+			t.Fatal(err)
+		}
+		expectPublish(t, ch, "a/b", string([]byte{'0' + qos}), false)
+	}
+	pub.Publish("b/a", mqpp.QosAtLeastOnce, false, []byte("unmatched")).Wait()
+	pub.Publish("a/c", mqpp.QosAtLeastOnce, false, []byte("matched")).Wait()
+	expectPublish(t, ch, "a/c", "matched", false)
+}
+
+func TestCleanSessionTakeover(t *testing.T) {
+	b := New(Options{})
+	defer b.Close()
+
+	old := mqpptest.Connect(t, client.Options{ClientID: "same", CleanSession: true, Dial: b.Dial})
+	defer old.Disconnect()
+	ch := make(chan *mqpp.Publish, 8)
+	sub := mqpptest.Connect(t, client.Options{ClientID: "same", CleanSession: true, Dial: b.Dial})
+	defer sub.Disconnect()
+	if err := sub.Subscribe(collect(ch), mqpp.Subscription{TopicFilter: "t", RequestedQoS: mqpp.QosAtLeastOnce}).Wait(); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(20 * time.Millisecond) // the taken over connection is finished
+
+	pub := mqpptest.Connect(t, client.Options{ClientID: "pub", Dial: b.Dial})
+	defer pub.Disconnect()
+	pub.Publish("t", mqpp.QosAtLeastOnce, false, []byte("x")).Wait()
+	expectPublish(t, ch, "t", "x", false)
+}
+
+func TestRetainedAndWill(t *testing.T) {
+	b := New(Options{})
+	defer b.Close()
+
+	pub := mqpptest.Connect(t, client.Options{ClientID: "pub", Dial: b.Dial})
+	pub.Publish("r/1", mqpp.QosAtLeastOnce, true, []byte("kept")).Wait()
+	pub.Publish("r/2", mqpp.QosAtLeastOnce, true, []byte("cleared")).Wait()
+	pub.Publish("r/2", mqpp.QosAtLeastOnce, true, nil).Wait()
+
+	ch := make(chan *mqpp.Publish, 8)
+	sub := mqpptest.Connect(t, client.Options{ClientID: "sub", Dial: b.Dial})
+	defer sub.Disconnect()
+	sub.Subscribe(collect(ch), mqpp.Subscription{TopicFilter: "r/#", RequestedQoS: mqpp.QosAtLeastOnce}).Wait()
+	expectPublish(t, ch, "r/1", "kept", true)
+
+	var server net.Conn
+	dying := client.New(client.Options{ClientID: "dying", WillTopic: "r/will", WillMessage: []byte("gone"), Dial: func() (net.Conn, error) {
+		c, s := net.Pipe()
+		server = c
+		go b.ServeConn(s)
+		return c, nil
+	}})
+	if err := dying.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	server.Close() // abnormal disconnect
+	expectPublish(t, ch, "r/will", "gone", false)
+
+	pub.Disconnect()
+	select {
+	case p := <-ch:
+		t.Fatalf("unexpected publish %s", p.TopicName())
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestPersistentSession(t *testing.T) {
+	b := New(Options{})
+	defer b.Close()
+
+	ch := make(chan *mqpp.Publish, 8)
+	opts := client.Options{ClientID: "persistent", Dial: b.Dial, DefaultHandler: collect(ch)}
+	sub := mqpptest.Connect(t, opts)
+	sub.Subscribe(nil, mqpp.Subscription{TopicFilter: "q", RequestedQoS: mqpp.QosAtLeastOnce}).Wait()
+	sub.Disconnect()
+
+	pub := mqpptest.Connect(t, client.Options{ClientID: "pub", CleanSession: true, Dial: b.Dial})
+	defer pub.Disconnect()
+	pub.Publish("q", mqpp.QosAtMostOnce, false, []byte("dropped")).Wait()
+	pub.Publish("q", mqpp.QosAtLeastOnce, false, []byte("queued")).Wait()
+
+	var present bool
+	opts.OnConnect = func(c *client.Client, sessionPresent bool) { present = sessionPresent }
+	sub = mqpptest.Connect(t, opts)
+	defer sub.Disconnect()
+	if !present {
+		t.Fatal("expect session present")
+	}
+	expectPublish(t, ch, "q", "queued", false)
+}
+
+func TestAuthenticate(t *testing.T) {
+	b := New(Options{Authenticator: AuthenticatorFunc(func(remote net.Addr, c *mqpp.Connect) byte {
+		if c.Username() != "user" || string(c.Password()) != "secret" {
+			return mqpp.RefusedBadCredentials
+		}
+		return mqpp.Accepted
+	})})
+	defer b.Close()
+
+	c := client.New(client.Options{ClientID: "c", Username: "user", Password: []byte("wrong"), Dial: b.Dial})
+	if err := c.Connect(); err != client.ConnectError(mqpp.RefusedBadCredentials) {
+		t.Fatalf("expect bad credentials, actual %v", err)
+	}
+	c = client.New(client.Options{ClientID: "c", Username: "user", Password: []byte("secret"), Dial: b.Dial})
+	if err := c.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	c.Disconnect()
+}
+
+func TestMaxPacketSize(t *testing.T) {
+	b := New(Options{MaxPacketSize: 1024})
+	defer b.Close()
+	c, _ := b.Dial()
+	defer c.Close()
+
+	// CONNECT announcing 16KiB is dropped before it's buffered
+	go c.Write(append([]byte{0x10, 0x80, 0x80, 0x01}, make([]byte, 2048)...))
+	c.SetReadDeadline(time.Now().Add(time.Second))
+	if n, err := c.Read(make([]byte, 16)); err != io.EOF {
+		t.Fatalf("expect connection closed, read %d: %v", n, err)
+	}
+}
+
+func TestInvalidConnectFlags(t *testing.T) {
+	b := New(Options{})
+	defer b.Close()
+	c := mqpp.MakeConnect(mqpp.ProtocolName, mqpp.ProtocolLevel, false, 0, true, 60, "c", "", nil, "", nil)
+	i := 2 + 2 + len(mqpp.ProtocolName) + 1
+	for _, flags := range []byte{0x03, 0x1e, 0x10, 0x20, 0x42} { // reserved, will QoS 3, will QoS without will, will retain without will, password without user
+		data := append([]byte(nil), c.Bytes()...)
+		data[i] = flags
+		nc, _ := b.Dial()
+		go nc.Write(data)
+		nc.SetReadDeadline(time.Now().Add(time.Second))
+		if n, err := nc.Read(make([]byte, 16)); err != io.EOF {
+			t.Errorf("flags %#x: expect connection closed without CONNACK, read %d: %v", flags, n, err)
+		}
+		nc.Close()
+	}
+}
+
+func TestSlowConsumer(t *testing.T) {
+	b := New(Options{})
+	defer b.Close()
+	nc, _ := b.Dial()
+	defer nc.Close()
+	c := mqpp.MakeConnect(mqpp.ProtocolName, mqpp.ProtocolLevel, false, 0, true, 60, "slow", "", nil, "", nil)
+	sub := mqpp.MakeSubscribe(1, []mqpp.Subscription{{TopicFilter: "a", RequestedQoS: mqpp.QosAtLeastOnce}})
+	go nc.Write(append(c.Bytes(), sub.Bytes()...))
+	if _, err := io.ReadFull(nc, make([]byte, 4+5)); err != nil {
+		t.Fatal(err)
+	}
+
+	pub := mqpptest.Connect(t, client.Options{ClientID: "pub", Dial: b.Dial})
+	defer pub.Disconnect()
+	flood := func(qos byte) {
+		done := make(chan error, 1)
+		go func() {
+			for i := 0; i < 300; i++ {
+				if err := pub.Publish("a", qos, false, []byte("m")).Wait(); err != nil {
+					done <- err
+					return
+				}
+			}
+			done <- nil
+		}()
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Fatal(err)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("publisher blocked by slow subscriber at QoS %d", qos)
+		}
+	}
+	drain := func() error {
+		nc.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+		buf := make([]byte, 4096)
+		for {
+			if _, err := nc.Read(buf); err != nil {
+				return err
+			}
+		}
+	}
+
+	// QoS 0 overflow is dropped, the subscriber stays connected
+	flood(mqpp.QosAtMostOnce)
+	if err := drain(); err == io.EOF {
+		t.Fatal("expect subscriber connected after QoS 0 overflow")
+	}
+	// QoS 1 overflow disconnects it
+	flood(mqpp.QosAtLeastOnce)
+	if err := drain(); err != io.EOF {
+		t.Fatalf("expect subscriber disconnected, %v", err)
+	}
+}
+
+func TestAckMismatch(t *testing.T) {
+	b := New(Options{})
+	defer b.Close()
+	nc, _ := b.Dial()
+	defer nc.Close()
+	c := mqpp.MakeConnect(mqpp.ProtocolName, mqpp.ProtocolLevel, false, 0, true, 60, "sub", "", nil, "", nil)
+	sub := mqpp.MakeSubscribe(1, []mqpp.Subscription{{TopicFilter: "a", RequestedQoS: mqpp.QosAtLeastOnce}})
+	go nc.Write(append(c.Bytes(), sub.Bytes()...))
+	if _, err := io.ReadFull(nc, make([]byte, 4+5)); err != nil {
+		t.Fatal(err)
+	}
+
+	pub := mqpptest.Connect(t, client.Options{ClientID: "pub", Dial: b.Dial})
+	defer pub.Disconnect()
+	go pub.Publish("a", mqpp.QosAtLeastOnce, false, []byte("m"))
+	data := make([]byte, 2+2+1+2+1)
+	if _, err := io.ReadFull(nc, data); err != nil {
+		t.Fatal(err)
+	}
+	p, err := mqpp.Parse(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// PUBREC for a QoS 1 publish is a protocol violation
+	go nc.Write(mqpp.MakePubrec(p.(*mqpp.Publish).PacketIdentifier()).Bytes())
+	nc.SetReadDeadline(time.Now().Add(time.Second))
+	if n, err := nc.Read(make([]byte, 16)); err != io.EOF {
+		t.Fatalf("expect connection closed, read %d: %v", n, err)
+	}
+}
+
+func TestSessionRestore(t *testing.T) {
+	sessions := store.NewMemorySessions()
+	b := New(Options{Sessions: sessions})
+
+	ch := make(chan *mqpp.Publish, 8)
+	opts := client.Options{ClientID: "persistent", DefaultHandler: collect(ch)}
+	opts.Dial = b.Dial
+	sub := mqpptest.Connect(t, opts)
+	sub.Subscribe(nil, mqpp.Subscription{TopicFilter: "q", RequestedQoS: mqpp.QosExactlyOnce}).Wait()
+	sub.Disconnect()
+	pub := mqpptest.Connect(t, client.Options{ClientID: "pub", CleanSession: true, Dial: b.Dial})
+	pub.Publish("q", mqpp.QosAtLeastOnce, false, []byte("survived")).Wait()
+	pub.Disconnect()
+	b.Close()
+
+	if st, ok, _ := sessions.Load("persistent"); !ok || len(st.Pending)+len(st.Inflight) != 1 || len(st.Subscriptions) != 1 {
+		t.Fatalf("expect stored session with subscription and pending message, actual %v", st)
+	}
+	if _, ok, _ := sessions.Load("pub"); ok {
+		t.Fatal("expect clean session not stored")
+	}
+
+	b = New(Options{Sessions: sessions})
+	defer b.Close()
+	opts.Dial = b.Dial
+	sub = mqpptest.Connect(t, opts)
+	defer sub.Disconnect()
+	expectPublish(t, ch, "q", "survived", false)
+}
+
+// slowSessions blocks saving until release is closed
+type slowSessions struct {
+	*store.MemorySessions
+	release chan struct{}
+}
+
+func (s slowSessions) Save(st *store.Session) error {
+	<-s.release
+	return s.MemorySessions.Save(st)
+}
+
+func TestSlowSessionStore(t *testing.T) {
+	sessions := slowSessions{store.NewMemorySessions(), make(chan struct{})}
+	b := New(Options{Sessions: sessions})
+
+	persistent := mqpptest.Connect(t, client.Options{ClientID: "persistent", Dial: b.Dial})
+	persistent.Subscribe(nil, mqpp.Subscription{TopicFilter: "q", RequestedQoS: mqpp.QosAtLeastOnce})
+
+	// routing between clean sessions goes on while the store is stuck
+	ch := make(chan *mqpp.Publish, 8)
+	sub := mqpptest.Connect(t, client.Options{ClientID: "sub", CleanSession: true, Dial: b.Dial})
+	if err := sub.Subscribe(collect(ch), mqpp.Subscription{TopicFilter: "a"}).WaitTimeout(time.Second); err != nil {
+		t.Fatal(err)
+	}
+	pub := mqpptest.Connect(t, client.Options{ClientID: "pub", CleanSession: true, Dial: b.Dial})
+	pub.Publish("a", mqpp.QosAtMostOnce, false, []byte("go")).Wait()
+	expectPublish(t, ch, "a", "go", false)
+	pub.Disconnect()
+	sub.Disconnect()
+	persistent.Disconnect()
+
+	close(sessions.release)
+	b.Close()
+	if st, ok, _ := sessions.Load("persistent"); !ok || len(st.Subscriptions) != 1 {
+		t.Fatalf("expect latest snapshot saved on close, actual %v", st)
+	}
+}
+
+// span is recorded by spanHook, its context is a child of the remote one if any.
+// parent is the context of the span held by the context it started with.
+type span struct {
+	hook   *spanHook
+	op     trace.Op
+	typ    byte
+	remote trace.Context
+	parent trace.Context
+	tc     trace.Context
+	ended  bool
+}
+
+type spanKey struct{}
+
+func (s *span) Context() trace.Context { return s.tc }
+func (s *span) End(err error) {
+	s.hook.mu.Lock()
+	s.ended = true
+	s.hook.mu.Unlock()
+}
+
+// spanHook records spans, those of the same name share an ascending span id
+type spanHook struct {
+	mu    sync.Mutex
+	name  byte
+	spans []*span
+}
+
+func (h *spanHook) Start(ctx context.Context, op trace.Op, p mqpp.ControlPacket) (context.Context, trace.Span) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s := &span{hook: h, op: op, typ: p.Type()}
+	s.remote, _ = trace.RemoteFromContext(ctx)
+	if parent, ok := ctx.Value(spanKey{}).(*span); ok {
+		s.parent = parent.tc
+	}
+	s.tc.TraceID = s.remote.TraceID
+	if !s.remote.IsValid() {
+		s.tc.TraceID[0] = h.name
+	}
+	s.tc.SpanID = [8]byte{h.name, byte(len(h.spans) + 1)}
+	s.tc.Flags = 1
+	h.spans = append(h.spans, s)
+	return context.WithValue(ctx, spanKey{}, s), s
+}
+
+// ended waits for n ended spans of op and packet type, and returns copies of them
+func (h *spanHook) ended(t *testing.T, op trace.Op, typ byte, n int) []span {
+	t.Helper()
+	for deadline := time.Now().Add(time.Second); ; time.Sleep(time.Millisecond) {
+		var found []span
+		h.mu.Lock()
+		for _, s := range h.spans {
+			if s.op == op && s.typ == typ && s.ended {
+				found = append(found, *s)
+			}
+		}
+		h.mu.Unlock()
+		if len(found) >= n || time.Now().After(deadline) {
+			if len(found) != n {
+				t.Fatalf("%c: %d ended %v %s spans, expected %d", h.name, len(found), op, mqpp.TypeName(typ), n)
+			}
+			return found
+		}
+	}
+}
+
+func TestTracing(t *testing.T) {
+	bh, ph, sh := &spanHook{name: 'b'}, &spanHook{name: 'p'}, &spanHook{name: 's'}
+	b := New(Options{Hook: bh})
+	defer b.Close()
+
+	ch := make(chan *mqpp.Publish, 1)
+	sub := mqpptest.Connect(t, client.Options{ClientID: "sub", Dial: b.Dial, Hook: sh, TraceEnvelope: true})
+	defer sub.Disconnect()
+	if err := sub.Subscribe(collect(ch), mqpp.Subscription{TopicFilter: "t", RequestedQoS: mqpp.QosAtLeastOnce}).Wait(); err != nil {
+		t.Fatal(err)
+	}
+	pub := mqpptest.Connect(t, client.Options{ClientID: "pub", Dial: b.Dial, Hook: ph, TraceEnvelope: true})
+	defer pub.Disconnect()
+	app := &span{tc: trace.Context{SpanID: [8]byte{'a'}}}
+	ctx := context.WithValue(context.Background(), spanKey{}, app)
+	if err := pub.PublishContext(ctx, "t", mqpp.QosAtLeastOnce, false, []byte("traced")).Wait(); err != nil {
+		t.Fatal(err)
+	}
+	expectPublish(t, ch, "t", "traced", false)
+
+	written := ph.ended(t, trace.Write, mqpp.TPUBLISH, 1)[0]
+	if written.remote.IsValid() || written.parent != app.tc {
+		t.Fatalf("unexpected publisher span %+v", written)
+	}
+	parent := written.tc
+	read := bh.ended(t, trace.Read, mqpp.TPUBLISH, 1)[0]
+	if read.remote != parent {
+		t.Fatalf("unexpected broker read span %+v", read)
+	}
+	if s := bh.ended(t, trace.Write, mqpp.TPUBLISH, 1)[0]; s.remote != parent || s.parent != read.tc {
+		t.Fatalf("unexpected broker write span %+v", s)
+	}
+	if s := sh.ended(t, trace.Read, mqpp.TPUBLISH, 1)[0]; s.remote != parent || s.tc.TraceID != parent.TraceID {
+		t.Fatalf("unexpected subscriber span %+v", s)
+	}
+	bh.ended(t, trace.Read, mqpp.TCONNECT, 2)
+	sh.ended(t, trace.Write, mqpp.TPUBACK, 1)
+}
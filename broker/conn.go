@@ -0,0 +1,349 @@
+// Copyright (c) 2016 The MQPP Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package broker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/abo/mqpp"
+	"github.com/abo/mqpp/conform"
+	"github.com/abo/mqpp/trace"
+)
+
+var (
+	// errDisconnect - client sent DISCONNECT, the will message is discarded
+	errDisconnect = errors.New("mqpp/broker: Client Disconnected")
+	// errTakeover - another connection connected with the same client identifier
+	errTakeover = errors.New("mqpp/broker: Session Taken Over")
+	// errSlowConsumer - the connection's write queue is full, it doesn't keep up with its subscriptions
+	errSlowConsumer = errors.New("mqpp/broker: Slow Consumer")
+)
+
+// conn is a client connection served by a Broker
+type conn struct {
+	broker *Broker
+	nc     net.Conn
+	out    chan outgoing
+	done   chan struct{}
+	once   sync.Once
+	err    error
+
+	// set by connect, used only by the reading goroutine
+	session   *session
+	keepAlive time.Duration
+	will      *mqpp.Will
+}
+
+func newConn(b *Broker, nc net.Conn) *conn {
+	return &conn{
+		broker: b,
+		nc:     nc,
+		out:    make(chan outgoing, 256),
+		done:   make(chan struct{}),
+	}
+}
+
+// outgoing is a packet queued for writing, ctx is the parent of its write span
+type outgoing struct {
+	ctx context.Context
+	p   mqpp.ControlPacket
+}
+
+// send queues p for writing, it fails only if the connection is closed
+func (c *conn) send(ctx context.Context, p mqpp.ControlPacket) error {
+	select {
+	case c.out <- outgoing{ctx, p}:
+		return nil
+	case <-c.done:
+		return c.err
+	}
+}
+
+// deliver queues a publish routed from another connection without blocking it.
+// When the queue is full a QoS 0 publish is dropped, any other closes the
+// connection, its session keeps the publish in flight to resend on reconnect.
+func (c *conn) deliver(ctx context.Context, p mqpp.ControlPacket) {
+	select {
+	case c.out <- outgoing{ctx, p}:
+	case <-c.done:
+	default:
+		if pub, ok := p.(*mqpp.Publish); ok && pub.QoS() == mqpp.QosAtMostOnce {
+			return
+		}
+		c.close(errSlowConsumer)
+	}
+}
+
+// close closes the connection, only the first err is kept
+func (c *conn) close(err error) {
+	c.once.Do(func() {
+		c.err = err
+		close(c.done)
+		c.nc.Close()
+	})
+}
+
+func (c *conn) writeLoop() {
+	for {
+		select {
+		case o := <-c.out:
+			_, span := trace.Start(o.ctx, c.broker.opts.Hook, trace.Write, o.p)
+			_, err := o.p.WriteTo(c.nc)
+			span.End(err)
+			if err != nil {
+				c.close(err)
+				return
+			}
+		case <-c.done:
+			return
+		}
+	}
+}
+
+func (c *conn) serve() {
+	go c.writeLoop()
+
+	s := mqpp.NewSplitter(c.nc)
+	s.Buffer(nil, c.broker.opts.MaxPacketSize)
+	c.nc.SetReadDeadline(time.Now().Add(c.broker.opts.ConnectTimeout))
+	p, err := next(s)
+	if err == nil {
+		ctx, span := trace.Start(context.Background(), c.broker.opts.Hook, trace.Read, p)
+		if connect, ok := p.(*mqpp.Connect); ok {
+			err = c.connect(ctx, connect)
+		} else {
+			err = mqpp.ErrProtocolViolation
+		}
+		span.End(err)
+	}
+
+	for err == nil {
+		if ka := c.keepAlive; ka > 0 {
+			// the server allows one and a half times the keep alive period
+			c.nc.SetReadDeadline(time.Now().Add(ka * 3 / 2))
+		} else {
+			c.nc.SetReadDeadline(time.Time{})
+		}
+		if p, err = next(s); err == nil {
+			ctx, span := trace.Start(context.Background(), c.broker.opts.Hook, trace.Read, p)
+			err = c.handle(ctx, p)
+			span.End(err)
+		}
+	}
+	c.close(err)
+	c.finish()
+}
+
+// next reads a packet which doesn't share the splitter's buffer
+func next(s *mqpp.Splitter) (mqpp.ControlPacket, error) {
+	if !s.Scan() {
+		if err := s.Err(); err != nil {
+			return nil, err
+		}
+		return nil, io.EOF
+	}
+	return mqpp.Parse(append([]byte(nil), s.Bytes()...))
+}
+
+// connect performs CONNECT/CONNACK, and attaches the connection to its session
+func (c *conn) connect(ctx context.Context, p *mqpp.Connect) error {
+	b := c.broker
+	if p.ProtocolName() != mqpp.ProtocolName {
+		return mqpp.ErrProtocolViolation
+	}
+	if p.ProtocolLevel() != mqpp.ProtocolLevel {
+		return c.refuse(mqpp.RefusedProtocolVersion)
+	}
+	if len(conform.CheckConnectFlags(p)) > 0 {
+		return mqpp.ErrProtocolViolation
+	}
+
+	clientID := p.ClientIdentifier()
+	if clientID == "" {
+		if !p.CleanSession() {
+			return c.refuse(mqpp.RefusedInvalidIdentifier)
+		}
+	}
+	if b.opts.Authenticator != nil {
+		if code := b.opts.Authenticator.Authenticate(c.nc.RemoteAddr(), p); code != mqpp.Accepted {
+			return c.refuse(code)
+		}
+	}
+
+	b.mu.Lock()
+	if clientID == "" {
+		b.nextAnon++
+		clientID = fmt.Sprintf("mqpp-%d", b.nextAnon)
+	}
+	var takeover *conn
+	s, present := b.sessions[clientID], false
+	if s != nil {
+		takeover = s.conn
+	}
+	if s == nil || s.clean || p.CleanSession() {
+		if s != nil && !s.clean {
+			b.unpersistLocked(clientID)
+		}
+		s = newSession(clientID, p.CleanSession())
+		b.sessions[clientID] = s
+	} else {
+		present = true
+	}
+	s.conn = c
+	c.session = s
+	// CONNACK must be the first packet, queue it before publishes can be routed here
+	c.out <- outgoing{ctx, mqpp.MakeConnack(present, mqpp.Accepted)}
+	resend := s.resumeLocked()
+	b.persistLocked(s)
+	b.mu.Unlock()
+
+	if takeover != nil {
+		takeover.close(errTakeover)
+	}
+	c.keepAlive = time.Duration(p.KeepAlive()) * time.Second
+	c.will = mqpp.NewWill(p)
+	for _, pkt := range resend {
+		c.send(ctx, pkt)
+	}
+	return nil
+}
+
+// refuse writes CONNACK with a refused return code, the connection is closed afterward.
+// Nothing else has been queued yet, so it's written directly to be sure it's flushed before close.
+func (c *conn) refuse(code byte) error {
+	mqpp.MakeConnack(false, code).WriteTo(c.nc)
+	return fmt.Errorf("mqpp/broker: %s", mqpp.ConnectReturnCodeResponses[code])
+}
+
+// finish detaches the closed connection from its session, and publishes the
+// will message unless the client disconnected normally.
+func (c *conn) finish() {
+	b := c.broker
+	b.mu.Lock()
+	if s := c.session; s != nil && s.conn == c {
+		s.conn = nil
+		if s.clean && b.sessions[s.clientID] == s {
+			delete(b.sessions, s.clientID)
+		}
+	}
+	closed := b.closed
+	b.mu.Unlock()
+
+	if c.will == nil {
+		return
+	}
+	reason := mqpp.CloseReasonOf(c.err)
+	switch c.err {
+	case errDisconnect:
+		reason = mqpp.CloseDisconnect
+	case errTakeover, ErrClosed:
+		reason = mqpp.CloseServer
+	}
+	if will, ok := c.will.End(reason); ok && !closed {
+		b.publish(context.Background(), will)
+	}
+}
+
+// handle processes a packet received after CONNECT, ctx is the context of its read span
+func (c *conn) handle(ctx context.Context, p mqpp.ControlPacket) error {
+	b, s := c.broker, c.session
+	switch pkt := p.(type) {
+	case *mqpp.Publish:
+		if pkt.QoS() > mqpp.QosExactlyOnce || !mqpp.ValidTopicName(pkt.TopicName()) {
+			return mqpp.ErrProtocolViolation
+		}
+		switch pkt.QoS() {
+		case mqpp.QosAtMostOnce:
+			b.publish(ctx, pkt)
+		case mqpp.QosAtLeastOnce:
+			b.publish(ctx, pkt)
+			c.send(ctx, mqpp.MakePuback(pkt.PacketIdentifier()))
+		case mqpp.QosExactlyOnce:
+			b.mu.Lock()
+			dup := s.received[pkt.PacketIdentifier()]
+			s.received[pkt.PacketIdentifier()] = true
+			if !dup {
+				b.persistLocked(s)
+			}
+			b.mu.Unlock()
+			if !dup {
+				b.publish(ctx, pkt)
+			}
+			c.send(ctx, mqpp.MakePubrec(pkt.PacketIdentifier()))
+		}
+	case *mqpp.Pubrel:
+		b.mu.Lock()
+		delete(s.received, pkt.PacketIdentifier())
+		b.persistLocked(s)
+		b.mu.Unlock()
+		c.send(ctx, mqpp.MakePubcomp(pkt.PacketIdentifier()))
+	case *mqpp.Puback, *mqpp.Pubrec, *mqpp.Pubcomp:
+		id := pkt.(interface{ PacketIdentifier() uint16 }).PacketIdentifier()
+		b.mu.Lock()
+		err := s.ackLocked(p.Type(), id)
+		if err == nil {
+			b.persistLocked(s)
+		}
+		b.mu.Unlock()
+		if err != nil {
+			return err
+		}
+		if p.Type() == mqpp.TPUBREC {
+			c.send(ctx, mqpp.MakePubrel(id))
+		}
+	case *mqpp.Subscribe:
+		subs := pkt.Payload()
+		if len(subs) == 0 {
+			return mqpp.ErrProtocolViolation
+		}
+		codes := make([]byte, len(subs))
+		var ds []delivery
+		b.mu.Lock()
+		for i, sub := range subs {
+			if sub.RequestedQoS > mqpp.QosExactlyOnce || !mqpp.ValidTopicFilter(sub.TopicFilter) {
+				codes[i] = mqpp.SubackFailure
+				continue
+			}
+			codes[i] = sub.RequestedQoS
+			s.subs[sub.TopicFilter] = sub.RequestedQoS
+			ds = append(ds, b.retainedLocked(s, sub.TopicFilter, sub.RequestedQoS)...)
+		}
+		b.persistLocked(s)
+		b.mu.Unlock()
+		c.send(ctx, mqpp.MakeSuback(pkt.PacketIdentifier(), codes))
+		send(ctx, ds)
+	case *mqpp.Unsubscribe:
+		b.mu.Lock()
+		for _, filter := range pkt.Payload() {
+			delete(s.subs, filter)
+		}
+		b.persistLocked(s)
+		b.mu.Unlock()
+		c.send(ctx, mqpp.MakeUnsuback(pkt.PacketIdentifier()))
+	case *mqpp.Pingreq:
+		c.send(ctx, mqpp.MakePingresp())
+	case *mqpp.Disconnect:
+		return errDisconnect
+	default:
+		return mqpp.ErrProtocolViolation
+	}
+	return nil
+}
@@ -0,0 +1,220 @@
+// Copyright (c) 2016 The MQPP Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package broker
+
+import (
+	"sort"
+
+	"github.com/abo/mqpp"
+	"github.com/abo/mqpp/store"
+)
+
+// message is an application message waiting for an offline persistent session
+type message struct {
+	qos     byte
+	retain  bool
+	topic   string
+	payload []byte
+}
+
+// session is the state of a client identifier, it outlives connections unless
+// clean session is requested. All fields are guarded by Broker.mu.
+type session struct {
+	clientID string
+	clean    bool
+	conn     *conn // nil when client is offline
+	subs     map[string]byte
+	received map[uint16]bool // inbound QoS 2 packet identifiers waiting for PUBREL
+
+	nextID   uint16
+	inflight map[uint16]mqpp.ControlPacket // outbound Publish or Pubrel waiting for acknowledgement
+	order    []uint16
+	queue    []message
+}
+
+func newSession(clientID string, clean bool) *session {
+	return &session{
+		clientID: clientID,
+		clean:    clean,
+		subs:     make(map[string]byte),
+		received: make(map[uint16]bool),
+		inflight: make(map[uint16]mqpp.ControlPacket),
+	}
+}
+
+// match returns the maximum QoS granted to filters matching topic
+func (s *session) match(topic string) (byte, bool) {
+	var qos byte
+	matched := false
+	for filter, q := range s.subs {
+		if mqpp.MatchTopic(filter, topic) {
+			if !matched || q > qos {
+				qos = q
+			}
+			matched = true
+		}
+	}
+	return qos, matched
+}
+
+// deliverLocked makes the publish for a connected client, or queues QoS 1 and
+// 2 messages for an offline persistent session.
+func (s *session) deliverLocked(maxQueued int, qos byte, retain bool, topic string, payload []byte) (delivery, bool) {
+	if s.conn == nil {
+		if !s.clean && qos > mqpp.QosAtMostOnce {
+			if len(s.queue) >= maxQueued {
+				s.queue = s.queue[1:]
+			}
+			s.queue = append(s.queue, message{qos: qos, retain: retain, topic: topic, payload: payload})
+		}
+		return delivery{}, false
+	}
+
+	p, ok := s.makeLocked(message{qos: qos, retain: retain, topic: topic, payload: payload})
+	if !ok {
+		return delivery{}, false
+	}
+	return delivery{to: s.conn, pkt: p}, true
+}
+
+// makeLocked builds the publish of m, and tracks it until acknowledged if QoS > 0
+func (s *session) makeLocked(m message) (mqpp.ControlPacket, bool) {
+	if m.qos == mqpp.QosAtMostOnce {
+		p := mqpp.MakePublish(false, m.qos, m.retain, m.topic, 0, m.payload)
+		return &p, true
+	}
+
+	for i := 0; i < 65535; i++ {
+		s.nextID++
+		if s.nextID == 0 {
+			s.nextID = 1
+		}
+		if _, used := s.inflight[s.nextID]; !used {
+			p := mqpp.MakePublish(false, m.qos, m.retain, m.topic, s.nextID, m.payload)
+			s.inflight[s.nextID] = &p
+			s.order = append(s.order, s.nextID)
+			return &p, true
+		}
+	}
+	return nil, false
+}
+
+// resumeLocked returns unacknowledged packets with DUP set, followed by queued messages
+func (s *session) resumeLocked() []mqpp.ControlPacket {
+	var resend []mqpp.ControlPacket
+	for _, id := range s.order {
+		pkt := s.inflight[id]
+		if p, ok := pkt.(*mqpp.Publish); ok {
+			dup := mqpp.MakePublish(true, p.QoS(), p.Retain(), p.TopicName(), id, p.Payload())
+			pkt = &dup
+			s.inflight[id] = pkt
+		}
+		resend = append(resend, pkt)
+	}
+
+	for _, m := range s.queue {
+		if p, ok := s.makeLocked(m); ok {
+			resend = append(resend, p)
+		}
+	}
+	s.queue = nil
+	return resend
+}
+
+// ackLocked applies an acknowledgement of type t to the outbound flow id: PUBACK
+// completes a QoS 1 publish, PUBREC moves a QoS 2 publish to PUBREL and PUBCOMP
+// completes a PUBREL. An acknowledgement not matching the flow is a protocol violation.
+func (s *session) ackLocked(t byte, id uint16) error {
+	pkt, ok := s.inflight[id]
+	if !ok {
+		return nil
+	}
+	var qos byte
+	if p, ok := pkt.(*mqpp.Publish); ok {
+		qos = p.QoS()
+	}
+	switch {
+	case t == mqpp.TPUBACK && qos == mqpp.QosAtLeastOnce:
+	case t == mqpp.TPUBREC && qos == mqpp.QosExactlyOnce:
+		s.inflight[id] = mqpp.MakePubrel(id)
+		return nil
+	case t == mqpp.TPUBREC && pkt.Type() == mqpp.TPUBREL:
+		return nil
+	case t == mqpp.TPUBCOMP && pkt.Type() == mqpp.TPUBREL:
+	default:
+		return mqpp.ErrProtocolViolation
+	}
+	delete(s.inflight, id)
+	for i, v := range s.order {
+		if v == id {
+			s.order = append(s.order[:i], s.order[i+1:]...)
+			break
+		}
+	}
+	return nil
+}
+
+// snapshotLocked returns the state of s to be saved in a store.SessionStore
+func (s *session) snapshotLocked() *store.Session {
+	st := &store.Session{ClientID: s.clientID}
+	for filter, qos := range s.subs {
+		st.Subscriptions = append(st.Subscriptions, mqpp.Subscription{TopicFilter: filter, RequestedQoS: qos})
+	}
+	sort.Slice(st.Subscriptions, func(i, j int) bool { return st.Subscriptions[i].TopicFilter < st.Subscriptions[j].TopicFilter })
+	for id := range s.received {
+		st.Received = append(st.Received, id)
+	}
+	for _, id := range s.order {
+		st.Inflight = append(st.Inflight, s.inflight[id])
+	}
+	for _, m := range s.queue {
+		p := mqpp.MakePublish(false, m.qos, m.retain, m.topic, 0, m.payload)
+		st.Pending = append(st.Pending, &p)
+	}
+	return st
+}
+
+// restoreSession rebuilds an offline persistent session from a stored snapshot
+func restoreSession(st *store.Session) *session {
+	s := newSession(st.ClientID, false)
+	for _, sub := range st.Subscriptions {
+		s.subs[sub.TopicFilter] = sub.RequestedQoS
+	}
+	for _, id := range st.Received {
+		s.received[id] = true
+	}
+	for _, pkt := range st.Inflight {
+		var id uint16
+		switch p := pkt.(type) {
+		case *mqpp.Publish:
+			id = p.PacketIdentifier()
+		case *mqpp.Pubrel:
+			id = p.PacketIdentifier()
+		default:
+			continue
+		}
+		s.inflight[id] = pkt
+		s.order = append(s.order, id)
+		if id > s.nextID {
+			s.nextID = id
+		}
+	}
+	for _, pkt := range st.Pending {
+		if p, ok := pkt.(*mqpp.Publish); ok {
+			s.queue = append(s.queue, message{qos: p.QoS(), retain: p.Retain(), topic: p.TopicName(), payload: p.Payload()})
+		}
+	}
+	return s
+}
@@ -0,0 +1,295 @@
+// Copyright (c) 2016 The MQPP Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package capture persists mqtt conversations with timing, for replay, diffing
+// and regression tests.
+//
+// A capture file starts with the 7 bytes magic "MQPPCAP" and a version byte,
+// followed by records of, in big endian:
+//
+//	timestamp  int64   unix nanoseconds
+//	conn       uint32  connection id, unique within the file
+//	direction  byte    0 client to server, 1 server to client
+//	length     uint32  length of packet
+//	packet     [length]byte, a whole mqtt packet as ControlPacket.Bytes
+//
+// Records are in the order they were written, timestamps of different
+// connections may be slightly out of order.
+package capture
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"sort"
+	"time"
+
+	"github.com/abo/mqpp"
+)
+
+// Magic and Version of capture files
+const (
+	Magic   = "MQPPCAP"
+	Version = 1
+)
+
+const (
+	headerSize    = 8
+	recordHead    = 17
+	indexInterval = 256 // records between index entries
+)
+
+var (
+	// ErrFormat - not a capture file, or it's corrupt
+	ErrFormat = errors.New("mqpp/capture: Invalid Capture File")
+	// ErrNotSeekable - the underlying reader can't seek
+	ErrNotSeekable = errors.New("mqpp/capture: Not Seekable")
+)
+
+// Record is a packet of a connection. Err is set if Raw can't be parsed,
+// in which case Packet is nil.
+type Record struct {
+	Time      time.Time
+	Conn      uint32
+	Direction mqpp.Direction
+	Raw       []byte
+	Packet    mqpp.ControlPacket
+	Err       error
+}
+
+// Writer writes a capture file, it's not safe for concurrent use
+type Writer struct {
+	w       *bufio.Writer
+	offset  int64
+	records int
+	maxTime int64
+	index   Index
+}
+
+// NewWriter writes the file header to w
+func NewWriter(w io.Writer) (*Writer, error) {
+	cw := &Writer{w: bufio.NewWriter(w), offset: headerSize}
+	cw.w.WriteString(Magic)
+	if err := cw.w.WriteByte(Version); err != nil {
+		return nil, err
+	}
+	return cw, nil
+}
+
+// Write appends packet p
+func (w *Writer) Write(ts time.Time, conn uint32, dir mqpp.Direction, p mqpp.ControlPacket) error {
+	return w.WriteRaw(ts, conn, dir, p.Bytes())
+}
+
+// WriteRaw appends a packet as raw bytes, which may be one failed to parse but
+// has at least the fixed header byte and one byte of remaining length
+func (w *Writer) WriteRaw(ts time.Time, conn uint32, dir mqpp.Direction, raw []byte) error {
+	if len(raw) < 2 {
+		return mqpp.ErrIncompletePacket
+	}
+	if len(raw) > mqpp.MaxPacketSize {
+		return mqpp.ErrMalformedRemLen
+	}
+	nano := ts.UnixNano()
+	if w.records%indexInterval == 0 {
+		w.index.add(w.offset, w.maxTime)
+	}
+	if w.records == 0 || nano > w.maxTime {
+		w.maxTime = nano
+	}
+
+	var head [recordHead]byte
+	putHead(head[:], nano, conn, dir, len(raw))
+	if _, err := w.w.Write(head[:]); err != nil {
+		return err
+	}
+	if _, err := w.w.Write(raw); err != nil {
+		return err
+	}
+	w.records++
+	w.offset += int64(recordHead + len(raw))
+	return nil
+}
+
+// Flush writes buffered records to the underlying writer
+func (w *Writer) Flush() error {
+	return w.w.Flush()
+}
+
+// Index returns the index of records written so far
+func (w *Writer) Index() *Index {
+	return &Index{entries: append([]indexEntry(nil), w.index.entries...)}
+}
+
+func putHead(head []byte, nano int64, conn uint32, dir mqpp.Direction, length int) {
+	binary.BigEndian.PutUint64(head[0:8], uint64(nano))
+	binary.BigEndian.PutUint32(head[8:12], conn)
+	head[12] = byte(dir)
+	binary.BigEndian.PutUint32(head[13:17], uint32(length))
+}
+
+// Reader reads records of a capture file
+type Reader struct {
+	// Lenient skips validating flags of fixed headers, see mqpp.ParseLenient
+	Lenient bool
+
+	r      io.Reader
+	br     *bufio.Reader
+	offset int64
+}
+
+// NewReader reads and checks the file header of r
+func NewReader(r io.Reader) (*Reader, error) {
+	cr := &Reader{r: r, br: bufio.NewReader(r)}
+	var header [headerSize]byte
+	if _, err := io.ReadFull(cr.br, header[:]); err != nil {
+		return nil, ErrFormat
+	}
+	if string(header[:7]) != Magic || header[7] != Version {
+		return nil, ErrFormat
+	}
+	cr.offset = headerSize
+	return cr, nil
+}
+
+// Next returns the next record, or io.EOF at the end of file. A record cut
+// short, e.g. by a crashed writer, is io.ErrUnexpectedEOF.
+func (r *Reader) Next() (*Record, error) {
+	var head [recordHead]byte
+	if _, err := io.ReadFull(r.br, head[:]); err != nil {
+		return nil, err
+	}
+	length := binary.BigEndian.Uint32(head[13:17])
+	if length < 2 || length > mqpp.MaxPacketSize || head[12] > byte(mqpp.ServerToClient) {
+		return nil, ErrFormat
+	}
+	// grown as bytes arrive, a corrupt length doesn't allocate more than the file holds
+	var buf bytes.Buffer
+	if _, err := io.CopyN(&buf, r.br, int64(length)); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	raw := buf.Bytes()
+	r.offset += int64(recordHead) + int64(length)
+
+	rec := &Record{
+		Time:      time.Unix(0, int64(binary.BigEndian.Uint64(head[0:8]))),
+		Conn:      binary.BigEndian.Uint32(head[8:12]),
+		Direction: mqpp.Direction(head[12]),
+		Raw:       raw,
+	}
+	if r.Lenient {
+		rec.Packet, rec.Err = mqpp.ParseLenient(raw)
+	} else {
+		rec.Packet, rec.Err = mqpp.Parse(raw)
+	}
+	return rec, nil
+}
+
+// Seek positions r so that Next returns records at or after t, using idx to
+// skip most of the file. The reader passed to NewReader must be an io.Seeker.
+func (r *Reader) Seek(idx *Index, t time.Time) error {
+	s, ok := r.r.(io.Seeker)
+	if !ok {
+		return ErrNotSeekable
+	}
+	offset := idx.lookup(t.UnixNano())
+	if _, err := s.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+	r.br.Reset(r.r)
+	r.offset = offset
+
+	for {
+		head, err := r.br.Peek(recordHead)
+		if err != nil {
+			if err == io.EOF && len(head) == 0 {
+				return nil
+			}
+			return err
+		}
+		if int64(binary.BigEndian.Uint64(head[0:8])) >= t.UnixNano() {
+			return nil
+		}
+		// skip the record
+		length := int64(recordHead) + int64(binary.BigEndian.Uint32(head[13:17]))
+		if _, err := r.br.Discard(int(length)); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return err
+		}
+		r.offset += length
+	}
+}
+
+// Index maps time to file offsets, one entry every 256 records
+type Index struct {
+	entries []indexEntry
+}
+
+// indexEntry is the offset of a record, and the latest timestamp of all records before it
+type indexEntry struct {
+	offset int64
+	before int64
+}
+
+func (idx *Index) add(offset, before int64) {
+	idx.entries = append(idx.entries, indexEntry{offset, before})
+}
+
+// lookup returns the offset of the last entry which all records before are earlier than nano
+func (idx *Index) lookup(nano int64) int64 {
+	// before is non-decreasing, entries[0] has nothing before it
+	i := sort.Search(len(idx.entries), func(i int) bool {
+		return i > 0 && idx.entries[i].before >= nano
+	})
+	if i == 0 {
+		return headerSize
+	}
+	return idx.entries[i-1].offset
+}
+
+// BuildIndex scans capture file r from the start and indexes it
+func BuildIndex(r io.ReadSeeker) (*Index, error) {
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	cr, err := NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+
+	idx := &Index{}
+	var maxTime int64
+	for n := 0; ; n++ {
+		offset := cr.offset
+		rec, err := cr.Next()
+		if err == io.EOF {
+			return idx, nil
+		} else if err != nil {
+			return nil, err
+		}
+		if n%indexInterval == 0 {
+			idx.add(offset, maxTime)
+		}
+		if nano := rec.Time.UnixNano(); n == 0 || nano > maxTime {
+			maxTime = nano
+		}
+	}
+}
@@ -0,0 +1,172 @@
+// Copyright (c) 2016 The MQPP Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package capture
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/abo/mqpp"
+)
+
+var base = time.Unix(1500000000, 0)
+
+func TestWriteRead(t *testing.T) {
+	var buf bytes.Buffer
+	w, err := NewWriter(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	publish := mqpp.MakePublish(false, mqpp.QosAtLeastOnce, false, "a/b", 1, []byte("hello"))
+	if err := w.Write(base, 1, mqpp.ClientToServer, &publish); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Write(base.Add(time.Millisecond), 1, mqpp.ServerToClient, mqpp.MakePuback(1)); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.WriteRaw(base.Add(2*time.Millisecond), 2, mqpp.ClientToServer, []byte{0x00, 0x00}); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := NewReader(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec, err := r.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p, ok := rec.Packet.(*mqpp.Publish); !ok || p.TopicName() != "a/b" || !rec.Time.Equal(base) || rec.Conn != 1 || rec.Direction != mqpp.ClientToServer {
+		t.Fatalf("unexpected record %+v", rec)
+	}
+	if rec, err = r.Next(); err != nil || rec.Packet.Type() != mqpp.TPUBACK || rec.Direction != mqpp.ServerToClient {
+		t.Fatalf("unexpected record %+v, %v", rec, err)
+	}
+	if rec, err = r.Next(); err != nil || rec.Packet != nil || rec.Err != mqpp.ErrReservedPacketType || rec.Conn != 2 {
+		t.Fatalf("unexpected record %+v, %v", rec, err)
+	}
+	if _, err = r.Next(); err != io.EOF {
+		t.Fatalf("expect EOF, got %v", err)
+	}
+
+	// cut short
+	r, _ = NewReader(bytes.NewReader(buf.Bytes()[:buf.Len()-1]))
+	r.Next()
+	r.Next()
+	if _, err = r.Next(); err != io.ErrUnexpectedEOF {
+		t.Fatalf("expect ErrUnexpectedEOF, got %v", err)
+	}
+	// a corrupt length past the end of file
+	huge := append([]byte(nil), buf.Bytes()[:headerSize+recordHead]...)
+	huge[headerSize+13] = 0x0f
+	r, _ = NewReader(bytes.NewReader(huge))
+	if _, err = r.Next(); err != io.ErrUnexpectedEOF {
+		t.Fatalf("expect ErrUnexpectedEOF, got %v", err)
+	}
+	if err := w.WriteRaw(base, 2, mqpp.ClientToServer, []byte{0x00}); err != mqpp.ErrIncompletePacket {
+		t.Fatalf("expect ErrIncompletePacket, got %v", err)
+	}
+	if _, err := NewReader(bytes.NewReader([]byte("MQPPCAP\x02"))); err != ErrFormat {
+		t.Fatalf("expect ErrFormat, got %v", err)
+	}
+}
+
+func TestSeek(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "capture")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, err := NewWriter(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const n = 1000
+	for i := 0; i < n; i++ {
+		// the two connections are a little out of order
+		ts := base.Add(time.Duration(i) * time.Second)
+		if i%2 == 1 {
+			ts = ts.Add(-1500 * time.Millisecond)
+		}
+		if err := w.Write(ts, uint32(i%2), mqpp.ClientToServer, mqpp.MakePuback(uint16(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	f, err = os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	built, err := BuildIndex(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	written := w.Index()
+	if len(built.entries) != len(written.entries) || len(built.entries) != 4 {
+		t.Fatalf("%d entries built, %d written", len(built.entries), len(written.entries))
+	}
+
+	f.Seek(0, io.SeekStart)
+	r, err := NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, at := range []int{0, 1, 300, 513, 998, 2000} {
+		if err := r.Seek(built, base.Add(time.Duration(at)*time.Second)); err != nil {
+			t.Fatal(err)
+		}
+		// the first record at or after the time
+		expect := -1
+		for i := 0; i < n; i++ {
+			ts := i * 1000
+			if i%2 == 1 {
+				ts -= 1500
+			}
+			if ts >= at*1000 {
+				expect = i
+				break
+			}
+		}
+		rec, err := r.Next()
+		if expect < 0 {
+			if err != io.EOF {
+				t.Fatalf("seek %d: expect EOF, got %v", at, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if id := int(rec.Packet.(*mqpp.Puback).PacketIdentifier()); id != expect {
+			t.Fatalf("seek %d: got record %d, expect %d", at, id, expect)
+		}
+	}
+
+	if err := (&Reader{r: bytes.NewBuffer(nil)}).Seek(built, base); err != ErrNotSeekable {
+		t.Fatalf("expect ErrNotSeekable, got %v", err)
+	}
+}
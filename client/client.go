@@ -0,0 +1,632 @@
+// Copyright (c) 2016 The MQPP Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package client implements a MQTT 3.1.1 client on top of mqpp packets.
+//
+// A Client connects through Options.Dial, so any net.Conn works as transport,
+// including one end of a net.Pipe for in-process tests:
+//
+//	c := client.New(client.Options{
+//	    ClientID: "sensor-1",
+//	    Dial:     func() (net.Conn, error) { return net.Dial("tcp", "localhost:1883") },
+//	})
+//	if err := c.Connect(); err != nil {
+//	    ...
+//	}
+//	c.Subscribe(handler, mqpp.Subscription{TopicFilter: "a/+", RequestedQoS: mqpp.QosAtLeastOnce}).Wait()
+//	c.Publish("a/b", mqpp.QosExactlyOnce, false, []byte("payload")).Wait()
+//	c.Disconnect()
+package client
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/abo/mqpp"
+	"github.com/abo/mqpp/trace"
+)
+
+// MessageHandler is called with every PUBLISH received from server which matches its topic filter.
+// Handlers run on the reading goroutine, a slow handler delays all incoming packets.
+type MessageHandler func(c *Client, p *mqpp.Publish)
+
+// ConnectError is the non-zero return code of CONNACK
+type ConnectError byte
+
+func (e ConnectError) Error() string {
+	if desc, ok := mqpp.ConnectReturnCodeResponses[byte(e)]; ok {
+		return "mqpp/client: " + desc
+	}
+	return fmt.Sprintf("mqpp/client: %#02x Connection Refused, unknown return code", byte(e))
+}
+
+// Options configures a Client, fields of CONNECT packet share the meaning of mqpp.MakeConnect's parameters
+type Options struct {
+	// Dial opens the transport to server, it's called on every (re)connect
+	Dial func() (net.Conn, error)
+
+	ClientID     string
+	Username     string
+	Password     []byte
+	KeepAlive    uint16 // in seconds, 0 turns keep alive off
+	CleanSession bool
+	WillTopic    string // will message is sent when WillTopic not empty
+	WillMessage  []byte
+	WillQoS      byte // ignored without WillTopic
+	WillRetain   bool // ignored without WillTopic
+
+	// ConnectTimeout bounds dial and CONNECT/CONNACK handshake, default 30s
+	ConnectTimeout time.Duration
+
+	// AutoReconnect reconnects with exponential backoff between MinBackoff(default 1s)
+	// and MaxBackoff(default 2m) once the connection is lost, unacknowledged packets
+	// are resent after reconnecting, and subscriptions are restored if the server
+	// did not keep the session.
+	AutoReconnect bool
+	MinBackoff    time.Duration
+	MaxBackoff    time.Duration
+
+	// DefaultHandler receives publishes which match none of the subscribed filters
+	DefaultHandler MessageHandler
+	// OnConnect is called after each successful handshake
+	OnConnect func(c *Client, sessionPresent bool)
+	// OnConnectionLost is called when an established connection broke
+	OnConnectionLost func(c *Client, err error)
+
+	// Hook traces packets read and written, a read span ends once the packet is handled
+	Hook trace.Hook
+	// TraceEnvelope wraps payloads of published messages in trace envelopes carrying
+	// the context of their write spans, and unwraps payloads of received messages
+	TraceEnvelope bool
+}
+
+// pending is an operation waiting for server's acknowledgement
+type pending struct {
+	packet  mqpp.ControlPacket // Publish, Pubrel, Subscribe or Unsubscribe, resent after reconnect
+	ctx     context.Context    // parent of write spans of packet
+	sent    bool
+	token   *Token
+	handler MessageHandler
+}
+
+// Client is a MQTT client, it is safe for concurrent use
+type Client struct {
+	opts Options
+
+	mu       sync.Mutex
+	conn     *connection // current connection, nil when disconnected
+	closed   bool
+	closing  chan struct{} // closed by Disconnect to stop reconnecting
+	nextID   uint16
+	inflight map[uint16]*pending
+	order    []uint16 // packet identifiers of inflight in sending order
+	received map[uint16]bool
+	handlers map[string]MessageHandler
+	granted  map[string]byte
+}
+
+// New create a client with options, call Connect to connect to server
+func New(opts Options) *Client {
+	if opts.ConnectTimeout <= 0 {
+		opts.ConnectTimeout = 30 * time.Second
+	}
+	if opts.MinBackoff <= 0 {
+		opts.MinBackoff = time.Second
+	}
+	if opts.MaxBackoff < opts.MinBackoff {
+		opts.MaxBackoff = 2 * time.Minute
+		if opts.MaxBackoff < opts.MinBackoff {
+			opts.MaxBackoff = opts.MinBackoff
+		}
+	}
+	return &Client{
+		opts:     opts,
+		closing:  make(chan struct{}),
+		inflight: make(map[uint16]*pending),
+		received: make(map[uint16]bool),
+		handlers: make(map[string]MessageHandler),
+		granted:  make(map[string]byte),
+	}
+}
+
+// Connect connects to server and performs CONNECT/CONNACK handshake, a refused
+// connection is reported as ConnectError.
+func (c *Client) Connect() error {
+	c.mu.Lock()
+	if c.conn != nil {
+		c.mu.Unlock()
+		return nil
+	}
+	if c.closed {
+		c.closed = false
+		c.closing = make(chan struct{})
+	}
+	c.mu.Unlock()
+
+	return c.connect()
+}
+
+// IsConnected reports whether client has an established connection
+func (c *Client) IsConnected() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.conn != nil
+}
+
+func (c *Client) connect() error {
+	nc, err := c.opts.Dial()
+	if err != nil {
+		return err
+	}
+
+	s, sessionPresent, err := c.handshake(nc)
+	if err != nil {
+		nc.Close()
+		return err
+	}
+
+	conn := newConnection(c, nc)
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		nc.Close()
+		return ErrClosed
+	}
+	c.conn = conn
+	resend := c.resumeLocked(sessionPresent)
+	c.mu.Unlock()
+
+	go conn.writeLoop()
+	go conn.readLoop(s)
+	if c.opts.KeepAlive > 0 {
+		go conn.keepAlive(time.Duration(c.opts.KeepAlive) * time.Second)
+	}
+	for _, o := range resend {
+		conn.sendContext(o.ctx, o.p)
+	}
+
+	if c.opts.OnConnect != nil {
+		c.opts.OnConnect(c, sessionPresent)
+	}
+	return nil
+}
+
+func (c *Client) handshake(nc net.Conn) (*mqpp.Splitter, bool, error) {
+	nc.SetDeadline(time.Now().Add(c.opts.ConnectTimeout))
+	defer nc.SetDeadline(time.Time{})
+
+	o := c.opts
+	if o.WillTopic == "" {
+		// MQTT-3.1.2-13, MQTT-3.1.2-15
+		o.WillQoS, o.WillRetain = mqpp.QosAtMostOnce, false
+	}
+	connect := mqpp.MakeConnect(mqpp.ProtocolName, mqpp.ProtocolLevel, o.WillRetain, o.WillQoS, o.CleanSession, o.KeepAlive, o.ClientID, o.WillTopic, o.WillMessage, o.Username, o.Password)
+	if _, err := connect.WriteTo(nc); err != nil {
+		return nil, false, err
+	}
+
+	s := mqpp.NewSplitter(nc)
+	s.Buffer(make([]byte, 4096), mqpp.MaxPacketSize)
+	p, err := s.NextPacket()
+	if err != nil {
+		return nil, false, err
+	}
+	if p == nil {
+		return nil, false, io.ErrUnexpectedEOF
+	}
+	connack, ok := p.(*mqpp.Connack)
+	if !ok {
+		return nil, false, mqpp.ErrProtocolViolation
+	}
+	if connack.ReturnCode() != mqpp.Accepted {
+		return nil, false, ConnectError(connack.ReturnCode())
+	}
+	return s, connack.SessionPresent(), nil
+}
+
+// resumeLocked returns packets to send on a new connection: subscriptions when
+// the server lost the session, then every unacknowledged packet in original order.
+func (c *Client) resumeLocked(sessionPresent bool) []outgoing {
+	var resend []outgoing
+	for _, id := range c.order {
+		pd := c.inflight[id]
+		if pub, ok := pd.packet.(*mqpp.Publish); ok && pd.sent {
+			dup := mqpp.MakePublish(true, pub.QoS(), pub.Retain(), pub.TopicName(), pub.PacketIdentifier(), pub.Payload())
+			pd.packet = &dup
+		}
+		pd.sent = true
+		resend = append(resend, outgoing{pd.ctx, pd.packet})
+	}
+
+	if !sessionPresent && len(c.granted) > 0 {
+		subs := make([]mqpp.Subscription, 0, len(c.granted))
+		for filter, qos := range c.granted {
+			subs = append(subs, mqpp.Subscription{TopicFilter: filter, RequestedQoS: qos})
+		}
+		if id, ok := c.allocateLocked(); ok {
+			p := mqpp.MakeSubscribe(id, subs)
+			c.addLocked(id, &pending{packet: &p, ctx: context.Background(), sent: true})
+			resend = append([]outgoing{{context.Background(), &p}}, resend...)
+		}
+	}
+	return resend
+}
+
+func (c *Client) allocateLocked() (uint16, bool) {
+	for i := 0; i < 65535; i++ {
+		c.nextID++
+		if c.nextID == 0 {
+			c.nextID = 1
+		}
+		if _, used := c.inflight[c.nextID]; !used {
+			return c.nextID, true
+		}
+	}
+	return 0, false
+}
+
+func (c *Client) addLocked(id uint16, pd *pending) {
+	c.inflight[id] = pd
+	c.order = append(c.order, id)
+}
+
+func (c *Client) removeLocked(id uint16) *pending {
+	pd, ok := c.inflight[id]
+	if !ok {
+		return nil
+	}
+	delete(c.inflight, id)
+	for i, v := range c.order {
+		if v == id {
+			c.order = append(c.order[:i], c.order[i+1:]...)
+			break
+		}
+	}
+	return pd
+}
+
+// enqueue registers a packet waiting for acknowledgement and sends it if connected.
+// build is called with the allocated packet identifier, ctx is the parent of its write spans.
+func (c *Client) enqueue(ctx context.Context, handler MessageHandler, build func(id uint16) mqpp.ControlPacket) *Token {
+	t := newToken()
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		t.complete(ErrClosed, nil)
+		return t
+	}
+	conn := c.conn
+	if conn == nil && !c.opts.AutoReconnect {
+		c.mu.Unlock()
+		t.complete(ErrNotConnected, nil)
+		return t
+	}
+	id, ok := c.allocateLocked()
+	if !ok {
+		c.mu.Unlock()
+		t.complete(ErrNoPacketIdentifier, nil)
+		return t
+	}
+	p := build(id)
+	c.addLocked(id, &pending{packet: p, ctx: ctx, sent: conn != nil, token: t, handler: handler})
+	c.mu.Unlock()
+
+	if conn != nil {
+		conn.sendContext(ctx, p)
+	}
+	return t
+}
+
+// Publish sends an application message, the token completes once the packet is
+// queued for writing for QoS 0, on PUBACK for QoS 1 and on PUBCOMP for QoS 2.
+// With AutoReconnect, QoS 1 and 2 messages published while disconnected are sent after reconnecting.
+func (c *Client) Publish(topic string, qos byte, retain bool, payload []byte) *Token {
+	return c.PublishContext(context.Background(), topic, qos, retain, payload)
+}
+
+// PublishContext is Publish whose write spans, and those of PUBREL, are children of
+// the span in ctx, so the trace context sent with the message continues the caller's trace.
+func (c *Client) PublishContext(ctx context.Context, topic string, qos byte, retain bool, payload []byte) *Token {
+	if qos > mqpp.QosExactlyOnce || !mqpp.ValidTopicName(topic) {
+		t := newToken()
+		t.complete(mqpp.ErrProtocolViolation, nil)
+		return t
+	}
+
+	if qos == mqpp.QosAtMostOnce {
+		t := newToken()
+		c.mu.Lock()
+		conn, closed := c.conn, c.closed
+		c.mu.Unlock()
+		switch {
+		case closed:
+			t.complete(ErrClosed, nil)
+		case conn == nil:
+			t.complete(ErrNotConnected, nil)
+		default:
+			p := mqpp.MakePublish(false, qos, retain, topic, 0, payload)
+			t.complete(conn.sendContext(ctx, &p), nil)
+		}
+		return t
+	}
+
+	return c.enqueue(ctx, nil, func(id uint16) mqpp.ControlPacket {
+		p := mqpp.MakePublish(false, qos, retain, topic, id, payload)
+		return &p
+	})
+}
+
+// Subscribe subscribes to topic filters, handler is called for publishes matching
+// any filter the server granted. The token completes on SUBACK with its return codes,
+// and with ErrSubscriptionFailed if any filter was refused.
+func (c *Client) Subscribe(handler MessageHandler, subs ...mqpp.Subscription) *Token {
+	if len(subs) == 0 {
+		t := newToken()
+		t.complete(mqpp.ErrProtocolViolation, nil)
+		return t
+	}
+	for _, s := range subs {
+		if s.RequestedQoS > mqpp.QosExactlyOnce || !mqpp.ValidTopicFilter(s.TopicFilter) {
+			t := newToken()
+			t.complete(mqpp.ErrProtocolViolation, nil)
+			return t
+		}
+	}
+
+	return c.enqueue(context.Background(), handler, func(id uint16) mqpp.ControlPacket {
+		p := mqpp.MakeSubscribe(id, subs)
+		return &p
+	})
+}
+
+// Unsubscribe unsubscribes from topic filters and removes their handlers once UNSUBACK received
+func (c *Client) Unsubscribe(filters ...string) *Token {
+	if len(filters) == 0 {
+		t := newToken()
+		t.complete(mqpp.ErrProtocolViolation, nil)
+		return t
+	}
+
+	return c.enqueue(context.Background(), nil, func(id uint16) mqpp.ControlPacket {
+		p := mqpp.MakeUnsubscribe(id, filters)
+		return &p
+	})
+}
+
+// Disconnect sends DISCONNECT and closes the connection, server discards will
+// message. Pending operations complete with ErrClosed.
+func (c *Client) Disconnect() error {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return nil
+	}
+	c.closed = true
+	close(c.closing)
+	conn := c.conn
+	c.conn = nil
+	pds := c.inflight
+	c.inflight = make(map[uint16]*pending)
+	c.order = nil
+	c.mu.Unlock()
+
+	for _, pd := range pds {
+		if pd.token != nil {
+			pd.token.complete(ErrClosed, nil)
+		}
+	}
+
+	if conn == nil {
+		return nil
+	}
+	err := conn.send(mqpp.MakeDisconnect())
+	select {
+	case <-conn.done:
+	case <-time.After(c.opts.ConnectTimeout):
+		conn.close(ErrTimeout)
+	}
+	return err
+}
+
+// connectionLost is called once per broken connection
+func (c *Client) connectionLost(conn *connection, err error) {
+	c.mu.Lock()
+	if c.conn != conn {
+		c.mu.Unlock()
+		return
+	}
+	c.conn = nil
+	closed := c.closed
+	c.mu.Unlock()
+	if closed {
+		return
+	}
+
+	if c.opts.OnConnectionLost != nil {
+		c.opts.OnConnectionLost(c, err)
+	}
+	if c.opts.AutoReconnect {
+		go c.reconnect()
+	}
+}
+
+func (c *Client) reconnect() {
+	c.mu.Lock()
+	closing := c.closing
+	c.mu.Unlock()
+
+	backoff := c.opts.MinBackoff
+	for {
+		select {
+		case <-closing:
+			return
+		case <-time.After(backoff):
+		}
+		if err := c.connect(); err == nil || err == ErrClosed {
+			return
+		}
+		if backoff *= 2; backoff > c.opts.MaxBackoff {
+			backoff = c.opts.MaxBackoff
+		}
+	}
+}
+
+// handle processes a packet received from server
+func (c *Client) handle(conn *connection, p mqpp.ControlPacket) error {
+	switch pkt := p.(type) {
+	case *mqpp.Publish:
+		switch pkt.QoS() {
+		case mqpp.QosAtMostOnce:
+			c.deliver(pkt)
+		case mqpp.QosAtLeastOnce:
+			c.deliver(pkt)
+			conn.send(mqpp.MakePuback(pkt.PacketIdentifier()))
+		case mqpp.QosExactlyOnce:
+			c.mu.Lock()
+			dup := c.received[pkt.PacketIdentifier()]
+			c.received[pkt.PacketIdentifier()] = true
+			c.mu.Unlock()
+			if !dup {
+				c.deliver(pkt)
+			}
+			conn.send(mqpp.MakePubrec(pkt.PacketIdentifier()))
+		default:
+			return mqpp.ErrProtocolViolation
+		}
+	case *mqpp.Pubrel:
+		c.mu.Lock()
+		delete(c.received, pkt.PacketIdentifier())
+		c.mu.Unlock()
+		conn.send(mqpp.MakePubcomp(pkt.PacketIdentifier()))
+	case *mqpp.Puback:
+		return c.acknowledge(p.Type(), pkt.PacketIdentifier(), nil)
+	case *mqpp.Pubrec:
+		id := pkt.PacketIdentifier()
+		pubrel := mqpp.MakePubrel(id)
+		ctx := context.Background()
+		c.mu.Lock()
+		if pd, ok := c.inflight[id]; ok {
+			switch ackType(pd.packet) {
+			case mqpp.TPUBREC:
+				pd.packet, ctx = pubrel, pd.ctx
+			case mqpp.TPUBCOMP:
+				// PUBREC resent, so is PUBREL
+				ctx = pd.ctx
+			default:
+				c.mu.Unlock()
+				return mqpp.ErrProtocolViolation
+			}
+		}
+		c.mu.Unlock()
+		conn.sendContext(ctx, pubrel)
+	case *mqpp.Pubcomp:
+		return c.acknowledge(p.Type(), pkt.PacketIdentifier(), nil)
+	case *mqpp.Suback:
+		return c.acknowledge(p.Type(), pkt.PacketIdentifier(), pkt.ReturnCodes())
+	case *mqpp.Unsuback:
+		return c.acknowledge(p.Type(), pkt.PacketIdentifier(), nil)
+	case *mqpp.Pingresp:
+		conn.pong()
+	default:
+		return mqpp.ErrProtocolViolation
+	}
+	return nil
+}
+
+// ackType returns the type of packet acknowledging pending packet p
+func ackType(p mqpp.ControlPacket) byte {
+	switch p.Type() {
+	case mqpp.TPUBLISH:
+		if p.(*mqpp.Publish).QoS() == mqpp.QosAtLeastOnce {
+			return mqpp.TPUBACK
+		}
+		return mqpp.TPUBREC
+	case mqpp.TPUBREL:
+		return mqpp.TPUBCOMP
+	case mqpp.TSUBSCRIBE:
+		return mqpp.TSUBACK
+	default:
+		return mqpp.TUNSUBACK
+	}
+}
+
+// acknowledge completes the pending operation of packet identifier id with an
+// acknowledgement of type t, one not matching the operation is a protocol violation.
+func (c *Client) acknowledge(t byte, id uint16, returnCodes []byte) error {
+	c.mu.Lock()
+	pd, ok := c.inflight[id]
+	if !ok {
+		c.mu.Unlock()
+		return nil
+	}
+	if ackType(pd.packet) != t {
+		c.mu.Unlock()
+		return mqpp.ErrProtocolViolation
+	}
+	c.removeLocked(id)
+	var err error
+	switch pkt := pd.packet.(type) {
+	case *mqpp.Subscribe:
+		subs := pkt.Payload()
+		if len(returnCodes) != len(subs) {
+			err = mqpp.ErrProtocolViolation
+			break
+		}
+		for i, s := range subs {
+			if returnCodes[i] == mqpp.SubackFailure {
+				err = ErrSubscriptionFailed
+				continue
+			}
+			c.granted[s.TopicFilter] = s.RequestedQoS
+			if pd.handler != nil {
+				c.handlers[s.TopicFilter] = pd.handler
+			}
+		}
+	case *mqpp.Unsubscribe:
+		for _, filter := range pkt.Payload() {
+			delete(c.handlers, filter)
+			delete(c.granted, filter)
+		}
+	}
+	c.mu.Unlock()
+
+	if pd.token != nil {
+		pd.token.complete(err, returnCodes)
+	}
+	return nil
+}
+
+// deliver calls handlers of every filter matching the topic, or the default handler if none
+func (c *Client) deliver(p *mqpp.Publish) {
+	topic := p.TopicName()
+	var hs []MessageHandler
+	c.mu.Lock()
+	for filter, h := range c.handlers {
+		if mqpp.MatchTopic(filter, topic) {
+			hs = append(hs, h)
+		}
+	}
+	c.mu.Unlock()
+
+	if len(hs) == 0 && c.opts.DefaultHandler != nil {
+		hs = append(hs, c.opts.DefaultHandler)
+	}
+	for _, h := range hs {
+		h(c, p)
+	}
+}
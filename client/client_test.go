@@ -0,0 +1,204 @@
+// Copyright (c) 2016 The MQPP Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/abo/mqpp"
+)
+
+// peer is the server end of a net.Pipe
+type peer struct {
+	t *testing.T
+	net.Conn
+	s *mqpp.Splitter
+}
+
+func (p *peer) expect(typ byte) mqpp.ControlPacket {
+	p.SetReadDeadline(time.Now().Add(time.Second))
+	if !p.s.Scan() {
+		p.t.Fatalf("expect packet type %d, got err: %v", typ, p.s.Err())
+	}
+	pkt, err := mqpp.Parse(append([]byte(nil), p.s.Bytes()...))
+	if err != nil || pkt.Type() != typ {
+		p.t.Fatalf("expect packet type %d, got %v, err: %v", typ, pkt, err)
+	}
+	return pkt
+}
+
+func (p *peer) send(pkts ...mqpp.ControlPacket) {
+	for _, pkt := range pkts {
+		if _, err := pkt.WriteTo(p); err != nil {
+			p.t.Fatal(err)
+		}
+	}
+}
+
+// pipeClient returns a client dialing into the returned channel of peers
+func pipeClient(t *testing.T, opts Options) (*Client, chan *peer) {
+	peers := make(chan *peer, 4)
+	opts.Dial = func() (net.Conn, error) {
+		c, s := net.Pipe()
+		peers <- &peer{t: t, Conn: s, s: mqpp.NewSplitter(s)}
+		return c, nil
+	}
+	return New(opts), peers
+}
+
+func accept(t *testing.T, peers chan *peer, sessionPresent bool) *peer {
+	p := <-peers
+	p.expect(mqpp.TCONNECT)
+	p.send(mqpp.MakeConnack(sessionPresent, mqpp.Accepted))
+	return p
+}
+
+func TestConnectRefused(t *testing.T) {
+	c, peers := pipeClient(t, Options{ClientID: "cid", WillQoS: mqpp.QosExactlyOnce, WillRetain: true})
+	go func() {
+		p := <-peers
+		connect := p.expect(mqpp.TCONNECT).(*mqpp.Connect)
+		if connect.ClientIdentifier() != "cid" {
+			t.Errorf("expect client id cid, actual %s", connect.ClientIdentifier())
+		}
+		if connect.WillQoS() != 0 || connect.WillRetain() {
+			t.Errorf("expect no will qos and retain without will topic, actual %d %v", connect.WillQoS(), connect.WillRetain())
+		}
+		p.send(mqpp.MakeConnack(false, mqpp.RefusedBadCredentials))
+	}()
+
+	err := c.Connect()
+	if err != ConnectError(mqpp.RefusedBadCredentials) {
+		t.Fatalf("expect bad credentials, actual %v", err)
+	}
+}
+
+func TestPublishSubscribe(t *testing.T) {
+	c, peers := pipeClient(t, Options{ClientID: "cid"})
+	received := make(chan *mqpp.Publish, 1)
+	flowed, done := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(done)
+		p := accept(t, peers, false)
+
+		sub := p.expect(mqpp.TSUBSCRIBE).(*mqpp.Subscribe)
+		p.send(mqpp.MakeSuback(sub.PacketIdentifier(), []byte{mqpp.QosExactlyOnce, mqpp.SubackFailure}))
+
+		p.expect(mqpp.TPUBLISH)
+		pub := p.expect(mqpp.TPUBLISH).(*mqpp.Publish)
+		p.send(mqpp.MakePuback(pub.PacketIdentifier()))
+		pub = p.expect(mqpp.TPUBLISH).(*mqpp.Publish)
+		p.send(mqpp.MakePubrec(pub.PacketIdentifier()))
+		rel := p.expect(mqpp.TPUBREL).(*mqpp.Pubrel)
+		p.send(mqpp.MakePubcomp(rel.PacketIdentifier()))
+
+		p.send(mqpp.MakePublish(false, mqpp.QosExactlyOnce, false, "a/b", 7, []byte("in")))
+		p.expect(mqpp.TPUBREC)
+		p.send(mqpp.MakePubrel(7))
+		p.expect(mqpp.TPUBCOMP)
+		close(flowed)
+		p.expect(mqpp.TDISCONNECT)
+	}()
+
+	if err := c.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	token := c.Subscribe(func(c *Client, p *mqpp.Publish) { received <- p },
+		mqpp.Subscription{TopicFilter: "a/+", RequestedQoS: mqpp.QosExactlyOnce},
+		mqpp.Subscription{TopicFilter: "b/#", RequestedQoS: mqpp.QosAtMostOnce})
+	if err := token.WaitTimeout(time.Second); err != ErrSubscriptionFailed || !bytes.Equal(token.ReturnCodes(), []byte{2, 0x80}) {
+		t.Fatalf("expect partial failure, actual %v %v", err, token.ReturnCodes())
+	}
+	for qos := byte(0); qos <= mqpp.QosExactlyOnce; qos++ {
+		if err := c.Publish("a/b", qos, false, []byte("out")).WaitTimeout(time.Second); err != nil {
+			t.Fatalf("qos %d: %v", qos, err)
+		}
+	}
+
+	select {
+	case p := <-received:
+		if p.TopicName() != "a/b" || string(p.Payload()) != "in" {
+			t.Fatalf("unexpected publish %v", p)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expect publish delivered")
+	}
+	<-flowed
+	c.Disconnect()
+	<-done
+}
+
+func TestReconnectResend(t *testing.T) {
+	c, peers := pipeClient(t, Options{ClientID: "cid", AutoReconnect: true, MinBackoff: time.Millisecond})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		p := accept(t, peers, false)
+		sub := p.expect(mqpp.TSUBSCRIBE).(*mqpp.Subscribe)
+		p.send(mqpp.MakeSuback(sub.PacketIdentifier(), []byte{mqpp.QosAtLeastOnce}))
+		pub := p.expect(mqpp.TPUBLISH).(*mqpp.Publish)
+		p.Close() // lost before PUBACK
+
+		p = accept(t, peers, false)
+		resub := p.expect(mqpp.TSUBSCRIBE).(*mqpp.Subscribe)
+		if resub.Payload()[0].TopicFilter != "t" {
+			t.Errorf("expect resubscribe to t, actual %v", resub.Payload())
+		}
+		p.send(mqpp.MakeSuback(resub.PacketIdentifier(), []byte{mqpp.QosAtLeastOnce}))
+		dup := p.expect(mqpp.TPUBLISH).(*mqpp.Publish)
+		if !dup.Dup() || dup.PacketIdentifier() != pub.PacketIdentifier() {
+			t.Errorf("expect dup publish %d, actual %v", pub.PacketIdentifier(), dup)
+		}
+		p.send(mqpp.MakePuback(dup.PacketIdentifier()))
+		p.expect(mqpp.TDISCONNECT)
+	}()
+
+	if err := c.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Subscribe(nil, mqpp.Subscription{TopicFilter: "t", RequestedQoS: mqpp.QosAtLeastOnce}).WaitTimeout(time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Publish("t", mqpp.QosAtLeastOnce, false, []byte("x")).WaitTimeout(time.Second); err != nil {
+		t.Fatal(err)
+	}
+	c.Disconnect()
+	<-done
+}
+
+func TestAckMismatch(t *testing.T) {
+	c, peers := pipeClient(t, Options{ClientID: "cid"})
+	closed := make(chan error, 1)
+	go func() {
+		p := accept(t, peers, false)
+		sub := p.expect(mqpp.TSUBSCRIBE).(*mqpp.Subscribe)
+		p.send(mqpp.MakeUnsuback(sub.PacketIdentifier()))
+		p.SetReadDeadline(time.Now().Add(time.Second))
+		_, err := p.Read(make([]byte, 1))
+		closed <- err
+	}()
+
+	if err := c.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	c.Subscribe(nil, mqpp.Subscription{TopicFilter: "t", RequestedQoS: mqpp.QosAtLeastOnce})
+	if err := <-closed; err != io.EOF {
+		t.Fatalf("expect connection closed on UNSUBACK of SUBSCRIBE, actual %v", err)
+	}
+}
@@ -0,0 +1,168 @@
+// Copyright (c) 2016 The MQPP Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"context"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/abo/mqpp"
+	"github.com/abo/mqpp/trace"
+)
+
+// connection is one established transport, it's discarded once broken
+type connection struct {
+	client *Client
+	conn   net.Conn
+	out    chan outgoing
+	done   chan struct{}
+	once   sync.Once
+	err    error
+
+	mu        sync.Mutex
+	lastWrite time.Time
+	pingSent  time.Time // zero when no PINGREQ outstanding
+}
+
+func newConnection(c *Client, nc net.Conn) *connection {
+	return &connection{
+		client:    c,
+		conn:      nc,
+		out:       make(chan outgoing, 128),
+		done:      make(chan struct{}),
+		lastWrite: time.Now(),
+	}
+}
+
+// outgoing is a packet queued for writing, ctx is the parent of its write span
+type outgoing struct {
+	ctx context.Context
+	p   mqpp.ControlPacket
+}
+
+// send queues p for writing, it fails only if the connection is broken
+func (c *connection) send(p mqpp.ControlPacket) error {
+	return c.sendContext(context.Background(), p)
+}
+
+// sendContext queues p for writing with the context of its write span
+func (c *connection) sendContext(ctx context.Context, p mqpp.ControlPacket) error {
+	select {
+	case c.out <- outgoing{ctx, p}:
+		return nil
+	case <-c.done:
+		return c.err
+	}
+}
+
+// close breaks the connection, only the first err is kept
+func (c *connection) close(err error) {
+	c.once.Do(func() {
+		c.err = err
+		close(c.done)
+		c.conn.Close()
+		c.client.connectionLost(c, err)
+	})
+}
+
+func (c *connection) writeLoop() {
+	for {
+		select {
+		case o := <-c.out:
+			p := o.p
+			_, span := trace.Start(o.ctx, c.client.opts.Hook, trace.Write, p)
+			if pub, ok := p.(*mqpp.Publish); ok && c.client.opts.TraceEnvelope && span.Context().IsValid() {
+				p = trace.InjectPublish(pub, span.Context())
+			}
+			_, err := p.WriteTo(c.conn)
+			span.End(err)
+			if err != nil {
+				c.close(err)
+				return
+			}
+			c.mu.Lock()
+			c.lastWrite = time.Now()
+			c.mu.Unlock()
+			if p.Type() == mqpp.TDISCONNECT {
+				c.close(ErrClosed)
+				return
+			}
+		case <-c.done:
+			return
+		}
+	}
+}
+
+func (c *connection) readLoop(s *mqpp.Splitter) {
+	for s.Scan() {
+		// packets are handed to handlers, so they must not share the splitter's buffer
+		p, err := mqpp.Parse(append([]byte(nil), s.Bytes()...))
+		if err == nil {
+			_, span := trace.Start(context.Background(), c.client.opts.Hook, trace.Read, p)
+			if pub, ok := p.(*mqpp.Publish); ok && c.client.opts.TraceEnvelope {
+				_, p, _ = trace.ExtractPublish(pub)
+			}
+			err = c.client.handle(c, p)
+			span.End(err)
+		}
+		if err != nil {
+			c.close(err)
+			return
+		}
+	}
+	err := s.Err()
+	if err == nil {
+		err = io.EOF
+	}
+	c.close(err)
+}
+
+// keepAlive sends PINGREQ when nothing was written for half of interval, and
+// breaks the connection if PINGRESP doesn't arrive within interval.
+func (c *connection) keepAlive(interval time.Duration) {
+	ticker := time.NewTicker(interval / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.done:
+			return
+		case now := <-ticker.C:
+			c.mu.Lock()
+			pingSent, idle := c.pingSent, now.Sub(c.lastWrite)
+			if pingSent.IsZero() && idle >= interval/2 {
+				c.pingSent = now
+			}
+			c.mu.Unlock()
+
+			if !pingSent.IsZero() {
+				if now.Sub(pingSent) >= interval {
+					c.close(ErrTimeout)
+					return
+				}
+			} else if idle >= interval/2 {
+				c.send(mqpp.MakePingreq())
+			}
+		}
+	}
+}
+
+func (c *connection) pong() {
+	c.mu.Lock()
+	c.pingSent = time.Time{}
+	c.mu.Unlock()
+}
@@ -0,0 +1,97 @@
+// Copyright (c) 2016 The MQPP Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrTimeout - the operation did not complete in time
+	ErrTimeout = errors.New("mqpp/client: Timeout")
+	// ErrNotConnected - there is no connection to server
+	ErrNotConnected = errors.New("mqpp/client: Not Connected")
+	// ErrClosed - client disconnected by Disconnect
+	ErrClosed = errors.New("mqpp/client: Client Closed")
+	// ErrSubscriptionFailed - server rejected one or more topic filters
+	ErrSubscriptionFailed = errors.New("mqpp/client: Subscription Failed")
+	// ErrNoPacketIdentifier - all 65535 packet identifiers are in use
+	ErrNoPacketIdentifier = errors.New("mqpp/client: No Packet Identifier Available")
+)
+
+// Token is the future of an asynchronous operation, it completes when the
+// server acknowledged the operation (PUBACK, PUBCOMP, SUBACK, UNSUBACK), or
+// immediately for QoS 0 publish once it has been written.
+type Token struct {
+	once        sync.Once
+	done        chan struct{}
+	err         error
+	returnCodes []byte
+}
+
+func newToken() *Token {
+	return &Token{done: make(chan struct{})}
+}
+
+func (t *Token) complete(err error, returnCodes []byte) {
+	t.once.Do(func() {
+		t.err = err
+		t.returnCodes = returnCodes
+		close(t.done)
+	})
+}
+
+// Done returns a channel which is closed when the operation completes
+func (t *Token) Done() <-chan struct{} {
+	return t.done
+}
+
+// Wait blocks until the operation completes, and return its error
+func (t *Token) Wait() error {
+	<-t.done
+	return t.err
+}
+
+// WaitTimeout blocks until the operation completes or timeout elapsed, returns ErrTimeout in latter case
+func (t *Token) WaitTimeout(timeout time.Duration) error {
+	select {
+	case <-t.done:
+		return t.err
+	case <-time.After(timeout):
+		return ErrTimeout
+	}
+}
+
+// Err returns the error of a completed operation, or nil if it is still pending
+func (t *Token) Err() error {
+	select {
+	case <-t.done:
+		return t.err
+	default:
+		return nil
+	}
+}
+
+// ReturnCodes returns the SUBACK return codes of a completed subscribe, one per topic filter
+func (t *Token) ReturnCodes() []byte {
+	select {
+	case <-t.done:
+		return t.returnCodes
+	default:
+		return nil
+	}
+}
@@ -0,0 +1,103 @@
+// Copyright (c) 2016 The MQPP Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/abo/mqpp/broker"
+)
+
+func loopback(t *testing.T) string {
+	b := broker.New(broker.Options{})
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go b.Serve(l)
+	t.Cleanup(func() { b.Close() })
+	return l.Addr().String()
+}
+
+func TestBench(t *testing.T) {
+	target := loopback(t)
+	for qos := byte(0); qos <= 2; qos++ {
+		opts := &options{target: target, conns: 4, rate: 2000, count: 50, qos: qos, topic: "bench/{conn}/{seq}",
+			size: 32, subscribe: true, inflight: 8, clientPrefix: "bench-", timeout: time.Second, wait: 2 * time.Second}
+		if err := opts.check(); err != nil {
+			t.Fatal(err)
+		}
+		if opts.filter != "bench/+/+" {
+			t.Fatalf("unexpected filter %s", opts.filter)
+		}
+		r, err := run(opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r.conns != 4 || r.published != 200 || r.received != 200 || r.errors() != 0 {
+			t.Fatalf("qos %d: unexpected %+v", qos, r)
+		}
+		if qos > 0 && (r.acked != 200 || len(r.ackLatency) != 200) || len(r.e2eLatency) != 200 {
+			t.Fatalf("qos %d: %d acked, %d ack and %d e2e latencies", qos, r.acked, len(r.ackLatency), len(r.e2eLatency))
+		}
+		// 50 messages per connection at 500/s each
+		if r.elapsed < 90*time.Millisecond {
+			t.Fatalf("qos %d: not paced, took %v", qos, r.elapsed)
+		}
+
+		var buf bytes.Buffer
+		r.write(&buf, opts)
+		if !strings.Contains(buf.String(), "published   200") || !strings.Contains(buf.String(), "errors      connect 0, read 0, write 0, unacked 0, lost 0") {
+			t.Fatalf("unexpected report:\n%s", buf.String())
+		}
+	}
+}
+
+func TestBenchDuration(t *testing.T) {
+	opts := &options{target: loopback(t), conns: 2, duration: 100 * time.Millisecond, qos: 1, topic: "d",
+		size: 8, inflight: 1, clientPrefix: "bench-", timeout: time.Second, wait: time.Second}
+	if err := opts.check(); err != nil {
+		t.Fatal(err)
+	}
+	r, err := run(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.published == 0 || r.acked != r.published || r.errors() != 0 || r.elapsed > time.Second {
+		t.Fatalf("unexpected %+v", r)
+	}
+}
+
+func TestBenchErrors(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	target := l.Addr().String()
+	l.Close()
+	opts := &options{target: target, conns: 1, count: 1, topic: "t", inflight: 1, timeout: time.Second}
+	if _, err := run(opts); err == nil {
+		t.Fatal("expect no connection")
+	}
+
+	opts = &options{target: target, conns: 1, count: 1, topic: "a/{conn}x", subscribe: true, size: 8, inflight: 1}
+	if err := opts.check(); err == nil {
+		t.Fatal("expect invalid derived filter")
+	}
+}
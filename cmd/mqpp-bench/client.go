@@ -0,0 +1,281 @@
+// Copyright (c) 2016 The MQPP Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/abo/mqpp"
+)
+
+// client is a benchmark connection, publishing or subscribing
+type client struct {
+	opts *options
+	conn net.Conn
+	s    *mqpp.Splitter
+	wmu  sync.Mutex // serializes writes of the publishing and reading goroutines
+
+	closing atomic.Bool
+	done    chan struct{} // closed when reading ends
+
+	mu        sync.Mutex
+	inflight  map[uint16]time.Time // sent time of QoS 1 and 2 publishes
+	nextID    uint16
+	window    chan struct{} // bounds inflight
+	published int64
+	acked     int64
+	received  int64
+	latencies []time.Duration // publish to ack, or end to end for subscribers
+	readErr   error
+	writeErr  error
+}
+
+// dial connects a client with CONNECT of clientID, and waits for CONNACK
+func dial(opts *options, clientID string) (*client, error) {
+	conn, err := net.DialTimeout("tcp", opts.target, opts.timeout)
+	if err != nil {
+		return nil, err
+	}
+	c := &client{
+		opts:     opts,
+		conn:     conn,
+		s:        mqpp.NewSplitter(conn),
+		done:     make(chan struct{}),
+		inflight: make(map[uint16]time.Time),
+		window:   make(chan struct{}, opts.inflight),
+	}
+	c.s.Buffer(make([]byte, 4096), mqpp.MaxPacketSize)
+
+	connect := mqpp.MakeConnect(mqpp.ProtocolName, mqpp.ProtocolLevel, false, 0, true, 0, clientID, "", nil, "", nil)
+	if err := c.write(&connect); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	p, err := c.next(mqpp.TCONNACK)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if code := p.(*mqpp.Connack).ReturnCode(); code != mqpp.Accepted {
+		conn.Close()
+		return nil, errRefused(code)
+	}
+	return c, nil
+}
+
+type errRefused byte
+
+func (e errRefused) Error() string {
+	return fmt.Sprintf("connection refused, return code %d", byte(e))
+}
+
+// next reads the next packet during handshakes, which must be of type t
+func (c *client) next(t byte) (mqpp.ControlPacket, error) {
+	c.conn.SetReadDeadline(time.Now().Add(c.opts.timeout))
+	defer c.conn.SetReadDeadline(time.Time{})
+	if !c.s.Scan() {
+		if err := c.s.Err(); err != nil {
+			return nil, err
+		}
+		return nil, errors.New("connection closed")
+	}
+	p, err := mqpp.Parse(append([]byte(nil), c.s.Bytes()...))
+	if err != nil {
+		return nil, err
+	}
+	if p.Type() != t {
+		return nil, fmt.Errorf("expect %s, got %s", mqpp.TypeName(t), mqpp.TypeName(p.Type()))
+	}
+	return p, nil
+}
+
+func (c *client) write(p mqpp.ControlPacket) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	_, err := p.WriteTo(c.conn)
+	return err
+}
+
+// subscribe subscribes to filter, and waits for SUBACK
+func (c *client) subscribe(filter string) error {
+	sub := mqpp.MakeSubscribe(1, []mqpp.Subscription{{TopicFilter: filter, RequestedQoS: c.opts.qos}})
+	if err := c.write(&sub); err != nil {
+		return err
+	}
+	p, err := c.next(mqpp.TSUBACK)
+	if err != nil {
+		return err
+	}
+	if codes := p.(*mqpp.Suback).ReturnCodes(); len(codes) != 1 || codes[0] == mqpp.SubackFailure {
+		return fmt.Errorf("subscription to %s refused", filter)
+	}
+	return nil
+}
+
+// readLoop completes QoS flows, and measures the latencies
+func (c *client) readLoop() {
+	defer close(c.done)
+	for c.s.Scan() {
+		p, err := mqpp.Parse(append([]byte(nil), c.s.Bytes()...))
+		if err != nil {
+			c.fail(&c.readErr, err)
+			return
+		}
+		switch p := p.(type) {
+		case *mqpp.Puback:
+			c.complete(p.PacketIdentifier())
+		case *mqpp.Pubrec:
+			if err := c.write(mqpp.MakePubrel(p.PacketIdentifier())); err != nil {
+				c.fail(&c.writeErr, err)
+			}
+		case *mqpp.Pubcomp:
+			c.complete(p.PacketIdentifier())
+		case *mqpp.Publish:
+			c.deliver(p)
+		case *mqpp.Pubrel:
+			if err := c.write(mqpp.MakePubcomp(p.PacketIdentifier())); err != nil {
+				c.fail(&c.writeErr, err)
+			}
+		}
+	}
+	if !c.closing.Load() {
+		err := c.s.Err()
+		if err == nil {
+			err = errors.New("connection closed by the target")
+		}
+		c.fail(&c.readErr, err)
+	}
+}
+
+func (c *client) fail(dst *error, err error) {
+	c.mu.Lock()
+	if *dst == nil {
+		*dst = err
+	}
+	c.mu.Unlock()
+}
+
+// complete ends the flow of publish id
+func (c *client) complete(id uint16) {
+	c.mu.Lock()
+	sent, ok := c.inflight[id]
+	if ok {
+		delete(c.inflight, id)
+		c.acked++
+		c.latencies = append(c.latencies, time.Since(sent))
+	}
+	c.mu.Unlock()
+	if ok {
+		<-c.window
+	}
+}
+
+// deliver counts a publish received by a subscriber, sent at the time in its payload
+func (c *client) deliver(p *mqpp.Publish) {
+	now := time.Now()
+	c.mu.Lock()
+	c.received++
+	if payload := p.Payload(); len(payload) >= 8 {
+		sent := time.Unix(0, int64(binary.BigEndian.Uint64(payload)))
+		c.latencies = append(c.latencies, now.Sub(sent))
+	}
+	c.mu.Unlock()
+
+	switch p.QoS() {
+	case mqpp.QosAtLeastOnce:
+		if err := c.write(mqpp.MakePuback(p.PacketIdentifier())); err != nil {
+			c.fail(&c.writeErr, err)
+		}
+	case mqpp.QosExactlyOnce:
+		if err := c.write(mqpp.MakePubrec(p.PacketIdentifier())); err != nil {
+			c.fail(&c.writeErr, err)
+		}
+	}
+}
+
+// publish sends publishes of connection n at the paced rate, till count or deadline.
+// interval is 0 for no pacing.
+func (c *client) publish(n int, start, deadline time.Time, interval time.Duration) {
+	payload := make([]byte, c.opts.size)
+	for i := 0; c.opts.count == 0 || i < c.opts.count; i++ {
+		if interval > 0 {
+			if d := time.Until(start.Add(time.Duration(i) * interval)); d > 0 {
+				time.Sleep(d)
+			}
+		}
+		if !deadline.IsZero() && !time.Now().Before(deadline) {
+			return
+		}
+
+		var id uint16
+		if c.opts.qos > mqpp.QosAtMostOnce {
+			select {
+			case c.window <- struct{}{}:
+			case <-c.done:
+				return
+			}
+			c.mu.Lock()
+			id = c.allocID()
+			c.mu.Unlock()
+		}
+		if len(payload) >= 8 {
+			binary.BigEndian.PutUint64(payload, uint64(time.Now().UnixNano()))
+		}
+		topic := strings.NewReplacer("{conn}", strconv.Itoa(n), "{seq}", strconv.Itoa(i)).Replace(c.opts.topic)
+		p := mqpp.MakePublish(false, c.opts.qos, false, topic, id, payload)
+		c.mu.Lock()
+		if id != 0 {
+			c.inflight[id] = time.Now()
+		}
+		c.published++
+		c.mu.Unlock()
+		if err := c.write(&p); err != nil {
+			c.fail(&c.writeErr, err)
+			return
+		}
+	}
+}
+
+// allocID returns an unused packet identifier, the window guarantees there's one
+func (c *client) allocID() uint16 {
+	for {
+		c.nextID++
+		if _, used := c.inflight[c.nextID]; c.nextID != 0 && !used {
+			return c.nextID
+		}
+	}
+}
+
+// pending returns the number of publishes not acknowledged yet
+func (c *client) pending() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.inflight)
+}
+
+func (c *client) close() {
+	c.closing.Store(true)
+	c.write(mqpp.MakeDisconnect())
+	c.conn.Close()
+	<-c.done
+}
@@ -0,0 +1,309 @@
+// Copyright (c) 2016 The MQPP Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Command mqpp-bench generates MQTT load against a broker, and reports
+// throughput, latency percentiles and errors.
+//
+// Usage:
+//
+//	mqpp-bench -target host:port [flags]
+//
+// Each of -conns connections publishes to -topic, where {conn} is replaced by
+// the connection number and {seq} by the message number, sharing -rate messages
+// per second among them. The first 8 bytes of payloads hold the sending time, so
+// with -subscribe a subscriber to -filter measures end to end latency. Publishing
+// stops after -count messages per connection or -duration, whichever comes first.
+// The exit status is 1 if any error occurred.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/abo/mqpp"
+)
+
+type options struct {
+	target       string
+	conns        int
+	rate         float64 // messages per second of all connections, 0 for unlimited
+	duration     time.Duration
+	count        int // per connection, 0 for unlimited
+	qos          byte
+	topic        string
+	filter       string
+	size         int
+	subscribe    bool
+	inflight     int
+	clientPrefix string
+	timeout      time.Duration
+	wait         time.Duration
+}
+
+// result of a benchmark
+type result struct {
+	qos           byte
+	subscribed    bool
+	conns         int
+	connectErrors int
+	published     int64
+	acked         int64
+	received      int64
+	readErrors    int
+	writeErrors   int
+	elapsed       time.Duration // of publishing
+	ackLatency    []time.Duration
+	e2eLatency    []time.Duration
+}
+
+// errors counts errors, lost QoS 0 publishes are not errors
+func (r *result) errors() int64 {
+	n := int64(r.connectErrors+r.readErrors+r.writeErrors) + r.unacked()
+	if r.qos > mqpp.QosAtMostOnce {
+		n += r.lost()
+	}
+	return n
+}
+
+// unacked is the number of QoS 1 and 2 publishes not acknowledged
+func (r *result) unacked() int64 {
+	if r.qos == mqpp.QosAtMostOnce {
+		return 0
+	}
+	return r.published - r.acked
+}
+
+// lost is the number of publishes the subscriber missed
+func (r *result) lost() int64 {
+	if !r.subscribed || r.received >= r.published {
+		return 0
+	}
+	return r.published - r.received
+}
+
+func main() {
+	opts := &options{}
+	flag.StringVar(&opts.target, "target", "", "address of the broker")
+	flag.IntVar(&opts.conns, "conns", 10, "number of publishing connections")
+	flag.Float64Var(&opts.rate, "rate", 1000, "messages per second of all connections, 0 for unlimited")
+	flag.DurationVar(&opts.duration, "duration", 10*time.Second, "how long to publish, 0 for no limit")
+	flag.IntVar(&opts.count, "count", 0, "messages per connection, 0 for no limit")
+	qos := flag.Int("qos", 0, "QoS of publishes and the subscription")
+	flag.StringVar(&opts.topic, "topic", "mqpp-bench/{conn}", "topic of publishes, {conn} and {seq} are replaced")
+	flag.StringVar(&opts.filter, "filter", "", "topic filter of the subscriber, derived from -topic if empty")
+	flag.IntVar(&opts.size, "size", 64, "payload size in bytes")
+	flag.BoolVar(&opts.subscribe, "subscribe", false, "subscribe to the publishes and measure end to end latency")
+	flag.IntVar(&opts.inflight, "inflight", 100, "max unacknowledged QoS 1 and 2 publishes per connection")
+	flag.StringVar(&opts.clientPrefix, "client-prefix", "mqpp-bench-", "prefix of client identifiers")
+	flag.DurationVar(&opts.timeout, "timeout", 5*time.Second, "timeout of dialing and handshakes")
+	flag.DurationVar(&opts.wait, "wait", 2*time.Second, "how long to wait for acks and deliveries after publishing")
+	flag.Parse()
+	opts.qos = byte(*qos)
+	if err := opts.check(); err != nil || flag.NArg() != 0 {
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+		}
+		fmt.Fprintf(os.Stderr, "usage: %s -target host:port [flags]\n", os.Args[0])
+		flag.PrintDefaults()
+		os.Exit(2)
+	}
+
+	r, err := run(opts)
+	if err != nil {
+		log.Fatal(err)
+	}
+	r.write(os.Stdout, opts)
+	if r.errors() > 0 {
+		os.Exit(1)
+	}
+}
+
+// check validates options, and derives the filter
+func (opts *options) check() error {
+	switch {
+	case opts.target == "":
+		return fmt.Errorf("-target is required")
+	case opts.conns <= 0:
+		return fmt.Errorf("-conns must be positive")
+	case opts.qos > mqpp.QosExactlyOnce:
+		return fmt.Errorf("-qos must be 0, 1 or 2")
+	case opts.inflight <= 0 || opts.inflight > 65535:
+		return fmt.Errorf("-inflight must be in 1..65535")
+	case opts.rate < 0 || opts.size < 0 || opts.count < 0 || opts.duration < 0:
+		return fmt.Errorf("-rate, -size, -count and -duration can't be negative")
+	case opts.count == 0 && opts.duration == 0:
+		return fmt.Errorf("either -count or -duration must be set")
+	}
+	if opts.subscribe {
+		if opts.size < 8 {
+			return fmt.Errorf("-size must be at least 8 to measure end to end latency")
+		}
+		if opts.filter == "" {
+			opts.filter = strings.NewReplacer("{conn}", "+", "{seq}", "+").Replace(opts.topic)
+		}
+		if !mqpp.ValidTopicFilter(opts.filter) {
+			return fmt.Errorf("invalid filter %q, set -filter", opts.filter)
+		}
+	}
+	return nil
+}
+
+// run publishes with all connections, and collects the result
+func run(opts *options) (*result, error) {
+	r := &result{qos: opts.qos, subscribed: opts.subscribe}
+	var sub *client
+	if opts.subscribe {
+		var err error
+		if sub, err = dial(opts, opts.clientPrefix+"sub"); err != nil {
+			return nil, fmt.Errorf("subscriber: %v", err)
+		}
+		if err := sub.subscribe(opts.filter); err != nil {
+			sub.conn.Close()
+			return nil, fmt.Errorf("subscriber: %v", err)
+		}
+		go sub.readLoop()
+	}
+
+	pubs := make([]*client, opts.conns)
+	var wg sync.WaitGroup
+	for i := range pubs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			c, err := dial(opts, fmt.Sprintf("%s%d", opts.clientPrefix, i))
+			if err != nil {
+				log.Printf("conn %d: %v", i, err)
+				return
+			}
+			pubs[i] = c
+			go c.readLoop()
+		}(i)
+	}
+	wg.Wait()
+	var connected []*client
+	for _, c := range pubs {
+		if c == nil {
+			r.connectErrors++
+			continue
+		}
+		connected = append(connected, c)
+	}
+	if len(connected) == 0 {
+		if sub != nil {
+			sub.close()
+		}
+		return nil, fmt.Errorf("no connection to %s", opts.target)
+	}
+	r.conns = len(connected)
+
+	var interval time.Duration
+	if opts.rate > 0 {
+		interval = time.Duration(float64(time.Second) * float64(len(connected)) / opts.rate)
+	}
+	start := time.Now()
+	var deadline time.Time
+	if opts.duration > 0 {
+		deadline = start.Add(opts.duration)
+	}
+	for i, c := range connected {
+		wg.Add(1)
+		go func(i int, c *client) {
+			defer wg.Done()
+			c.publish(i, start, deadline, interval)
+		}(i, c)
+	}
+	wg.Wait()
+	r.elapsed = time.Since(start)
+
+	// wait for acks and deliveries of the last publishes
+	for until := time.Now().Add(opts.wait); time.Now().Before(until); time.Sleep(10 * time.Millisecond) {
+		pending := 0
+		var published int64
+		for _, c := range connected {
+			pending += c.pending()
+			c.mu.Lock()
+			published += c.published
+			c.mu.Unlock()
+		}
+		if sub != nil {
+			sub.mu.Lock()
+			if sub.received < published {
+				pending++
+			}
+			sub.mu.Unlock()
+		}
+		if pending == 0 {
+			break
+		}
+	}
+
+	for _, c := range connected {
+		c.close()
+		r.published += c.published
+		r.acked += c.acked
+		r.ackLatency = append(r.ackLatency, c.latencies...)
+		r.count(c)
+	}
+	if sub != nil {
+		sub.close()
+		r.received = sub.received
+		r.e2eLatency = sub.latencies
+		r.count(sub)
+	}
+	return r, nil
+}
+
+// count adds up errors of c
+func (r *result) count(c *client) {
+	if c.readErr != nil {
+		log.Printf("read: %v", c.readErr)
+		r.readErrors++
+	}
+	if c.writeErr != nil {
+		log.Printf("write: %v", c.writeErr)
+		r.writeErrors++
+	}
+}
+
+func (r *result) write(w io.Writer, opts *options) {
+	fmt.Fprintf(w, "target      %s, %d connections, QoS %d, %d bytes payload\n", opts.target, r.conns, opts.qos, opts.size)
+	fmt.Fprintf(w, "published   %d in %.2fs, %.1f msg/s\n", r.published, r.elapsed.Seconds(), float64(r.published)/r.elapsed.Seconds())
+	if r.qos > mqpp.QosAtMostOnce {
+		fmt.Fprintf(w, "acked       %d, latency %s\n", r.acked, percentiles(r.ackLatency))
+	}
+	if r.subscribed {
+		fmt.Fprintf(w, "received    %d, latency %s\n", r.received, percentiles(r.e2eLatency))
+	}
+	fmt.Fprintf(w, "errors      connect %d, read %d, write %d, unacked %d, lost %d\n",
+		r.connectErrors, r.readErrors, r.writeErrors, r.unacked(), r.lost())
+}
+
+// percentiles formats min, p50, p90, p99 and max of ds
+func percentiles(ds []time.Duration) string {
+	if len(ds) == 0 {
+		return "n/a"
+	}
+	sort.Slice(ds, func(i, j int) bool { return ds[i] < ds[j] })
+	at := func(p float64) time.Duration {
+		return ds[int(p*float64(len(ds)-1)+0.5)]
+	}
+	return fmt.Sprintf("min %v, p50 %v, p90 %v, p99 %v, max %v", ds[0], at(0.5), at(0.9), at(0.99), ds[len(ds)-1])
+}
@@ -0,0 +1,191 @@
+// Copyright (c) 2016 The MQPP Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/abo/mqpp"
+	"github.com/abo/mqpp/internal/describe"
+)
+
+func writeText(w io.Writer, r *record, verbose, hexdump bool) error {
+	var b strings.Builder
+	if r.Time.IsZero() {
+		fmt.Fprintf(&b, "@%08d", r.Offset)
+	} else {
+		b.WriteString(r.Time.Format("15:04:05.000000"))
+	}
+	b.WriteString(" " + r.Flow)
+
+	if r.Control != nil {
+		b.WriteString(" " + describe.Line(r.Control, verbose))
+	} else if len(r.Raw) > 0 {
+		fmt.Fprintf(&b, " %s error: %v (%d bytes)", typeOf(r.Raw), r.Err, len(r.Raw))
+	} else {
+		fmt.Fprintf(&b, " error: %v", r.Err)
+	}
+	b.WriteByte('\n')
+	for _, v := range r.Violations {
+		b.WriteString("  violation " + v.String() + "\n")
+	}
+
+	if hexdump && len(r.Raw) > 0 {
+		for _, line := range annotate(r.Raw, r.Control) {
+			b.WriteString("  " + line + "\n")
+		}
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+func typeOf(raw []byte) string {
+	return mqpp.TypeName(raw[0] >> 4)
+}
+
+func writeJSON(w io.Writer, r *record, verbose, hexdump bool) error {
+	obj := map[string]interface{}{"flow": r.Flow}
+	if r.Time.IsZero() {
+		obj["offset"] = r.Offset
+	} else {
+		obj["time"] = r.Time.Format(time.RFC3339Nano)
+	}
+	if r.Direction != "" {
+		obj["direction"] = r.Direction
+	}
+	if len(r.Raw) > 0 {
+		obj["type"] = typeOf(r.Raw)
+		obj["length"] = len(r.Raw)
+	}
+	if r.Err != nil {
+		obj["error"] = r.Err.Error()
+	}
+	if r.Control != nil {
+		fs := make(map[string]interface{})
+		for _, f := range describe.Fields(r.Control) {
+			if f.Verbose && !verbose {
+				continue
+			}
+			if b, ok := f.Value.([]byte); ok {
+				if utf8.Valid(b) {
+					f.Value = string(b)
+				} else {
+					f.Value = hex.EncodeToString(b)
+				}
+			}
+			fs[f.Name] = f.Value
+		}
+		obj["fields"] = fs
+	}
+	if len(r.Violations) > 0 {
+		vs := make([]string, len(r.Violations))
+		for i, v := range r.Violations {
+			vs[i] = v.String()
+		}
+		obj["violations"] = vs
+	}
+	if hexdump && len(r.Raw) > 0 {
+		obj["hex"] = hex.EncodeToString(r.Raw)
+	}
+
+	data, err := json.Marshal(obj)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(data, '\n'))
+	return err
+}
+
+// region is a labeled byte range of a packet
+type region struct {
+	end   int
+	label string
+}
+
+// regions splits raw into its wire level parts, p may be nil if raw is malformed
+func regions(raw []byte, p mqpp.ControlPacket) []region {
+	remlen, n := binary.Uvarint(raw[1:])
+	if n <= 0 {
+		return []region{{1, "fixed header: " + typeOf(raw)}, {len(raw), "malformed remaining length"}}
+	}
+	header := 1 + n
+	rs := []region{
+		{1, fmt.Sprintf("fixed header: %s flags=%#x", typeOf(raw), raw[0]&0x0f)},
+		{header, fmt.Sprintf("remaining length: %d", remlen)},
+	}
+
+	switch p := p.(type) {
+	case nil:
+	case *mqpp.Publish:
+		offset := header + 2 + len(p.TopicName())
+		rs = append(rs, region{offset, fmt.Sprintf("topic: %q", p.TopicName())})
+		if p.QoS() > mqpp.QosAtMostOnce {
+			offset += 2
+			rs = append(rs, region{offset, fmt.Sprintf("packet identifier: %d", p.PacketIdentifier())})
+		}
+		rs = append(rs, region{len(raw), fmt.Sprintf("payload: %d bytes", len(p.Payload()))})
+		return rs
+	case *mqpp.Connect:
+		offset := header + 2 + len(p.ProtocolName())
+		rs = append(rs, region{offset, fmt.Sprintf("protocol name: %q", p.ProtocolName())},
+			region{offset + 1, fmt.Sprintf("protocol level: %d", p.ProtocolLevel())},
+			region{offset + 2, fmt.Sprintf("connect flags: %#02x", raw[offset+1])},
+			region{offset + 4, fmt.Sprintf("keep alive: %d", p.KeepAlive())})
+	case *mqpp.Connack:
+		rs = append(rs, region{header + 1, fmt.Sprintf("session present: %v", p.SessionPresent())},
+			region{header + 2, fmt.Sprintf("return code: %d", p.ReturnCode())})
+	case interface{ PacketIdentifier() uint16 }:
+		rs = append(rs, region{header + 2, fmt.Sprintf("packet identifier: %d", p.PacketIdentifier())})
+	}
+	if last := rs[len(rs)-1].end; last < len(raw) {
+		rs = append(rs, region{len(raw), "payload"})
+	}
+	return rs
+}
+
+// annotate dumps raw as hex, 16 bytes a line, labeling each region at its first line
+func annotate(raw []byte, p mqpp.ControlPacket) []string {
+	var lines []string
+	start := 0
+	for _, r := range regions(raw, p) {
+		if r.end > len(raw) {
+			r.end = len(raw)
+		}
+		label := r.label
+		for start < r.end {
+			end := start + 16
+			if end > r.end {
+				end = r.end
+			}
+			h := make([]string, 0, 16)
+			for _, c := range raw[start:end] {
+				h = append(h, fmt.Sprintf("%02x", c))
+			}
+			lines = append(lines, fmt.Sprintf("%04x  %-47s  %s", start, strings.Join(h, " "), label))
+			label, start = "", end
+		}
+	}
+	for i := range lines {
+		lines[i] = strings.TrimRight(lines[i], " ")
+	}
+	return lines
+}
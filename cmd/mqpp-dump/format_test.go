@@ -0,0 +1,93 @@
+// Copyright (c) 2016 The MQPP Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/abo/mqpp"
+)
+
+func TestAnnotate(t *testing.T) {
+	pkts := []mqpp.ControlPacket{
+		mqpp.MakeConnect(mqpp.ProtocolName, mqpp.ProtocolLevel, false, 0, true, 60, "c1", "", nil, "u", []byte("p")),
+		mqpp.MakeConnack(true, mqpp.Accepted),
+		mqpp.MakePublish(false, mqpp.QosAtMostOnce, false, "a/b", 0, bytes.Repeat([]byte("x"), 40)),
+		mqpp.MakeSubscribe(2, []mqpp.Subscription{{TopicFilter: "a/#", RequestedQoS: 1}}),
+		mqpp.MakePingreq(),
+	}
+	for _, p := range pkts {
+		raw := p.Bytes()
+		parsed, err := mqpp.Parse(raw)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// every byte is dumped once, in order
+		var dumped []string
+		for _, line := range annotate(raw, parsed) {
+			cols := strings.SplitN(line, "  ", 3)
+			dumped = append(dumped, strings.Fields(cols[1])...)
+		}
+		if len(dumped) != len(raw) {
+			t.Fatalf("%s: dumped %d bytes of %d", mqpp.TypeName(p.Type()), len(dumped), len(raw))
+		}
+	}
+}
+
+func TestFilter(t *testing.T) {
+	connect := mqpp.MakeConnect(mqpp.ProtocolName, mqpp.ProtocolLevel, false, 0, true, 60, "c1", "", nil, "", nil)
+	publish := mqpp.MakePublish(false, mqpp.QosAtMostOnce, false, "a/b", 0, nil)
+	subscribe := mqpp.MakeSubscribe(1, []mqpp.Subscription{{TopicFilter: "a/b/c"}})
+	records := []*record{
+		{Flow: "1.1.1.1:1 > 2.2.2.2:1883", Control: &connect},
+		{Flow: "3.3.3.3:1 > 2.2.2.2:1883", Control: &publish},
+		{Flow: "2.2.2.2:1883 > 1.1.1.1:1", Control: &publish},
+		{Flow: "1.1.1.1:1 > 2.2.2.2:1883", Control: &subscribe},
+		{Flow: "1.1.1.1:1 > 2.2.2.2:1883", Err: mqpp.ErrMalformedRemLen},
+	}
+
+	cases := []struct {
+		types, client, topic string
+		expect               string
+	}{
+		{"", "", "", "11111"},
+		{"publish", "", "", "01100"},
+		{"", "c1", "", "10111"},
+		{"", "", "a/#", "01110"},
+		{"publish,subscribe", "c1", "a/+", "00100"},
+	}
+	for _, c := range cases {
+		f, err := newFilter(c.types, c.client, c.topic)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []byte
+		for _, r := range records {
+			if f.accept(r) {
+				got = append(got, '1')
+			} else {
+				got = append(got, '0')
+			}
+		}
+		if string(got) != c.expect {
+			t.Fatalf("%+v: got %s", c, got)
+		}
+	}
+	if _, err := newFilter("publish,bogus", "", ""); err == nil {
+		t.Fatal("unknown type accepted")
+	}
+}
@@ -0,0 +1,361 @@
+// Copyright (c) 2016 The MQPP Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Command mqpp-dump decodes mqtt packets of a pcap/pcapng capture, a raw byte
+// dump or stdin, and prints them one per line, like tcpdump does.
+//
+// Usage:
+//
+//	mqpp-dump [flags] [file]
+//
+// The file is read from stdin if it's absent or "-". Pcap, pcapng and mqpp capture
+// files are told by their magic numbers, anything else is taken as a raw stream of
+// mqtt packets.
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/abo/mqpp"
+	"github.com/abo/mqpp/capture"
+	"github.com/abo/mqpp/conform"
+	"github.com/abo/mqpp/pcap"
+)
+
+var (
+	verbose  = flag.Bool("v", false, "print every field, including payloads")
+	hexdump  = flag.Bool("x", false, "print annotated hex of every packet")
+	lenient  = flag.Bool("lenient", false, "decode packets with invalid fixed header flags")
+	recovery = flag.Bool("recover", false, "skip corrupted bytes of raw streams instead of stopping, and report them")
+	check    = flag.Bool("check", false, "check the session rules of MQTT 3.1.1, raw streams are not checked")
+	jsonOut  = flag.Bool("json", false, "print a json object per line")
+	types    = flag.String("type", "", "comma separated packet types to print, e.g. publish,subscribe")
+	clientID = flag.String("client", "", "print packets of connections with this client identifier only")
+	topic    = flag.String("topic", "", "print publish/subscribe/unsubscribe matching this topic filter only")
+)
+
+// record is a packet and where it comes from
+type record struct {
+	Time      time.Time // zero for raw files
+	Offset    int64     // of raw streams
+	Flow      string
+	Direction string // empty for raw streams
+	Dir       mqpp.Direction
+	Raw       []byte
+	Control   mqpp.ControlPacket
+	Err       error
+
+	Violations []conform.Violation
+}
+
+// source yields records, io.EOF at the end
+type source interface {
+	next() (*record, error)
+}
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: %s [flags] [file]\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() > 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	f, err := newFilter(*types, *clientID, *topic)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "mqpp-dump:", err)
+		os.Exit(2)
+	}
+
+	in, live := io.Reader(os.Stdin), true
+	if name := flag.Arg(0); name != "" && name != "-" {
+		file, err := os.Open(name)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "mqpp-dump:", err)
+			os.Exit(1)
+		}
+		defer file.Close()
+		in, live = file, false
+	}
+
+	src, err := open(in, live, *lenient, *recovery)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "mqpp-dump:", err)
+		os.Exit(1)
+	}
+
+	checkers := make(map[string]*conform.Checker)
+	out := bufio.NewWriter(os.Stdout)
+	defer out.Flush()
+	for {
+		r, err := src.next()
+		if err == io.EOF {
+			return
+		} else if err != nil {
+			out.Flush()
+			fmt.Fprintln(os.Stderr, "mqpp-dump:", err)
+			os.Exit(1)
+		}
+		if *check {
+			checkRecord(checkers, r)
+		}
+		if !f.accept(r) {
+			continue
+		}
+		if *jsonOut {
+			err = writeJSON(out, r, *verbose, *hexdump)
+		} else {
+			err = writeText(out, r, *verbose, *hexdump)
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "mqpp-dump:", err)
+			os.Exit(1)
+		}
+		if live {
+			out.Flush()
+		}
+	}
+}
+
+// open tells captures from raw streams by the leading magic number
+func open(in io.Reader, live, lenient, recovery bool) (source, error) {
+	br := bufio.NewReader(in)
+	if head, _ := br.Peek(len(capture.Magic)); string(head) == capture.Magic {
+		r, err := capture.NewReader(br)
+		if err != nil {
+			return nil, err
+		}
+		r.Lenient = lenient
+		return &recordSource{r}, nil
+	}
+	head, _ := br.Peek(4)
+	if len(head) == 4 {
+		switch binary.LittleEndian.Uint32(head) {
+		case 0xa1b2c3d4, 0xa1b23c4d, 0xd4c3b2a1, 0x4d3cb2a1, 0x0a0d0d0a:
+			e, err := pcap.NewExtractor(br)
+			if err != nil {
+				return nil, err
+			}
+			e.Lenient = lenient
+			return &captureSource{e}, nil
+		}
+	}
+	return newRawSource(br, live, lenient, recovery), nil
+}
+
+type captureSource struct {
+	e *pcap.Extractor
+}
+
+func (s *captureSource) next() (*record, error) {
+	p, err := s.e.Next()
+	if err != nil {
+		return nil, err
+	}
+	r := &record{Time: p.Timestamp, Direction: p.Direction.String(), Dir: p.Direction, Raw: p.Raw, Control: p.Control, Err: p.Err}
+	if p.Direction == mqpp.ClientToServer {
+		r.Flow = p.Flow.Client.String() + " > " + p.Flow.Server.String()
+	} else {
+		r.Flow = p.Flow.Server.String() + " > " + p.Flow.Client.String()
+	}
+	return r, nil
+}
+
+// recordSource reads a capture file of mqpp-proxy
+type recordSource struct {
+	r *capture.Reader
+}
+
+func (s *recordSource) next() (*record, error) {
+	rec, err := s.r.Next()
+	if err != nil {
+		return nil, err
+	}
+	r := &record{Time: rec.Time, Direction: rec.Direction.String(), Dir: rec.Direction, Raw: rec.Raw, Control: rec.Packet, Err: rec.Err}
+	if rec.Direction == mqpp.ClientToServer {
+		r.Flow = fmt.Sprintf("conn#%d > server", rec.Conn)
+	} else {
+		r.Flow = fmt.Sprintf("server > conn#%d", rec.Conn)
+	}
+	return r, nil
+}
+
+// rawSource splits a stream of mqtt packets, scanning stops at the first
+// framing error since packet boundaries are lost, unless it's recovering
+type rawSource struct {
+	s      *mqpp.Splitter
+	live   bool
+	offset int64
+	done   bool
+	queue  []*record // skipped ranges reported while scanning
+}
+
+func newRawSource(r io.Reader, live, lenient, recovery bool) *rawSource {
+	s := mqpp.NewSplitter(r)
+	s.Buffer(make([]byte, 4096), mqpp.MaxPacketSize)
+	s.Lenient = lenient
+	src := &rawSource{s: s, live: live}
+	if recovery {
+		s.Recover = true
+		s.OnSkip = func(offset, length int64) {
+			src.queue = append(src.queue, &record{Flow: "raw", Offset: offset, Err: fmt.Errorf("skipped %d corrupted bytes", length)})
+		}
+	}
+	return src
+}
+
+func (s *rawSource) next() (*record, error) {
+	if len(s.queue) > 0 {
+		r := s.queue[0]
+		s.queue = s.queue[1:]
+		return r, nil
+	}
+	if s.done {
+		return nil, io.EOF
+	}
+	r := &record{Flow: "raw", Offset: s.offset}
+	if s.live {
+		r.Time = time.Now()
+	}
+	if !s.s.Scan() {
+		s.done = true
+		if len(s.queue) > 0 {
+			return s.next()
+		}
+		if s.s.Err() == nil {
+			return nil, io.EOF
+		}
+		r.Err = s.s.Err()
+		return r, nil
+	}
+	r.Raw = append([]byte(nil), s.s.Bytes()...)
+	r.Offset = s.s.Offset()
+	s.offset = r.Offset + int64(len(r.Raw))
+	if s.s.Lenient {
+		r.Control, r.Err = mqpp.ParseLenient(r.Raw)
+	} else {
+		r.Control, r.Err = mqpp.Parse(r.Raw)
+	}
+	if len(s.queue) > 0 {
+		// skipped bytes come first
+		s.queue = append(s.queue, r)
+		return s.next()
+	}
+	return r, nil
+}
+
+// checkRecord checks r against the conversation of its flow
+func checkRecord(checkers map[string]*conform.Checker, r *record) {
+	if r.Direction == "" || r.Control == nil {
+		return
+	}
+	key := flowKey(r)
+	c, ok := checkers[key]
+	if !ok {
+		c = conform.NewChecker()
+		checkers[key] = c
+	}
+	r.Violations = c.Check(r.Dir, r.Control)
+}
+
+// filter selects records by packet type, client identifier and topic
+type filter struct {
+	types   map[byte]bool
+	client  string
+	topic   string
+	clients map[string]string // flow key to client identifier
+}
+
+func newFilter(types, client, topic string) (*filter, error) {
+	f := &filter{client: client, topic: topic, clients: make(map[string]string)}
+	if topic != "" && !mqpp.ValidTopicFilter(topic) {
+		return nil, fmt.Errorf("invalid topic filter %q", topic)
+	}
+	if types == "" {
+		return f, nil
+	}
+	f.types = make(map[byte]bool)
+	for _, name := range strings.Split(types, ",") {
+		t := typeByName(strings.TrimSpace(name))
+		if t == 0 {
+			return nil, fmt.Errorf("unknown packet type %q", name)
+		}
+		f.types[t] = true
+	}
+	return f, nil
+}
+
+func typeByName(name string) byte {
+	for t := mqpp.TCONNECT; t <= mqpp.TDISCONNECT; t++ {
+		if strings.EqualFold(mqpp.TypeName(t), name) {
+			return t
+		}
+	}
+	return 0
+}
+
+// flowKey is the same for both directions of a flow
+func flowKey(r *record) string {
+	ends := strings.SplitN(r.Flow, " > ", 2)
+	if len(ends) == 2 && ends[0] > ends[1] {
+		return ends[1] + " " + ends[0]
+	}
+	return strings.Join(ends, " ")
+}
+
+func (f *filter) accept(r *record) bool {
+	if c, ok := r.Control.(*mqpp.Connect); ok {
+		f.clients[flowKey(r)] = c.ClientIdentifier()
+	}
+	if f.client != "" && f.clients[flowKey(r)] != f.client {
+		return false
+	}
+	if r.Control == nil {
+		// errors are reported unless they are filtered by type or topic
+		return f.types == nil && f.topic == ""
+	}
+	if f.types != nil && !f.types[r.Control.Type()] {
+		return false
+	}
+	if f.topic == "" {
+		return true
+	}
+	switch p := r.Control.(type) {
+	case *mqpp.Publish:
+		return mqpp.MatchTopic(f.topic, p.TopicName())
+	case *mqpp.Subscribe:
+		for _, s := range p.Payload() {
+			if s.TopicFilter == f.topic || mqpp.MatchTopic(f.topic, s.TopicFilter) {
+				return true
+			}
+		}
+	case *mqpp.Unsubscribe:
+		for _, filter := range p.Payload() {
+			if filter == f.topic || mqpp.MatchTopic(f.topic, filter) {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,314 @@
+// Copyright (c) 2016 The MQPP Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Command mqpp-proxy is a transparent mqtt proxy for inspecting live traffic.
+// It forwards every byte between clients and the upstream broker untouched,
+// decodes each direction and logs the packets, with credentials redacted.
+//
+// Usage:
+//
+//	mqpp-proxy -upstream broker:1883 [-listen :1884] [-record file] [-check] [-v]
+//
+// Forwarding never waits for a packet to be complete nor for the decoder, and
+// goes on after the stream of a direction can't be decoded any more, or is read
+// faster than it's decoded.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/abo/mqpp"
+	"github.com/abo/mqpp/capture"
+	"github.com/abo/mqpp/conform"
+	"github.com/abo/mqpp/internal/describe"
+)
+
+var arrows = [...]string{mqpp.ClientToServer: "c>s", mqpp.ServerToClient: "s>c"}
+
+const (
+	decodeQueue   = 256         // chunks forwarded but not yet decoded before decoding is given up
+	flushInterval = time.Second // how often the record is flushed
+)
+
+var (
+	listen   = flag.String("listen", ":1884", "address to accept clients on")
+	upstream = flag.String("upstream", "", "address of the broker")
+	record   = flag.String("record", "", "record packets of both directions to this capture file, unredacted")
+	verbose  = flag.Bool("v", false, "log every field, including payloads")
+	lenient  = flag.Bool("lenient", false, "decode packets with invalid fixed header flags")
+	check    = flag.Bool("check", false, "log violations of the session rules of MQTT 3.1.1")
+)
+
+type proxy struct {
+	upstream string
+	verbose  bool
+	lenient  bool
+	check    bool
+	nextID   uint32
+
+	mu   sync.Mutex // guards rec
+	rec  *capture.Writer
+	file *os.File
+}
+
+func main() {
+	flag.Parse()
+	if *upstream == "" || flag.NArg() > 0 {
+		fmt.Fprintf(os.Stderr, "usage: %s -upstream host:port [flags]\n", os.Args[0])
+		flag.PrintDefaults()
+		os.Exit(2)
+	}
+
+	p := &proxy{upstream: *upstream, verbose: *verbose, lenient: *lenient, check: *check}
+	if *record != "" {
+		if err := p.createRecord(*record); err != nil {
+			log.Fatal(err)
+		}
+		go func() {
+			for range time.Tick(flushInterval) {
+				if err := p.flushRecord(); err != nil {
+					log.Printf("record: %v", err)
+				}
+			}
+		}()
+	}
+
+	l, err := net.Listen("tcp", *listen)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("proxying %s to %s", l.Addr(), p.upstream)
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sig
+		l.Close()
+	}()
+
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				time.Sleep(10 * time.Millisecond)
+				continue
+			}
+			break
+		}
+		go p.serve(c)
+	}
+
+	if err := p.closeRecord(); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func (p *proxy) createRecord(path string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	w, err := capture.NewWriter(f)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	p.rec, p.file = w, f
+	return nil
+}
+
+// record appends a packet, a killed proxy loses those of the last flushInterval
+func (p *proxy) record(id uint32, dir mqpp.Direction, raw []byte) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.rec == nil {
+		return nil
+	}
+	return p.rec.WriteRaw(time.Now(), id, dir, raw)
+}
+
+func (p *proxy) flushRecord() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.rec == nil {
+		return nil
+	}
+	return p.rec.Flush()
+}
+
+func (p *proxy) closeRecord() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.rec == nil {
+		return nil
+	}
+	err := p.rec.Flush()
+	if cerr := p.file.Close(); err == nil {
+		err = cerr
+	}
+	p.rec = nil
+	return err
+}
+
+// serve proxies a client connection
+func (p *proxy) serve(client net.Conn) {
+	id := atomic.AddUint32(&p.nextID, 1)
+	server, err := net.DialTimeout("tcp", p.upstream, 10*time.Second)
+	if err != nil {
+		log.Printf("#%d %s: %v", id, client.RemoteAddr(), err)
+		client.Close()
+		return
+	}
+	log.Printf("#%d %s connected to %s", id, client.RemoteAddr(), server.RemoteAddr())
+
+	var chk *checker
+	if p.check {
+		chk = &checker{c: conform.NewChecker()}
+	}
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		p.forward(id, mqpp.ClientToServer, client, server, chk)
+		wg.Done()
+	}()
+	go func() {
+		p.forward(id, mqpp.ServerToClient, server, client, chk)
+		wg.Done()
+	}()
+	wg.Wait()
+	client.Close()
+	server.Close()
+	log.Printf("#%d closed", id)
+}
+
+// checker checks both directions of a connection
+type checker struct {
+	mu sync.Mutex
+	c  *conform.Checker
+}
+
+func (c *checker) check(dir mqpp.Direction, p mqpp.ControlPacket) []conform.Violation {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.c.Check(dir, p)
+}
+
+// chunks reads the chunks sent on a channel as a stream
+type chunks struct {
+	ch  <-chan []byte
+	cur []byte
+}
+
+func (c *chunks) Read(b []byte) (int, error) {
+	for len(c.cur) == 0 {
+		chunk, ok := <-c.ch
+		if !ok {
+			return 0, io.EOF
+		}
+		c.cur = chunk
+	}
+	n := copy(b, c.cur)
+	c.cur = c.cur[n:]
+	return n, nil
+}
+
+// forward copies src to dst byte by byte as they come, and tees them to a
+// decoder which stops at the first framing error. The decoder is given up when
+// it falls decodeQueue chunks behind rather than slowing forwarding down.
+func (p *proxy) forward(id uint32, dir mqpp.Direction, src, dst net.Conn, chk *checker) {
+	ch := make(chan []byte, decodeQueue)
+	decoded := make(chan struct{})
+	go func() {
+		p.decode(id, dir, &chunks{ch: ch}, chk)
+		close(decoded)
+	}()
+
+	buf := make([]byte, 32<<10)
+	decoding := true
+	tee := func(b []byte) {
+		select {
+		case <-decoded:
+			decoding = false
+			return
+		default:
+		}
+		select {
+		case ch <- append([]byte(nil), b...):
+		default:
+			log.Printf("#%d %s decoder falling behind, stop decoding", id, arrows[dir])
+			decoding = false
+		}
+	}
+	for {
+		n, err := src.Read(buf)
+		if n > 0 {
+			if _, werr := dst.Write(buf[:n]); werr != nil {
+				err = werr
+			} else if decoding {
+				tee(buf[:n])
+			}
+		}
+		if err == io.EOF {
+			// pass the half close on
+			if tc, ok := dst.(*net.TCPConn); ok {
+				tc.CloseWrite()
+			} else {
+				dst.Close()
+			}
+			break
+		} else if err != nil {
+			src.Close()
+			dst.Close()
+			break
+		}
+	}
+	close(ch)
+	<-decoded
+}
+
+func (p *proxy) decode(id uint32, dir mqpp.Direction, r io.Reader, chk *checker) {
+	s := mqpp.NewSplitter(r)
+	s.Buffer(make([]byte, 4096), mqpp.MaxPacketSize)
+	s.Lenient = p.lenient
+	for s.Scan() {
+		raw := s.Bytes()
+		if pkt, err := s.Packet(); err != nil {
+			log.Printf("#%d %s %s error: %v (%d bytes)", id, arrows[dir], mqpp.TypeName(raw[0]>>4), err, len(raw))
+		} else {
+			log.Printf("#%d %s %s", id, arrows[dir], describe.Line(pkt, p.verbose))
+			for _, v := range chk.check(dir, pkt) {
+				log.Printf("#%d %s violation %s", id, arrows[dir], v)
+			}
+		}
+		if err := p.record(id, dir, raw); err != nil {
+			log.Printf("#%d record: %v", id, err)
+		}
+	}
+	if err := s.Err(); err != nil {
+		log.Printf("#%d %s stop decoding: %v", id, arrows[dir], err)
+	}
+}
@@ -0,0 +1,158 @@
+// Copyright (c) 2016 The MQPP Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/abo/mqpp"
+	"github.com/abo/mqpp/capture"
+)
+
+func TestForward(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	// upstream echoes what it gets
+	up, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer up.Close()
+	go func() {
+		c, err := up.Accept()
+		if err != nil {
+			return
+		}
+		io.Copy(c, c)
+		c.Close()
+	}()
+
+	path := filepath.Join(t.TempDir(), "cap")
+	p := &proxy{upstream: up.Addr().String()}
+	if err := p.createRecord(path); err != nil {
+		t.Fatal(err)
+	}
+	client, proxied := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		p.serve(proxied)
+		close(done)
+	}()
+
+	var sent bytes.Buffer
+	sent.Write(mqpp.MakePingreq().Bytes())
+	sent.Write(mqpp.MakePublish(false, mqpp.QosAtLeastOnce, false, "a/b", 7, []byte("hello")).Bytes())
+	sent.Write([]byte{0x30, 0xff, 0xff, 0xff, 0xff, 0x01, 'x'}) // malformed remaining length
+	sent.Write(mqpp.MakePingreq().Bytes())
+
+	go func() {
+		client.Write(sent.Bytes()[:5])
+		client.Write(sent.Bytes()[5:])
+	}()
+	got := make([]byte, sent.Len())
+	if _, err := io.ReadFull(client, got); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, sent.Bytes()) {
+		t.Fatalf("forwarded % x, expect % x", got, sent.Bytes())
+	}
+	client.Close()
+	<-done
+	if err := p.closeRecord(); err != nil {
+		t.Fatal(err)
+	}
+
+	// both directions of the 2 packets before the malformed one are recorded
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	r, err := capture.NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	counts := map[mqpp.Direction]int{}
+	for {
+		rec, err := r.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		if rec.Conn != 1 || rec.Err != nil {
+			t.Fatalf("unexpected record %+v", rec)
+		}
+		counts[rec.Direction]++
+	}
+	if counts[mqpp.ClientToServer] != 2 || counts[mqpp.ServerToClient] != 2 {
+		t.Fatalf("recorded %v", counts)
+	}
+}
+
+func TestForwardSlowDecoder(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	up, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer up.Close()
+	go func() {
+		c, err := up.Accept()
+		if err != nil {
+			return
+		}
+		io.Copy(c, c)
+		c.Close()
+	}()
+
+	p := &proxy{upstream: up.Addr().String()}
+	if err := p.createRecord(filepath.Join(t.TempDir(), "cap")); err != nil {
+		t.Fatal(err)
+	}
+	// the decoders block recording while forwarding goes on
+	p.mu.Lock()
+	client, proxied := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		p.serve(proxied)
+		close(done)
+	}()
+
+	ping := mqpp.MakePingreq().Bytes()
+	go func() {
+		for i := 0; i < 2*decodeQueue; i++ {
+			client.Write(ping)
+		}
+	}()
+	if _, err := io.ReadFull(client, make([]byte, 2*decodeQueue*len(ping))); err != nil {
+		t.Fatal(err)
+	}
+	p.mu.Unlock()
+	client.Close()
+	<-done
+	if err := p.closeRecord(); err != nil {
+		t.Fatal(err)
+	}
+}
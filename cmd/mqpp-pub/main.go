@@ -0,0 +1,152 @@
+// Copyright (c) 2016 The MQPP Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Command mqpp-pub publishes messages to a MQTT broker, like mosquitto_pub does.
+//
+// Usage:
+//
+//	mqpp-pub -t topic [-m message | -f file | -l] [flags]
+//
+// The payload is the -m message, or the content of -f file, "-" for stdin. With -l
+// every non-empty line of stdin is published as a message. Each message is sent
+// once the previous one completed its QoS flow.
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/abo/mqpp"
+	"github.com/abo/mqpp/client"
+	"github.com/abo/mqpp/internal/connflags"
+)
+
+// maxPayload is the largest remaining length of MQTT, payloads must be shorter by the topic and packet identifier
+const maxPayload = 268435455
+
+type options struct {
+	topic   string
+	qos     byte
+	retain  bool
+	message string // payload if neither file nor lines is set
+	file    string
+	lines   bool
+	timeout time.Duration
+}
+
+func main() {
+	conn := connflags.Register(flag.CommandLine, "mqpp-pub-")
+	opts := &options{}
+	flag.StringVar(&opts.topic, "t", "", "topic to publish to")
+	qos := flag.Uint("q", 0, "QoS of messages")
+	flag.BoolVar(&opts.retain, "r", false, "retain messages")
+	flag.StringVar(&opts.message, "m", "", "message to publish")
+	flag.StringVar(&opts.file, "f", "", "publish the content of this file as a message, - for stdin")
+	flag.BoolVar(&opts.lines, "l", false, "publish every non-empty line of stdin as a message")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: %s -t topic [-m message | -f file | -l] [flags]\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	sources := 0
+	if opts.file != "" {
+		sources++
+	}
+	if opts.lines {
+		sources++
+	}
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "m" {
+			sources++
+		}
+	})
+	if opts.topic == "" || sources != 1 || flag.NArg() > 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	if *qos > uint(mqpp.QosExactlyOnce) || !mqpp.ValidTopicName(opts.topic) {
+		fmt.Fprintln(os.Stderr, "mqpp-pub: invalid QoS or topic")
+		os.Exit(2)
+	}
+	opts.qos, opts.timeout = byte(*qos), conn.Timeout
+	copts, err := conn.Options()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "mqpp-pub:", err)
+		os.Exit(2)
+	}
+
+	c := client.New(copts)
+	if err := c.Connect(); err != nil {
+		fmt.Fprintln(os.Stderr, "mqpp-pub:", err)
+		os.Exit(1)
+	}
+	_, err = publish(c, opts, os.Stdin)
+	c.Disconnect()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "mqpp-pub:", err)
+		os.Exit(1)
+	}
+}
+
+// publish sends the messages of opts, and returns how many completed
+func publish(c *client.Client, opts *options, stdin io.Reader) (int, error) {
+	send := func(payload []byte) error {
+		return c.Publish(opts.topic, opts.qos, opts.retain, payload).WaitTimeout(opts.timeout)
+	}
+
+	switch {
+	case opts.lines:
+		n, s := 0, bufio.NewScanner(stdin)
+		s.Buffer(make([]byte, 4096), maxPayload)
+		for s.Scan() {
+			if len(s.Bytes()) == 0 {
+				continue
+			}
+			if err := send(s.Bytes()); err != nil {
+				return n, err
+			}
+			n++
+		}
+		return n, s.Err()
+	case opts.file != "":
+		payload, err := readFile(opts.file, stdin)
+		if err != nil {
+			return 0, err
+		}
+		if len(payload) > maxPayload {
+			return 0, errors.New("file is too large for a message")
+		}
+		if err := send(payload); err != nil {
+			return 0, err
+		}
+		return 1, nil
+	default:
+		if err := send([]byte(opts.message)); err != nil {
+			return 0, err
+		}
+		return 1, nil
+	}
+}
+
+func readFile(name string, stdin io.Reader) ([]byte, error) {
+	if name == "-" {
+		return io.ReadAll(stdin)
+	}
+	return os.ReadFile(name)
+}
@@ -0,0 +1,124 @@
+// Copyright (c) 2016 The MQPP Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/abo/mqpp"
+	"github.com/abo/mqpp/broker"
+	"github.com/abo/mqpp/client"
+	"github.com/abo/mqpp/internal/connflags"
+	"github.com/abo/mqpp/mqpptest"
+)
+
+func TestPublish(t *testing.T) {
+	b := broker.New(broker.Options{})
+	defer b.Close()
+	ch := make(chan *mqpp.Publish, 8)
+	sub := mqpptest.Connect(t, client.Options{ClientID: "sub", Dial: b.Dial})
+	handler := func(c *client.Client, p *mqpp.Publish) { ch <- p }
+	if err := sub.Subscribe(handler, mqpp.Subscription{TopicFilter: "#", RequestedQoS: mqpp.QosExactlyOnce}).Wait(); err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(t.TempDir(), "payload")
+	if err := os.WriteFile(file, []byte("from\nfile"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		opts     options
+		stdin    string
+		payloads []string
+	}{
+		{options{topic: "m", message: "hello"}, "", []string{"hello"}},
+		{options{topic: "m", qos: mqpp.QosExactlyOnce}, "", []string{""}},
+		{options{topic: "l", qos: mqpp.QosAtLeastOnce, lines: true}, "a\n\nb\r\nc", []string{"a", "b", "c"}},
+		{options{topic: "f", qos: mqpp.QosExactlyOnce, file: file}, "", []string{"from\nfile"}},
+		{options{topic: "f", file: "-"}, "from\nstdin\n", []string{"from\nstdin\n"}},
+	}
+	for i, tt := range tests {
+		pub := mqpptest.Connect(t, client.Options{ClientID: "pub", CleanSession: true, Dial: b.Dial})
+		tt.opts.timeout = time.Second
+		n, err := publish(pub, &tt.opts, strings.NewReader(tt.stdin))
+		if err != nil || n != len(tt.payloads) {
+			t.Fatalf("%d: published %d, %v", i, n, err)
+		}
+		for _, payload := range tt.payloads {
+			select {
+			case p := <-ch:
+				if p.TopicName() != tt.opts.topic || p.QoS() != tt.opts.qos || string(p.Payload()) != payload {
+					t.Fatalf("%d: unexpected %s %d %q", i, p.TopicName(), p.QoS(), p.Payload())
+				}
+			case <-time.After(time.Second):
+				t.Fatalf("%d: %q not received", i, payload)
+			}
+		}
+		pub.Disconnect()
+	}
+
+	retain := &options{topic: "r", retain: true, message: "kept", timeout: time.Second}
+	if _, err := publish(mqpptest.Connect(t, client.Options{Dial: b.Dial, CleanSession: true}), retain, nil); err != nil {
+		t.Fatal(err)
+	}
+	<-ch
+	late := make(chan *mqpp.Publish, 1)
+	mqpptest.Connect(t, client.Options{Dial: b.Dial, CleanSession: true}).Subscribe(func(c *client.Client, p *mqpp.Publish) { late <- p },
+		mqpp.Subscription{TopicFilter: "r"}).Wait()
+	select {
+	case p := <-late:
+		if !p.Retain() || string(p.Payload()) != "kept" {
+			t.Fatalf("unexpected retained %q", p.Payload())
+		}
+	case <-time.After(time.Second):
+		t.Fatal("retained message not received")
+	}
+}
+
+func TestConnFlags(t *testing.T) {
+	tests := []struct {
+		args []string
+		err  bool
+	}{
+		{[]string{}, false},
+		{[]string{"-id", "x", "-u", "user", "-P", "pass", "-k", "0", "-clean=false"}, false},
+		{[]string{"-will-topic", "w", "-will-payload", "gone", "-will-qos", "1", "-will-retain"}, false},
+		{[]string{"-k", "65536"}, true},
+		{[]string{"-id", "", "-clean=false"}, true},
+		{[]string{"-will-topic", "w", "-will-qos", "3"}, true},
+		{[]string{"-will-topic", "w/#"}, true},
+		{[]string{"-will-payload", "orphan"}, true},
+		{[]string{"-P", "pass"}, true},
+	}
+	for _, tt := range tests {
+		fs := flag.NewFlagSet("test", flag.ContinueOnError)
+		f := connflags.Register(fs, "test-")
+		if err := fs.Parse(tt.args); err != nil {
+			t.Fatal(err)
+		}
+		opts, err := f.Options()
+		if (err != nil) != tt.err {
+			t.Fatalf("%v: unexpected error %v", tt.args, err)
+		}
+		if err == nil && (opts.ClientID != f.ClientID || opts.Dial == nil || opts.ConnectTimeout != f.Timeout) {
+			t.Fatalf("%v: unexpected %+v", tt.args, opts)
+		}
+	}
+}
@@ -0,0 +1,253 @@
+// Copyright (c) 2016 The MQPP Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Command mqpp-replay replays the client side of connections recorded by
+// mqpp-proxy against a target broker, and reports where the broker's responses
+// diverge from the recorded ones.
+//
+// Usage:
+//
+//	mqpp-replay -target host:port [flags] capture
+//
+// Packets are sent with their recorded timing, scaled by -speed. Client
+// identifiers are prefixed and packet identifiers renumbered, so the replay
+// doesn't collide with the recorded clients or state they left on the broker.
+// The exit status is 1 if any connection diverged.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/abo/mqpp"
+	"github.com/abo/mqpp/capture"
+	"github.com/abo/mqpp/internal/describe"
+)
+
+// lookahead is how far recorded responses are searched for an observed one
+const lookahead = 8
+
+type options struct {
+	target       string
+	speed        float64
+	clientPrefix string
+	ack          bool
+	wait         time.Duration
+	conns        map[uint32]bool // all if nil
+	verbose      bool
+}
+
+// report compares recorded and observed server packets of a connection
+type report struct {
+	conn        uint32
+	clientID    string
+	expected    int
+	observed    int
+	divergences []string
+}
+
+func main() {
+	opts := &options{}
+	flag.StringVar(&opts.target, "target", "", "address of the broker to replay against")
+	flag.Float64Var(&opts.speed, "speed", 1, "timing scale, 2 replays twice as fast, 0 as fast as possible")
+	flag.StringVar(&opts.clientPrefix, "client-prefix", "replay-", "prefix of rewritten client identifiers")
+	flag.BoolVar(&opts.ack, "ack", true, "answer QoS flows of the server's publishes instead of replaying the recorded acks")
+	flag.DurationVar(&opts.wait, "wait", time.Second, "how long to wait for responses after the last packet")
+	flag.BoolVar(&opts.verbose, "v", false, "log every replayed packet")
+	conns := flag.String("conn", "", "comma separated connection ids to replay, all if empty")
+	from := flag.String("from", "", "replay records since this RFC 3339 time")
+	flag.Parse()
+	if opts.target == "" || flag.NArg() != 1 || opts.speed < 0 {
+		fmt.Fprintf(os.Stderr, "usage: %s -target host:port [flags] capture\n", os.Args[0])
+		flag.PrintDefaults()
+		os.Exit(2)
+	}
+
+	if *conns != "" {
+		opts.conns = make(map[uint32]bool)
+		for _, s := range strings.Split(*conns, ",") {
+			id, err := strconv.ParseUint(strings.TrimSpace(s), 10, 32)
+			if err != nil {
+				log.Fatalf("invalid connection id %q", s)
+			}
+			opts.conns[uint32(id)] = true
+		}
+	}
+
+	f, err := os.Open(flag.Arg(0))
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer f.Close()
+	r, err := open(f, *from)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	reports, err := replay(r, opts)
+	if err != nil {
+		log.Fatal(err)
+	}
+	diverged := false
+	for _, rep := range reports {
+		fmt.Printf("conn#%d %s: %d recorded, %d observed", rep.conn, rep.clientID, rep.expected, rep.observed)
+		if len(rep.divergences) == 0 {
+			fmt.Println(", ok")
+			continue
+		}
+		diverged = true
+		fmt.Printf(", %d divergences\n", len(rep.divergences))
+		for _, d := range rep.divergences {
+			fmt.Println("  " + d)
+		}
+	}
+	if diverged {
+		os.Exit(1)
+	}
+}
+
+// open reads capture file f, from the first record at or after from if it's set
+func open(f *os.File, from string) (*capture.Reader, error) {
+	if from == "" {
+		return capture.NewReader(f)
+	}
+	t, err := time.Parse(time.RFC3339Nano, from)
+	if err != nil {
+		return nil, err
+	}
+	idx, err := capture.BuildIndex(f)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	r, err := capture.NewReader(f)
+	if err != nil {
+		return nil, err
+	}
+	return r, r.Seek(idx, t)
+}
+
+// replay dispatches records in order at their scaled time, each connection is
+// dialed by its first client packet
+func replay(r *capture.Reader, opts *options) ([]report, error) {
+	sessions := make(map[uint32]*session)
+	var order []uint32
+	closeAll := func() {
+		for _, id := range order {
+			sessions[id].close()
+		}
+	}
+
+	var first, start time.Time
+	for {
+		rec, err := r.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			closeAll()
+			return nil, err
+		}
+		if opts.conns != nil && !opts.conns[rec.Conn] {
+			continue
+		}
+
+		if start.IsZero() {
+			first, start = rec.Time, time.Now()
+		} else if opts.speed > 0 {
+			due := start.Add(time.Duration(float64(rec.Time.Sub(first)) / opts.speed))
+			if d := time.Until(due); d > 0 {
+				time.Sleep(d)
+			}
+		}
+
+		s, ok := sessions[rec.Conn]
+		if !ok {
+			if rec.Direction == mqpp.ServerToClient {
+				continue // the client side was not recorded
+			}
+			if s, err = dialSession(rec.Conn, opts); err != nil {
+				closeAll()
+				return nil, err
+			}
+			sessions[rec.Conn] = s
+			order = append(order, rec.Conn)
+		}
+		if opts.verbose && rec.Direction == mqpp.ClientToServer {
+			if rec.Packet != nil {
+				log.Printf("conn#%d %s", rec.Conn, describe.Line(rec.Packet, false))
+			} else {
+				log.Printf("conn#%d %d bytes: %v", rec.Conn, len(rec.Raw), rec.Err)
+			}
+		}
+		s.replay(rec)
+	}
+
+	time.Sleep(opts.wait)
+	closeAll()
+	reports := make([]report, 0, len(order))
+	for _, id := range order {
+		s := sessions[id]
+		s.mu.Lock()
+		reports = append(reports, report{
+			conn:        id,
+			clientID:    s.clientID,
+			expected:    len(s.expected),
+			observed:    len(s.observed),
+			divergences: compare(s.expected, s.observed),
+		})
+		s.mu.Unlock()
+	}
+	return reports, nil
+}
+
+// compare matches observed packets to recorded ones in order, tolerating a
+// few reordered ones, and lists what's unexpected and then what's missing
+func compare(expected, observed []string) []string {
+	var diffs []string
+	matched := make([]bool, len(expected))
+	i := 0 // the first unmatched
+	for _, o := range observed {
+		found := false
+		for j, n := i, 0; j < len(expected) && n < lookahead; j++ {
+			if matched[j] {
+				continue
+			}
+			if expected[j] == o {
+				matched[j], found = true, true
+				break
+			}
+			n++
+		}
+		if !found {
+			diffs = append(diffs, "unexpected "+o)
+		}
+		for i < len(expected) && matched[i] {
+			i++
+		}
+	}
+	for j, e := range expected {
+		if !matched[j] {
+			diffs = append(diffs, "missing "+e)
+		}
+	}
+	return diffs
+}
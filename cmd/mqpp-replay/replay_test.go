@@ -0,0 +1,126 @@
+// Copyright (c) 2016 The MQPP Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/abo/mqpp"
+	"github.com/abo/mqpp/broker"
+	"github.com/abo/mqpp/capture"
+)
+
+// record builds a capture of a client subscribing and publishing to itself,
+// one record every 20ms
+func record(t *testing.T, extra ...mqpp.ControlPacket) *capture.Reader {
+	var buf bytes.Buffer
+	w, err := capture.NewWriter(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	connect := mqpp.MakeConnect(mqpp.ProtocolName, mqpp.ProtocolLevel, false, 0, true, 60, "dev", "", nil, "", nil)
+	subscribe := mqpp.MakeSubscribe(10, []mqpp.Subscription{{TopicFilter: "a/b", RequestedQoS: mqpp.QosAtLeastOnce}})
+	publish := mqpp.MakePublish(false, mqpp.QosAtLeastOnce, false, "a/b", 11, []byte("x"))
+	delivered := mqpp.MakePublish(false, mqpp.QosAtLeastOnce, false, "a/b", 1, []byte("x"))
+	records := []struct {
+		dir mqpp.Direction
+		p   mqpp.ControlPacket
+	}{
+		{mqpp.ClientToServer, &connect},
+		{mqpp.ServerToClient, mqpp.MakeConnack(false, mqpp.Accepted)},
+		{mqpp.ClientToServer, &subscribe},
+		{mqpp.ServerToClient, mqpp.MakeSuback(10, []byte{mqpp.QosAtLeastOnce})},
+		{mqpp.ClientToServer, &publish},
+		{mqpp.ServerToClient, mqpp.MakePuback(11)},
+		{mqpp.ServerToClient, &delivered},
+		{mqpp.ClientToServer, mqpp.MakePuback(1)},
+		{mqpp.ClientToServer, mqpp.MakeDisconnect()},
+	}
+	for _, p := range extra {
+		records = append(records, struct {
+			dir mqpp.Direction
+			p   mqpp.ControlPacket
+		}{mqpp.ServerToClient, p})
+	}
+	base := time.Unix(1500000000, 0)
+	for i, r := range records {
+		if err := w.Write(base.Add(time.Duration(i)*20*time.Millisecond), 7, r.dir, r.p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	w.Flush()
+	r, err := capture.NewReader(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func TestReplay(t *testing.T) {
+	b := broker.New(broker.Options{})
+	defer b.Close()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go b.Serve(l)
+
+	opts := &options{target: l.Addr().String(), speed: 2, clientPrefix: "replay-", ack: true, wait: 200 * time.Millisecond}
+	start := time.Now()
+	reports, err := replay(record(t), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 8*20*time.Millisecond/2+opts.wait {
+		t.Fatalf("replayed in %v, faster than recorded", elapsed)
+	}
+	if len(reports) != 1 {
+		t.Fatalf("%d reports", len(reports))
+	}
+	if rep := reports[0]; rep.conn != 7 || rep.clientID != "replay-dev" || rep.expected != 4 || rep.observed != 4 || len(rep.divergences) != 0 {
+		t.Fatalf("unexpected report %+v", rep)
+	}
+
+	opts.speed = 4
+	extra := mqpp.MakePublish(false, mqpp.QosAtMostOnce, false, "c/d", 0, []byte("y"))
+	reports, err = replay(record(t, &extra), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := []string{"missing PUBLISH qos=0 retain=false topic=c/d len=1"}
+	if !reflect.DeepEqual(reports[0].divergences, expect) {
+		t.Fatalf("divergences %q, expect %q", reports[0].divergences, expect)
+	}
+}
+
+func TestCompare(t *testing.T) {
+	cases := []struct {
+		expected, observed, diffs []string
+	}{
+		{[]string{"a", "b", "c"}, []string{"a", "b", "c"}, nil},
+		{[]string{"a", "b", "c"}, []string{"b", "a", "c"}, nil},
+		{[]string{"a", "b", "c"}, []string{"a", "x", "c"}, []string{"unexpected x", "missing b"}},
+		{[]string{"a"}, []string{"a", "a"}, []string{"unexpected a"}},
+	}
+	for _, c := range cases {
+		if diffs := compare(c.expected, c.observed); !reflect.DeepEqual(diffs, c.diffs) {
+			t.Fatalf("compare(%q, %q) = %q, expect %q", c.expected, c.observed, diffs, c.diffs)
+		}
+	}
+}
@@ -0,0 +1,223 @@
+// Copyright (c) 2016 The MQPP Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/abo/mqpp"
+	"github.com/abo/mqpp/capture"
+	"github.com/abo/mqpp/internal/describe"
+)
+
+// session replays the client side of a recorded connection
+type session struct {
+	id   uint32
+	opts *options
+	conn net.Conn
+	out  chan []byte
+	quit chan struct{}
+	done chan struct{} // closed when reading ends
+
+	// packet identifiers of the client's flows, recorded to replayed and back
+	ids     map[uint16]uint16
+	origIDs map[uint16]uint16
+	nextID  uint16
+
+	mu       sync.Mutex
+	clientID string
+	expected []string // recorded server packets
+	observed []string
+}
+
+func dialSession(id uint32, opts *options) (*session, error) {
+	c, err := net.Dial("tcp", opts.target)
+	if err != nil {
+		return nil, err
+	}
+	s := &session{
+		id:      id,
+		opts:    opts,
+		conn:    c,
+		out:     make(chan []byte, 256),
+		quit:    make(chan struct{}),
+		done:    make(chan struct{}),
+		ids:     make(map[uint16]uint16),
+		origIDs: make(map[uint16]uint16),
+	}
+	go s.writeLoop()
+	go s.readLoop()
+	return s, nil
+}
+
+func (s *session) writeLoop() {
+	for {
+		select {
+		case data := <-s.out:
+			if _, err := s.conn.Write(data); err != nil {
+				s.conn.Close()
+			}
+		case <-s.quit:
+			return
+		}
+	}
+}
+
+func (s *session) readLoop() {
+	defer close(s.done)
+	sp := mqpp.NewSplitter(s.conn)
+	sp.Buffer(make([]byte, 4096), mqpp.MaxPacketSize)
+	for sp.Scan() {
+		raw := append([]byte(nil), sp.Bytes()...)
+		p, err := mqpp.Parse(raw)
+		s.mu.Lock()
+		s.observed = append(s.observed, summary(raw, p, err))
+		s.mu.Unlock()
+		if err == nil && s.opts.ack {
+			s.answer(p)
+		}
+	}
+}
+
+// answer completes the QoS flows of the server's publishes
+func (s *session) answer(p mqpp.ControlPacket) {
+	switch p := p.(type) {
+	case *mqpp.Publish:
+		if p.QoS() == mqpp.QosAtLeastOnce {
+			s.send(mqpp.MakePuback(p.PacketIdentifier()))
+		} else if p.QoS() == mqpp.QosExactlyOnce {
+			s.send(mqpp.MakePubrec(p.PacketIdentifier()))
+		}
+	case *mqpp.Pubrel:
+		s.send(mqpp.MakePubcomp(p.PacketIdentifier()))
+	}
+}
+
+func (s *session) send(p mqpp.ControlPacket) {
+	s.write(p.Bytes())
+}
+
+func (s *session) write(data []byte) {
+	select {
+	case s.out <- data:
+	case <-s.quit:
+	}
+}
+
+// replay sends a recorded client packet, rewritten, or notes a recorded server packet
+func (s *session) replay(rec *capture.Record) {
+	if rec.Direction == mqpp.ServerToClient {
+		s.mu.Lock()
+		s.expected = append(s.expected, summary(rec.Raw, rec.Packet, rec.Err))
+		s.mu.Unlock()
+		return
+	}
+
+	if rec.Err != nil {
+		// sent as is, the broker shall close the connection
+		s.write(rec.Raw)
+		return
+	}
+	if p := s.rewrite(rec.Packet); p != nil {
+		s.send(p)
+	}
+}
+
+// rewrite renames the client, and renumbers packet identifiers of the client's
+// flows so they don't collide with state left on the broker. Acks of the
+// server's publishes are dropped if they are answered live.
+func (s *session) rewrite(p mqpp.ControlPacket) mqpp.ControlPacket {
+	switch p := p.(type) {
+	case *mqpp.Connect:
+		id := p.ClientIdentifier()
+		if id != "" {
+			id = s.opts.clientPrefix + id
+		}
+		s.mu.Lock()
+		s.clientID = id
+		s.mu.Unlock()
+		c := mqpp.MakeConnect(p.ProtocolName(), p.ProtocolLevel(), p.WillRetain(), p.WillQoS(), p.CleanSession(),
+			p.KeepAlive(), id, p.WillTopic(), p.WillMessage(), p.Username(), p.Password())
+		return &c
+	case *mqpp.Publish:
+		if p.QoS() == mqpp.QosAtMostOnce {
+			return p
+		}
+		pub := mqpp.MakePublish(p.Dup(), p.QoS(), p.Retain(), p.TopicName(), s.mapID(p.PacketIdentifier(), !p.Dup()), p.Payload())
+		return &pub
+	case *mqpp.Pubrel:
+		return mqpp.MakePubrel(s.mapID(p.PacketIdentifier(), false))
+	case *mqpp.Subscribe:
+		sub := mqpp.MakeSubscribe(s.mapID(p.PacketIdentifier(), true), p.Payload())
+		return &sub
+	case *mqpp.Unsubscribe:
+		unsub := mqpp.MakeUnsubscribe(s.mapID(p.PacketIdentifier(), true), p.Payload())
+		return &unsub
+	case *mqpp.Puback, *mqpp.Pubrec, *mqpp.Pubcomp:
+		if s.opts.ack {
+			return nil
+		}
+	}
+	return p
+}
+
+// mapID returns the replayed identifier of a recorded one, a fresh one is
+// taken when a flow starts
+func (s *session) mapID(orig uint16, start bool) uint16 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if id, ok := s.ids[orig]; ok && !start {
+		return id
+	}
+	for {
+		s.nextID++
+		if s.nextID == 0 {
+			s.nextID = 1
+		}
+		if _, used := s.origIDs[s.nextID]; !used || len(s.origIDs) >= 65535 {
+			break
+		}
+	}
+	if old, ok := s.ids[orig]; ok {
+		delete(s.origIDs, old)
+	}
+	s.ids[orig], s.origIDs[s.nextID] = s.nextID, orig
+	return s.nextID
+}
+
+// summary describes a packet for comparing recorded and observed server
+// packets, identifiers and dup flags are left out since they differ by nature
+func summary(raw []byte, p mqpp.ControlPacket, err error) string {
+	if err != nil {
+		return mqpp.TypeName(raw[0]>>4) + " error=" + describe.Text(err.Error())
+	}
+	var b strings.Builder
+	b.WriteString(mqpp.TypeName(p.Type()))
+	for _, f := range describe.Fields(p) {
+		if f.Name != "id" && f.Name != "dup" && !f.Verbose {
+			b.WriteString(" " + f.Name + "=" + describe.Text(f.Value))
+		}
+	}
+	return b.String()
+}
+
+// close ends the session, late responses are no longer observed
+func (s *session) close() {
+	close(s.quit)
+	s.conn.Close()
+	<-s.done
+}
@@ -0,0 +1,223 @@
+// Copyright (c) 2016 The MQPP Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Command mqpp-sub subscribes to topic filters of a MQTT broker and prints the
+// messages it receives, like mosquitto_sub does.
+//
+// Usage:
+//
+//	mqpp-sub -t filter [-t filter ...] [flags]
+//
+// Each message is printed on a line with its topic, QoS and retain flag, the
+// payload is printed as is, in hex, or in a json object with -F.
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+	"unicode/utf8"
+
+	"github.com/abo/mqpp"
+	"github.com/abo/mqpp/client"
+	"github.com/abo/mqpp/internal/connflags"
+)
+
+// filters is a repeatable flag
+type filters []string
+
+func (f *filters) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *filters) Set(s string) error {
+	if !mqpp.ValidTopicFilter(s) {
+		return fmt.Errorf("invalid topic filter %q", s)
+	}
+	*f = append(*f, s)
+	return nil
+}
+
+func main() {
+	conn := connflags.Register(flag.CommandLine, "mqpp-sub-")
+	var fs filters
+	flag.Var(&fs, "t", "topic filter to subscribe to, may be repeated")
+	qos := flag.Uint("q", 0, "requested QoS of the subscriptions")
+	format := flag.String("F", "text", "output format: text, hex or json")
+	count := flag.Int("C", 0, "exit after this many messages, 0 for never")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: %s -t filter [-t filter ...] [flags]\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if len(fs) == 0 || flag.NArg() > 0 || *count < 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	if *qos > uint(mqpp.QosExactlyOnce) {
+		fmt.Fprintln(os.Stderr, "mqpp-sub: QoS must be 0, 1 or 2")
+		os.Exit(2)
+	}
+	out := bufio.NewWriter(os.Stdout)
+	p, err := newPrinter(out, *format, *count)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "mqpp-sub:", err)
+		os.Exit(2)
+	}
+	copts, err := conn.Options()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "mqpp-sub:", err)
+		os.Exit(2)
+	}
+	lost := make(chan error, 1)
+	copts.OnConnectionLost = func(c *client.Client, err error) {
+		select {
+		case lost <- err:
+		default:
+		}
+	}
+
+	c := client.New(copts)
+	if err := c.Connect(); err != nil {
+		fmt.Fprintln(os.Stderr, "mqpp-sub:", err)
+		os.Exit(1)
+	}
+	if err := subscribe(c, p, fs, byte(*qos), conn.Timeout); err != nil {
+		c.Disconnect()
+		fmt.Fprintln(os.Stderr, "mqpp-sub:", err)
+		os.Exit(1)
+	}
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	select {
+	case <-p.done:
+	case <-sig:
+	case err = <-lost:
+	}
+	c.Disconnect()
+	if werr := p.flush(); err == nil {
+		err = werr
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "mqpp-sub:", err)
+		os.Exit(1)
+	}
+}
+
+// subscribe subscribes to filters with handler of p, and reports filters the broker refused
+func subscribe(c *client.Client, p *printer, fs []string, qos byte, timeout time.Duration) error {
+	subs := make([]mqpp.Subscription, len(fs))
+	for i, f := range fs {
+		subs[i] = mqpp.Subscription{TopicFilter: f, RequestedQoS: qos}
+	}
+	t := c.Subscribe(p.handle, subs...)
+	err := t.WaitTimeout(timeout)
+	if err == client.ErrSubscriptionFailed {
+		var refused []string
+		for i, code := range t.ReturnCodes() {
+			if code == mqpp.SubackFailure {
+				refused = append(refused, fs[i])
+			}
+		}
+		return fmt.Errorf("subscription to %s refused", strings.Join(refused, ", "))
+	}
+	return err
+}
+
+// printer writes received messages in a format, and closes done after count messages
+type printer struct {
+	mu     sync.Mutex
+	w      *bufio.Writer
+	format func(w io.Writer, p *mqpp.Publish) error
+	count  int
+	n      int
+	err    error
+	done   chan struct{}
+}
+
+func newPrinter(w *bufio.Writer, format string, count int) (*printer, error) {
+	p := &printer{w: w, count: count, done: make(chan struct{})}
+	switch format {
+	case "text":
+		p.format = writeText
+	case "hex":
+		p.format = writeHex
+	case "json":
+		p.format = writeJSON
+	default:
+		return nil, fmt.Errorf("unknown format %q", format)
+	}
+	return p, nil
+}
+
+func (p *printer) handle(c *client.Client, m *mqpp.Publish) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.count > 0 && p.n >= p.count || p.err != nil {
+		return
+	}
+	p.n++
+	if p.err = p.format(p.w, m); p.err == nil {
+		p.err = p.w.Flush()
+	}
+	if p.err != nil || p.n == p.count {
+		close(p.done)
+	}
+}
+
+// flush returns the first write error
+func (p *printer) flush() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.err != nil {
+		return p.err
+	}
+	return p.w.Flush()
+}
+
+func writeText(w io.Writer, p *mqpp.Publish) error {
+	_, err := fmt.Fprintf(w, "%s qos=%d retain=%t %s\n", p.TopicName(), p.QoS(), p.Retain(), p.Payload())
+	return err
+}
+
+func writeHex(w io.Writer, p *mqpp.Publish) error {
+	_, err := fmt.Fprintf(w, "%s qos=%d retain=%t %s\n", p.TopicName(), p.QoS(), p.Retain(), hex.EncodeToString(p.Payload()))
+	return err
+}
+
+// writeJSON writes an object per line, the payload is a string if it's valid UTF-8 or payload_hex otherwise
+func writeJSON(w io.Writer, p *mqpp.Publish) error {
+	obj := map[string]interface{}{"topic": p.TopicName(), "qos": p.QoS(), "retain": p.Retain()}
+	if b := p.Payload(); utf8.Valid(b) {
+		obj["payload"] = string(b)
+	} else {
+		obj["payload_hex"] = hex.EncodeToString(b)
+	}
+	data, err := json.Marshal(obj)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(data, '\n'))
+	return err
+}
@@ -0,0 +1,75 @@
+// Copyright (c) 2016 The MQPP Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/abo/mqpp"
+	"github.com/abo/mqpp/broker"
+	"github.com/abo/mqpp/client"
+	"github.com/abo/mqpp/mqpptest"
+)
+
+func TestSubscribe(t *testing.T) {
+	tests := []struct {
+		format string
+		expect string
+	}{
+		{"text", "x qos=1 retain=true kept\na/b qos=0 retain=false hi\na/c qos=1 retain=false \xff\n"},
+		{"hex", "x qos=1 retain=true 6b657074\na/b qos=0 retain=false 6869\na/c qos=1 retain=false ff\n"},
+		{"json", `{"payload":"kept","qos":1,"retain":true,"topic":"x"}` + "\n" +
+			`{"payload":"hi","qos":0,"retain":false,"topic":"a/b"}` + "\n" +
+			`{"payload_hex":"ff","qos":1,"retain":false,"topic":"a/c"}` + "\n"},
+	}
+	for _, tt := range tests {
+		b := broker.New(broker.Options{})
+		pub := mqpptest.Connect(t, client.Options{ClientID: "pub", Dial: b.Dial})
+		pub.Publish("x", mqpp.QosAtLeastOnce, true, []byte("kept")).Wait()
+
+		var buf bytes.Buffer
+		p, err := newPrinter(bufio.NewWriter(&buf), tt.format, 3)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sub := mqpptest.Connect(t, client.Options{ClientID: "sub", Dial: b.Dial})
+		if err := subscribe(sub, p, []string{"a/+", "x"}, mqpp.QosAtLeastOnce, time.Second); err != nil {
+			t.Fatal(err)
+		}
+		pub.Publish("a/b", mqpp.QosAtMostOnce, false, []byte("hi")).Wait()
+		pub.Publish("a/c", mqpp.QosExactlyOnce, false, []byte{0xff}).Wait()
+		pub.Publish("a/d", mqpp.QosAtMostOnce, false, []byte("over count")).Wait()
+		select {
+		case <-p.done:
+		case <-time.After(time.Second):
+			t.Fatalf("%s: done not closed", tt.format)
+		}
+		sub.Disconnect()
+		if err := p.flush(); err != nil {
+			t.Fatal(err)
+		}
+		if buf.String() != tt.expect {
+			t.Fatalf("%s: unexpected output\n%s", tt.format, buf.String())
+		}
+		b.Close()
+	}
+
+	if _, err := newPrinter(nil, "xml", 0); err == nil {
+		t.Fatal("unknown format accepted")
+	}
+}
@@ -0,0 +1,323 @@
+// Copyright (c) 2016 The MQPP Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package conform checks that a conversation between a client and a server
+// follows the session rules of MQTT 3.1.1. Packets are checked one by one as
+// they come, so it's usable online in a proxy as well as offline over captures.
+package conform
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/abo/mqpp"
+)
+
+// Violation is a breach of a rule of the specification
+type Violation struct {
+	Rule      string // normative statement, e.g. "MQTT-3.1.0-1", or section number if there's none
+	Direction mqpp.Direction
+	Type      byte
+	Message   string
+}
+
+func (v Violation) String() string {
+	return fmt.Sprintf("[%s] %s %s: %s", v.Rule, v.Direction, mqpp.TypeName(v.Type), v.Message)
+}
+
+// CheckConnectFlags returns the rules broken by the connect flags of p, a server
+// must close the connection without CONNACK on any of them.
+func CheckConnectFlags(p *mqpp.Connect) []Violation {
+	var vs []Violation
+	report := func(rule, message string) {
+		vs = append(vs, Violation{Rule: rule, Direction: mqpp.ClientToServer, Type: mqpp.TCONNECT, Message: message})
+	}
+	if p.ConnectFlags()&0x01 != 0 {
+		report("MQTT-3.1.2-3", "reserved connect flag set")
+	}
+	switch {
+	case p.WillFlag() && p.WillQoS() > mqpp.QosExactlyOnce:
+		report("MQTT-3.1.2-14", "will QoS 3")
+	case !p.WillFlag() && p.WillQoS() != mqpp.QosAtMostOnce:
+		report("MQTT-3.1.2-13", fmt.Sprintf("will QoS %d without will flag", p.WillQoS()))
+	}
+	if !p.WillFlag() && p.WillRetain() {
+		report("MQTT-3.1.2-15", "will retain without will flag")
+	}
+	if p.PasswordFlag() && !p.UsernameFlag() {
+		report("MQTT-3.1.2-22", "password without user name")
+	}
+	return vs
+}
+
+// states of a publish flow, as seen on the wire
+const (
+	awaitPuback byte = iota + 1
+	awaitPubrec
+	awaitPubrel
+	awaitPubcomp
+)
+
+// sender tracks the packet identifiers in flight of one side
+type sender struct {
+	publish     map[uint16]byte // flow state
+	subscribe   map[uint16]int  // number of topic filters
+	unsubscribe map[uint16]bool
+}
+
+func newSender() *sender {
+	return &sender{
+		publish:     make(map[uint16]byte),
+		subscribe:   make(map[uint16]int),
+		unsubscribe: make(map[uint16]bool),
+	}
+}
+
+func (s *sender) inflight(id uint16) bool {
+	_, pub := s.publish[id]
+	_, sub := s.subscribe[id]
+	return pub || sub || s.unsubscribe[id]
+}
+
+// Checker follows a conversation, it's not safe for concurrent use
+type Checker struct {
+	connected    bool // CONNECT sent
+	acknowledged bool // CONNACK sent
+	refused      bool
+	resumed      bool // session present, flows of the last connection may go on
+	disconnected bool
+	senders      [2]*sender // by direction
+}
+
+// NewChecker returns a checker of a new network connection
+func NewChecker() *Checker {
+	return &Checker{senders: [2]*sender{newSender(), newSender()}}
+}
+
+// Check consumes packet p sent in direction dir, and returns the rules it breaks.
+// p is a parsed packet, as returned by mqpp.Parse.
+func (c *Checker) Check(dir mqpp.Direction, p mqpp.ControlPacket) []Violation {
+	var vs []Violation
+	report := func(rule, format string, args ...interface{}) {
+		vs = append(vs, Violation{Rule: rule, Direction: dir, Type: p.Type(), Message: fmt.Sprintf(format, args...)})
+	}
+
+	if dir == mqpp.ClientToServer {
+		switch {
+		case c.disconnected:
+			report("MQTT-3.14.4-2", "sent after DISCONNECT")
+		case !c.connected && p.Type() != mqpp.TCONNECT:
+			report("MQTT-3.1.0-1", "the first packet must be CONNECT")
+		}
+		switch p.Type() {
+		case mqpp.TCONNACK, mqpp.TSUBACK, mqpp.TUNSUBACK, mqpp.TPINGRESP:
+			report("2.2.1", "sent by the client")
+		}
+	} else {
+		switch {
+		case c.refused:
+			report("MQTT-3.2.2-5", "sent after a refused CONNACK")
+		case !c.acknowledged && p.Type() != mqpp.TCONNACK:
+			report("MQTT-3.2.0-1", "the first packet must be CONNACK")
+		}
+		switch p.Type() {
+		case mqpp.TCONNECT, mqpp.TSUBSCRIBE, mqpp.TUNSUBSCRIBE, mqpp.TPINGREQ, mqpp.TDISCONNECT:
+			report("2.2.1", "sent by the server")
+		}
+	}
+
+	// packets parsed leniently may break the flags
+	if p.Type() != mqpp.TPUBLISH && mqpp.ValidateFixedHeader(p.Bytes()[0]) != nil {
+		report("MQTT-2.2.2-1", "invalid flags %#02x", p.Bytes()[0]&0x0f)
+	}
+
+	// own flows of the sender, and flows of the peer it's responding to
+	own, peer := c.senders[dir], c.senders[1-dir]
+	switch p := p.(type) {
+	case *mqpp.Connect:
+		if c.connected {
+			report("MQTT-3.1.0-2", "second CONNECT")
+		}
+		c.connected = true
+		vs = append(vs, CheckConnectFlags(p)...)
+		for _, s := range []string{p.ClientIdentifier(), p.WillTopic(), p.Username()} {
+			if rule := stringRule(s); rule != "" {
+				report(rule, "invalid string %q", s)
+			}
+		}
+	case *mqpp.Connack:
+		if c.acknowledged {
+			report("MQTT-3.2.0-1", "second CONNACK")
+		}
+		c.acknowledged = true
+		if p.ReturnCode() != mqpp.Accepted {
+			c.refused = true
+			if p.SessionPresent() {
+				report("MQTT-3.2.2-4", "session present with return code %d", p.ReturnCode())
+			}
+		}
+		c.resumed = p.SessionPresent()
+	case *mqpp.Disconnect:
+		c.disconnected = true
+	case *mqpp.Publish:
+		if rule := stringRule(p.TopicName()); rule != "" {
+			report(rule, "invalid string %q", p.TopicName())
+		}
+		if p.TopicName() == "" {
+			report("MQTT-4.7.3-1", "empty topic name")
+		} else if !mqpp.ValidTopicName(p.TopicName()) {
+			report("MQTT-3.3.2-2", "invalid topic name %q", p.TopicName())
+		}
+		if p.QoS() > mqpp.QosExactlyOnce {
+			report("MQTT-3.3.1-4", "QoS 3")
+		}
+		if p.QoS() == mqpp.QosAtMostOnce {
+			if p.Dup() {
+				report("MQTT-3.3.1-2", "DUP set on QoS 0")
+			}
+			break
+		}
+		id := p.PacketIdentifier()
+		if id == 0 {
+			report("MQTT-2.3.1-1", "packet identifier 0")
+		}
+		state, ok := own.publish[id]
+		switch {
+		case p.Dup() && ok && (state == awaitPuback || state == awaitPubrec):
+			// re-sent
+		case own.inflight(id):
+			report(reuseRule(dir), "packet identifier %d in use", id)
+		}
+		if p.QoS() == mqpp.QosAtLeastOnce {
+			own.publish[id] = awaitPuback
+		} else if !ok || state == awaitPubrec || state == awaitPuback {
+			own.publish[id] = awaitPubrec
+		}
+	case *mqpp.Puback:
+		id := p.PacketIdentifier()
+		if peer.publish[id] == awaitPuback {
+			delete(peer.publish, id)
+		} else if !c.resumed {
+			report("MQTT-2.3.1-6", "no QoS 1 PUBLISH %d in flight", id)
+		}
+	case *mqpp.Pubrec:
+		id := p.PacketIdentifier()
+		if state := peer.publish[id]; state == awaitPubrec || state == awaitPubrel {
+			peer.publish[id] = awaitPubrel
+		} else if !c.resumed {
+			report("MQTT-2.3.1-6", "no QoS 2 PUBLISH %d in flight", id)
+		}
+	case *mqpp.Pubrel:
+		id := p.PacketIdentifier()
+		if state := own.publish[id]; state == awaitPubrel || state == awaitPubcomp {
+			own.publish[id] = awaitPubcomp
+		} else if !c.resumed {
+			report("MQTT-4.3.3-1", "PUBREL %d not following PUBREC", id)
+		}
+	case *mqpp.Pubcomp:
+		id := p.PacketIdentifier()
+		if peer.publish[id] == awaitPubcomp {
+			delete(peer.publish, id)
+		} else if !c.resumed {
+			report("MQTT-4.3.3-2", "PUBCOMP %d not following PUBREL", id)
+		}
+	case *mqpp.Subscribe:
+		id := p.PacketIdentifier()
+		if id == 0 {
+			report("MQTT-2.3.1-1", "packet identifier 0")
+		}
+		if own.inflight(id) {
+			report(reuseRule(dir), "packet identifier %d in use", id)
+		}
+		filters := p.Payload()
+		if len(filters) == 0 {
+			report("MQTT-3.8.3-3", "no topic filter")
+		}
+		for _, f := range filters {
+			if rule := stringRule(f.TopicFilter); rule != "" {
+				report(rule, "invalid string %q", f.TopicFilter)
+			}
+			if !mqpp.ValidTopicFilter(f.TopicFilter) {
+				report("4.7.1", "invalid topic filter %q", f.TopicFilter)
+			}
+			if f.RequestedQoS > mqpp.QosExactlyOnce {
+				report("MQTT-3.8.3-4", "requested QoS %#02x", f.RequestedQoS)
+			}
+		}
+		own.subscribe[id] = len(filters)
+	case *mqpp.Suback:
+		for _, code := range p.ReturnCodes() {
+			if code > mqpp.QosExactlyOnce && code != mqpp.SubackFailure {
+				report("MQTT-3.9.3-2", "reserved return code %#02x", code)
+			}
+		}
+		id := p.PacketIdentifier()
+		n, ok := peer.subscribe[id]
+		if !ok {
+			report("MQTT-3.8.4-2", "no SUBSCRIBE %d in flight", id)
+			break
+		}
+		delete(peer.subscribe, id)
+		if len(p.ReturnCodes()) != n {
+			report("MQTT-3.8.4-5", "%d return codes for %d topic filters", len(p.ReturnCodes()), n)
+		}
+	case *mqpp.Unsubscribe:
+		id := p.PacketIdentifier()
+		if id == 0 {
+			report("MQTT-2.3.1-1", "packet identifier 0")
+		}
+		if own.inflight(id) {
+			report(reuseRule(dir), "packet identifier %d in use", id)
+		}
+		if len(p.Payload()) == 0 {
+			report("MQTT-3.10.3-2", "no topic filter")
+		}
+		for _, f := range p.Payload() {
+			if rule := stringRule(f); rule != "" {
+				report(rule, "invalid string %q", f)
+			}
+			if !mqpp.ValidTopicFilter(f) {
+				report("4.7.1", "invalid topic filter %q", f)
+			}
+		}
+		own.unsubscribe[id] = true
+	case *mqpp.Unsuback:
+		id := p.PacketIdentifier()
+		if !peer.unsubscribe[id] {
+			report("MQTT-3.10.4-4", "no UNSUBSCRIBE %d in flight", id)
+		}
+		delete(peer.unsubscribe, id)
+	}
+	return vs
+}
+
+// reuseRule is the rule of assigning unused packet identifiers of dir
+func reuseRule(dir mqpp.Direction) string {
+	if dir == mqpp.ClientToServer {
+		return "MQTT-2.3.1-2"
+	}
+	return "MQTT-2.3.1-4"
+}
+
+// stringRule returns the rule s breaks as an UTF-8 encoded string, or "" if none
+func stringRule(s string) string {
+	if !utf8.ValidString(s) {
+		return "MQTT-1.5.3-1"
+	}
+	if strings.ContainsRune(s, 0) {
+		return "MQTT-1.5.3-2"
+	}
+	return ""
+}
@@ -0,0 +1,275 @@
+// Copyright (c) 2016 The MQPP Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package conform
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/abo/mqpp"
+	"github.com/abo/mqpp/internal/vectors"
+)
+
+const (
+	c2s = mqpp.ClientToServer
+	s2c = mqpp.ServerToClient
+)
+
+type event struct {
+	dir mqpp.Direction
+	p   mqpp.ControlPacket
+}
+
+func connect() mqpp.ControlPacket {
+	p := mqpp.MakeConnect(mqpp.ProtocolName, mqpp.ProtocolLevel, false, 0, true, 60, "c", "", nil, "", nil)
+	return &p
+}
+
+func publish(dup bool, qos byte, topic string, id uint16) mqpp.ControlPacket {
+	p := mqpp.MakePublish(dup, qos, false, topic, id, nil)
+	return &p
+}
+
+// flags overwrites the flags of the fixed header
+func flags(p mqpp.ControlPacket, flags byte) mqpp.ControlPacket {
+	data := append([]byte(nil), p.Bytes()...)
+	data[0] = data[0]&0xf0 | flags
+	parsed, err := mqpp.ParseLenient(data)
+	if err != nil {
+		panic(err)
+	}
+	return parsed
+}
+
+func subscribe(id uint16, filters ...string) mqpp.ControlPacket {
+	var subs []mqpp.Subscription
+	for _, f := range filters {
+		subs = append(subs, mqpp.Subscription{TopicFilter: f})
+	}
+	p := mqpp.MakeSubscribe(id, subs)
+	return &p
+}
+
+// check parses p as it comes from the wire, leniently since some cases break the flags
+func check(t *testing.T, checker *Checker, dir mqpp.Direction, p mqpp.ControlPacket) []Violation {
+	parsed, err := mqpp.ParseLenient(p.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return checker.Check(dir, parsed)
+}
+
+func TestChecker(t *testing.T) {
+	session := []event{{c2s, connect()}, {s2c, mqpp.MakeConnack(false, mqpp.Accepted)}}
+	cases := []struct {
+		name   string
+		events []event
+		rules  []string
+	}{
+		{"qos flows", []event{
+			{c2s, publish(false, 1, "a", 1)},
+			{c2s, publish(false, 2, "a", 2)},
+			{s2c, mqpp.MakePuback(1)},
+			{s2c, mqpp.MakePubrec(2)},
+			{c2s, mqpp.MakePubrel(2)},
+			{s2c, mqpp.MakePubcomp(2)},
+			{s2c, publish(false, 2, "a", 1)},
+			{c2s, mqpp.MakePubrec(1)},
+			{s2c, mqpp.MakePubrel(1)},
+			{c2s, mqpp.MakePubcomp(1)},
+			{c2s, publish(false, 1, "a", 1)},
+			{c2s, publish(true, 1, "a", 1)},
+			{s2c, mqpp.MakePuback(1)},
+			{c2s, subscribe(3, "a/#", "b")},
+			{s2c, mqpp.MakeSuback(3, []byte{0, 0})},
+			{c2s, mqpp.MakePingreq()},
+			{s2c, mqpp.MakePingresp()},
+			{c2s, mqpp.MakeDisconnect()},
+		}, nil},
+		{"identifier reuse", []event{
+			{c2s, publish(false, 1, "a", 1)},
+			{c2s, subscribe(1, "a")},
+			{s2c, publish(false, 1, "a", 0)},
+		}, []string{"MQTT-2.3.1-2", "MQTT-2.3.1-1"}},
+		{"pubrel before pubrec", []event{
+			{c2s, publish(false, 2, "a", 1)},
+			{c2s, mqpp.MakePubrel(1)},
+			{s2c, mqpp.MakePubcomp(1)},
+			{s2c, mqpp.MakePuback(5)},
+		}, []string{"MQTT-4.3.3-1", "MQTT-4.3.3-2", "MQTT-2.3.1-6"}},
+		{"suback", []event{
+			{c2s, subscribe(1, "a", "b/#/c")},
+			{s2c, mqpp.MakeSuback(1, []byte{0})},
+			{s2c, mqpp.MakeSuback(2, []byte{0})},
+		}, []string{"4.7.1", "MQTT-3.8.4-5", "MQTT-3.8.4-2"}},
+		{"after disconnect", []event{
+			{c2s, mqpp.MakeDisconnect()},
+			{c2s, mqpp.MakePingreq()},
+			{c2s, connect()},
+		}, []string{"MQTT-3.14.4-2", "MQTT-3.14.4-2", "MQTT-3.1.0-2"}},
+		{"wrong direction", []event{
+			{s2c, mqpp.MakePingreq()},
+			{c2s, publish(true, 0, "a/+", 0)},
+		}, []string{"2.2.1", "MQTT-3.3.2-2", "MQTT-3.3.1-2"}},
+		{"flags", []event{
+			{c2s, flags(mqpp.MakePubrel(1), 0)},
+			{c2s, flags(publish(false, 1, "a", 1), 0x06)},
+		}, []string{"MQTT-2.2.2-1", "MQTT-4.3.3-1", "MQTT-3.3.1-4"}},
+	}
+	for _, c := range cases {
+		checker := NewChecker()
+		var rules []string
+		for _, e := range append(append([]event(nil), session...), c.events...) {
+			for _, v := range check(t, checker, e.dir, e.p) {
+				rules = append(rules, v.Rule)
+			}
+		}
+		if !reflect.DeepEqual(rules, c.rules) {
+			t.Errorf("%s: violated %v, expect %v", c.name, rules, c.rules)
+		}
+	}
+}
+
+func TestCheckerHandshake(t *testing.T) {
+	checker := NewChecker()
+	vs := check(t, checker, c2s, mqpp.MakePingreq())
+	if len(vs) != 1 || vs[0].Rule != "MQTT-3.1.0-1" {
+		t.Fatalf("unexpected %v", vs)
+	}
+	if vs[0].String() != "[MQTT-3.1.0-1] client->server PINGREQ: the first packet must be CONNECT" {
+		t.Fatalf("unexpected %s", vs[0])
+	}
+	check(t, checker, c2s, connect())
+	if vs = check(t, checker, s2c, mqpp.MakePingresp()); len(vs) != 1 || vs[0].Rule != "MQTT-3.2.0-1" {
+		t.Fatalf("unexpected %v", vs)
+	}
+
+	checker = NewChecker()
+	check(t, checker, c2s, connect())
+	if vs = check(t, checker, s2c, mqpp.MakeConnack(true, mqpp.RefusedBadCredentials)); len(vs) != 1 || vs[0].Rule != "MQTT-3.2.2-4" {
+		t.Fatalf("unexpected %v", vs)
+	}
+	if vs = check(t, checker, s2c, mqpp.MakePingresp()); len(vs) != 1 || vs[0].Rule != "MQTT-3.2.2-5" {
+		t.Fatalf("unexpected %v", vs)
+	}
+
+	// flows of the last connection go on when the session is resumed
+	checker = NewChecker()
+	check(t, checker, c2s, connect())
+	check(t, checker, s2c, mqpp.MakeConnack(true, mqpp.Accepted))
+	if vs = check(t, checker, c2s, mqpp.MakePubrel(9)); len(vs) != 0 {
+		t.Fatalf("unexpected %v", vs)
+	}
+}
+
+// connectFlags overwrites the connect flags of c
+func connectFlags(c mqpp.Connect, set, clear byte) mqpp.ControlPacket {
+	data := append([]byte(nil), c.Bytes()...)
+	i := 2 + 2 + len(mqpp.ProtocolName) + 1
+	data[i] = data[i]&^clear | set
+	parsed, err := mqpp.ParseLenient(data)
+	if err != nil {
+		panic(err)
+	}
+	return parsed
+}
+
+func TestCheckerEncoding(t *testing.T) {
+	plain := mqpp.MakeConnect(mqpp.ProtocolName, mqpp.ProtocolLevel, false, 0, true, 60, "c", "", nil, "", nil)
+	will := mqpp.MakeConnect(mqpp.ProtocolName, mqpp.ProtocolLevel, false, 0, true, 60, "c", "w", []byte("bye"), "", nil)
+	credentials := mqpp.MakeConnect(mqpp.ProtocolName, mqpp.ProtocolLevel, false, 0, true, 60, "c", "", nil, "u", []byte("p"))
+	invalid := mqpp.MakeConnect(mqpp.ProtocolName, mqpp.ProtocolLevel, false, 0, true, 60, "\xff", "", nil, "a\x00", nil)
+	qos3 := mqpp.MakeSubscribe(1, []mqpp.Subscription{{TopicFilter: "a", RequestedQoS: 3}})
+	unsubscribe := mqpp.MakeUnsubscribe(2, []string{"a/#/b"})
+
+	cases := []struct {
+		name   string
+		events []event // a session is set up before, unless the first is CONNECT
+		rules  []string
+	}{
+		{"reserved connect flag", []event{{c2s, connectFlags(plain, 0x01, 0)}}, []string{"MQTT-3.1.2-3"}},
+		{"will qos without will", []event{{c2s, connectFlags(plain, 0x08, 0)}}, []string{"MQTT-3.1.2-13"}},
+		{"will retain without will", []event{{c2s, connectFlags(plain, 0x20, 0)}}, []string{"MQTT-3.1.2-15"}},
+		{"will qos 3", []event{{c2s, connectFlags(will, 0x18, 0)}}, []string{"MQTT-3.1.2-14"}},
+		{"password without user name", []event{{c2s, connectFlags(credentials, 0, 0x80)}}, []string{"MQTT-3.1.2-22"}},
+		{"invalid strings", []event{{c2s, &invalid}}, []string{"MQTT-1.5.3-1", "MQTT-1.5.3-2"}},
+		{"empty topic", []event{{c2s, publish(false, 0, "", 0)}}, []string{"MQTT-4.7.3-1"}},
+		{"requested qos 3", []event{{c2s, &qos3}}, []string{"MQTT-3.8.3-4"}},
+		{"reserved return code", []event{{c2s, subscribe(1, "a")}, {s2c, mqpp.MakeSuback(1, []byte{0x03})}}, []string{"MQTT-3.9.3-2"}},
+		{"unsubscribe filter", []event{{c2s, &unsubscribe}}, []string{"4.7.1"}},
+	}
+	for _, c := range cases {
+		checker := NewChecker()
+		events := c.events
+		if c.events[0].p.Type() != mqpp.TCONNECT {
+			events = append([]event{{c2s, connect()}, {s2c, mqpp.MakeConnack(false, mqpp.Accepted)}}, events...)
+		}
+		var rules []string
+		for _, e := range events {
+			for _, v := range check(t, checker, e.dir, e.p) {
+				rules = append(rules, v.Rule)
+			}
+		}
+		if !reflect.DeepEqual(rules, c.rules) {
+			t.Errorf("%s: violated %v, expect %v", c.name, rules, c.rules)
+		}
+	}
+}
+
+// TestVectors checks the rules broken by the encoding test vectors are reported
+func TestVectors(t *testing.T) {
+	files, _ := filepath.Glob("../testdata/vectors/*.txt")
+	if len(files) == 0 {
+		t.Fatal("no vectors")
+	}
+	for _, file := range files {
+		vs, err := vectors.Load(file)
+		if err != nil {
+			t.Fatalf("%s: %v", file, err)
+		}
+		for _, v := range vs {
+			if v.Lenient != vectors.OK {
+				continue
+			}
+			p, err := mqpp.ParseLenient(v.Bytes)
+			if err != nil {
+				t.Fatalf("%s:%d: %v", file, v.Line, err)
+			}
+
+			checker, dir := NewChecker(), c2s
+			switch p.Type() {
+			case mqpp.TCONNACK, mqpp.TSUBACK, mqpp.TUNSUBACK, mqpp.TPINGRESP:
+				dir = s2c
+			}
+			if p.Type() != mqpp.TCONNECT {
+				checker.Check(c2s, connect())
+				if p.Type() != mqpp.TCONNACK {
+					connack := mqpp.MakeConnack(false, mqpp.Accepted)
+					checker.Check(s2c, &connack)
+				}
+			}
+			reported := make(map[string]bool)
+			for _, violation := range checker.Check(dir, p) {
+				reported[violation.Rule] = true
+			}
+			for _, rule := range v.Violates {
+				if !reported[rule] {
+					t.Errorf("%s:%d %s: %s not reported, got %v", file, v.Line, v.Name, rule, reported)
+				}
+			}
+		}
+	}
+}
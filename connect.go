@@ -33,44 +33,42 @@ type Connect struct {
 }
 
 func newConnect(data []byte) (*Connect, error) {
-	if len(data) < 1 || data[0] != (TCONNECT<<4) {
+	if len(data) < 1 || data[0]>>4 != TCONNECT {
 		return nil, ErrProtocolViolation
 	}
 
 	pkt := &Connect{endecBytes: data}
-
-	_, offset := pkt.byte(0)             // 1)packet type, reserved
-	remlen, offset := pkt.remlen(offset) // 2)remaining length
-
-	if offset <= 1 {
-		return nil, ErrMalformedRemLen
+	offset, pktLen, err := pkt.header() // 1)packet type, reserved 2)remaining length
+	if err != nil {
+		return nil, err
 	}
-	pktLen := offset + int(remlen)
-	if len(data) < pktLen {
+	pkt.endecBytes = data[:pktLen]
+
+	pkt.protocolNamePos = offset
+	pkt.protocolLevelPos = pkt.skipString(offset, pktLen)       // 3)protocol name
+	pkt.connectFlagsPos = skip(pkt.protocolLevelPos, 1, pktLen) // 4)protocol level
+	pkt.keepalivePos = skip(pkt.connectFlagsPos, 1, pktLen)     // 5)connect flags
+	pkt.clientIDPos = skip(pkt.keepalivePos, 2, pktLen)         // 6)keep alive
+	offset = pkt.skipString(pkt.clientIDPos, pktLen)            // 7)clientid
+	if offset < 0 {
 		return nil, ErrProtocolViolation
 	}
-	pkt.protocolNamePos = offset
-	_, pkt.protocolLevelPos = pkt.string(offset)            // 3)protocol name
-	_, pkt.connectFlagsPos = pkt.byte(pkt.protocolLevelPos) // 4)protocol level
-	usernameFlag := pkt.bit(pkt.connectFlagsPos, 7)
-	passwordFlag := pkt.bit(pkt.connectFlagsPos, 6)
-	willFlag := pkt.bit(pkt.connectFlagsPos, 2)
-	_, pkt.keepalivePos = pkt.byte(pkt.connectFlagsPos) // 5)connect flags
-	_, pkt.clientIDPos = pkt.uint16(pkt.keepalivePos)   // 6)keep alive
-	_, offset = pkt.string(pkt.clientIDPos)             // 7)clientid
 
-	if willFlag {
+	if pkt.WillFlag() {
 		pkt.willTopicPos = offset
-		_, pkt.willMessagePos = pkt.string(pkt.willTopicPos) // 8)will topic
-		_, offset = pkt.string(pkt.willMessagePos)           // 9)will message
+		pkt.willMessagePos = pkt.skipString(pkt.willTopicPos, pktLen) // 8)will topic
+		offset = pkt.skipString(pkt.willMessagePos, pktLen)           // 9)will message
 	}
-	if usernameFlag {
+	if pkt.UsernameFlag() {
 		pkt.usernamePos = offset
-		_, offset = pkt.string(pkt.usernamePos) // 10)user name
+		offset = pkt.skipString(pkt.usernamePos, pktLen) // 10)user name
 	}
-	if passwordFlag {
+	if pkt.PasswordFlag() {
 		pkt.passwordPos = offset
-		// _, _ = pkt.string(pkt.passwordPos) // 11)password
+		offset = pkt.skipString(pkt.passwordPos, pktLen) // 11)password
+	}
+	if offset < 0 {
+		return nil, ErrProtocolViolation
 	}
 
 	return pkt, nil
@@ -133,6 +131,12 @@ func (c *Connect) ProtocolLevel() byte {
 	return protoLevel
 }
 
+// ConnectFlags return the connect flags byte, reserved bit included
+func (c *Connect) ConnectFlags() byte {
+	flags, _ := c.byte(c.connectFlagsPos)
+	return flags
+}
+
 // UsernameFlag return is username present in the payload
 func (c *Connect) UsernameFlag() bool {
 	return c.bit(c.connectFlagsPos, 7)
@@ -187,7 +191,7 @@ func (c *Connect) WillTopic() string {
 
 // WillMessage return will message if willflag is set, or []byte{} when willflag not set
 func (c *Connect) WillMessage() []byte {
-	if c.WillFlag() {
+	if !c.WillFlag() {
 		return []byte{}
 	}
 	msg, _ := c.string(c.willMessagePos)
@@ -22,7 +22,7 @@ type Disconnect struct {
 
 func newDisconnect(data []byte) (*Disconnect, error) {
 	// check packet length, packet type, remaining length
-	if len(data) < 2 || data[0] != (TDISCONNECT<<4) || data[1] != 0 {
+	if len(data) < 2 || data[0]>>4 != TDISCONNECT || data[1] != 0 {
 		return nil, ErrProtocolViolation
 	}
 	return &Disconnect{endecBytes: data[0:2]}, nil
@@ -133,10 +133,44 @@ func (bs endecBytes) string(offset int) (string, int) {
 	return string(bs[start : start+int(l)]), start + int(l)
 }
 
+// header decodes the remaining length, returns the offset of the variable header
+// and the length of the packet, which must be all in bs
+func (bs endecBytes) header() (int, int, error) {
+	remlen, offset := bs.remlen(1)
+	if offset <= 1 {
+		return 0, 0, ErrMalformedRemLen
+	}
+	pktLen := offset + int(remlen)
+	if len(bs) < pktLen {
+		return 0, 0, ErrProtocolViolation
+	}
+	return offset, pktLen, nil
+}
+
+// skip returns the offset after a field of n bytes at offset, or -1 if it overruns end.
+// offset of -1 is passed through, so fields can be chained and checked at last.
+func skip(offset, n, end int) int {
+	if offset < 0 || offset+n > end {
+		return -1
+	}
+	return offset + n
+}
+
+// skipString returns the offset after the string at offset, or -1 if it overruns end
+func (bs endecBytes) skipString(offset, end int) int {
+	if skip(offset, 2, end) < 0 {
+		return -1
+	}
+	return skip(offset+2, int(binary.BigEndian.Uint16(bs[offset:])), end)
+}
+
 func (bs endecBytes) remlen(offset int) (uint32, int) {
 	val, n := binary.Uvarint(bs[offset:])
 
-	if val > 268435455 {
+	if n == 0 && len(bs) >= offset+4 { // not ended in 4 bytes
+		n = 5
+	}
+	if n > 4 { // more than 268435455
 		return 0, offset - n
 	}
 	return uint32(val), offset + n
@@ -0,0 +1,140 @@
+// Copyright (c) 2016 The MQPP Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mqpp
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+// seeds of the fuzz targets are in testdata/fuzz, regenerate them by
+// go run testdata/fuzz/gen.go
+
+func FuzzSplit(f *testing.F) {
+	f.Fuzz(func(t *testing.T, data []byte) {
+		for _, recover := range []bool{false, true} {
+			s := NewSplitter(bytes.NewReader(data))
+			s.Buffer(make([]byte, 4096), len(data)+1)
+			s.Recover = recover
+			last := int64(-1)
+			for s.Scan() {
+				if s.Offset() <= last || s.Offset()+int64(len(s.Bytes())) > int64(len(data)) {
+					t.Fatalf("recover %v: token at %d of %d bytes out of stream", recover, s.Offset(), len(s.Bytes()))
+				}
+				last = s.Offset()
+				if !bytes.Equal(s.Bytes(), data[s.Offset():s.Offset()+int64(len(s.Bytes()))]) {
+					t.Fatalf("recover %v: token at %d doesn't match the stream", recover, s.Offset())
+				}
+				if p, err := s.Packet(); err == nil {
+					checkReparse(t, p, ParseLenient)
+				}
+			}
+		}
+	})
+}
+
+func FuzzParse(f *testing.F) {
+	f.Fuzz(func(t *testing.T, data []byte) {
+		if p, err := Parse(data); err == nil {
+			checkReparse(t, p, Parse)
+		}
+		if p, err := ParseLenient(data); err == nil {
+			checkReparse(t, p, ParseLenient)
+		}
+	})
+}
+
+func FuzzConnect(f *testing.F)     { fuzzParser(f, parser(newConnect)) }
+func FuzzConnack(f *testing.F)     { fuzzParser(f, parser(newConnack)) }
+func FuzzPublish(f *testing.F)     { fuzzParser(f, parser(newPublish)) }
+func FuzzPuback(f *testing.F)      { fuzzParser(f, parser(newPuback)) }
+func FuzzPubrec(f *testing.F)      { fuzzParser(f, parser(newPubrec)) }
+func FuzzPubrel(f *testing.F)      { fuzzParser(f, parser(newPubrel)) }
+func FuzzPubcomp(f *testing.F)     { fuzzParser(f, parser(newPubcomp)) }
+func FuzzSubscribe(f *testing.F)   { fuzzParser(f, parser(newSubscribe)) }
+func FuzzSuback(f *testing.F)      { fuzzParser(f, parser(newSuback)) }
+func FuzzUnsubscribe(f *testing.F) { fuzzParser(f, parser(newUnsubscribe)) }
+func FuzzUnsuback(f *testing.F)    { fuzzParser(f, parser(newUnsuback)) }
+func FuzzPingreq(f *testing.F)     { fuzzParser(f, parser(newPingreq)) }
+func FuzzPingresp(f *testing.F)    { fuzzParser(f, parser(newPingresp)) }
+func FuzzDisconnect(f *testing.F)  { fuzzParser(f, parser(newDisconnect)) }
+
+// parser adapts newXxx to a func returning ControlPacket, without typed nil
+func parser[T ControlPacket](parse func([]byte) (T, error)) func([]byte) (ControlPacket, error) {
+	return func(data []byte) (ControlPacket, error) {
+		p, err := parse(data)
+		if err != nil {
+			return nil, err
+		}
+		return p, nil
+	}
+}
+
+func fuzzParser(f *testing.F, parse func([]byte) (ControlPacket, error)) {
+	f.Fuzz(func(t *testing.T, data []byte) {
+		if p, err := parse(data); err == nil {
+			checkReparse(t, p, parse)
+		}
+	})
+}
+
+// checkReparse checks Bytes() of p parses again to the same packet
+func checkReparse(t *testing.T, p ControlPacket, parse func([]byte) (ControlPacket, error)) {
+	fields := packetFields(p)
+	q, err := parse(append([]byte(nil), p.Bytes()...))
+	if err != nil {
+		t.Fatalf("reparse % x: %v", p.Bytes(), err)
+	}
+	if !bytes.Equal(p.Bytes(), q.Bytes()) {
+		t.Fatalf("reparse % x: got bytes % x", p.Bytes(), q.Bytes())
+	}
+	if !reflect.DeepEqual(fields, packetFields(q)) {
+		t.Fatalf("reparse % x: fields %v, got %v", p.Bytes(), fields, packetFields(q))
+	}
+}
+
+// packetFields returns values of all accessors of p
+func packetFields(p ControlPacket) []interface{} {
+	switch p := p.(type) {
+	case *Connect:
+		return []interface{}{p.ProtocolName(), p.ProtocolLevel(), p.UsernameFlag(), p.PasswordFlag(),
+			p.WillRetain(), p.WillQoS(), p.WillFlag(), p.CleanSession(), p.KeepAlive(),
+			p.ClientIdentifier(), p.WillTopic(), p.WillMessage(), p.Username(), p.Password()}
+	case *Connack:
+		return []interface{}{p.SessionPresent(), p.ReturnCode()}
+	case *Publish:
+		return []interface{}{p.Dup(), p.QoS(), p.Retain(), p.TopicName(), p.PacketIdentifier(), p.Payload()}
+	case *Puback:
+		return []interface{}{p.PacketIdentifier()}
+	case *Pubrec:
+		return []interface{}{p.PacketIdentifier()}
+	case *Pubrel:
+		return []interface{}{p.PacketIdentifier()}
+	case *Pubcomp:
+		return []interface{}{p.PacketIdentifier()}
+	case *Subscribe:
+		return []interface{}{p.PacketIdentifier(), p.Payload()}
+	case *Suback:
+		return []interface{}{p.PacketIdentifier(), p.ReturnCodes()}
+	case *Unsubscribe:
+		return []interface{}{p.PacketIdentifier(), p.Payload()}
+	case *Unsuback:
+		return []interface{}{p.PacketIdentifier()}
+	case *Pingreq, *Pingresp, *Disconnect:
+		return nil
+	}
+	panic("unknown packet type")
+}
@@ -0,0 +1,58 @@
+// Copyright (c) 2016 The MQPP Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mqpp
+
+// fixedHeaderFlags are the flags each packet type must carry in its fixed header,
+// according to 3.1.1 section 2.2.2. Flags of PUBLISH are DUP, QoS and RETAIN,
+// checked by ValidateFixedHeader. Reserved packet types are absent.
+var fixedHeaderFlags = map[byte]byte{
+	TCONNECT:     0x00,
+	TCONNACK:     0x00,
+	TPUBLISH:     0x00,
+	TPUBACK:      0x00,
+	TPUBREC:      0x00,
+	TPUBREL:      0x02,
+	TPUBCOMP:     0x00,
+	TSUBSCRIBE:   0x02,
+	TSUBACK:      0x00,
+	TUNSUBSCRIBE: 0x02,
+	TUNSUBACK:    0x00,
+	TPINGREQ:     0x00,
+	TPINGRESP:    0x00,
+	TDISCONNECT:  0x00,
+}
+
+// ValidateFixedHeader checks the first byte of a packet: the packet type must not be
+// reserved, the flags must be the required ones, and for PUBLISH, QoS must not be 3
+// and DUP must be 0 for QoS 0.
+func ValidateFixedHeader(b byte) error {
+	t, flags := b>>4, b&0x0f
+	required, ok := fixedHeaderFlags[t]
+	if !ok {
+		return ErrReservedPacketType
+	}
+	if t != TPUBLISH {
+		if flags != required {
+			return ErrProtocolViolation
+		}
+		return nil
+	}
+
+	qos, dup := flags>>1&0x03, flags&0x08 != 0
+	if qos > QosExactlyOnce || (qos == QosAtMostOnce && dup) {
+		return ErrProtocolViolation
+	}
+	return nil
+}
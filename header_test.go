@@ -0,0 +1,76 @@
+// Copyright (c) 2016 The MQPP Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mqpp
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestValidateFixedHeader(t *testing.T) {
+	cases := []struct {
+		b      byte
+		expect error
+	}{
+		{0x00, ErrReservedPacketType},
+		{0xf0, ErrReservedPacketType},
+		{TCONNECT << 4, nil},
+		{TCONNECT<<4 | 0x01, ErrProtocolViolation},
+		{TPUBREL << 4, ErrProtocolViolation},
+		{TPUBREL<<4 | 0x02, nil},
+		{TSUBSCRIBE << 4, ErrProtocolViolation},
+		{TSUBSCRIBE<<4 | 0x02, nil},
+		{TUNSUBSCRIBE<<4 | 0x03, ErrProtocolViolation},
+		{TUNSUBSCRIBE<<4 | 0x02, nil},
+		{TPUBACK<<4 | 0x02, ErrProtocolViolation},
+		{TPUBLISH<<4 | 0x01, nil},                  // retain
+		{TPUBLISH<<4 | 0x0d, nil},                  // dup, qos 2, retain
+		{TPUBLISH<<4 | 0x06, ErrProtocolViolation}, // qos 3
+		{TPUBLISH<<4 | 0x08, ErrProtocolViolation}, // dup with qos 0
+	}
+	for _, c := range cases {
+		if err := ValidateFixedHeader(c.b); err != c.expect {
+			t.Errorf("%#02x: expect %v, got %v", c.b, c.expect, err)
+		}
+	}
+}
+
+func TestLenient(t *testing.T) {
+	qos3 := MakePublish(false, QosExactlyOnce, false, "a", 1, []byte("x")).Bytes()
+	qos3[0] |= 0x02
+	pubrel := MakePubrel(1).Bytes()
+	pubrel[0] &^= 0x02
+	data := append(append([]byte(nil), qos3...), pubrel...)
+
+	s := NewSplitter(bytes.NewReader(data))
+	for s.Scan() {
+		if _, err := s.Packet(); err != ErrProtocolViolation {
+			t.Fatalf("strict: expect ErrProtocolViolation, got %v", err)
+		}
+	}
+
+	s = NewSplitter(bytes.NewReader(data))
+	s.Lenient = true
+	p, err := s.NextPacket()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pub := p.(*Publish); pub.QoS() != 3 || pub.PacketIdentifier() != 1 || string(pub.Payload()) != "x" {
+		t.Fatalf("unexpected publish qos %d id %d payload %q", pub.QoS(), pub.PacketIdentifier(), pub.Payload())
+	}
+	if p, err = s.NextPacket(); err != nil || p.(*Pubrel).PacketIdentifier() != 1 {
+		t.Fatalf("unexpected %v, %v", p, err)
+	}
+}
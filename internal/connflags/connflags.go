@@ -0,0 +1,99 @@
+// Copyright (c) 2016 The MQPP Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package connflags declares the connection flags shared by mqpp-pub and mqpp-sub.
+package connflags
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"time"
+
+	"github.com/abo/mqpp"
+	"github.com/abo/mqpp/client"
+)
+
+// Flags are the fields of CONNECT, with the meaning of mqpp.MakeConnect's parameters
+type Flags struct {
+	Target       string
+	ClientID     string
+	Username     string
+	Password     string
+	KeepAlive    uint
+	CleanSession bool
+	WillTopic    string
+	WillMessage  string
+	WillQoS      uint
+	WillRetain   bool
+	Timeout      time.Duration
+}
+
+// Register declares the flags on fs, the client identifier defaults to prefix
+// followed by the process id.
+func Register(fs *flag.FlagSet, prefix string) *Flags {
+	f := &Flags{}
+	fs.StringVar(&f.Target, "target", "localhost:1883", "address of the broker")
+	fs.StringVar(&f.ClientID, "id", fmt.Sprintf("%s%d", prefix, os.Getpid()), "client identifier")
+	fs.StringVar(&f.Username, "u", "", "user name")
+	fs.StringVar(&f.Password, "P", "", "password")
+	fs.UintVar(&f.KeepAlive, "k", 60, "keep alive in seconds, 0 turns it off")
+	fs.BoolVar(&f.CleanSession, "clean", true, "start a clean session, and discard it on disconnect")
+	fs.StringVar(&f.WillTopic, "will-topic", "", "topic of the will message")
+	fs.StringVar(&f.WillMessage, "will-payload", "", "payload of the will message")
+	fs.UintVar(&f.WillQoS, "will-qos", 0, "QoS of the will message")
+	fs.BoolVar(&f.WillRetain, "will-retain", false, "retain the will message")
+	fs.DurationVar(&f.Timeout, "timeout", 10*time.Second, "bound of dialing, CONNECT/CONNACK handshake and acknowledgements")
+	return f
+}
+
+// Options checks the flags and converts them to client options
+func (f *Flags) Options() (client.Options, error) {
+	switch {
+	case f.KeepAlive > 65535:
+		return client.Options{}, errors.New("keep alive must be at most 65535 seconds")
+	case f.ClientID == "" && !f.CleanSession:
+		return client.Options{}, errors.New("a persistent session needs a client identifier")
+	case f.WillQoS > uint(mqpp.QosExactlyOnce):
+		return client.Options{}, errors.New("will QoS must be 0, 1 or 2")
+	case f.WillTopic != "" && !mqpp.ValidTopicName(f.WillTopic):
+		return client.Options{}, fmt.Errorf("invalid will topic %q", f.WillTopic)
+	case f.WillTopic == "" && (f.WillMessage != "" || f.WillQoS > 0 || f.WillRetain):
+		return client.Options{}, errors.New("will flags need a will topic")
+	case f.Password != "" && f.Username == "":
+		return client.Options{}, errors.New("a password needs a user name")
+	}
+
+	target, timeout := f.Target, f.Timeout
+	opts := client.Options{
+		Dial:           func() (net.Conn, error) { return net.DialTimeout("tcp", target, timeout) },
+		ClientID:       f.ClientID,
+		Username:       f.Username,
+		KeepAlive:      uint16(f.KeepAlive),
+		CleanSession:   f.CleanSession,
+		WillTopic:      f.WillTopic,
+		WillQoS:        byte(f.WillQoS),
+		WillRetain:     f.WillRetain,
+		ConnectTimeout: f.Timeout,
+	}
+	if f.Password != "" {
+		opts.Password = []byte(f.Password)
+	}
+	if f.WillTopic != "" {
+		opts.WillMessage = []byte(f.WillMessage)
+	}
+	return opts, nil
+}
@@ -0,0 +1,134 @@
+// Copyright (c) 2016 The MQPP Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package describe formats mqtt packets for humans, it's shared by the commands.
+package describe
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/abo/mqpp"
+)
+
+// Field is a decoded field of a packet, verbose ones are for detailed output only
+type Field struct {
+	Name    string
+	Value   interface{}
+	Verbose bool
+}
+
+// Fields decodes p into its fields in wire order, credentials are redacted
+func Fields(p mqpp.ControlPacket) []Field {
+	switch p := p.(type) {
+	case *mqpp.Connect:
+		fs := []Field{
+			{Name: "protocol", Value: fmt.Sprintf("%s/%d", p.ProtocolName(), p.ProtocolLevel())},
+			{Name: "client", Value: p.ClientIdentifier()},
+			{Name: "clean", Value: p.CleanSession()},
+			{Name: "keepalive", Value: p.KeepAlive()},
+		}
+		if p.WillFlag() {
+			fs = append(fs, Field{Name: "will", Value: p.WillTopic()},
+				Field{Name: "will_qos", Value: p.WillQoS()},
+				Field{Name: "will_retain", Value: p.WillRetain()},
+				Field{Name: "will_message", Value: p.WillMessage(), Verbose: true})
+		}
+		if p.UsernameFlag() {
+			fs = append(fs, Field{Name: "username", Value: p.Username()})
+		}
+		if p.PasswordFlag() {
+			fs = append(fs, Field{Name: "password", Value: "<redacted>"})
+		}
+		return fs
+	case *mqpp.Connack:
+		return []Field{
+			{Name: "session_present", Value: p.SessionPresent()},
+			{Name: "rc", Value: p.ReturnCode()},
+			{Name: "reason", Value: mqpp.ConnectReturnCodeResponses[p.ReturnCode()], Verbose: true},
+		}
+	case *mqpp.Publish:
+		fs := []Field{
+			{Name: "dup", Value: p.Dup()},
+			{Name: "qos", Value: p.QoS()},
+			{Name: "retain", Value: p.Retain()},
+			{Name: "topic", Value: p.TopicName()},
+		}
+		if p.QoS() > mqpp.QosAtMostOnce {
+			fs = append(fs, Field{Name: "id", Value: p.PacketIdentifier()})
+		}
+		return append(fs, Field{Name: "len", Value: len(p.Payload())},
+			Field{Name: "payload", Value: p.Payload(), Verbose: true})
+	case *mqpp.Puback:
+		return []Field{{Name: "id", Value: p.PacketIdentifier()}}
+	case *mqpp.Pubrec:
+		return []Field{{Name: "id", Value: p.PacketIdentifier()}}
+	case *mqpp.Pubrel:
+		return []Field{{Name: "id", Value: p.PacketIdentifier()}}
+	case *mqpp.Pubcomp:
+		return []Field{{Name: "id", Value: p.PacketIdentifier()}}
+	case *mqpp.Unsuback:
+		return []Field{{Name: "id", Value: p.PacketIdentifier()}}
+	case *mqpp.Subscribe:
+		var subs []string
+		for _, s := range p.Payload() {
+			subs = append(subs, fmt.Sprintf("%s:%d", s.TopicFilter, s.RequestedQoS))
+		}
+		return []Field{{Name: "id", Value: p.PacketIdentifier()}, {Name: "filters", Value: subs}}
+	case *mqpp.Suback:
+		codes := make([]int, len(p.ReturnCodes()))
+		for i, c := range p.ReturnCodes() {
+			codes[i] = int(c)
+		}
+		return []Field{{Name: "id", Value: p.PacketIdentifier()}, {Name: "codes", Value: codes}}
+	case *mqpp.Unsubscribe:
+		return []Field{{Name: "id", Value: p.PacketIdentifier()}, {Name: "filters", Value: p.Payload()}}
+	}
+	return nil
+}
+
+// Text formats v for a line of text output
+func Text(v interface{}) string {
+	switch v := v.(type) {
+	case string:
+		if v == "" || strings.ContainsAny(v, " \t\"=") || !strconv.CanBackquote(v) {
+			return strconv.Quote(v)
+		}
+		return v
+	case []byte:
+		return strconv.Quote(string(v))
+	case []string:
+		return strings.Join(v, ",")
+	case []int:
+		s := make([]string, len(v))
+		for i, n := range v {
+			s[i] = strconv.Itoa(n)
+		}
+		return strings.Join(s, ",")
+	}
+	return fmt.Sprint(v)
+}
+
+// Line formats p as its type followed by name=value pairs of its fields
+func Line(p mqpp.ControlPacket, verbose bool) string {
+	var b strings.Builder
+	b.WriteString(mqpp.TypeName(p.Type()))
+	for _, f := range Fields(p) {
+		if !f.Verbose || verbose {
+			b.WriteString(" " + f.Name + "=" + Text(f.Value))
+		}
+	}
+	return b.String()
+}
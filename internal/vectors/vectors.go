@@ -0,0 +1,160 @@
+// Copyright (c) 2016 The MQPP Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package vectors reads the encoding test vectors in testdata/vectors, it's shared by the
+// test suites. The format is described in testdata/vectors/README.md.
+package vectors
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Outcomes of parsing and splitting
+const (
+	OK                       = "ok"
+	Packet                   = "packet"
+	Incomplete               = "incomplete"
+	MalformedRemainingLength = "malformed-remaining-length"
+	ProtocolViolation        = "protocol-violation"
+	ReservedType             = "reserved-type"
+)
+
+// Vector is a packet encoding labelled with the expected outcomes
+type Vector struct {
+	Name     string // normative statement or section, and description
+	Line     int
+	Bytes    []byte
+	Parse    string            // outcome of strict parsing
+	Lenient  string            // outcome of lenient parsing
+	Split    string            // outcome of splitting the bytes as a stream
+	Violates []string          // rules broken by a parsed packet
+	Fields   map[string]string // expected fields of a parsed packet
+}
+
+// Rule returns the normative statement or section the vector is for
+func (v *Vector) Rule() string {
+	return strings.Fields(v.Name)[0]
+}
+
+// Load reads the vectors of file
+func Load(file string) ([]Vector, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return Read(f)
+}
+
+// Read reads vectors from r
+func Read(r io.Reader) ([]Vector, error) {
+	var vs []Vector
+	var v *Vector
+	end := func() error {
+		if v == nil {
+			return nil
+		}
+		if len(v.Bytes) == 0 || v.Parse == "" {
+			return fmt.Errorf("line %d: vector without bytes or parse", v.Line)
+		}
+		if v.Lenient == "" {
+			v.Lenient = v.Parse
+		}
+		if v.Split == "" {
+			v.Split = Packet
+		}
+		vs = append(vs, *v)
+		v = nil
+		return nil
+	}
+
+	s := bufio.NewScanner(r)
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			if err := end(); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		i := strings.Index(line, ":")
+		if i < 0 {
+			return nil, fmt.Errorf("line %d: expect key: value", n)
+		}
+		key, value := line[:i], strings.TrimSpace(line[i+1:])
+		if key == "vector" {
+			if err := end(); err != nil {
+				return nil, err
+			}
+			v = &Vector{Name: value, Line: n, Fields: make(map[string]string)}
+			continue
+		}
+		if v == nil {
+			return nil, fmt.Errorf("line %d: %s out of vector", n, key)
+		}
+		switch key {
+		case "bytes":
+			b, err := hex.DecodeString(strings.Join(strings.Fields(value), ""))
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %v", n, err)
+			}
+			v.Bytes = append(v.Bytes, b...)
+		case "parse":
+			v.Parse = value
+		case "lenient":
+			v.Lenient = value
+		case "split":
+			v.Split = value
+		case "violates":
+			v.Violates = append(v.Violates, strings.Fields(value)...)
+		default:
+			v.Fields[key] = value
+		}
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	if err := end(); err != nil {
+		return nil, err
+	}
+	return vs, nil
+}
+
+// Values splits the value of a field into words, quoted strings are unquoted
+func Values(value string) ([]string, error) {
+	var words []string
+	for value = strings.TrimSpace(value); value != ""; value = strings.TrimSpace(value) {
+		if value[0] != '"' {
+			i := strings.IndexAny(value, " \t")
+			if i < 0 {
+				i = len(value)
+			}
+			words, value = append(words, value[:i]), value[i:]
+			continue
+		}
+		quoted, err := strconv.QuotedPrefix(value)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", value, err)
+		}
+		word, _ := strconv.Unquote(quoted)
+		words, value = append(words, word), value[len(quoted):]
+	}
+	return words, nil
+}
@@ -0,0 +1,29 @@
+// Copyright (c) 2016 The MQPP Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mqpptest
+
+import "github.com/abo/mqpp/client"
+
+// Connect connects a client with opts, e.g. Dial set to broker.Broker.Dial, or
+// fails tb. The client is disconnected when the test ends.
+func Connect(tb TB, opts client.Options) *client.Client {
+	tb.Helper()
+	c := client.New(opts)
+	if err := c.Connect(); err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { c.Disconnect() })
+	return c
+}
@@ -0,0 +1,217 @@
+// Copyright (c) 2016 The MQPP Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mqpptest
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/abo/mqpp"
+	"github.com/abo/mqpp/internal/describe"
+)
+
+// Matcher checks fields of a packet
+type Matcher struct {
+	desc  string
+	match func(p mqpp.ControlPacket) error
+}
+
+func (m Matcher) String() string {
+	return m.desc
+}
+
+// Match returns why p doesn't match, or nil
+func (m Matcher) Match(p mqpp.ControlPacket) error {
+	return m.match(p)
+}
+
+// Func returns a matcher described by desc, matching packets which f returns true for
+func Func(desc string, f func(p mqpp.ControlPacket) bool) Matcher {
+	return Matcher{desc, func(p mqpp.ControlPacket) error {
+		if !f(p) {
+			return fmt.Errorf("not %s", desc)
+		}
+		return nil
+	}}
+}
+
+// Is matches packets of type t which match all of ms
+func Is(t byte, ms ...Matcher) Matcher {
+	desc := mqpp.TypeName(t)
+	if len(ms) > 0 {
+		descs := make([]string, len(ms))
+		for i, m := range ms {
+			descs[i] = m.desc
+		}
+		desc += " with " + strings.Join(descs, ", ")
+	}
+	return Matcher{desc, func(p mqpp.ControlPacket) error {
+		if p.Type() != t {
+			return fmt.Errorf("type %s", mqpp.TypeName(p.Type()))
+		}
+		for _, m := range ms {
+			if err := m.match(p); err != nil {
+				return err
+			}
+		}
+		return nil
+	}}
+}
+
+// field returns a matcher comparing a field of packets of type T, verb formats the values
+func field[T mqpp.ControlPacket](name, verb string, expect interface{}, get func(p T) interface{}) Matcher {
+	desc := fmt.Sprintf("%s "+verb, name, expect)
+	return Matcher{desc, func(p mqpp.ControlPacket) error {
+		pkt, ok := p.(T)
+		if !ok {
+			return fmt.Errorf("%s has no %s", mqpp.TypeName(p.Type()), name)
+		}
+		actual := get(pkt)
+		if b, ok := expect.([]byte); ok && bytes.Equal(b, actual.([]byte)) || reflect.DeepEqual(expect, actual) {
+			return nil
+		}
+		return fmt.Errorf("%s is "+verb, name, actual)
+	}}
+}
+
+// ClientID matches CONNECT with client identifier id
+func ClientID(id string) Matcher {
+	return field("client id", "%q", id, func(p *mqpp.Connect) interface{} { return p.ClientIdentifier() })
+}
+
+// Username matches CONNECT with user name
+func Username(username string) Matcher {
+	return field("username", "%q", username, func(p *mqpp.Connect) interface{} { return p.Username() })
+}
+
+// CleanSession matches CONNECT with the clean session flag
+func CleanSession(clean bool) Matcher {
+	return field("clean session", "%v", clean, func(p *mqpp.Connect) interface{} { return p.CleanSession() })
+}
+
+// WillTopic matches CONNECT with will topic, "" matches CONNECT without will
+func WillTopic(topic string) Matcher {
+	return field("will topic", "%q", topic, func(p *mqpp.Connect) interface{} { return p.WillTopic() })
+}
+
+// Topic matches PUBLISH with topic name
+func Topic(topic string) Matcher {
+	return field("topic", "%q", topic, func(p *mqpp.Publish) interface{} { return p.TopicName() })
+}
+
+// QoS matches PUBLISH of qos
+func QoS(qos byte) Matcher {
+	return field("qos", "%d", qos, func(p *mqpp.Publish) interface{} { return p.QoS() })
+}
+
+// Retain matches PUBLISH with the retain flag
+func Retain(retain bool) Matcher {
+	return field("retain", "%v", retain, func(p *mqpp.Publish) interface{} { return p.Retain() })
+}
+
+// Dup matches PUBLISH with the dup flag
+func Dup(dup bool) Matcher {
+	return field("dup", "%v", dup, func(p *mqpp.Publish) interface{} { return p.Dup() })
+}
+
+// Payload matches PUBLISH with payload
+func Payload(payload []byte) Matcher {
+	return field("payload", "%q", payload, func(p *mqpp.Publish) interface{} { return p.Payload() })
+}
+
+// PacketID matches packets with packet identifier id
+func PacketID(id uint16) Matcher {
+	desc := fmt.Sprintf("packet id %d", id)
+	return Matcher{desc, func(p mqpp.ControlPacket) error {
+		pkt, ok := p.(interface{ PacketIdentifier() uint16 })
+		if !ok {
+			return fmt.Errorf("%s has no packet id", mqpp.TypeName(p.Type()))
+		}
+		if actual := pkt.PacketIdentifier(); actual != id {
+			return fmt.Errorf("packet id is %d", actual)
+		}
+		return nil
+	}}
+}
+
+// Filters matches SUBSCRIBE and UNSUBSCRIBE with the topic filters, in order
+func Filters(filters ...string) Matcher {
+	desc := fmt.Sprintf("filters %q", filters)
+	return Matcher{desc, func(p mqpp.ControlPacket) error {
+		var actual []string
+		switch p := p.(type) {
+		case *mqpp.Subscribe:
+			for _, s := range p.Payload() {
+				actual = append(actual, s.TopicFilter)
+			}
+		case *mqpp.Unsubscribe:
+			actual = p.Payload()
+		default:
+			return fmt.Errorf("%s has no topic filters", mqpp.TypeName(p.Type()))
+		}
+		if len(actual) != len(filters) || (len(filters) > 0 && !reflect.DeepEqual(actual, filters)) {
+			return fmt.Errorf("filters are %q", actual)
+		}
+		return nil
+	}}
+}
+
+// Subscriptions matches SUBSCRIBE with the topic filters and requested qos, in order
+func Subscriptions(subs ...mqpp.Subscription) Matcher {
+	return field("subscriptions", "%v", subs, func(p *mqpp.Subscribe) interface{} { return p.Payload() })
+}
+
+// ReturnCodes matches SUBACK with return codes
+func ReturnCodes(codes ...byte) Matcher {
+	return field("return codes", "%v", codes, func(p *mqpp.Suback) interface{} { return p.ReturnCodes() })
+}
+
+// ReturnCode matches CONNACK with return code
+func ReturnCode(code byte) Matcher {
+	return field("return code", "%d", code, func(p *mqpp.Connack) interface{} { return p.ReturnCode() })
+}
+
+// MatchSequence checks pkts matches ms one by one
+func MatchSequence(pkts []mqpp.ControlPacket, ms ...Matcher) error {
+	for i, m := range ms {
+		if i >= len(pkts) {
+			return fmt.Errorf("mqpptest: no.%d: expect %s, got nothing\nsequence:%s", i+1, m, lines(pkts))
+		}
+		if err := m.match(pkts[i]); err != nil {
+			return fmt.Errorf("mqpptest: no.%d: expect %s: %v\nsequence:%s", i+1, m, err, lines(pkts))
+		}
+	}
+	if len(pkts) > len(ms) {
+		return fmt.Errorf("mqpptest: no.%d: expect nothing more, got %s\nsequence:%s", len(ms)+1, describe.Line(pkts[len(ms)], true), lines(pkts))
+	}
+	return nil
+}
+
+// TB is the part of testing.TB used by AssertSequence and Connect
+type TB interface {
+	Helper()
+	Fatal(args ...interface{})
+	Cleanup(func())
+}
+
+// AssertSequence fails tb if pkts don't match ms one by one
+func AssertSequence(tb TB, pkts []mqpp.ControlPacket, ms ...Matcher) {
+	tb.Helper()
+	if err := MatchSequence(pkts, ms...); err != nil {
+		tb.Fatal(err)
+	}
+}
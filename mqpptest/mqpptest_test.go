@@ -0,0 +1,161 @@
+// Copyright (c) 2016 The MQPP Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mqpptest
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/abo/mqpp"
+	"github.com/abo/mqpp/client"
+)
+
+func dial(conns ...net.Conn) func() (net.Conn, error) {
+	return func() (net.Conn, error) {
+		c := conns[0]
+		conns = conns[1:]
+		return c, nil
+	}
+}
+
+func TestPeerScript(t *testing.T) {
+	peer, conn := Pipe()
+	acked := make(chan struct{})
+	done := peer.Go(
+		Expect(mqpp.TCONNECT, ClientID("cid"), CleanSession(true), WillTopic("")).Reply(mqpp.MakeConnack(false, mqpp.Accepted)),
+		Expect(mqpp.TSUBSCRIBE, Filters("a/+")).Ack(),
+		Expect(mqpp.TPUBLISH, Topic("a/b"), QoS(mqpp.QosExactlyOnce), Payload([]byte("out"))).Ack(),
+		Expect(mqpp.TPUBREL).Ack(),
+		Send(mqpp.MakePublish(false, mqpp.QosAtLeastOnce, false, "a/c", 9, []byte("in"))),
+		Expect(mqpp.TPUBACK, PacketID(9)),
+		Do(func() error { close(acked); return nil }),
+		Expect(mqpp.TDISCONNECT),
+		ExpectClose(),
+	)
+
+	received := make(chan *mqpp.Publish, 1)
+	c := client.New(client.Options{ClientID: "cid", CleanSession: true, Dial: dial(conn)})
+	if err := c.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Subscribe(func(c *client.Client, p *mqpp.Publish) { received <- p },
+		mqpp.Subscription{TopicFilter: "a/+", RequestedQoS: mqpp.QosAtLeastOnce}).WaitTimeout(time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Publish("a/b", mqpp.QosExactlyOnce, false, []byte("out")).WaitTimeout(time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if p := <-received; string(p.Payload()) != "in" {
+		t.Fatalf("unexpected %v", p)
+	}
+	<-acked // PUBACK is sent after the handler
+	c.Disconnect()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	AssertSequence(t, peer.Received(),
+		Is(mqpp.TCONNECT),
+		Is(mqpp.TSUBSCRIBE, Subscriptions(mqpp.Subscription{TopicFilter: "a/+", RequestedQoS: mqpp.QosAtLeastOnce})),
+		Is(mqpp.TPUBLISH, Dup(false), Retain(false)),
+		Is(mqpp.TPUBREL),
+		Is(mqpp.TPUBACK),
+		Is(mqpp.TDISCONNECT),
+	)
+}
+
+func TestPeerUnexpected(t *testing.T) {
+	peer, conn := Pipe()
+	defer peer.Close()
+	conn.SetWriteDeadline(time.Now().Add(time.Second))
+	for i := 0; i < 200; i++ {
+		if _, err := mqpp.MakePingreq().WriteTo(conn); err != nil {
+			t.Fatalf("write %d blocked: %v", i, err)
+		}
+	}
+	conn.Close()
+	for i := 0; i < 200; i++ {
+		if _, err := peer.Expect(mqpp.TPINGREQ); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := peer.ExpectClose(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPeerDiagnostics(t *testing.T) {
+	peer, conn := Pipe()
+	peer.Timeout = 50 * time.Millisecond
+	done := peer.Go(
+		Expect(mqpp.TCONNECT, ClientID("other")),
+	)
+	c := client.New(client.Options{ClientID: "cid", Dial: dial(conn), ConnectTimeout: 100 * time.Millisecond})
+	go c.Connect()
+	err := <-done
+	if err == nil {
+		t.Fatal("expect mismatch")
+	}
+	msg := err.Error()
+	if !strings.Contains(msg, `step 1: expect CONNECT with client id "other"`) || !strings.Contains(msg, `client id is "cid"`) || !strings.Contains(msg, "1. CONNECT") {
+		t.Fatalf("unexpected diagnostics: %s", msg)
+	}
+
+	peer, conn = Pipe()
+	peer.Timeout = 50 * time.Millisecond
+	defer conn.Close()
+	err = peer.Run(Expect(mqpp.TPINGREQ))
+	if se, ok := err.(*StepError); !ok || se.Step != 1 || !strings.Contains(err.Error(), "nothing received in 50ms") {
+		t.Fatalf("expect timeout, got %v", err)
+	}
+}
+
+func TestMatchSequence(t *testing.T) {
+	sub := mqpp.MakeSubscribe(1, []mqpp.Subscription{{TopicFilter: "a"}})
+	puback := mqpp.MakePuback(2)
+	pkts := []mqpp.ControlPacket{&sub, &puback}
+
+	if err := MatchSequence(pkts, Is(mqpp.TSUBSCRIBE, PacketID(1), Filters("a")), Is(mqpp.TPUBACK, PacketID(2))); err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		ms     []Matcher
+		expect string
+	}{
+		{[]Matcher{Is(mqpp.TSUBSCRIBE)}, "no.2: expect nothing more, got PUBACK"},
+		{[]Matcher{Is(mqpp.TSUBSCRIBE), Is(mqpp.TPUBACK), Is(mqpp.TPINGREQ)}, "no.3: expect PINGREQ, got nothing"},
+		{[]Matcher{Is(mqpp.TSUBSCRIBE), Is(mqpp.TPUBACK, Topic("a"))}, "PUBACK has no topic"},
+		{[]Matcher{Is(mqpp.TSUBSCRIBE, Filters("b")), Is(mqpp.TPUBACK)}, `filters are ["a"]`},
+		{[]Matcher{Is(mqpp.TPUBACK)}, "type SUBSCRIBE"},
+	}
+	for _, c := range cases {
+		if err := MatchSequence(pkts, c.ms...); err == nil || !strings.Contains(err.Error(), c.expect) {
+			t.Errorf("expect %s, got %v", c.expect, err)
+		}
+	}
+}
+
+func TestAck(t *testing.T) {
+	sub := mqpp.MakeSubscribe(3, []mqpp.Subscription{{TopicFilter: "a", RequestedQoS: 1}, {TopicFilter: "b", RequestedQoS: 2}})
+	qos0 := mqpp.MakePublish(false, mqpp.QosAtMostOnce, false, "a", 0, nil)
+	if err := MatchSequence(Ack(&sub), Is(mqpp.TSUBACK, PacketID(3), ReturnCodes(1, 2))); err != nil {
+		t.Fatal(err)
+	}
+	if acks := Ack(&qos0); len(acks) != 0 {
+		t.Fatalf("unexpected %v", acks)
+	}
+}
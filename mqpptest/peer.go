@@ -0,0 +1,243 @@
+// Copyright (c) 2016 The MQPP Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package mqpptest provides a scripted MQTT peer for testing components built on mqpp.
+//
+// A Peer plays one end of a connection, usually a net.Pipe, and runs steps in order:
+//
+//	peer, conn := mqpptest.Pipe()
+//	done := peer.Go(
+//		mqpptest.Expect(mqpp.TCONNECT, mqpptest.ClientID("cid")).Reply(mqpp.MakeConnack(false, mqpp.Accepted)),
+//		mqpptest.Expect(mqpp.TSUBSCRIBE, mqpptest.Filters("a/+")).Ack(),
+//		mqpptest.Expect(mqpp.TDISCONNECT),
+//		mqpptest.ExpectClose(),
+//	)
+//	// drive the component under test over conn
+//	if err := <-done; err != nil {
+//		t.Fatal(err)
+//	}
+package mqpptest
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/abo/mqpp"
+	"github.com/abo/mqpp/internal/describe"
+)
+
+// DefaultTimeout bounds waiting for each expected packet when Peer.Timeout is zero
+const DefaultTimeout = time.Second
+
+// errClosed ends the incoming packets when the connection is closed
+var errClosed = errors.New("connection closed")
+
+// incoming is a packet received, or the error which stopped receiving
+type incoming struct {
+	p   mqpp.ControlPacket
+	err error
+}
+
+// Peer is a scripted MQTT peer. It receives packets in background from the start
+// and queues them without bound, so the component under test never blocks on writing.
+type Peer struct {
+	// Timeout bounds waiting for each expected packet, DefaultTimeout if zero
+	Timeout time.Duration
+
+	conn  net.Conn
+	ready chan struct{} // signaled when the queue grows
+
+	mu       sync.Mutex
+	received []mqpp.ControlPacket
+	queue    []incoming // not expected yet
+	ended    bool       // receiving stopped, the last of queue is the reason
+}
+
+// Pipe returns a peer on one end of a net.Pipe, and the other end for the component under test
+func Pipe() (*Peer, net.Conn) {
+	c, s := net.Pipe()
+	return NewPeer(s), c
+}
+
+// NewPeer returns a peer playing on conn
+func NewPeer(conn net.Conn) *Peer {
+	p := &Peer{conn: conn, ready: make(chan struct{}, 1)}
+	go p.receive()
+	return p
+}
+
+func (p *Peer) receive() {
+	s := mqpp.NewSplitter(p.conn)
+	s.Buffer(make([]byte, 4096), mqpp.MaxPacketSize)
+	for s.Scan() {
+		pkt, err := mqpp.Parse(append([]byte(nil), s.Bytes()...))
+		if err != nil {
+			p.push(incoming{err: fmt.Errorf("% x: %v", s.Bytes(), err)})
+			return
+		}
+		p.push(incoming{p: pkt})
+	}
+	err := s.Err()
+	if err == nil || errors.Is(err, io.ErrClosedPipe) || errors.Is(err, net.ErrClosed) {
+		err = errClosed
+	}
+	p.push(incoming{err: err})
+}
+
+func (p *Peer) push(in incoming) {
+	p.mu.Lock()
+	if in.p != nil {
+		p.received = append(p.received, in.p)
+	} else {
+		p.ended = true
+	}
+	p.queue = append(p.queue, in)
+	p.mu.Unlock()
+	select {
+	case p.ready <- struct{}{}:
+	default:
+	}
+}
+
+// Conn returns the connection the peer plays on
+func (p *Peer) Conn() net.Conn {
+	return p.conn
+}
+
+// Received returns all packets received so far, in order
+func (p *Peer) Received() []mqpp.ControlPacket {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]mqpp.ControlPacket(nil), p.received...)
+}
+
+// Close closes the connection
+func (p *Peer) Close() error {
+	return p.conn.Close()
+}
+
+// Send writes packets to the component
+func (p *Peer) Send(pkts ...mqpp.ControlPacket) error {
+	for _, pkt := range pkts {
+		if _, err := pkt.WriteTo(p.conn); err != nil {
+			return fmt.Errorf("send %s: %v", describe.Line(pkt, false), err)
+		}
+	}
+	return nil
+}
+
+// Expect waits for the next packet and checks it's of type t and matches ms
+func (p *Peer) Expect(t byte, ms ...Matcher) (mqpp.ControlPacket, error) {
+	m := Is(t, ms...)
+	in, err := p.next()
+	if err != nil {
+		return nil, fmt.Errorf("expect %s: %v", m, err)
+	}
+	if in.err != nil {
+		return nil, fmt.Errorf("expect %s: %v", m, in.err)
+	}
+	if err := m.match(in.p); err != nil {
+		return nil, fmt.Errorf("expect %s, got %s: %v", m, describe.Line(in.p, true), err)
+	}
+	return in.p, nil
+}
+
+// ExpectClose waits for the component to close the connection
+func (p *Peer) ExpectClose() error {
+	in, err := p.next()
+	if err != nil {
+		return fmt.Errorf("expect connection closed: %v", err)
+	}
+	if in.p != nil {
+		return fmt.Errorf("expect connection closed, got %s", describe.Line(in.p, true))
+	}
+	if in.err != errClosed {
+		return fmt.Errorf("expect connection closed, got %v", in.err)
+	}
+	return nil
+}
+
+func (p *Peer) next() (incoming, error) {
+	timeout := p.Timeout
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+	expire := time.After(timeout)
+	for {
+		p.mu.Lock()
+		if len(p.queue) > 0 {
+			in := p.queue[0]
+			p.queue = p.queue[1:]
+			p.mu.Unlock()
+			return in, nil
+		}
+		ended := p.ended
+		p.mu.Unlock()
+		if ended {
+			return incoming{err: errClosed}, nil
+		}
+		select {
+		case <-p.ready:
+		case <-expire:
+			return incoming{}, fmt.Errorf("nothing received in %v", timeout)
+		}
+	}
+}
+
+// Run runs steps in order, it stops at the first failure and returns it, with the
+// packets received till then.
+func (p *Peer) Run(steps ...Step) error {
+	for i, s := range steps {
+		if err := s.run(p); err != nil {
+			return &StepError{Step: i + 1, Err: err, Received: p.Received()}
+		}
+	}
+	return nil
+}
+
+// Go runs steps in background, the returned channel receives the result of Run
+func (p *Peer) Go(steps ...Step) <-chan error {
+	done := make(chan error, 1)
+	go func() {
+		done <- p.Run(steps...)
+	}()
+	return done
+}
+
+// StepError is the failure of a step
+type StepError struct {
+	Step     int // from 1
+	Err      error
+	Received []mqpp.ControlPacket
+}
+
+func (e *StepError) Error() string {
+	return fmt.Sprintf("mqpptest: step %d: %v\nreceived:%s", e.Step, e.Err, lines(e.Received))
+}
+
+func lines(pkts []mqpp.ControlPacket) string {
+	if len(pkts) == 0 {
+		return " nothing"
+	}
+	var b strings.Builder
+	for i, pkt := range pkts {
+		fmt.Fprintf(&b, "\n\t%d. %s", i+1, describe.Line(pkt, true))
+	}
+	return b.String()
+}
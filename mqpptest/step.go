@@ -0,0 +1,138 @@
+// Copyright (c) 2016 The MQPP Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mqpptest
+
+import (
+	"time"
+
+	"github.com/abo/mqpp"
+)
+
+// Step is an action of a script run by Peer
+type Step struct {
+	run    func(p *Peer) error
+	expect func(p *Peer) (mqpp.ControlPacket, error) // set by Expect
+}
+
+// Expect is a step waiting for the next packet of type t matching ms
+func Expect(t byte, ms ...Matcher) Step {
+	expect := func(p *Peer) (mqpp.ControlPacket, error) {
+		return p.Expect(t, ms...)
+	}
+	return Step{run: func(p *Peer) error {
+		_, err := expect(p)
+		return err
+	}, expect: expect}
+}
+
+// ExpectClose is a step waiting for the component to close the connection
+func ExpectClose() Step {
+	return Step{run: (*Peer).ExpectClose}
+}
+
+// Send is a step sending packets
+func Send(pkts ...mqpp.ControlPacket) Step {
+	return Step{run: func(p *Peer) error {
+		return p.Send(pkts...)
+	}}
+}
+
+// Close is a step closing the connection
+func Close() Step {
+	return Step{run: (*Peer).Close}
+}
+
+// Sleep is a step pausing the script
+func Sleep(d time.Duration) Step {
+	return Step{run: func(p *Peer) error {
+		time.Sleep(d)
+		return nil
+	}}
+}
+
+// Do is a step calling f, e.g. to signal the test or trigger the component
+func Do(f func() error) Step {
+	return Step{run: func(p *Peer) error {
+		return f()
+	}}
+}
+
+// Reply replies pkts to the packet expected by s, s must be made by Expect
+func (s Step) Reply(pkts ...mqpp.ControlPacket) Step {
+	return s.ReplyWith(func(mqpp.ControlPacket) []mqpp.ControlPacket { return pkts })
+}
+
+// ReplyWith replies packets returned by f, which is called with the packet expected by s.
+// s must be made by Expect.
+func (s Step) ReplyWith(f func(p mqpp.ControlPacket) []mqpp.ControlPacket) Step {
+	if s.expect == nil {
+		panic("mqpptest: reply to a step not made by Expect")
+	}
+	return Step{run: func(p *Peer) error {
+		pkt, err := s.expect(p)
+		if err != nil {
+			return err
+		}
+		return p.Send(f(pkt)...)
+	}}
+}
+
+// Ack replies Ack of the packet expected by s, s must be made by Expect
+func (s Step) Ack() Step {
+	return s.ReplyWith(Ack)
+}
+
+// Ack returns the acknowledgement a server or client sends for p, nothing if it needs none.
+// CONNECT is accepted, and SUBSCRIBE is granted the requested qos.
+func Ack(p mqpp.ControlPacket) []mqpp.ControlPacket {
+	var ack mqpp.ControlPacket
+	switch p := p.(type) {
+	case *mqpp.Connect:
+		connack := mqpp.MakeConnack(false, mqpp.Accepted)
+		ack = &connack
+	case *mqpp.Publish:
+		switch p.QoS() {
+		case mqpp.QosAtLeastOnce:
+			puback := mqpp.MakePuback(p.PacketIdentifier())
+			ack = &puback
+		case mqpp.QosExactlyOnce:
+			pubrec := mqpp.MakePubrec(p.PacketIdentifier())
+			ack = &pubrec
+		}
+	case *mqpp.Pubrec:
+		pubrel := mqpp.MakePubrel(p.PacketIdentifier())
+		ack = &pubrel
+	case *mqpp.Pubrel:
+		pubcomp := mqpp.MakePubcomp(p.PacketIdentifier())
+		ack = &pubcomp
+	case *mqpp.Subscribe:
+		var codes []byte
+		for _, s := range p.Payload() {
+			codes = append(codes, s.RequestedQoS)
+		}
+		suback := mqpp.MakeSuback(p.PacketIdentifier(), codes)
+		ack = &suback
+	case *mqpp.Unsubscribe:
+		unsuback := mqpp.MakeUnsuback(p.PacketIdentifier())
+		ack = &unsuback
+	case *mqpp.Pingreq:
+		pingresp := mqpp.MakePingresp()
+		ack = &pingresp
+	}
+	if ack == nil {
+		return nil
+	}
+	return []mqpp.ControlPacket{ack}
+}
@@ -26,6 +26,10 @@ const (
 	ProtocolLevel byte   = 4
 )
 
+// MaxPacketSize is the largest packet allowed by MQTT, 4 bytes remaining length
+// of 268435455 plus fixed header byte
+const MaxPacketSize = 268435455 + 5
+
 // MQTT Control Packet types
 const (
 	TCONNECT byte = iota + 1
@@ -44,6 +48,47 @@ const (
 	TDISCONNECT
 )
 
+var packetTypeNames = map[byte]string{
+	TCONNECT:     "CONNECT",
+	TCONNACK:     "CONNACK",
+	TPUBLISH:     "PUBLISH",
+	TPUBACK:      "PUBACK",
+	TPUBREC:      "PUBREC",
+	TPUBREL:      "PUBREL",
+	TPUBCOMP:     "PUBCOMP",
+	TSUBSCRIBE:   "SUBSCRIBE",
+	TSUBACK:      "SUBACK",
+	TUNSUBSCRIBE: "UNSUBSCRIBE",
+	TUNSUBACK:    "UNSUBACK",
+	TPINGREQ:     "PINGREQ",
+	TPINGRESP:    "PINGRESP",
+	TDISCONNECT:  "DISCONNECT",
+}
+
+// TypeName returns the name of control packet type t, e.g. "CONNECT"
+func TypeName(t byte) string {
+	if name, ok := packetTypeNames[t]; ok {
+		return name
+	}
+	return fmt.Sprintf("RESERVED(%d)", t)
+}
+
+// Direction of a packet within a connection
+type Direction byte
+
+// Directions
+const (
+	ClientToServer Direction = iota
+	ServerToClient
+)
+
+func (d Direction) String() string {
+	if d == ClientToServer {
+		return "client->server"
+	}
+	return "server->client"
+}
+
 // QoS definitions
 const (
 	QosAtMostOnce byte = iota
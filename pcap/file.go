@@ -0,0 +1,281 @@
+// Copyright (c) 2016 The MQPP Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package pcap reads pcap and pcapng capture files without libpcap, reassembles
+// TCP streams, and extracts MQTT packets of every direction of every flow.
+package pcap
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+	"time"
+)
+
+// Link types of captured frames
+const (
+	LinkTypeNull     uint16 = 0   // BSD loopback, 4 bytes protocol family in host order
+	LinkTypeEthernet uint16 = 1   // IEEE 802.3 Ethernet
+	LinkTypeRaw      uint16 = 101 // raw IPv4 or IPv6
+	LinkTypeLinuxSLL uint16 = 113 // Linux cooked capture v1
+	LinkTypeIPv4     uint16 = 228
+	LinkTypeIPv6     uint16 = 229
+)
+
+// pcap magic numbers, as read in little endian
+const (
+	magicMicro      uint32 = 0xa1b2c3d4
+	magicNano       uint32 = 0xa1b23c4d
+	magicMicroSwap  uint32 = 0xd4c3b2a1
+	magicNanoSwap   uint32 = 0x4d3cb2a1
+	magicPcapngSHB  uint32 = 0x0a0d0d0a
+	pcapngByteOrder uint32 = 0x1a2b3c4d
+)
+
+// pcapng block types
+const (
+	blockSectionHeader  uint32 = 0x0a0d0d0a
+	blockInterface      uint32 = 0x00000001
+	blockPacket         uint32 = 0x00000002 // obsolete
+	blockSimplePacket   uint32 = 0x00000003
+	blockEnhancedPacket uint32 = 0x00000006
+	optionEndOfOpt      uint16 = 0
+	optionIfTsresol     uint16 = 9
+	maxBlockLength      uint32 = 64 << 20
+	defaultTsresol      byte   = 6
+)
+
+// ErrFormat - the file is neither pcap nor pcapng, or it's corrupt
+var ErrFormat = errors.New("mqpp/pcap: Invalid Capture File")
+
+// Frame is a captured link layer frame
+type Frame struct {
+	Timestamp time.Time
+	LinkType  uint16
+	Data      []byte
+}
+
+// FileReader reads frames of a pcap or pcapng file
+type FileReader struct {
+	r     *bufio.Reader
+	ng    bool
+	order binary.ByteOrder
+
+	// pcap
+	linkType uint16
+	nano     bool
+
+	// pcapng
+	ifaces []iface
+}
+
+// iface is a pcapng interface description
+type iface struct {
+	linkType uint16
+	tsresol  byte // if_tsresol, 10^-n seconds, or 2^-n when the most significant bit set
+}
+
+// NewFileReader detects the format of r and reads its header
+func NewFileReader(r io.Reader) (*FileReader, error) {
+	fr := &FileReader{r: bufio.NewReaderSize(r, 64<<10)}
+	head, err := fr.r.Peek(4)
+	if err != nil {
+		return nil, ErrFormat
+	}
+
+	switch binary.LittleEndian.Uint32(head) {
+	case magicPcapngSHB:
+		fr.ng = true
+		return fr, nil
+	case magicMicro:
+		fr.order = binary.LittleEndian
+	case magicNano:
+		fr.order, fr.nano = binary.LittleEndian, true
+	case magicMicroSwap:
+		fr.order = binary.BigEndian
+	case magicNanoSwap:
+		fr.order, fr.nano = binary.BigEndian, true
+	default:
+		return nil, ErrFormat
+	}
+
+	header := make([]byte, 24)
+	if _, err := io.ReadFull(fr.r, header); err != nil {
+		return nil, ErrFormat
+	}
+	fr.linkType = uint16(fr.order.Uint32(header[20:24]))
+	return fr, nil
+}
+
+// Next returns the next frame, or io.EOF at the end of file
+func (fr *FileReader) Next() (*Frame, error) {
+	if fr.ng {
+		return fr.nextBlock()
+	}
+
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(fr.r, header); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return nil, ErrFormat
+		}
+		return nil, err
+	}
+	sec, frac := fr.order.Uint32(header[0:4]), fr.order.Uint32(header[4:8])
+	capLen := fr.order.Uint32(header[8:12])
+	if capLen > maxBlockLength {
+		return nil, ErrFormat
+	}
+	data := make([]byte, capLen)
+	if _, err := io.ReadFull(fr.r, data); err != nil {
+		return nil, ErrFormat
+	}
+	nsec := int64(frac) * 1000
+	if fr.nano {
+		nsec = int64(frac)
+	}
+	return &Frame{Timestamp: time.Unix(int64(sec), nsec), LinkType: fr.linkType, Data: data}, nil
+}
+
+// nextBlock reads pcapng blocks until a packet block
+func (fr *FileReader) nextBlock() (*Frame, error) {
+	for {
+		head := make([]byte, 8)
+		if _, err := io.ReadFull(fr.r, head); err != nil {
+			if err == io.ErrUnexpectedEOF {
+				return nil, ErrFormat
+			}
+			return nil, err
+		}
+
+		if binary.LittleEndian.Uint32(head[0:4]) == blockSectionHeader {
+			// byte order of a section is decided by its own header
+			bom := make([]byte, 4)
+			if _, err := io.ReadFull(fr.r, bom); err != nil {
+				return nil, ErrFormat
+			}
+			switch binary.LittleEndian.Uint32(bom) {
+			case pcapngByteOrder:
+				fr.order = binary.LittleEndian
+			case 0x4d3c2b1a:
+				fr.order = binary.BigEndian
+			default:
+				return nil, ErrFormat
+			}
+			length := fr.order.Uint32(head[4:8])
+			if length < 16 || length > maxBlockLength {
+				return nil, ErrFormat
+			}
+			if _, err := io.CopyN(io.Discard, fr.r, int64(length-12)); err != nil {
+				return nil, ErrFormat
+			}
+			fr.ifaces = nil
+			continue
+		}
+		if fr.order == nil {
+			return nil, ErrFormat
+		}
+
+		typ, length := fr.order.Uint32(head[0:4]), fr.order.Uint32(head[4:8])
+		if length < 12 || length > maxBlockLength || length%4 != 0 {
+			return nil, ErrFormat
+		}
+		body := make([]byte, length-12)
+		if _, err := io.ReadFull(fr.r, body); err != nil {
+			return nil, ErrFormat
+		}
+		if _, err := io.CopyN(io.Discard, fr.r, 4); err != nil { // trailing block length
+			return nil, ErrFormat
+		}
+
+		switch typ {
+		case blockInterface:
+			if len(body) < 8 {
+				return nil, ErrFormat
+			}
+			fr.ifaces = append(fr.ifaces, iface{linkType: fr.order.Uint16(body[0:2]), tsresol: fr.tsresol(body[8:])})
+		case blockEnhancedPacket, blockPacket:
+			if len(body) < 20 {
+				return nil, ErrFormat
+			}
+			id := fr.order.Uint32(body[0:4])
+			if typ == blockPacket {
+				id = uint32(fr.order.Uint16(body[0:2]))
+			}
+			if int(id) >= len(fr.ifaces) {
+				return nil, ErrFormat
+			}
+			capLen := fr.order.Uint32(body[12:16])
+			if int(capLen) > len(body)-20 {
+				return nil, ErrFormat
+			}
+			ts := uint64(fr.order.Uint32(body[4:8]))<<32 | uint64(fr.order.Uint32(body[8:12]))
+			return &Frame{
+				Timestamp: fr.ifaces[id].timestamp(ts),
+				LinkType:  fr.ifaces[id].linkType,
+				Data:      body[20 : 20+capLen],
+			}, nil
+		case blockSimplePacket:
+			if len(body) < 4 || len(fr.ifaces) == 0 {
+				return nil, ErrFormat
+			}
+			capLen := fr.order.Uint32(body[0:4])
+			if int(capLen) > len(body)-4 {
+				capLen = uint32(len(body) - 4)
+			}
+			return &Frame{LinkType: fr.ifaces[0].linkType, Data: body[4 : 4+capLen]}, nil
+		}
+	}
+}
+
+// tsresol finds if_tsresol in interface options
+func (fr *FileReader) tsresol(options []byte) byte {
+	for len(options) >= 4 {
+		code, l := fr.order.Uint16(options[0:2]), int(fr.order.Uint16(options[2:4]))
+		if code == optionEndOfOpt || len(options) < 4+l {
+			break
+		}
+		if code == optionIfTsresol && l >= 1 {
+			return options[4]
+		}
+		options = options[4+(l+3)/4*4:]
+	}
+	return defaultTsresol
+}
+
+func (i iface) timestamp(ts uint64) time.Time {
+	if i.tsresol&0x80 != 0 {
+		sec := float64(ts) * math.Pow(2, -float64(i.tsresol&0x7f))
+		whole := math.Floor(sec)
+		return time.Unix(int64(whole), int64((sec-whole)*1e9))
+	}
+
+	digits := int(i.tsresol)
+	if digits > 19 {
+		return time.Time{}
+	}
+	unit := uint64(1)
+	for n := 0; n < digits; n++ {
+		unit *= 10
+	}
+	sec, frac := ts/unit, ts%unit
+	for n := digits; n < 9; n++ {
+		frac *= 10
+	}
+	for n := 9; n < digits; n++ {
+		frac /= 10
+	}
+	return time.Unix(int64(sec), int64(frac))
+}
@@ -0,0 +1,166 @@
+// Copyright (c) 2016 The MQPP Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pcap
+
+import (
+	"encoding/binary"
+	"net/netip"
+)
+
+// ether types
+const (
+	etherTypeIPv4  uint16 = 0x0800
+	etherTypeIPv6  uint16 = 0x86dd
+	etherTypeVLAN  uint16 = 0x8100
+	etherTypeQinQ  uint16 = 0x88a8
+	ipProtocolTCP  byte   = 6
+	tcpFlagFIN     byte   = 0x01
+	tcpFlagSYN     byte   = 0x02
+	tcpFlagRST     byte   = 0x04
+	tcpFlagACK     byte   = 0x10
+	ipv4MoreFrags  uint16 = 0x2000
+	ipv4FragOffset uint16 = 0x1fff
+)
+
+// segment is a decoded TCP segment
+type segment struct {
+	src, dst netip.AddrPort
+	seq      uint32
+	flags    byte
+	payload  []byte
+}
+
+// decodeFrame decodes a TCP segment carried by f, ok is false for anything else
+func decodeFrame(f *Frame) (*segment, bool) {
+	data := f.Data
+	switch f.LinkType {
+	case LinkTypeEthernet:
+		if len(data) < 14 {
+			return nil, false
+		}
+		etherType, data := binary.BigEndian.Uint16(data[12:14]), data[14:]
+		for etherType == etherTypeVLAN || etherType == etherTypeQinQ {
+			if len(data) < 4 {
+				return nil, false
+			}
+			etherType, data = binary.BigEndian.Uint16(data[2:4]), data[4:]
+		}
+		return decodeEtherType(etherType, data)
+	case LinkTypeLinuxSLL:
+		if len(data) < 16 {
+			return nil, false
+		}
+		return decodeEtherType(binary.BigEndian.Uint16(data[14:16]), data[16:])
+	case LinkTypeNull:
+		if len(data) < 4 {
+			return nil, false
+		}
+		family := binary.LittleEndian.Uint32(data[0:4])
+		if family > 0xffff {
+			family = binary.BigEndian.Uint32(data[0:4])
+		}
+		switch family {
+		case 2: // AF_INET
+			return decodeIPv4(data[4:])
+		case 24, 28, 30: // AF_INET6 of BSDs and darwin
+			return decodeIPv6(data[4:])
+		}
+	case LinkTypeRaw, LinkTypeIPv4, LinkTypeIPv6:
+		if len(data) < 1 {
+			return nil, false
+		}
+		switch data[0] >> 4 {
+		case 4:
+			return decodeIPv4(data)
+		case 6:
+			return decodeIPv6(data)
+		}
+	}
+	return nil, false
+}
+
+func decodeEtherType(etherType uint16, data []byte) (*segment, bool) {
+	switch etherType {
+	case etherTypeIPv4:
+		return decodeIPv4(data)
+	case etherTypeIPv6:
+		return decodeIPv6(data)
+	}
+	return nil, false
+}
+
+func decodeIPv4(data []byte) (*segment, bool) {
+	if len(data) < 20 || data[0]>>4 != 4 {
+		return nil, false
+	}
+	ihl := int(data[0]&0x0f) * 4
+	total := int(binary.BigEndian.Uint16(data[2:4]))
+	frag := binary.BigEndian.Uint16(data[6:8])
+	if ihl < 20 || total < ihl || len(data) < ihl || data[9] != ipProtocolTCP || frag&(ipv4MoreFrags|ipv4FragOffset) != 0 {
+		// fragments are not reassembled
+		return nil, false
+	}
+	if total < len(data) { // ethernet padding
+		data = data[:total]
+	}
+	src, _ := netip.AddrFromSlice(data[12:16])
+	dst, _ := netip.AddrFromSlice(data[16:20])
+	return decodeTCP(src, dst, data[ihl:])
+}
+
+func decodeIPv6(data []byte) (*segment, bool) {
+	if len(data) < 40 || data[0]>>4 != 6 {
+		return nil, false
+	}
+	payloadLen := int(binary.BigEndian.Uint16(data[4:6]))
+	next := data[6]
+	src, _ := netip.AddrFromSlice(data[8:24])
+	dst, _ := netip.AddrFromSlice(data[24:40])
+	data = data[40:]
+	if payloadLen < len(data) {
+		data = data[:payloadLen]
+	}
+
+	for {
+		switch next {
+		case ipProtocolTCP:
+			return decodeTCP(src, dst, data)
+		case 0, 43, 60: // hop-by-hop, routing, destination options
+			if len(data) < 8 || len(data) < (int(data[1])+1)*8 {
+				return nil, false
+			}
+			next, data = data[0], data[(int(data[1])+1)*8:]
+		default: // fragment(44) and anything else
+			return nil, false
+		}
+	}
+}
+
+func decodeTCP(src, dst netip.Addr, data []byte) (*segment, bool) {
+	if len(data) < 20 {
+		return nil, false
+	}
+	offset := int(data[12]>>4) * 4
+	if offset < 20 || len(data) < offset {
+		return nil, false
+	}
+	return &segment{
+		src:     netip.AddrPortFrom(src.Unmap(), binary.BigEndian.Uint16(data[0:2])),
+		dst:     netip.AddrPortFrom(dst.Unmap(), binary.BigEndian.Uint16(data[2:4])),
+		seq:     binary.BigEndian.Uint32(data[4:8]),
+		flags:   data[13],
+		payload: data[offset:],
+	}, true
+}
@@ -0,0 +1,302 @@
+// Copyright (c) 2016 The MQPP Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pcap
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/abo/mqpp"
+)
+
+var (
+	client = netip.MustParseAddrPort("10.0.0.2:50000")
+	server = netip.MustParseAddrPort("10.0.0.1:1883")
+	base   = time.Unix(1500000000, 0)
+)
+
+type capture struct {
+	ts   time.Time
+	data []byte // ipv4 packet
+}
+
+// tcp4 builds an ipv4 packet carrying a tcp segment
+func tcp4(src, dst netip.AddrPort, seq uint32, flags byte, payload []byte) []byte {
+	b := make([]byte, 40, 40+len(payload))
+	b[0], b[9] = 0x45, ipProtocolTCP
+	binary.BigEndian.PutUint16(b[2:4], uint16(40+len(payload)))
+	s, d := src.Addr().As4(), dst.Addr().As4()
+	copy(b[12:16], s[:])
+	copy(b[16:20], d[:])
+	binary.BigEndian.PutUint16(b[20:22], src.Port())
+	binary.BigEndian.PutUint16(b[22:24], dst.Port())
+	binary.BigEndian.PutUint32(b[24:28], seq)
+	b[32], b[33] = 5<<4, flags
+	return append(b, payload...)
+}
+
+func ethernet(ip []byte) []byte {
+	b := make([]byte, 14, 14+len(ip))
+	binary.BigEndian.PutUint16(b[12:14], etherTypeIPv4)
+	return append(b, ip...)
+}
+
+// writePcap writes a nanosecond big endian pcap of ethernet frames
+func writePcap(caps []capture) []byte {
+	var buf bytes.Buffer
+	header := make([]byte, 24)
+	binary.BigEndian.PutUint32(header[0:4], magicNano)
+	binary.BigEndian.PutUint16(header[4:6], 2)
+	binary.BigEndian.PutUint16(header[6:8], 4)
+	binary.BigEndian.PutUint32(header[16:20], 65535)
+	binary.BigEndian.PutUint32(header[20:24], uint32(LinkTypeEthernet))
+	buf.Write(header)
+	for _, c := range caps {
+		frame := ethernet(c.data)
+		rec := make([]byte, 16)
+		binary.BigEndian.PutUint32(rec[0:4], uint32(c.ts.Unix()))
+		binary.BigEndian.PutUint32(rec[4:8], uint32(c.ts.Nanosecond()))
+		binary.BigEndian.PutUint32(rec[8:12], uint32(len(frame)))
+		binary.BigEndian.PutUint32(rec[12:16], uint32(len(frame)))
+		buf.Write(rec)
+		buf.Write(frame)
+	}
+	return buf.Bytes()
+}
+
+func block(typ uint32, body []byte) []byte {
+	for len(body)%4 != 0 {
+		body = append(body, 0)
+	}
+	b := make([]byte, 8, 12+len(body))
+	binary.LittleEndian.PutUint32(b[0:4], typ)
+	binary.LittleEndian.PutUint32(b[4:8], uint32(12+len(body)))
+	b = append(b, body...)
+	return binary.LittleEndian.AppendUint32(b, uint32(12+len(body)))
+}
+
+// writePcapng writes a pcapng of raw ip packets on an interface of millisecond resolution
+func writePcapng(caps []capture) []byte {
+	var buf bytes.Buffer
+	shb := make([]byte, 16)
+	binary.LittleEndian.PutUint32(shb[0:4], pcapngByteOrder)
+	binary.LittleEndian.PutUint16(shb[4:6], 1)
+	binary.LittleEndian.PutUint64(shb[8:16], ^uint64(0))
+	buf.Write(block(blockSectionHeader, shb))
+
+	idb := make([]byte, 8)
+	binary.LittleEndian.PutUint16(idb[0:2], LinkTypeRaw)
+	idb = append(idb, 9, 0, 1, 0, 3, 0, 0, 0, 0, 0, 0, 0) // if_tsresol 3, opt_endofopt
+	buf.Write(block(blockInterface, idb))
+
+	for _, c := range caps {
+		epb := make([]byte, 20)
+		ts := uint64(c.ts.UnixMilli())
+		binary.LittleEndian.PutUint32(epb[4:8], uint32(ts>>32))
+		binary.LittleEndian.PutUint32(epb[8:12], uint32(ts))
+		binary.LittleEndian.PutUint32(epb[12:16], uint32(len(c.data)))
+		binary.LittleEndian.PutUint32(epb[16:20], uint32(len(c.data)))
+		buf.Write(block(blockEnhancedPacket, append(epb, c.data...)))
+	}
+	return buf.Bytes()
+}
+
+func extract(t *testing.T, file []byte) []*Packet {
+	return extractMax(t, file, 0)
+}
+
+func extractMax(t *testing.T, file []byte, maxPacketSize int) []*Packet {
+	e, err := NewExtractor(bytes.NewReader(file))
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.MaxPacketSize = maxPacketSize
+	var ps []*Packet
+	for {
+		p, err := e.Next()
+		if err == io.EOF {
+			return ps
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		ps = append(ps, p)
+	}
+}
+
+func bytesOf(p mqpp.ControlPacket) []byte {
+	return p.Bytes()
+}
+
+// conversation captures a session whose client segments arrive out of order and retransmitted
+func conversationCaptures() []capture {
+	connect := bytesOf(mqpp.MakeConnect("MQTT", 4, false, 0, true, 60, "c1", "", nil, "", nil))
+	connack := bytesOf(mqpp.MakeConnack(false, 0))
+	publish := bytesOf(mqpp.MakePublish(false, 1, false, "a/b", 1, []byte("hello")))
+	puback := bytesOf(mqpp.MakePuback(1))
+	disconnect := bytesOf(mqpp.MakeDisconnect())
+	tail := append(publish, disconnect...)
+
+	cs, ss := uint32(1000), uint32(0xfffffff0) // server seq wraps around
+	at := func(ms int) time.Time { return base.Add(time.Duration(ms) * time.Millisecond) }
+	return []capture{
+		{at(0), tcp4(client, server, cs, tcpFlagSYN, nil)},
+		{at(1), tcp4(server, client, ss, tcpFlagSYN|tcpFlagACK, nil)},
+		{at(2), tcp4(client, server, cs+1+5, tcpFlagACK, connect[5:])}, // ahead of the hole
+		{at(3), tcp4(client, server, cs+1, tcpFlagACK, connect[:5])},
+		{at(4), tcp4(client, server, cs+1, tcpFlagACK, connect[:5])}, // retransmission
+		{at(5), tcp4(server, client, ss+1, tcpFlagACK, connack)},
+		{at(6), tcp4(client, server, cs+1+uint32(len(connect))-2, tcpFlagACK, append(connect[len(connect)-2:], tail...))}, // overlaps 2 bytes
+
+		{at(7), tcp4(server, client, ss+1+uint32(len(connack)), tcpFlagACK, puback[:3])},
+		{at(8), tcp4(client, server, cs+1+uint32(len(connect)+len(tail)), tcpFlagACK|tcpFlagFIN, nil)},
+	}
+}
+
+func TestExtract(t *testing.T) {
+	caps := conversationCaptures()
+
+	for name, file := range map[string][]byte{"pcap": writePcap(caps), "pcapng": writePcapng(caps)} {
+		ps := extract(t, file)
+		expect := []struct {
+			dir mqpp.Direction
+			typ byte
+			err error
+			ms  int
+		}{
+			{mqpp.ClientToServer, mqpp.TCONNECT, nil, 3},
+			{mqpp.ServerToClient, mqpp.TCONNACK, nil, 5},
+			{mqpp.ClientToServer, mqpp.TPUBLISH, nil, 6},
+			{mqpp.ClientToServer, mqpp.TDISCONNECT, nil, 6},
+			{mqpp.ServerToClient, 0, mqpp.ErrIncompletePacket, 7},
+		}
+		if len(ps) != len(expect) {
+			t.Fatalf("%s: %d packets, expect %d", name, len(ps), len(expect))
+		}
+		for i, x := range expect {
+			p := ps[i]
+			if p.Flow != (Flow{client, server}) || p.Direction != x.dir || p.Err != x.err {
+				t.Fatalf("%s #%d: %v %v %v", name, i, p.Flow, p.Direction, p.Err)
+			}
+			if !p.Timestamp.Equal(base.Add(time.Duration(x.ms) * time.Millisecond)) {
+				t.Fatalf("%s #%d: timestamp %v", name, i, p.Timestamp)
+			}
+			if x.err == nil && p.Control.Type() != x.typ {
+				t.Fatalf("%s #%d: type %d, expect %d", name, i, p.Control.Type(), x.typ)
+			}
+		}
+		if pub := ps[2].Control.(*mqpp.Publish); pub.TopicName() != "a/b" || string(pub.Payload()) != "hello" {
+			t.Fatalf("%s: publish %s %s", name, pub.TopicName(), pub.Payload())
+		}
+		if len(ps[4].Raw) != 3 {
+			t.Fatalf("%s: incomplete tail of %d bytes", name, len(ps[4].Raw))
+		}
+	}
+}
+
+func TestExtractLargePacket(t *testing.T) {
+	publish := bytesOf(mqpp.MakePublish(false, 0, false, "big", 0, bytes.Repeat([]byte{0x5a}, 1<<20)))
+	stream := append(publish, bytesOf(mqpp.MakePingreq())...)
+
+	caps := []capture{{base, tcp4(client, server, 0, tcpFlagSYN, nil)}}
+	for off := 0; off < len(stream); off += 1400 {
+		end := off + 1400
+		if end > len(stream) {
+			end = len(stream)
+		}
+		caps = append(caps, capture{base.Add(time.Duration(off)), tcp4(client, server, 1+uint32(off), tcpFlagACK, stream[off:end])})
+	}
+
+	file := writePcap(caps)
+	ps := extractMax(t, file, 2<<20)
+	if len(ps) != 2 || ps[0].Err != nil || ps[1].Err != nil {
+		t.Fatalf("expect publish and pingreq, actual %d packets", len(ps))
+	}
+	if !bytes.Equal(ps[0].Raw, publish) || ps[1].Control.Type() != mqpp.TPINGREQ {
+		t.Fatalf("unexpected packets %v %v", ps[0].Control, ps[1].Control)
+	}
+
+	// over the default limit the publish is skipped, and framing goes on after it
+	ps = extract(t, file)
+	if len(ps) != 2 || ps[0].Err != ErrTooLarge || ps[1].Err != nil || ps[1].Control.Type() != mqpp.TPINGREQ {
+		t.Fatalf("expect too large publish and pingreq, actual %d packets", len(ps))
+	}
+	for _, max := range []int{1000, 1400, 2000} { // segment boundaries around the limit
+		if ps = extractMax(t, file, max); len(ps) != 2 || ps[0].Err != ErrTooLarge || ps[1].Err != nil {
+			t.Fatalf("max %d: expect too large publish and pingreq, actual %d packets", max, len(ps))
+		}
+	}
+}
+
+func TestExtractMidstream(t *testing.T) {
+	// no handshake, the server is told by its port
+	ping, pong := bytesOf(mqpp.MakePingreq()), bytesOf(mqpp.MakePingresp())
+	other := netip.MustParseAddrPort("10.0.0.3:40000")
+	caps := []capture{
+		{base, tcp4(server, client, 7, tcpFlagACK, pong)},
+		{base, tcp4(client, server, 9, tcpFlagACK, ping)},
+		{base, tcp4(other, server, 1, tcpFlagACK, ping)},
+		{base, tcp4(client, server, 100, tcpFlagACK, ping)}, // hole never filled
+	}
+
+	e, err := NewExtractor(bytes.NewReader(writePcap(caps)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.Filter = func(f Flow) bool { return f.Client == client }
+	var got []string
+	for {
+		p, err := e.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		if p.Flow != (Flow{client, server}) {
+			t.Fatalf("unexpected flow %v", p.Flow)
+		}
+		if p.Err != nil {
+			got = append(got, p.Err.Error())
+		} else {
+			got = append(got, p.Direction.String())
+		}
+	}
+	expect := []string{"server->client", "client->server", ErrGap.Error()}
+	if len(got) != len(expect) {
+		t.Fatalf("%v, expect %v", got, expect)
+	}
+	for i := range expect {
+		if got[i] != expect[i] {
+			t.Fatalf("%v, expect %v", got, expect)
+		}
+	}
+}
+
+func TestFileReaderFormat(t *testing.T) {
+	if _, err := NewFileReader(bytes.NewReader([]byte("not a capture"))); err != ErrFormat {
+		t.Fatalf("expect ErrFormat, got %v", err)
+	}
+	file := writePcap([]capture{{base, tcp4(client, server, 1, tcpFlagACK, nil)}})
+	fr, err := NewFileReader(bytes.NewReader(file[:len(file)-3]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fr.Next(); err != ErrFormat {
+		t.Fatalf("truncated record, expect ErrFormat, got %v", err)
+	}
+}
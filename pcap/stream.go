@@ -0,0 +1,403 @@
+// Copyright (c) 2016 The MQPP Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pcap
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/netip"
+	"time"
+
+	"github.com/abo/mqpp"
+)
+
+const maxPending = 1024 // out of order segments kept per direction before giving up the gap
+
+// ErrGap - bytes of the stream were never captured, packets after the gap can't be framed
+var ErrGap = errors.New("mqpp/pcap: Missing Segments")
+
+// ErrTooLarge - a packet is over Extractor.MaxPacketSize, it's skipped
+var ErrTooLarge = errors.New("mqpp/pcap: Packet Too Large")
+
+// mqtt ports, used to tell the server when the handshake was not captured
+var serverPorts = map[uint16]bool{1883: true, 8883: true}
+
+// Flow identifies a tcp connection
+type Flow struct {
+	Client netip.AddrPort
+	Server netip.AddrPort
+}
+
+func (f Flow) String() string {
+	return f.Client.String() + "-" + f.Server.String()
+}
+
+// Packet is a mqtt packet extracted from a flow. Err is set if Raw can't be parsed,
+// it's the incomplete tail of a direction, or the packet is skipped as too large,
+// in which case Control is nil.
+type Packet struct {
+	Flow      Flow
+	Direction mqpp.Direction
+	Timestamp time.Time // of the segment which completes the packet
+	Raw       []byte
+	Control   mqpp.ControlPacket
+	Err       error
+}
+
+// Extractor reads a capture file and extracts mqtt packets of every tcp flow
+type Extractor struct {
+	// Filter selects flows to extract, all flows if nil
+	Filter func(Flow) bool
+	// Lenient skips validating flags of fixed headers, see mqpp.ParseLenient
+	Lenient bool
+	// MaxPacketSize bounds packets buffered per direction, default 1MiB. A larger
+	// packet is reported with ErrTooLarge and skipped.
+	MaxPacketSize int
+
+	fr    *FileReader
+	conns map[connKey]*conversation
+	order []connKey
+	out   []*Packet
+	eof   bool
+}
+
+// connKey is the unordered pair of endpoints
+type connKey struct {
+	a, b netip.AddrPort
+}
+
+func makeConnKey(x, y netip.AddrPort) connKey {
+	if x.Compare(y) > 0 {
+		x, y = y, x
+	}
+	return connKey{x, y}
+}
+
+type conversation struct {
+	flow    Flow
+	ignored bool
+	halves  [2]half
+}
+
+// half is one direction of a conversation
+type half struct {
+	started bool
+	next    uint32
+	pending map[uint32][]byte
+	buf     []byte
+	need    int // length of the packet at the start of buf, 0 if its header is incomplete
+	skip    int // bytes left of a packet over MaxPacketSize, dropped unbuffered
+	lastTS  time.Time
+	fin     bool
+	finSeq  uint32
+	done    bool
+	broken  bool
+}
+
+// NewExtractor reads the header of capture file r
+func NewExtractor(r io.Reader) (*Extractor, error) {
+	fr, err := NewFileReader(r)
+	if err != nil {
+		return nil, err
+	}
+	return &Extractor{fr: fr, conns: make(map[connKey]*conversation)}, nil
+}
+
+// Next returns the next packet in the order they are completed, or io.EOF
+// after all flows are flushed at the end of file
+func (e *Extractor) Next() (*Packet, error) {
+	for len(e.out) == 0 {
+		if e.eof {
+			return nil, io.EOF
+		}
+
+		f, err := e.fr.Next()
+		if err == io.EOF {
+			e.eof = true
+			for _, k := range e.order {
+				if c, ok := e.conns[k]; ok {
+					e.finish(c, &c.halves[mqpp.ClientToServer], mqpp.ClientToServer)
+					e.finish(c, &c.halves[mqpp.ServerToClient], mqpp.ServerToClient)
+				}
+			}
+			e.conns, e.order = nil, nil
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		if seg, ok := decodeFrame(f); ok {
+			e.handle(seg, f.Timestamp)
+		}
+	}
+
+	p := e.out[0]
+	e.out[0] = nil
+	e.out = e.out[1:]
+	return p, nil
+}
+
+func (e *Extractor) handle(seg *segment, ts time.Time) {
+	syn, ack := seg.flags&tcpFlagSYN != 0, seg.flags&tcpFlagACK != 0
+	k := makeConnKey(seg.src, seg.dst)
+	c := e.conns[k]
+	if c != nil && syn && !ack && c.flow.Client == seg.src {
+		// the port is reused by a new connection
+		if h := &c.halves[mqpp.ClientToServer]; h.started && h.next != seg.seq+1 {
+			e.finish(c, &c.halves[mqpp.ClientToServer], mqpp.ClientToServer)
+			e.finish(c, &c.halves[mqpp.ServerToClient], mqpp.ServerToClient)
+			c = nil
+		}
+	}
+	if c == nil {
+		c = &conversation{flow: guessFlow(seg)}
+		if e.Filter != nil && !e.Filter(c.flow) {
+			c.ignored = true
+		}
+		if _, ok := e.conns[k]; !ok {
+			e.order = append(e.order, k)
+		}
+		e.conns[k] = c
+	}
+	if c.ignored {
+		if seg.flags&tcpFlagRST != 0 {
+			e.remove(k)
+		}
+		return
+	}
+
+	dir := mqpp.ClientToServer
+	if seg.src != c.flow.Client {
+		dir = mqpp.ServerToClient
+	}
+	h := &c.halves[dir]
+	seq := seg.seq
+	if syn {
+		seq++
+	}
+	if !h.started {
+		h.started, h.next = true, seq
+	}
+	if seg.flags&tcpFlagFIN != 0 && !h.fin {
+		h.fin, h.finSeq = true, seq+uint32(len(seg.payload))
+	}
+
+	if len(seg.payload) > 0 && !h.done {
+		e.insert(c, h, dir, seq, seg.payload, ts)
+	}
+
+	if seg.flags&tcpFlagRST != 0 {
+		e.finish(c, &c.halves[mqpp.ClientToServer], mqpp.ClientToServer)
+		e.finish(c, &c.halves[mqpp.ServerToClient], mqpp.ServerToClient)
+	} else if h.fin && h.next == h.finSeq {
+		e.finish(c, h, dir)
+	}
+	if c.halves[mqpp.ClientToServer].done && c.halves[mqpp.ServerToClient].done {
+		e.remove(k)
+	}
+}
+
+// guessFlow tells client from server by the handshake, or the well known ports,
+// or takes the first sender as the client
+func guessFlow(seg *segment) Flow {
+	syn, ack := seg.flags&tcpFlagSYN != 0, seg.flags&tcpFlagACK != 0
+	switch {
+	case syn && !ack:
+		return Flow{Client: seg.src, Server: seg.dst}
+	case syn && ack:
+		return Flow{Client: seg.dst, Server: seg.src}
+	case serverPorts[seg.src.Port()] && !serverPorts[seg.dst.Port()]:
+		return Flow{Client: seg.dst, Server: seg.src}
+	default:
+		return Flow{Client: seg.src, Server: seg.dst}
+	}
+}
+
+func (e *Extractor) remove(k connKey) {
+	delete(e.conns, k)
+	for i, o := range e.order {
+		if o == k {
+			e.order = append(e.order[:i], e.order[i+1:]...)
+			break
+		}
+	}
+}
+
+// insert puts payload at seq into the stream, trimming retransmitted bytes and
+// holding segments arrived ahead of a hole
+func (e *Extractor) insert(c *conversation, h *half, dir mqpp.Direction, seq uint32, payload []byte, ts time.Time) {
+	diff := int32(seq - h.next)
+	if diff > 0 {
+		if h.pending == nil {
+			h.pending = make(map[uint32][]byte)
+		}
+		if old, ok := h.pending[seq]; !ok || len(old) < len(payload) {
+			h.pending[seq] = payload
+		}
+		if len(h.pending) > maxPending {
+			e.skipGap(c, h, dir)
+		}
+		return
+	}
+	if -int(diff) >= len(payload) {
+		return // retransmission
+	}
+	h.append(payload[-diff:], ts)
+
+	for len(h.pending) > 0 {
+		progressed := false
+		for s, p := range h.pending {
+			d := int32(s - h.next)
+			if d > 0 {
+				continue
+			}
+			delete(h.pending, s)
+			if -int(d) < len(p) {
+				h.append(p[-d:], ts)
+				progressed = true
+			}
+		}
+		if !progressed {
+			break
+		}
+	}
+	e.parse(c, h, dir)
+}
+
+func (h *half) append(data []byte, ts time.Time) {
+	h.next += uint32(len(data))
+	h.lastTS = ts
+	if !h.broken {
+		if h.skip > 0 {
+			n := h.skip
+			if n > len(data) {
+				n = len(data)
+			}
+			h.skip -= n
+			data = data[n:]
+		}
+		h.buf = append(h.buf, data...)
+	}
+}
+
+// skipGap gives up the missing bytes, the rest of the direction can't be framed
+func (e *Extractor) skipGap(c *conversation, h *half, dir mqpp.Direction) {
+	first := true
+	var lowest uint32
+	for s := range h.pending {
+		if first || int32(s-lowest) < 0 {
+			lowest, first = s, false
+		}
+	}
+	e.parse(c, h, dir)
+	e.emitTail(c, h, dir)
+	if !h.broken {
+		e.emit(&Packet{Flow: c.flow, Direction: dir, Timestamp: h.lastTS, Err: ErrGap})
+		h.broken = true
+	}
+	h.next = lowest
+	payload := h.pending[lowest]
+	delete(h.pending, lowest)
+	e.insert(c, h, dir, lowest, payload, h.lastTS)
+}
+
+// parse emits every complete packet in buf and keeps the incomplete tail, buf
+// is only scanned once its first packet is complete
+func (e *Extractor) parse(c *conversation, h *half, dir mqpp.Direction) {
+	if h.broken || len(h.buf) == 0 || len(h.buf) < h.need {
+		return
+	}
+
+	s := mqpp.NewSplitter(bytes.NewReader(h.buf))
+	s.Buffer(nil, e.maxPacketSize())
+	consumed := 0
+	for s.Scan() {
+		raw := append([]byte(nil), s.Bytes()...)
+		consumed += len(raw)
+		p := &Packet{Flow: c.flow, Direction: dir, Timestamp: h.lastTS, Raw: raw}
+		if e.Lenient {
+			p.Control, p.Err = mqpp.ParseLenient(raw)
+		} else {
+			p.Control, p.Err = mqpp.Parse(raw)
+		}
+		e.emit(p)
+	}
+	if s.Err() == mqpp.ErrMalformedRemLen {
+		e.emit(&Packet{Flow: c.flow, Direction: dir, Timestamp: h.lastTS, Raw: h.buf[consumed:], Err: mqpp.ErrMalformedRemLen})
+		h.buf, h.broken = nil, true
+		return
+	}
+	h.buf = append(h.buf[:0], h.buf[consumed:]...)
+	h.need = packetLen(h.buf)
+	if h.need > e.maxPacketSize() {
+		e.emit(&Packet{Flow: c.flow, Direction: dir, Timestamp: h.lastTS, Err: ErrTooLarge})
+		if len(h.buf) < h.need {
+			h.buf, h.skip, h.need = nil, h.need-len(h.buf), 0
+			return
+		}
+		h.buf, h.need = append(h.buf[:0], h.buf[h.need:]...), 0
+		e.parse(c, h, dir)
+	}
+}
+
+func (e *Extractor) maxPacketSize() int {
+	if e.MaxPacketSize <= 0 {
+		return 1 << 20
+	}
+	if e.MaxPacketSize > mqpp.MaxPacketSize {
+		return mqpp.MaxPacketSize
+	}
+	return e.MaxPacketSize
+}
+
+// packetLen returns the length of the packet at the start of b, 0 if its fixed
+// header is incomplete
+func packetLen(b []byte) int {
+	remlen, mult := 0, 1
+	for i := 1; i < len(b) && i <= 4; i++ {
+		remlen += int(b[i]&0x7f) * mult
+		if b[i] < 0x80 {
+			return i + 1 + remlen
+		}
+		mult *= 128
+	}
+	return 0
+}
+
+// finish flushes a direction when it's closed or the capture ends
+func (e *Extractor) finish(c *conversation, h *half, dir mqpp.Direction) {
+	if h.done {
+		return
+	}
+	if len(h.pending) > 0 && !h.broken {
+		e.emitTail(c, h, dir)
+		e.emit(&Packet{Flow: c.flow, Direction: dir, Timestamp: h.lastTS, Err: ErrGap})
+		h.broken = true
+	}
+	e.emitTail(c, h, dir)
+	h.done, h.pending = true, nil
+}
+
+func (e *Extractor) emitTail(c *conversation, h *half, dir mqpp.Direction) {
+	if len(h.buf) > 0 && !h.broken {
+		e.emit(&Packet{Flow: c.flow, Direction: dir, Timestamp: h.lastTS, Raw: h.buf, Err: mqpp.ErrIncompletePacket})
+	}
+	h.buf, h.need, h.skip = nil, 0, 0
+}
+
+func (e *Extractor) emit(p *Packet) {
+	e.out = append(e.out, p)
+}
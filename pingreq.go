@@ -21,7 +21,7 @@ type Pingreq struct {
 }
 
 func newPingreq(data []byte) (*Pingreq, error) {
-	if len(data) < 2 || data[0] != (TPINGREQ<<4) || data[1] != 0 {
+	if len(data) < 2 || data[0]>>4 != TPINGREQ || data[1] != 0 {
 		return nil, ErrProtocolViolation
 	}
 	return &Pingreq{endecBytes: data[0:2]}, nil
@@ -21,7 +21,7 @@ type Pingresp struct {
 }
 
 func newPingresp(data []byte) (*Pingresp, error) {
-	if len(data) < 2 || data[0] != (TPINGRESP<<4) || data[1] != 0 {
+	if len(data) < 2 || data[0]>>4 != TPINGRESP || data[1] != 0 {
 		return nil, ErrProtocolViolation
 	}
 	return &Pingresp{endecBytes: data[0:2]}, nil
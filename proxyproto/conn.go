@@ -0,0 +1,88 @@
+// Copyright (c) 2016 The MQPP Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxyproto
+
+import (
+	"bufio"
+	"net"
+	"sync"
+)
+
+// Conn is a net.Conn whose PROXY header is stripped on first Read, RemoteAddr
+// or Header call. RemoteAddr and LocalAddr return the addresses in the header
+// when present.
+type Conn struct {
+	net.Conn
+	br *bufio.Reader
+
+	once   sync.Once
+	header *Header
+	err    error
+}
+
+// NewConn wraps nc, the header is not read until needed so it doesn't block the accepting goroutine
+func NewConn(nc net.Conn) *Conn {
+	return &Conn{Conn: nc, br: bufio.NewReader(nc)}
+}
+
+func (c *Conn) readHeader() {
+	c.once.Do(func() {
+		c.header, c.err = Read(c.br)
+	})
+}
+
+// Header returns the PROXY header, nil if the connection had none
+func (c *Conn) Header() (*Header, error) {
+	c.readHeader()
+	return c.header, c.err
+}
+
+// Read reads the stream after PROXY header
+func (c *Conn) Read(b []byte) (int, error) {
+	if c.readHeader(); c.err != nil {
+		return 0, c.err
+	}
+	return c.br.Read(b)
+}
+
+// RemoteAddr returns the original source address, or the proxy's address without a header
+func (c *Conn) RemoteAddr() net.Addr {
+	if c.readHeader(); c.header != nil && c.header.Source != nil {
+		return c.header.Source
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// LocalAddr returns the original destination address, or the local address without a header
+func (c *Conn) LocalAddr() net.Addr {
+	if c.readHeader(); c.header != nil && c.header.Destination != nil {
+		return c.header.Destination
+	}
+	return c.Conn.LocalAddr()
+}
+
+// Listener wraps accepted connections as Conn, e.g. broker.Serve(proxyproto.Listener{Listener: l})
+type Listener struct {
+	net.Listener
+}
+
+// Accept waits for the next connection and wraps it as Conn
+func (l Listener) Accept() (net.Conn, error) {
+	nc, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return NewConn(nc), nil
+}
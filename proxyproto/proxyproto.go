@@ -0,0 +1,305 @@
+// Copyright (c) 2016 The MQPP Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package proxyproto strips a PROXY protocol(v1 text or v2 binary) header
+// prepended by load balancers such as HAProxy or AWS NLB, exposes the original
+// addresses and TLVs, and hands the remaining MQTT stream to mqpp.Splitter.
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/abo/mqpp"
+)
+
+// ErrInvalidHeader - the stream begins with a malformed PROXY header
+var ErrInvalidHeader = errors.New("mqpp/proxyproto: Invalid PROXY Header")
+
+var (
+	v1Prefix    = []byte("PROXY ")
+	v2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+)
+
+// maxV1Length is the longest v1 header line, CRLF included
+const maxV1Length = 107
+
+// TLV types of PROXY protocol v2
+const (
+	TypeALPN      byte = 0x01
+	TypeAuthority byte = 0x02
+	TypeCRC32C    byte = 0x03
+	TypeNoop      byte = 0x04
+	TypeUniqueID  byte = 0x05
+	TypeSSL       byte = 0x20
+	TypeNetNS     byte = 0x30
+
+	subTypeSSLVersion byte = 0x21
+	subTypeSSLCN      byte = 0x22
+	subTypeSSLCipher  byte = 0x23
+	subTypeSSLSigAlg  byte = 0x24
+	subTypeSSLKeyAlg  byte = 0x25
+)
+
+// TLV is a type-length-value extension of a v2 header
+type TLV struct {
+	Type  byte
+	Value []byte
+}
+
+// Header is a parsed PROXY header
+type Header struct {
+	Version int // 1 or 2
+	// Local is set for v2 LOCAL command, the connection was opened by the proxy
+	// itself(e.g. health check), addresses are absent
+	Local       bool
+	Source      net.Addr // original client address, nil when unknown
+	Destination net.Addr // address the client connected to, nil when unknown
+	TLVs        []TLV
+}
+
+// TLS is the content of PP2_TYPE_SSL, describing the TLS connection the proxy terminated
+type TLS struct {
+	Client  byte   // PP2_CLIENT_SSL(0x01), PP2_CLIENT_CERT_CONN(0x02), PP2_CLIENT_CERT_SESS(0x04) bits
+	Verify  uint32 // zero if the client certificate was verified
+	Version string
+	CN      string // common name of client certificate subject
+	Cipher  string
+	SigAlg  string
+	KeyAlg  string
+}
+
+// TLV returns the value of first TLV of type t
+func (h *Header) TLV(t byte) ([]byte, bool) {
+	for _, tlv := range h.TLVs {
+		if tlv.Type == t {
+			return tlv.Value, true
+		}
+	}
+	return nil, false
+}
+
+// TLS returns the TLS information sent by the proxy
+func (h *Header) TLS() (*TLS, bool) {
+	v, ok := h.TLV(TypeSSL)
+	if !ok || len(v) < 5 {
+		return nil, false
+	}
+	info := &TLS{Client: v[0], Verify: binary.BigEndian.Uint32(v[1:5])}
+	subs, err := parseTLVs(v[5:])
+	if err != nil {
+		return nil, false
+	}
+	for _, sub := range subs {
+		switch sub.Type {
+		case subTypeSSLVersion:
+			info.Version = string(sub.Value)
+		case subTypeSSLCN:
+			info.CN = string(sub.Value)
+		case subTypeSSLCipher:
+			info.Cipher = string(sub.Value)
+		case subTypeSSLSigAlg:
+			info.SigAlg = string(sub.Value)
+		case subTypeSSLKeyAlg:
+			info.KeyAlg = string(sub.Value)
+		}
+	}
+	return info, true
+}
+
+// Read strips a PROXY header from the beginning of r. The header is nil if the
+// stream doesn't begin with one, and nothing is consumed then.
+func Read(r *bufio.Reader) (*Header, error) {
+	first, err := r.Peek(1)
+	if err != nil {
+		if err == io.EOF {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	switch first[0] {
+	case v1Prefix[0]:
+		if b, _ := r.Peek(len(v1Prefix)); bytes.Equal(b, v1Prefix) {
+			return readV1(r)
+		}
+	case v2Signature[0]:
+		if b, _ := r.Peek(len(v2Signature)); bytes.Equal(b, v2Signature) {
+			return readV2(r)
+		}
+	}
+	return nil, nil
+}
+
+func readV1(r *bufio.Reader) (*Header, error) {
+	line := make([]byte, 0, maxV1Length)
+	for {
+		c, err := r.ReadByte()
+		if err != nil {
+			return nil, ErrInvalidHeader
+		}
+		line = append(line, c)
+		if c == '\n' {
+			break
+		}
+		if len(line) == maxV1Length {
+			return nil, ErrInvalidHeader
+		}
+	}
+	if len(line) < 2 || line[len(line)-2] != '\r' {
+		return nil, ErrInvalidHeader
+	}
+
+	fields := strings.Split(string(line[len(v1Prefix):len(line)-2]), " ")
+	h := &Header{Version: 1}
+	switch fields[0] {
+	case "UNKNOWN":
+		return h, nil
+	case "TCP4", "TCP6":
+	default:
+		return nil, ErrInvalidHeader
+	}
+	if len(fields) != 5 {
+		return nil, ErrInvalidHeader
+	}
+	src, dst := net.ParseIP(fields[1]), net.ParseIP(fields[2])
+	sport, err1 := strconv.ParseUint(fields[3], 10, 16)
+	dport, err2 := strconv.ParseUint(fields[4], 10, 16)
+	if src == nil || dst == nil || err1 != nil || err2 != nil || (fields[0] == "TCP4") != (src.To4() != nil && dst.To4() != nil) {
+		return nil, ErrInvalidHeader
+	}
+	h.Source = &net.TCPAddr{IP: src, Port: int(sport)}
+	h.Destination = &net.TCPAddr{IP: dst, Port: int(dport)}
+	return h, nil
+}
+
+func readV2(r *bufio.Reader) (*Header, error) {
+	fixed := make([]byte, 16)
+	if _, err := io.ReadFull(r, fixed); err != nil {
+		return nil, ErrInvalidHeader
+	}
+	verCmd, family := fixed[12], fixed[13]
+	body := make([]byte, binary.BigEndian.Uint16(fixed[14:16]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, ErrInvalidHeader
+	}
+	if verCmd>>4 != 2 {
+		return nil, ErrInvalidHeader
+	}
+
+	h := &Header{Version: 2}
+	switch verCmd & 0x0f {
+	case 0x0: // LOCAL
+		h.Local = true
+	case 0x1: // PROXY
+	default:
+		return nil, ErrInvalidHeader
+	}
+
+	var addrLen int
+	switch family >> 4 {
+	case 0x0: // AF_UNSPEC
+	case 0x1: // AF_INET
+		addrLen = 12
+	case 0x2: // AF_INET6
+		addrLen = 36
+	case 0x3: // AF_UNIX
+		addrLen = 216
+	default:
+		return nil, ErrInvalidHeader
+	}
+	if len(body) < addrLen {
+		return nil, ErrInvalidHeader
+	}
+	if !h.Local {
+		h.Source, h.Destination = v2Addrs(family, body[:addrLen])
+	}
+
+	tlvs, err := parseTLVs(body[addrLen:])
+	if err != nil {
+		return nil, err
+	}
+	h.TLVs = tlvs
+	return h, nil
+}
+
+// v2Addrs decodes address block of family, transport protocol is in low nibble: 1 stream, 2 datagram
+func v2Addrs(family byte, b []byte) (net.Addr, net.Addr) {
+	udp := family&0x0f == 0x2
+	ipAddr := func(ip []byte, port []byte) net.Addr {
+		p := int(binary.BigEndian.Uint16(port))
+		if udp {
+			return &net.UDPAddr{IP: net.IP(ip), Port: p}
+		}
+		return &net.TCPAddr{IP: net.IP(ip), Port: p}
+	}
+	switch family >> 4 {
+	case 0x1:
+		return ipAddr(b[0:4], b[8:10]), ipAddr(b[4:8], b[10:12])
+	case 0x2:
+		return ipAddr(b[0:16], b[32:34]), ipAddr(b[16:32], b[34:36])
+	case 0x3:
+		unix := func(path []byte) net.Addr {
+			if i := bytes.IndexByte(path, 0); i >= 0 {
+				path = path[:i]
+			}
+			network := "unix"
+			if udp {
+				network = "unixgram"
+			}
+			return &net.UnixAddr{Name: string(path), Net: network}
+		}
+		return unix(b[0:108]), unix(b[108:216])
+	}
+	return nil, nil
+}
+
+func parseTLVs(b []byte) ([]TLV, error) {
+	var tlvs []TLV
+	for len(b) > 0 {
+		if len(b) < 3 {
+			return nil, ErrInvalidHeader
+		}
+		l := int(binary.BigEndian.Uint16(b[1:3]))
+		if len(b) < 3+l {
+			return nil, ErrInvalidHeader
+		}
+		tlvs = append(tlvs, TLV{Type: b[0], Value: b[3 : 3+l]})
+		b = b[3+l:]
+	}
+	return tlvs, nil
+}
+
+// NewReader strips a PROXY header from r, and returns the header(nil if absent)
+// with a reader of the remaining stream.
+func NewReader(r io.Reader) (*Header, io.Reader, error) {
+	br := bufio.NewReader(r)
+	h, err := Read(br)
+	return h, br, err
+}
+
+// NewSplitter strips a PROXY header from r, and returns a Splitter of the remaining stream
+func NewSplitter(r io.Reader) (*mqpp.Splitter, *Header, error) {
+	h, rest, err := NewReader(r)
+	if err != nil {
+		return nil, nil, err
+	}
+	return mqpp.NewSplitter(rest), h, nil
+}
@@ -0,0 +1,136 @@
+// Copyright (c) 2016 The MQPP Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxyproto
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+
+	"github.com/abo/mqpp"
+)
+
+var connect = mqpp.MakeConnect(mqpp.ProtocolName, mqpp.ProtocolLevel, false, 0, true, 30, "cid", "", nil, "", nil)
+
+// expectConnect checks the stream after header is the CONNECT packet
+func expectConnect(t *testing.T, s *mqpp.Splitter) {
+	p, err := s.NextPacket()
+	if err != nil || p == nil || !bytes.Equal(p.Bytes(), connect.Bytes()) {
+		t.Fatalf("expect CONNECT after header, actual %v, err: %v", p, err)
+	}
+}
+
+func tlv(t byte, value []byte) []byte {
+	b := []byte{t, 0, 0}
+	binary.BigEndian.PutUint16(b[1:], uint16(len(value)))
+	return append(b, value...)
+}
+
+func v2Header(verCmd, family byte, addrs []byte, tlvs ...[]byte) []byte {
+	body := append([]byte(nil), addrs...)
+	for _, t := range tlvs {
+		body = append(body, t...)
+	}
+	h := append(append([]byte(nil), v2Signature...), verCmd, family, 0, 0)
+	binary.BigEndian.PutUint16(h[14:], uint16(len(body)))
+	return append(h, body...)
+}
+
+func TestV1(t *testing.T) {
+	cases := []struct {
+		line     string
+		src, dst string
+	}{
+		{"PROXY TCP4 192.168.0.1 192.168.0.11 56324 1883\r\n", "192.168.0.1:56324", "192.168.0.11:1883"},
+		{"PROXY TCP6 2001:db8::1 2001:db8::2 4000 8883\r\n", "[2001:db8::1]:4000", "[2001:db8::2]:8883"},
+		{"PROXY UNKNOWN ffff:f...f:ffff ffff:f...f:ffff 65535 65535\r\n", "", ""},
+	}
+	for _, c := range cases {
+		s, h, err := NewSplitter(bytes.NewReader(append([]byte(c.line), connect.Bytes()...)))
+		if err != nil || h == nil || h.Version != 1 {
+			t.Fatalf("%q: expect v1 header, actual %v, err: %v", c.line, h, err)
+		}
+		if c.src != "" && (h.Source.String() != c.src || h.Destination.String() != c.dst) {
+			t.Errorf("%q: expect %s -> %s, actual %v -> %v", c.line, c.src, c.dst, h.Source, h.Destination)
+		}
+		expectConnect(t, s)
+	}
+
+	for _, line := range []string{"PROXY TCP4 1.2.3.4\r\n", "PROXY TCP4 ::1 ::1 1 2\r\n", "PROXY TCP4 1.2.3.4 1.2.3.4 1 2\n"} {
+		if _, _, err := NewReader(bytes.NewReader([]byte(line))); err != ErrInvalidHeader {
+			t.Errorf("%q: expect invalid header, actual %v", line, err)
+		}
+	}
+}
+
+func TestV2(t *testing.T) {
+	addrs := []byte{10, 0, 0, 1, 10, 0, 0, 2, 0x1f, 0x90, 0x07, 0x5b}
+	ssl := append([]byte{0x07, 0, 0, 0, 0}, tlv(subTypeSSLVersion, []byte("TLSv1.3"))...)
+	ssl = append(ssl, tlv(subTypeSSLCN, []byte("device-42"))...)
+	header := v2Header(0x21, 0x11, addrs, tlv(TypeALPN, []byte("mqtt")), tlv(TypeSSL, ssl))
+
+	s, h, err := NewSplitter(bytes.NewReader(append(header, connect.Bytes()...)))
+	if err != nil || h == nil || h.Version != 2 || h.Local {
+		t.Fatalf("expect v2 PROXY header, actual %+v, err: %v", h, err)
+	}
+	if h.Source.String() != "10.0.0.1:8080" || h.Destination.String() != "10.0.0.2:1883" {
+		t.Fatalf("unexpected addresses %v -> %v", h.Source, h.Destination)
+	}
+	if alpn, ok := h.TLV(TypeALPN); !ok || string(alpn) != "mqtt" {
+		t.Fatalf("expect ALPN mqtt, actual %s", alpn)
+	}
+	tls, ok := h.TLS()
+	if !ok || tls.Client != 0x07 || tls.Verify != 0 || tls.Version != "TLSv1.3" || tls.CN != "device-42" {
+		t.Fatalf("unexpected TLS %+v", tls)
+	}
+	expectConnect(t, s)
+
+	// LOCAL command carries no addresses
+	s, h, err = NewSplitter(bytes.NewReader(append(v2Header(0x20, 0x00, nil), connect.Bytes()...)))
+	if err != nil || !h.Local || h.Source != nil {
+		t.Fatalf("expect LOCAL header, actual %+v, err: %v", h, err)
+	}
+	expectConnect(t, s)
+
+	// truncated TLV
+	bad := v2Header(0x21, 0x11, addrs, []byte{TypeALPN, 0, 9, 'x'})
+	if _, _, err := NewReader(bytes.NewReader(bad)); err != ErrInvalidHeader {
+		t.Fatalf("expect invalid header, actual %v", err)
+	}
+}
+
+func TestNoHeader(t *testing.T) {
+	s, h, err := NewSplitter(bytes.NewReader(connect.Bytes()))
+	if err != nil || h != nil {
+		t.Fatalf("expect no header, actual %v, err: %v", h, err)
+	}
+	expectConnect(t, s)
+}
+
+func TestConn(t *testing.T) {
+	client, server := net.Pipe()
+	go func() {
+		client.Write([]byte("PROXY TCP4 192.168.0.1 192.168.0.11 56324 1883\r\n"))
+		client.Write(connect.Bytes())
+		client.Close()
+	}()
+
+	c := NewConn(server)
+	if c.RemoteAddr().String() != "192.168.0.1:56324" {
+		t.Fatalf("expect original source, actual %v", c.RemoteAddr())
+	}
+	expectConnect(t, mqpp.NewSplitter(c))
+}
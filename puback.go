@@ -22,7 +22,7 @@ type Puback struct {
 }
 
 func newPuback(data []byte) (*Puback, error) {
-	if len(data) < 4 || data[0] != (TPUBACK<<4) || data[1] != 2 {
+	if len(data) < 4 || data[0]>>4 != TPUBACK || data[1] != 2 {
 		return nil, ErrProtocolViolation
 	}
 	return &Puback{endecBytes: data[0:4]}, nil
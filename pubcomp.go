@@ -22,7 +22,7 @@ type Pubcomp struct {
 }
 
 func newPubcomp(data []byte) (*Pubcomp, error) {
-	if len(data) < 4 || data[0] != (TPUBCOMP<<4) || data[1] != 2 {
+	if len(data) < 4 || data[0]>>4 != TPUBCOMP || data[1] != 2 {
 		return nil, ErrProtocolViolation
 	}
 	return &Pubcomp{endecBytes: data[0:4]}, nil
@@ -30,21 +30,20 @@ func newPublish(data []byte) (*Publish, error) {
 		return nil, ErrProtocolViolation
 	}
 	p := &Publish{endecBytes: data}
-	fixedHeader, offset := p.byte(0)
-	qos := fixedHeader << 5 >> 6
-	remlen, offset := p.remlen(offset)
-	if offset <= 1 {
-		return nil, ErrMalformedRemLen
-	}
-	pktLen := offset + int(remlen)
-	if len(data) < pktLen {
-		return nil, ErrProtocolViolation
+	offset, pktLen, err := p.header()
+	if err != nil {
+		return nil, err
 	}
+	p.endecBytes = data[:pktLen]
+
 	p.topicNamePos = offset
-	_, offset = p.string(p.topicNamePos)
-	if qos > QosAtMostOnce {
+	offset = p.skipString(p.topicNamePos, pktLen)
+	if p.QoS() > QosAtMostOnce {
 		p.packetIDPos = offset
-		_, offset = p.uint16(offset)
+		offset = skip(offset, 2, pktLen)
+	}
+	if offset < 0 {
+		return nil, ErrProtocolViolation
 	}
 	p.payloadPos = offset
 
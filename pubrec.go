@@ -22,7 +22,7 @@ type Pubrec struct {
 }
 
 func newPubrec(data []byte) (*Pubrec, error) {
-	if len(data) < 4 || data[0] != (TPUBREC<<4) || data[1] != 2 {
+	if len(data) < 4 || data[0]>>4 != TPUBREC || data[1] != 2 {
 		return nil, ErrProtocolViolation
 	}
 	return &Pubrec{endecBytes: data[0:4]}, nil
@@ -22,7 +22,7 @@ type Pubrel struct {
 }
 
 func newPubrel(data []byte) (*Pubrel, error) {
-	if len(data) < 4 || data[0] != (TPUBREL<<4|0x02) || data[1] != 2 {
+	if len(data) < 4 || data[0]>>4 != TPUBREL || data[1] != 2 {
 		return nil, ErrProtocolViolation
 	}
 	return &Pubrel{endecBytes: data[0:4]}, nil
@@ -0,0 +1,316 @@
+// Copyright (c) 2016 The MQPP Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package queue buffers outbound packets while a connection is down, in memory
+// up to a bound and then in a segment file on disk, and drains them in order
+// once reconnected.
+package queue
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/abo/mqpp"
+)
+
+// compactMin is how many bytes are read from the segment before it can be compacted
+const compactMin = 1 << 20
+
+var (
+	// ErrFull - the packet exceeds both memory and segment limits
+	ErrFull = errors.New("mqpp/queue: Queue Full")
+	// ErrDropped - a QoS 0 publish was dropped under pressure by policy
+	ErrDropped = errors.New("mqpp/queue: QoS 0 Publish Dropped")
+	// ErrClosed - the queue has been closed
+	ErrClosed = errors.New("mqpp/queue: Queue Closed")
+)
+
+// Policy decides what happens to QoS 0 publishes when memory is full
+type Policy byte
+
+// QoS 0 policies, other packets always spill to the segment file
+const (
+	SpillQoS0      Policy = iota // QoS 0 publishes spill to disk like any other packet
+	DropNewestQoS0               // the QoS 0 publish being pushed is dropped
+	DropOldestQoS0               // oldest QoS 0 publishes in memory are dropped to make room
+)
+
+// Options configures a Queue
+type Options struct {
+	// MaxMemory bounds bytes of packets held in memory, default 1MiB
+	MaxMemory int
+	// SegmentPath is the file packets spill to once memory is full, empty disables spilling
+	SegmentPath string
+	// MaxSegment bounds bytes of the segment file, 0 is unlimited
+	MaxSegment int64
+	// Policy applies to QoS 0 publishes under memory pressure
+	Policy Policy
+}
+
+// Queue is a FIFO of outbound packets, it is safe for concurrent use. Packets
+// keep the order they were pushed in, so ordering of every QoS level is preserved,
+// only QoS 0 publishes may be dropped, according to Policy.
+type Queue struct {
+	opts Options
+
+	drainMu sync.Mutex // serializes Drain
+
+	mu       sync.Mutex
+	closed   bool
+	mem      []mqpp.ControlPacket
+	memBytes int
+	seg      *os.File
+	segRead  int64 // offset of the oldest packet in segment
+	segWrite int64 // end of segment
+	segCount int
+	dropped  int
+}
+
+// New create an empty queue, the segment file is created when memory is full the first time
+func New(opts Options) *Queue {
+	if opts.MaxMemory <= 0 {
+		opts.MaxMemory = 1 << 20
+	}
+	return &Queue{opts: opts}
+}
+
+func isQoS0(p mqpp.ControlPacket) bool {
+	pub, ok := p.(*mqpp.Publish)
+	if !ok {
+		var v mqpp.Publish
+		if v, ok = p.(mqpp.Publish); ok {
+			pub = &v
+		}
+	}
+	return ok && pub.QoS() == mqpp.QosAtMostOnce
+}
+
+// Push appends p to the queue. It returns ErrDropped if p is a QoS 0 publish
+// dropped by policy, or ErrFull if there is no room left for it.
+func (q *Queue) Push(p mqpp.ControlPacket) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return ErrClosed
+	}
+
+	size := int(p.Length())
+	qos0 := isQoS0(p)
+	full := q.memBytes+size > q.opts.MaxMemory
+	if full && q.opts.Policy == DropOldestQoS0 {
+		q.evictLocked(size)
+		full = q.memBytes+size > q.opts.MaxMemory
+	}
+	if !full && q.segCount == 0 {
+		q.mem = append(q.mem, p)
+		q.memBytes += size
+		return nil
+	}
+
+	if qos0 && full && q.opts.Policy == DropNewestQoS0 {
+		q.dropped++
+		return ErrDropped
+	}
+	if err := q.spillLocked(p); err != nil {
+		if qos0 && err == ErrFull {
+			q.dropped++
+			return ErrDropped
+		}
+		return err
+	}
+	return nil
+}
+
+// evictLocked drops oldest QoS 0 publishes in memory until size bytes fit
+func (q *Queue) evictLocked(size int) {
+	kept := q.mem[:0]
+	for _, p := range q.mem {
+		if q.memBytes+size > q.opts.MaxMemory && isQoS0(p) {
+			q.memBytes -= int(p.Length())
+			q.dropped++
+			continue
+		}
+		kept = append(kept, p)
+	}
+	for i := len(kept); i < len(q.mem); i++ {
+		q.mem[i] = nil
+	}
+	q.mem = kept
+}
+
+func (q *Queue) spillLocked(p mqpp.ControlPacket) error {
+	if q.opts.SegmentPath == "" {
+		return ErrFull
+	}
+	if q.opts.MaxSegment > 0 && q.segWrite-q.segRead+int64(p.Length()) > q.opts.MaxSegment {
+		return ErrFull
+	}
+	if q.seg == nil {
+		f, err := os.OpenFile(q.opts.SegmentPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+		if err != nil {
+			return err
+		}
+		q.seg = f
+	}
+	n, err := q.seg.WriteAt(p.Bytes(), q.segWrite)
+	if err != nil {
+		return err
+	}
+	q.segWrite += int64(n)
+	q.segCount++
+	return nil
+}
+
+// popLocked removes and returns the oldest packet
+func (q *Queue) popLocked() (mqpp.ControlPacket, error) {
+	if len(q.mem) > 0 {
+		p := q.mem[0]
+		q.mem[0] = nil
+		q.mem = q.mem[1:]
+		q.memBytes -= int(p.Length())
+		return p, nil
+	}
+	if q.segCount == 0 {
+		return nil, nil
+	}
+
+	// fixed header byte and at most 4 bytes remaining length
+	header := make([]byte, 5)
+	n, err := q.seg.ReadAt(header, q.segRead)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	remlen, m := binary.Uvarint(header[1:n])
+	if m <= 0 {
+		return nil, mqpp.ErrMalformedRemLen
+	}
+	data := make([]byte, 1+m+int(remlen))
+	if _, err := q.seg.ReadAt(data, q.segRead); err != nil {
+		return nil, err
+	}
+	p, err := mqpp.Parse(data)
+	if err != nil {
+		return nil, err
+	}
+
+	q.segRead += int64(len(data))
+	q.segCount--
+	if q.segCount == 0 {
+		// segment emptied, start over from its beginning
+		q.seg.Truncate(0)
+		q.segRead, q.segWrite = 0, 0
+	} else if q.segRead >= compactMin && q.segRead > q.segWrite-q.segRead {
+		// never emptied while pushes keep spilling, so it's compacted instead
+		q.compactLocked()
+	}
+	return p, nil
+}
+
+// compactLocked moves unread packets to the beginning of segment and truncates
+// it. Read bytes outnumber unread ones, so the copy never overwrites what's yet
+// to be copied, and the segment stays valid if it fails halfway.
+func (q *Queue) compactLocked() {
+	live := q.segWrite - q.segRead
+	buf := make([]byte, 64<<10)
+	for off := int64(0); off < live; {
+		chunk := buf
+		if rest := live - off; rest < int64(len(chunk)) {
+			chunk = chunk[:rest]
+		}
+		n, err := q.seg.ReadAt(chunk, q.segRead+off)
+		if err != nil && err != io.EOF {
+			return
+		}
+		if _, err := q.seg.WriteAt(buf[:n], off); err != nil {
+			return
+		}
+		off += int64(n)
+	}
+	if err := q.seg.Truncate(live); err != nil {
+		return
+	}
+	q.segRead, q.segWrite = 0, live
+}
+
+// unpopLocked puts back a packet failed to write at the head, it's older than
+// everything else so it goes to the front of memory, even beyond MaxMemory.
+func (q *Queue) unpopLocked(p mqpp.ControlPacket) {
+	q.mem = append([]mqpp.ControlPacket{p}, q.mem...)
+	q.memBytes += int(p.Length())
+}
+
+// Drain writes queued packets to w in order until the queue is empty, returning
+// how many were written. A packet failed to write stays at the head of queue,
+// so Drain can be called again with the next connection.
+func (q *Queue) Drain(w io.Writer) (int, error) {
+	q.drainMu.Lock()
+	defer q.drainMu.Unlock()
+
+	written := 0
+	for {
+		q.mu.Lock()
+		if q.closed {
+			q.mu.Unlock()
+			return written, ErrClosed
+		}
+		p, err := q.popLocked()
+		q.mu.Unlock()
+		if err != nil || p == nil {
+			return written, err
+		}
+
+		if _, err := w.Write(p.Bytes()); err != nil {
+			q.mu.Lock()
+			if !q.closed {
+				q.unpopLocked(p)
+			}
+			q.mu.Unlock()
+			return written, err
+		}
+		written++
+	}
+}
+
+// Len returns the number of queued packets
+func (q *Queue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.mem) + q.segCount
+}
+
+// Dropped returns the number of QoS 0 publishes dropped by policy or for lack of room
+func (q *Queue) Dropped() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.dropped
+}
+
+// Close discards queued packets and removes the segment file
+func (q *Queue) Close() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return nil
+	}
+	q.closed = true
+	q.mem = nil
+	if q.seg == nil {
+		return nil
+	}
+	q.seg.Close()
+	return os.Remove(q.opts.SegmentPath)
+}
@@ -0,0 +1,170 @@
+// Copyright (c) 2016 The MQPP Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package queue
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/abo/mqpp"
+)
+
+func publish(qos byte, payload string) *mqpp.Publish {
+	p := mqpp.MakePublish(false, qos, false, "t", 1, []byte(payload))
+	return &p
+}
+
+// payloads drains q and returns payloads of written publishes
+func payloads(t *testing.T, q *Queue) string {
+	var buf bytes.Buffer
+	if _, err := q.Drain(&buf); err != nil {
+		t.Fatal(err)
+	}
+	s := mqpp.NewSplitter(&buf)
+	var out []byte
+	for {
+		p, err := s.NextPacket()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if p == nil {
+			return string(out)
+		}
+		out = append(out, p.(*mqpp.Publish).Payload()...)
+	}
+}
+
+func TestSpillOrder(t *testing.T) {
+	q := New(Options{MaxMemory: int(publish(0, "a").Length() + publish(1, "b").Length()), SegmentPath: filepath.Join(t.TempDir(), "segment")})
+	defer q.Close()
+
+	for i, c := range "abcdef" {
+		if err := q.Push(publish(byte(i%3), string(c))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if q.segCount != 4 {
+		t.Fatalf("expect 4 packets spilled, actual %d", q.segCount)
+	}
+	if actual := payloads(t, q); actual != "abcdef" {
+		t.Fatalf("expect abcdef, actual %s", actual)
+	}
+
+	// memory is used again once the segment is drained
+	q.Push(publish(1, "g"))
+	if q.segCount != 0 || q.Len() != 1 {
+		t.Fatalf("expect packet in memory, actual %d spilled", q.segCount)
+	}
+}
+
+func TestQoS0Policy(t *testing.T) {
+	cases := []struct {
+		policy  Policy
+		segment bool
+		expect  string
+		dropped int
+	}{
+		{DropNewestQoS0, true, "abcd", 1},
+		{DropOldestQoS0, true, "bd", 3},
+		{SpillQoS0, true, "abcxd", 0},
+		{SpillQoS0, false, "abc", 1}, // QoS 0 dropped and QoS 1 refused without room
+	}
+	for _, c := range cases {
+		opts := Options{MaxMemory: int(2*publish(0, "a").Length() + publish(1, "b").Length()), Policy: c.policy}
+		if c.segment {
+			opts.SegmentPath = filepath.Join(t.TempDir(), "segment")
+		}
+		q := New(opts)
+		q.Push(publish(0, "a"))
+		q.Push(publish(1, "b"))
+		q.Push(publish(0, "c"))
+		q.Push(publish(0, "x"))
+		if err := q.Push(publish(1, "d")); (err == ErrFull) == c.segment {
+			t.Fatalf("policy %d: unexpected error %v", c.policy, err)
+		}
+		if actual := payloads(t, q); actual != c.expect || q.Dropped() != c.dropped {
+			t.Errorf("policy %d: expect %s dropped %d, actual %s dropped %d", c.policy, c.expect, c.dropped, actual, q.Dropped())
+		}
+		q.Close()
+	}
+}
+
+type failingWriter struct {
+	n int
+	bytes.Buffer
+}
+
+func (w *failingWriter) Write(p []byte) (int, error) {
+	if w.n == 0 {
+		return 0, errors.New("broken")
+	}
+	w.n--
+	return w.Buffer.Write(p)
+}
+
+func TestDrainFailure(t *testing.T) {
+	q := New(Options{MaxMemory: int(publish(1, "a").Length()), SegmentPath: filepath.Join(t.TempDir(), "segment")})
+	defer q.Close()
+	for _, c := range "abc" {
+		q.Push(publish(mqpp.QosAtLeastOnce, string(c)))
+	}
+
+	if n, err := q.Drain(&failingWriter{n: 1}); n != 1 || err == nil {
+		t.Fatalf("expect 1 written before failure, actual %d, %v", n, err)
+	}
+	q.Push(publish(mqpp.QosAtLeastOnce, "d"))
+	if actual := payloads(t, q); actual != "bcd" {
+		t.Fatalf("expect bcd, actual %s", actual)
+	}
+}
+
+func TestSegmentCompaction(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "segment")
+	q := New(Options{MaxMemory: 1, SegmentPath: path})
+	defer q.Close()
+
+	pad := string(make([]byte, 64<<10))
+	for i := 0; i < 40; i++ {
+		if err := q.Push(publish(1, string(rune('0'+i))+pad)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	pop := func(i int) {
+		p, err := q.popLocked()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if payload := p.(*mqpp.Publish).Payload(); payload[0] != byte('0'+i) {
+			t.Fatalf("no.%d: unexpected payload %c", i, payload[0])
+		}
+	}
+	for i := 0; i < 30; i++ {
+		pop(i)
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// compacted once half of it was read
+	if fi.Size() != q.segWrite || fi.Size() > 20*(64<<10+16) {
+		t.Fatalf("expect segment compacted, size %d", fi.Size())
+	}
+	for i := 30; i < 40; i++ {
+		pop(i)
+	}
+}
@@ -0,0 +1,142 @@
+// Copyright (c) 2016 The MQPP Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mqpp
+
+// Recovery of corrupted streams. A packet is plausible if its fixed header is
+// valid, its remaining length is minimally encoded and fits its packet type.
+// At the start of a healthy stream that's enough, but after corruption the next
+// packet must also be followed by another plausible fixed header, or the end of
+// stream, to be taken as a resynchronization point.
+
+// recoverWindow bounds the look ahead to confirm a resynchronization point, a
+// candidate packet and the fixed header after it must fit in, so they fit the
+// buffer of a Splitter limited to bufio.MaxScanTokenSize too
+const recoverWindow = 64 << 10
+
+// verdicts of plausible
+const (
+	implausible = iota
+	undecided   // more data needed
+	isPlausible
+)
+
+// remaining lengths of packet types: fixed ones, and the minimum of the others
+var (
+	fixedRemLen = map[byte]uint32{
+		TCONNACK: 2, TPUBACK: 2, TPUBREC: 2, TPUBREL: 2, TPUBCOMP: 2, TUNSUBACK: 2,
+		TPINGREQ: 0, TPINGRESP: 0, TDISCONNECT: 0,
+	}
+	minRemLen = map[byte]uint32{
+		TCONNECT: 10, TPUBLISH: 2, TSUBSCRIBE: 5, TSUBACK: 3, TUNSUBSCRIBE: 4,
+	}
+)
+
+func (s *Splitter) validHeader(b byte) bool {
+	if s.Lenient {
+		_, ok := fixedHeaderFlags[b>>4]
+		return ok
+	}
+	return ValidateFixedHeader(b) == nil
+}
+
+// plausible tells whether data starts with a plausible packet of length n.
+// confirm requires it to be followed by a plausible fixed header or the end of stream.
+func (s *Splitter) plausible(data []byte, atEOF, confirm bool) (n int, verdict int) {
+	if len(data) == 0 || !s.validHeader(data[0]) {
+		return 0, implausible
+	}
+	l, offset := endecBytes(data).remlen(1)
+	if offset == 1 {
+		if atEOF {
+			return 0, implausible
+		}
+		return 0, undecided
+	}
+	if offset <= 1 || (offset > 2 && data[offset-1] == 0) {
+		return 0, implausible
+	}
+	t := data[0] >> 4
+	if fixed, ok := fixedRemLen[t]; ok && l != fixed {
+		return 0, implausible
+	} else if l < minRemLen[t] {
+		return 0, implausible
+	}
+
+	n = offset + int(l)
+	switch {
+	case n > len(data) && (atEOF || (confirm && n >= recoverWindow)):
+		return 0, implausible
+	case n > len(data):
+		return 0, undecided
+	case !confirm || (n == len(data) && atEOF):
+		return n, isPlausible
+	case n == len(data):
+		return 0, undecided
+	case s.validHeader(data[n]):
+		return n, isPlausible
+	}
+	return 0, implausible
+}
+
+// recoverPackets is the split function of a recovering Splitter
+func (s *Splitter) recoverPackets(data []byte, atEOF bool) (advance int, token []byte, err error) {
+	if len(data) == 0 {
+		s.skipped()
+		return 0, nil, nil
+	}
+
+	if !s.resyncing {
+		n, verdict := s.plausible(data, atEOF, false)
+		switch verdict {
+		case isPlausible:
+			return n, data[:n], nil
+		case undecided:
+			return 0, nil, nil
+		}
+		s.resyncing, s.skipOffset, s.skipLength = true, s.offset, 0
+	}
+
+	for i := 0; i < len(data); i++ {
+		n, verdict := s.plausible(data[i:], atEOF, true)
+		switch {
+		case verdict == implausible:
+			continue
+		case verdict == undecided && i > 0:
+			// skip what's surely corrupted, and come back to the candidate with more data
+			s.skipLength += int64(i)
+			return i, nil, nil
+		case verdict == undecided:
+			return 0, nil, nil
+		}
+		// the scanner stops at EOF unless a token comes with the skipped bytes
+		s.skipLength += int64(i)
+		s.skipped()
+		return i + n, data[i : i+n], nil
+	}
+
+	s.skipLength += int64(len(data))
+	if atEOF {
+		s.skipped()
+	}
+	return len(data), nil, nil
+}
+
+// skipped ends resynchronization, and reports the skipped range
+func (s *Splitter) skipped() {
+	if s.resyncing && s.skipLength > 0 && s.OnSkip != nil {
+		s.OnSkip(s.skipOffset, s.skipLength)
+	}
+	s.resyncing = false
+}
@@ -0,0 +1,112 @@
+// Copyright (c) 2016 The MQPP Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mqpp
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+	"testing/iotest"
+)
+
+func TestRecover(t *testing.T) {
+	publish := MakePublish(false, QosAtLeastOnce, false, "a/b", 1, []byte("hello")).Bytes()
+	puback := MakePuback(1).Bytes()
+	subscribe := MakeSubscribe(2, []Subscription{{TopicFilter: "a/#", RequestedQoS: QosAtMostOnce}}).Bytes()
+
+	var stream bytes.Buffer
+	stream.Write(publish)
+	stream.Write([]byte{0x30, 0xff, 0xff, 0xff, 0xff, 0x7f}) // malformed remaining length
+	stream.Write(puback)
+	stream.Write([]byte{0x40, 0x05, 0x00}) // puback of a wrong length
+	stream.Write([]byte{0x00, 0x32, 0x01})
+	stream.Write(subscribe)
+	stream.Write(publish)
+	stream.Write(publish[:len(publish)-1]) // cut short
+
+	type skip struct{ offset, length int64 }
+	expectSkips := []skip{
+		{int64(len(publish)), 6},
+		{int64(len(publish) + 6 + len(puback)), 6},
+		{int64(2*len(publish) + 12 + len(puback) + len(subscribe)), int64(len(publish) - 1)},
+	}
+	expectTypes := []byte{TPUBLISH, TPUBACK, TSUBSCRIBE, TPUBLISH}
+
+	// whole, and byte by byte
+	for _, oneByte := range []bool{false, true} {
+		var skips []skip
+		s := NewSplitter(bytes.NewReader(stream.Bytes()))
+		if oneByte {
+			s = NewSplitter(iotest.OneByteReader(bytes.NewReader(stream.Bytes())))
+		}
+		s.Recover = true
+		s.OnSkip = func(offset, length int64) { skips = append(skips, skip{offset, length}) }
+
+		var types []byte
+		var offsets []int64
+		for s.Scan() {
+			p, err := s.Packet()
+			if err != nil {
+				t.Fatal(err)
+			}
+			types = append(types, p.Type())
+			offsets = append(offsets, s.Offset())
+		}
+		if s.Err() != nil {
+			t.Fatal(s.Err())
+		}
+		if !reflect.DeepEqual(types, expectTypes) {
+			t.Fatalf("one byte %v: types %v, expect %v", oneByte, types, expectTypes)
+		}
+		if !reflect.DeepEqual(skips, expectSkips) {
+			t.Fatalf("one byte %v: skips %v, expect %v", oneByte, skips, expectSkips)
+		}
+		if offsets[1] != int64(len(publish)+6) {
+			t.Fatalf("one byte %v: puback at %d", oneByte, offsets[1])
+		}
+	}
+
+	// without recovery, scanning stops at the malformed remaining length
+	s := NewSplitter(bytes.NewReader(stream.Bytes()))
+	n := 0
+	for s.Scan() {
+		n++
+	}
+	if n != 1 || s.Err() != ErrMalformedRemLen {
+		t.Fatalf("%d packets, %v", n, s.Err())
+	}
+}
+
+func TestRecoverWindow(t *testing.T) {
+	// a candidate as long as the window can't be confirmed, the byte after it doesn't fit
+	long := MakePublish(false, QosAtMostOnce, false, "a", 0, make([]byte, recoverWindow-7)).Bytes()
+	if len(long) != recoverWindow {
+		t.Fatalf("publish of %d bytes", len(long))
+	}
+	stream := append(append([]byte{0x00}, long...), MakePuback(1).Bytes()...)
+
+	s := NewSplitter(bytes.NewReader(stream))
+	s.Buffer(make([]byte, 4096), recoverWindow)
+	s.Recover = true
+	var skipped int64
+	s.OnSkip = func(offset, length int64) { skipped += length }
+	var types []byte
+	for s.Scan() {
+		types = append(types, s.Bytes()[0]>>4)
+	}
+	if s.Err() != nil || !reflect.DeepEqual(types, []byte{TPUBACK}) || skipped != int64(len(stream)-4) {
+		t.Fatalf("types %v, skipped %d, err %v", types, skipped, s.Err())
+	}
+}
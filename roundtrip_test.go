@@ -0,0 +1,195 @@
+// Copyright (c) 2016 The MQPP Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mqpp
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+	"testing/quick"
+)
+
+// checkMade checks p is encoded with remaining length remlen, and parses to the same fields
+func checkMade(t *testing.T, p ControlPacket, remlen int) bool {
+	bs := endecBytes(p.Bytes())
+	l, offset := bs.remlen(1)
+	if int(l) != remlen || offset != 1+bs.calc(uint32(remlen)) {
+		t.Errorf("% x: expect remaining length %d, actual %d", bs[:offset], remlen, l)
+		return false
+	}
+	if p.Length() != uint32(len(bs)) || len(bs) != offset+remlen {
+		t.Errorf("expect length %d, actual %d of %d bytes", offset+remlen, p.Length(), len(bs))
+		return false
+	}
+	parsed, err := Parse(bs)
+	if err != nil {
+		t.Errorf("% x: %v", bs, err)
+		return false
+	}
+	if !reflect.DeepEqual(packetFields(p), packetFields(parsed)) {
+		t.Errorf("expect %v, parsed %v", packetFields(p), packetFields(parsed))
+		return false
+	}
+	return true
+}
+
+func TestConnectRoundTrip(t *testing.T) {
+	f := func(willRetain bool, willQoS byte, cleanSession bool, keepAlive uint16, clientID, willTopic string, willMessage []byte, username string, password []byte) bool {
+		willQoS %= 3
+		if willTopic == "" { // MQTT-3.1.2-13, MQTT-3.1.2-15
+			willQoS, willRetain = QosAtMostOnce, false
+		}
+		p := MakeConnect(ProtocolName, ProtocolLevel, willRetain, willQoS, cleanSession, keepAlive, clientID, willTopic, willMessage, username, password)
+		remlen := 2 + len(ProtocolName) + 1 + 1 + 2 + 2 + len(clientID)
+		willFlag := willTopic != ""
+		if willFlag {
+			remlen += 2 + len(willTopic) + 2 + len(willMessage)
+		} else {
+			willMessage = nil
+		}
+		if username != "" {
+			remlen += 2 + len(username)
+		}
+		if len(password) > 0 {
+			remlen += 2 + len(password)
+		}
+		return p.ProtocolName() == ProtocolName && p.ProtocolLevel() == ProtocolLevel &&
+			p.WillRetain() == willRetain && p.WillQoS() == willQoS && p.CleanSession() == cleanSession &&
+			p.KeepAlive() == keepAlive && p.ClientIdentifier() == clientID &&
+			p.WillFlag() == willFlag && p.WillTopic() == willTopic && bytes.Equal(p.WillMessage(), willMessage) &&
+			p.UsernameFlag() == (username != "") && p.Username() == username &&
+			p.PasswordFlag() == (len(password) > 0) && bytes.Equal(p.Password(), password) &&
+			checkMade(t, &p, remlen)
+	}
+	if err := quick.Check(f, nil); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestConnackRoundTrip(t *testing.T) {
+	f := func(sessionPresent bool, returnCode byte) bool {
+		returnCode %= 6
+		p := MakeConnack(sessionPresent, returnCode)
+		return p.SessionPresent() == sessionPresent && p.ReturnCode() == returnCode && checkMade(t, &p, 2)
+	}
+	if err := quick.Check(f, nil); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestPublishRoundTrip(t *testing.T) {
+	f := func(dup bool, qos byte, retain bool, topicName string, packetID uint16, payload []byte) bool {
+		qos %= 3
+		dup = dup && qos > QosAtMostOnce
+		p := MakePublish(dup, qos, retain, topicName, packetID, payload)
+		remlen := 2 + len(topicName) + len(payload)
+		if qos > QosAtMostOnce {
+			remlen += 2
+		} else {
+			packetID = 0
+		}
+		return p.Dup() == dup && p.QoS() == qos && p.Retain() == retain && p.TopicName() == topicName &&
+			p.PacketIdentifier() == packetID && bytes.Equal(p.Payload(), payload) && checkMade(t, &p, remlen)
+	}
+	if err := quick.Check(f, nil); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestAckRoundTrip(t *testing.T) {
+	f := func(packetID uint16) bool {
+		puback, pubrec, pubrel, pubcomp, unsuback := MakePuback(packetID), MakePubrec(packetID), MakePubrel(packetID), MakePubcomp(packetID), MakeUnsuback(packetID)
+		return puback.PacketIdentifier() == packetID && checkMade(t, &puback, 2) &&
+			pubrec.PacketIdentifier() == packetID && checkMade(t, &pubrec, 2) &&
+			pubrel.PacketIdentifier() == packetID && checkMade(t, &pubrel, 2) &&
+			pubcomp.PacketIdentifier() == packetID && checkMade(t, &pubcomp, 2) &&
+			unsuback.PacketIdentifier() == packetID && checkMade(t, &unsuback, 2)
+	}
+	if err := quick.Check(f, nil); err != nil {
+		t.Error(err)
+	}
+
+	pingreq, pingresp, disconnect := MakePingreq(), MakePingresp(), MakeDisconnect()
+	checkMade(t, &pingreq, 0)
+	checkMade(t, &pingresp, 0)
+	checkMade(t, &disconnect, 0)
+}
+
+func TestSubscribeRoundTrip(t *testing.T) {
+	f := func(packetID uint16, payload []Subscription) bool {
+		remlen := 2
+		for i := range payload {
+			payload[i].RequestedQoS %= 3
+			remlen += 2 + len(payload[i].TopicFilter) + 1
+		}
+		p := MakeSubscribe(packetID, payload)
+		subs := p.Payload()
+		return p.PacketIdentifier() == packetID && len(subs) == len(payload) &&
+			(len(subs) == 0 || reflect.DeepEqual(subs, payload)) && checkMade(t, &p, remlen)
+	}
+	if err := quick.Check(f, nil); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestSubackRoundTrip(t *testing.T) {
+	f := func(packetID uint16, returnCodes []byte) bool {
+		p := MakeSuback(packetID, returnCodes)
+		return p.PacketIdentifier() == packetID && bytes.Equal(p.ReturnCodes(), returnCodes) && checkMade(t, &p, 2+len(returnCodes))
+	}
+	if err := quick.Check(f, nil); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestUnsubscribeRoundTrip(t *testing.T) {
+	f := func(packetID uint16, filters []string) bool {
+		remlen := 2
+		for _, filter := range filters {
+			remlen += 2 + len(filter)
+		}
+		p := MakeUnsubscribe(packetID, filters)
+		got := p.Payload()
+		return p.PacketIdentifier() == packetID && len(got) == len(filters) &&
+			(len(got) == 0 || reflect.DeepEqual(got, filters)) && checkMade(t, &p, remlen)
+	}
+	if err := quick.Check(f, nil); err != nil {
+		t.Error(err)
+	}
+}
+
+// TestRemainingLengthThresholds makes packets around the sizes where the remaining length grows a byte
+func TestRemainingLengthThresholds(t *testing.T) {
+	for _, remlen := range []int{0, 1, 127, 128, 16383, 16384, 2097151, 2097152} {
+		if remlen >= 3 {
+			publish := MakePublish(false, QosAtMostOnce, false, "t", 0, make([]byte, remlen-3))
+			if !checkMade(t, &publish, remlen) || len(publish.Payload()) != remlen-3 {
+				t.Errorf("publish of remaining length %d", remlen)
+			}
+		}
+		if remlen >= 2 {
+			suback := MakeSuback(1, bytes.Repeat([]byte{QosAtLeastOnce}, remlen-2))
+			if !checkMade(t, &suback, remlen) || len(suback.ReturnCodes()) != remlen-2 {
+				t.Errorf("suback of remaining length %d", remlen)
+			}
+		}
+		if remlen >= 12 && remlen-12 <= 65535 { // client id is at most 65535 bytes
+			connect := MakeConnect(ProtocolName, ProtocolLevel, false, QosAtMostOnce, true, 0, string(make([]byte, remlen-12)), "", nil, "", nil)
+			if !checkMade(t, &connect, remlen) {
+				t.Errorf("connect of remaining length %d", remlen)
+			}
+		}
+	}
+}
@@ -22,11 +22,50 @@ import (
 // Splitter wrap bufio.Scanner with SplitFunc which split a file into mqtt packets
 type Splitter struct {
 	bufio.Scanner
+
+	// Lenient skips validating flags of fixed headers, to inspect traffic of peers
+	// which don't follow the specification
+	Lenient bool
+
+	// Recover skips corrupted bytes to the next plausible packet instead of stopping
+	// at a malformed remaining length. OnSkip is called with each range of skipped bytes.
+	Recover bool
+	OnSkip  func(offset, length int64)
+
+	offset      int64 // of the unconsumed bytes
+	tokenOffset int64
+	resyncing   bool
+	skipOffset  int64
+	skipLength  int64
 }
 
 // Packet returns the most recent token generated by a call to Scan as a mqtt packet holding its bytes.
+// The packet refers to the underlying buffer of Splitter, it may be overwritten by next call to Scan,
+// copy the bytes and use Parse if the packet must outlive it.
 func (s *Splitter) Packet() (ControlPacket, error) {
-	data := s.Bytes()
+	if s.Lenient {
+		return ParseLenient(s.Bytes())
+	}
+	return Parse(s.Bytes())
+}
+
+// Parse parses a whole mqtt packet from data, the returned packet refers to data.
+// The fixed header is checked by ValidateFixedHeader.
+func Parse(data []byte) (ControlPacket, error) {
+	if len(data) < 2 {
+		return nil, ErrIncompletePacket
+	}
+	if err := ValidateFixedHeader(data[0]); err != nil {
+		return nil, err
+	}
+	return ParseLenient(data)
+}
+
+// ParseLenient parses like Parse, but accepts any flags of the fixed header.
+func ParseLenient(data []byte) (ControlPacket, error) {
+	if len(data) < 2 {
+		return nil, ErrIncompletePacket
+	}
 	switch data[0] >> 4 {
 	case TCONNECT:
 		return newConnect(data)
@@ -74,11 +113,30 @@ func (s *Splitter) NextPacket() (ControlPacket, error) {
 
 // NewSplitter returns a new Splitter to read from r, with The split function splitPackets.
 func NewSplitter(r io.Reader) *Splitter {
-	scanner := bufio.NewScanner(r)
-	scanner.Split(splitPackets)
-	return &Splitter{
-		Scanner: *scanner,
+	s := &Splitter{Scanner: *bufio.NewScanner(r)}
+	s.Split(s.split)
+	return s
+}
+
+// Offset returns the offset in the stream of the most recent token generated by Scan
+func (s *Splitter) Offset() int64 {
+	return s.tokenOffset
+}
+
+func (s *Splitter) split(data []byte, atEOF bool) (advance int, token []byte, err error) {
+	if s.Recover {
+		advance, token, err = s.recoverPackets(data, atEOF)
+	} else {
+		advance, token, err = splitPackets(data, atEOF)
+	}
+	if token != nil {
+		// skipped bytes may come before the token
+		s.tokenOffset = s.offset + int64(advance-len(token))
+	}
+	if advance > 0 {
+		s.offset += int64(advance)
 	}
+	return
 }
 
 // splitPackets is a split function for a bufio.Scanner that returns each
@@ -91,7 +149,7 @@ func splitPackets(data []byte, atEOF bool) (advance int, token []byte, err error
 
 	l, n := endecBytes(data).remlen(1)
 
-	if n == 0 {
+	if n == 1 { // no byte of remaining length available yet
 		if atEOF {
 			return 1, nil, ErrIncompletePacket
 		}
@@ -99,7 +157,7 @@ func splitPackets(data []byte, atEOF bool) (advance int, token []byte, err error
 		return 0, nil, nil
 	}
 
-	if n < 0 {
+	if n <= 0 {
 		return n, nil, ErrMalformedRemLen
 	}
 
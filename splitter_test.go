@@ -61,3 +61,29 @@ func TestScan(t *testing.T) {
 	// data := []byte{0x31, 0x0a, 0x00, 0x08, 0x54, 0x6f, 0x70, 0x69, 0x63, 0x41, 0x2f, 0x43}
 	// data2 := []byte{0x31, 0x9, 0x0, 0x7, 0x54, 0x6f, 0x70, 0x69, 0x63, 0x2f, 0x43}
 }
+
+func TestMalformedRemainingLength(t *testing.T) {
+	if l, offset := endecBytes([]byte{0x30, 0xff, 0xff, 0xff, 0x7f}).remlen(1); l != 268435455 || offset != 5 {
+		t.Fatalf("expect the largest remaining length, actual %d at %d", l, offset)
+	}
+
+	cases := []struct {
+		data []byte
+		err  error
+	}{
+		{[]byte{0x30, 0x80, 0x80, 0x80, 0x80, 0x00}, ErrMalformedRemLen}, // 5 bytes
+		{[]byte{0x30, 0x80, 0x80, 0x80, 0x80}, ErrMalformedRemLen},       // not ended in 4 bytes
+		{[]byte{0x30, 0x80, 0x80, 0x80}, ErrIncompletePacket},
+	}
+	for i, c := range cases {
+		s := NewSplitter(bytes.NewReader(c.data))
+		if p, err := s.NextPacket(); p != nil || err != c.err {
+			t.Errorf("no.%d: expect %v from Splitter, actual %v", i, c.err, err)
+		}
+		if c.err == ErrMalformedRemLen {
+			if _, err := Parse(append(c.data, make([]byte, 16)...)); err != c.err {
+				t.Errorf("no.%d: expect %v from Parse, actual %v", i, c.err, err)
+			}
+		}
+	}
+}
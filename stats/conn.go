@@ -0,0 +1,227 @@
+// Copyright (c) 2016 The MQPP Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stats
+
+import (
+	"io"
+	"net"
+	"sync"
+
+	"github.com/abo/mqpp"
+)
+
+// Splitter is a mqpp.Splitter whose packets and errors are recorded
+type Splitter struct {
+	*mqpp.Splitter
+	stats *Stats
+	dir   mqpp.Direction
+	done  bool
+}
+
+// Splitter wraps sp, its packets are recorded with dir
+func (s *Stats) Splitter(sp *mqpp.Splitter, dir mqpp.Direction) *Splitter {
+	return &Splitter{Splitter: sp, stats: s, dir: dir}
+}
+
+// Scan advances to the next packet like mqpp.Splitter.Scan, and records it
+func (s *Splitter) Scan() bool {
+	if s.Splitter.Scan() {
+		s.stats.Packet(s.dir, s.Bytes())
+		return true
+	}
+	if err := s.Err(); err != nil && !s.done {
+		s.stats.Error(s.dir, err)
+	}
+	s.done = true
+	return false
+}
+
+// NextPacket advances to the next packet like mqpp.Splitter.NextPacket, and records it
+func (s *Splitter) NextPacket() (mqpp.ControlPacket, error) {
+	if !s.Scan() {
+		return nil, s.Err()
+	}
+	return s.Packet()
+}
+
+// Conn is a net.Conn whose packets read and written are recorded with their direction.
+// A packet is buffered until it's complete, counting of a direction stops at a malformed
+// remaining length. The connection is counted as open, and its unacknowledged QoS 1 and 2
+// messages as in flight, until Close.
+type Conn struct {
+	net.Conn
+	stats *Stats
+
+	rmu sync.Mutex
+	in  framer
+	wmu sync.Mutex
+	out framer
+
+	fmu      sync.Mutex
+	inflight map[flight]byte // QoS of messages in flight
+	closed   bool
+}
+
+// flight identifies a QoS 1 or 2 message by the direction it was published in
+type flight struct {
+	dir mqpp.Direction
+	id  uint16
+}
+
+// Conn wraps nc, packets read from it are in direction read, e.g. mqpp.ClientToServer
+// on the server side
+func (s *Stats) Conn(nc net.Conn, read mqpp.Direction) *Conn {
+	s.mu.Lock()
+	s.conns++
+	s.connsTotal++
+	s.mu.Unlock()
+	return &Conn{Conn: nc, stats: s, in: framer{dir: read}, out: framer{dir: 1 - read}, inflight: make(map[flight]byte)}
+}
+
+// Read reads from the connection, and records the packets completed
+func (c *Conn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.rmu.Lock()
+	c.in.write(c, b[:n])
+	if err == io.EOF {
+		c.in.end(c)
+	}
+	c.rmu.Unlock()
+	return n, err
+}
+
+// Write writes to the connection, and records the packets completed
+func (c *Conn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.wmu.Lock()
+	c.out.write(c, b[:n])
+	c.wmu.Unlock()
+	return n, err
+}
+
+// Close closes the connection, and stops counting it
+func (c *Conn) Close() error {
+	err := c.Conn.Close()
+	c.fmu.Lock()
+	defer c.fmu.Unlock()
+	if c.closed {
+		return err
+	}
+	c.closed = true
+	c.stats.mu.Lock()
+	c.stats.conns--
+	for f, qos := range c.inflight {
+		c.stats.inflight[f.dir][qos]--
+	}
+	c.stats.mu.Unlock()
+	c.inflight = nil
+	return err
+}
+
+// packet records raw, and follows the QoS flows it belongs to
+func (c *Conn) packet(dir mqpp.Direction, raw []byte) {
+	var f flight
+	var qos byte
+	acked := true
+	switch p := c.stats.packet(dir, raw).(type) {
+	case *mqpp.Publish:
+		f, qos, acked = flight{dir, p.PacketIdentifier()}, p.QoS(), false
+	case *mqpp.Puback:
+		f, qos = flight{1 - dir, p.PacketIdentifier()}, mqpp.QosAtLeastOnce
+	case *mqpp.Pubcomp:
+		f, qos = flight{1 - dir, p.PacketIdentifier()}, mqpp.QosExactlyOnce
+	}
+	if qos == mqpp.QosAtMostOnce {
+		return
+	}
+
+	c.fmu.Lock()
+	defer c.fmu.Unlock()
+	if c.closed {
+		return
+	}
+	n := int64(0)
+	if q, ok := c.inflight[f]; acked && ok && q == qos {
+		delete(c.inflight, f)
+		n = -1
+	} else if !acked && !ok {
+		c.inflight[f] = qos
+		n = 1
+	}
+	if n != 0 {
+		c.stats.mu.Lock()
+		c.stats.inflight[f.dir][qos] += n
+		c.stats.mu.Unlock()
+	}
+}
+
+// framer cuts a stream into packets
+type framer struct {
+	dir    mqpp.Direction
+	buf    []byte
+	skip   int // bytes left of an oversized packet, which are not buffered
+	broken bool
+}
+
+func (f *framer) write(c *Conn, b []byte) {
+	if f.broken {
+		return
+	}
+	if f.skip > 0 {
+		n := f.skip
+		if n > len(b) {
+			n = len(b)
+		}
+		f.skip -= n
+		b = b[n:]
+	}
+	f.buf = append(f.buf, b...)
+	for {
+		remlen, n := header(f.buf)
+		if n < 0 {
+			c.stats.Error(f.dir, mqpp.ErrMalformedRemLen)
+			f.broken, f.buf = true, nil
+			return
+		}
+		if n == 0 {
+			break
+		}
+		if size := n + remlen; size > c.stats.opts.MaxPacketSize {
+			c.stats.oversized(f.dir, f.buf[0]>>4, size, remlen)
+			if len(f.buf) < size {
+				f.skip, f.buf = size-len(f.buf), nil
+				return
+			}
+			f.buf = f.buf[size:]
+			continue
+		}
+		if len(f.buf) < n+remlen {
+			break
+		}
+		c.packet(f.dir, f.buf[:n+remlen])
+		f.buf = f.buf[n+remlen:]
+	}
+	if len(f.buf) == 0 {
+		f.buf = nil // release the array of large packets
+	}
+}
+
+// end records the bytes of an unfinished packet at the end of stream
+func (f *framer) end(c *Conn) {
+	if (len(f.buf) > 0 || f.skip > 0) && !f.broken {
+		c.stats.Error(f.dir, mqpp.ErrIncompletePacket)
+	}
+	f.buf, f.skip = nil, 0
+}
@@ -0,0 +1,143 @@
+// Copyright (c) 2016 The MQPP Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stats
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/abo/mqpp"
+)
+
+// directionLabels are the label values of directions
+var directionLabels = [directions]string{
+	mqpp.ClientToServer: "client_to_server",
+	mqpp.ServerToClient: "server_to_client",
+}
+
+// errorLabels are the label values of Errors
+var errorLabels = map[error]string{
+	mqpp.ErrMalformedRemLen:    "malformed_remaining_length",
+	mqpp.ErrIncompletePacket:   "incomplete_packet",
+	mqpp.ErrProtocolViolation:  "protocol_violation",
+	mqpp.ErrReservedPacketType: "reserved_packet_type",
+}
+
+// Handler serves snapshots of s in the Prometheus text exposition format
+func Handler(s *Stats) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		WritePrometheus(w, s.Snapshot())
+	})
+}
+
+// WritePrometheus writes snap in the Prometheus text exposition format, metrics are prefixed with mqpp_
+func WritePrometheus(w io.Writer, snap Snapshot) error {
+	bw := bufio.NewWriter(w)
+	dirs := []mqpp.Direction{mqpp.ClientToServer, mqpp.ServerToClient}
+
+	metric(bw, "packets_total", "counter", "Packets by direction and type.")
+	for _, d := range dirs {
+		for t, n := range snap.Packets[d] {
+			if n > 0 || !reserved(byte(t)) {
+				sample(bw, "packets_total", n, "direction", directionLabels[d], "type", mqpp.TypeName(byte(t)))
+			}
+		}
+	}
+	metric(bw, "bytes_total", "counter", "Bytes of packets by direction and type.")
+	for _, d := range dirs {
+		for t, n := range snap.Bytes[d] {
+			if n > 0 || !reserved(byte(t)) {
+				sample(bw, "bytes_total", n, "direction", directionLabels[d], "type", mqpp.TypeName(byte(t)))
+			}
+		}
+	}
+	metric(bw, "remaining_length_bytes", "histogram", "Remaining length of packets by direction.")
+	for _, d := range dirs {
+		h, cum := snap.RemainingLength[d], uint64(0)
+		for i, n := range h.Counts {
+			cum += n
+			le := "+Inf"
+			if i < len(h.Bounds) {
+				le = strconv.Itoa(h.Bounds[i])
+			}
+			sample(bw, "remaining_length_bytes_bucket", cum, "direction", directionLabels[d], "le", le)
+		}
+		sample(bw, "remaining_length_bytes_sum", h.Sum, "direction", directionLabels[d])
+		sample(bw, "remaining_length_bytes_count", cum, "direction", directionLabels[d])
+	}
+	metric(bw, "publish_total", "counter", "PUBLISH packets by direction and QoS.")
+	for _, d := range dirs {
+		for qos, n := range snap.PublishQoS[d] {
+			sample(bw, "publish_total", n, "direction", directionLabels[d], "qos", strconv.Itoa(qos))
+		}
+	}
+	metric(bw, "parse_errors_total", "counter", "Errors of splitting and parsing packets by direction and error.")
+	for _, d := range dirs {
+		for _, e := range Errors {
+			sample(bw, "parse_errors_total", snap.Errors[d][e], "direction", directionLabels[d], "error", errorLabels[e])
+		}
+	}
+	metric(bw, "inflight_messages", "gauge", "QoS 1 and 2 messages not acknowledged yet by the direction they were published in.")
+	for _, d := range dirs {
+		for qos := mqpp.QosAtLeastOnce; qos <= mqpp.QosExactlyOnce; qos++ {
+			sample(bw, "inflight_messages", snap.Inflight[d][qos], "direction", directionLabels[d], "qos", strconv.Itoa(int(qos)))
+		}
+	}
+	metric(bw, "connections", "gauge", "Open connections.")
+	sample(bw, "connections", snap.Connections)
+	metric(bw, "connections_total", "counter", "Connections opened.")
+	sample(bw, "connections_total", snap.ConnectionsTotal)
+	metric(bw, "topic_messages", "gauge", "PUBLISH packets of the topics of most volume.")
+	for _, tc := range snap.Topics {
+		sample(bw, "topic_messages", tc.Messages, "topic", tc.Topic)
+	}
+	metric(bw, "topic_bytes", "gauge", "Bytes of PUBLISH packets of the topics of most volume.")
+	for _, tc := range snap.Topics {
+		sample(bw, "topic_bytes", tc.Bytes, "topic", tc.Topic)
+	}
+	return bw.Flush()
+}
+
+// reserved reports whether t is a reserved packet type, which is written only when seen
+func reserved(t byte) bool {
+	return t < mqpp.TCONNECT || t > mqpp.TDISCONNECT
+}
+
+func metric(w *bufio.Writer, name, typ, help string) {
+	fmt.Fprintf(w, "# HELP mqpp_%s %s\n# TYPE mqpp_%s %s\n", name, help, name, typ)
+}
+
+// sample writes a line of name with label name and value pairs
+func sample(w *bufio.Writer, name string, value interface{}, labels ...string) {
+	w.WriteString("mqpp_" + name)
+	for i := 0; i < len(labels); i += 2 {
+		sep := ","
+		if i == 0 {
+			sep = "{"
+		}
+		w.WriteString(sep + labels[i] + `="` + labelEscaper.Replace(labels[i+1]) + `"`)
+	}
+	if len(labels) > 0 {
+		w.WriteString("}")
+	}
+	fmt.Fprintf(w, " %d\n", value)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
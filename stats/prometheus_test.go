@@ -0,0 +1,122 @@
+// Copyright (c) 2016 The MQPP Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stats
+
+import (
+	"io"
+	"net"
+	"net/http/httptest"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/abo/mqpp"
+)
+
+func TestInflight(t *testing.T) {
+	st := New(Options{})
+	c, s := net.Pipe()
+	conn := st.Conn(c, mqpp.ClientToServer)
+	go io.Copy(io.Discard, s)
+
+	check := func(step string, sent, received [3]int64) {
+		t.Helper()
+		if snap := st.Snapshot(); snap.Inflight[mqpp.ServerToClient] != sent || snap.Inflight[mqpp.ClientToServer] != received {
+			t.Fatalf("%s: unexpected inflight %v", step, snap.Inflight)
+		}
+	}
+	read := func(p mqpp.ControlPacket) {
+		t.Helper()
+		go s.Write(p.Bytes())
+		if _, err := conn.Read(make([]byte, len(p.Bytes()))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	pub1 := mqpp.MakePublish(false, 1, false, "t", 1, nil)
+	pub2 := mqpp.MakePublish(false, 2, false, "t", 2, nil)
+	conn.Write(stream(&pub1, &pub2, &pub1))
+	check("published", [3]int64{0, 1, 1}, [3]int64{})
+	read(mqpp.MakePuback(1))
+	check("puback", [3]int64{0, 0, 1}, [3]int64{})
+	read(mqpp.MakePubrec(2))
+	conn.Write(mqpp.MakePubrel(2).Bytes())
+	check("pubrec", [3]int64{0, 0, 1}, [3]int64{})
+	read(mqpp.MakePubcomp(1)) // not a QoS 2 message
+	check("unknown pubcomp", [3]int64{0, 0, 1}, [3]int64{})
+	read(mqpp.MakePubcomp(2))
+	check("pubcomp", [3]int64{}, [3]int64{})
+
+	read(&pub1)
+	read(&pub2)
+	check("received", [3]int64{}, [3]int64{0, 1, 1})
+	if snap := st.Snapshot(); snap.Connections != 1 || snap.ConnectionsTotal != 1 {
+		t.Fatalf("unexpected connections %d/%d", snap.Connections, snap.ConnectionsTotal)
+	}
+	conn.Close()
+	conn.Close()
+	check("closed", [3]int64{}, [3]int64{})
+	if snap := st.Snapshot(); snap.Connections != 0 || snap.ConnectionsTotal != 1 {
+		t.Fatalf("unexpected connections %d/%d", snap.Connections, snap.ConnectionsTotal)
+	}
+}
+
+func TestPrometheus(t *testing.T) {
+	st := New(Options{})
+	pub := mqpp.MakePublish(false, 1, false, `a"b\c`, 1, []byte("hello"))
+	st.Packet(mqpp.ClientToServer, pub.Bytes())
+	st.Packet(mqpp.ServerToClient, mqpp.MakePuback(1).Bytes())
+	st.Packet(mqpp.ClientToServer, []byte{0xf0, 0x00})
+	st.Conn(nil, mqpp.ClientToServer)
+
+	rec := httptest.NewRecorder()
+	Handler(st).ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Fatalf("unexpected content type %s", ct)
+	}
+	body := rec.Body.String()
+	line := regexp.MustCompile(`^(# (HELP|TYPE) mqpp_\w+ .+|mqpp_\w+(\{\w+="([^"\\]|\\.)*"(,\w+="([^"\\]|\\.)*")*\})? \d+)$`)
+	for _, l := range strings.Split(strings.TrimSuffix(body, "\n"), "\n") {
+		if !line.MatchString(l) {
+			t.Fatalf("invalid line %q", l)
+		}
+	}
+	for _, l := range []string{
+		"# TYPE mqpp_packets_total counter",
+		`mqpp_packets_total{direction="client_to_server",type="PUBLISH"} 1`,
+		`mqpp_packets_total{direction="server_to_client",type="PUBACK"} 1`,
+		`mqpp_packets_total{direction="client_to_server",type="RESERVED(15)"} 1`,
+		`mqpp_bytes_total{direction="client_to_server",type="PUBLISH"} ` + strconv.Itoa(len(pub.Bytes())),
+		`mqpp_remaining_length_bytes_bucket{direction="client_to_server",le="8"} 1`,
+		`mqpp_remaining_length_bytes_bucket{direction="client_to_server",le="32"} 2`,
+		`mqpp_remaining_length_bytes_bucket{direction="client_to_server",le="+Inf"} 2`,
+		`mqpp_remaining_length_bytes_count{direction="server_to_client"} 1`,
+		`mqpp_publish_total{direction="client_to_server",qos="1"} 1`,
+		`mqpp_parse_errors_total{direction="client_to_server",error="reserved_packet_type"} 1`,
+		`mqpp_parse_errors_total{direction="server_to_client",error="malformed_remaining_length"} 0`,
+		`mqpp_inflight_messages{direction="server_to_client",qos="2"} 0`,
+		"mqpp_connections 1",
+		"mqpp_connections_total 1",
+		`mqpp_topic_bytes{topic="a\"b\\c"} ` + strconv.Itoa(len(pub.Bytes())),
+	} {
+		if !strings.Contains(body, "\n"+l+"\n") {
+			t.Fatalf("%s missing in\n%s", l, body)
+		}
+	}
+	if strings.Contains(body, "RESERVED(0)") {
+		t.Fatalf("unseen reserved type written\n%s", body)
+	}
+}
@@ -0,0 +1,268 @@
+// Copyright (c) 2016 The MQPP Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package stats counts mqtt traffic per packet type and direction.
+//
+// A Stats is fed by wrapping the Splitter or the net.Conn a stream is decoded
+// from, or by calling Packet and Error directly:
+//
+//	st := stats.New(stats.Options{})
+//	nc = st.Conn(nc, mqpp.ClientToServer)
+//	...
+//	snap := st.Snapshot()
+//	fmt.Println(snap.Packets[mqpp.ClientToServer][mqpp.TPUBLISH])
+//
+// Handler serves snapshots in the Prometheus text exposition format:
+//
+//	http.Handle("/metrics", stats.Handler(st))
+package stats
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/abo/mqpp"
+)
+
+const directions = 2 // indexes of mqpp.Direction
+
+// Errors are the sentinels parse errors are counted by
+var Errors = []error{mqpp.ErrMalformedRemLen, mqpp.ErrIncompletePacket, mqpp.ErrProtocolViolation, mqpp.ErrReservedPacketType}
+
+// RemainingLengthBounds are the upper bounds of the buckets of remaining length histograms
+var RemainingLengthBounds = []int{0, 2, 8, 32, 128, 512, 2048, 8192, 32768, 131072, 524288, 2097152, 16777216}
+
+// Options configures a Stats
+type Options struct {
+	// TopN is the number of topics of snapshots, default 10
+	TopN int
+	// MaxTopics bounds the topics being tracked, default 1000. Once reached, a new
+	// topic replaces the one of least volume and inherits its counts, so counts
+	// of snapshots are upper bounds.
+	MaxTopics int
+	// MaxPacketSize bounds packets a Conn buffers to parse, default 1MiB. A larger
+	// one is counted by its fixed header only, its PUBLISH topic and QoS flow are missed.
+	MaxPacketSize int
+}
+
+// Histogram counts values by buckets. Counts[i] holds the values no larger than
+// Bounds[i] and larger than Bounds[i-1], the last count holds those above all bounds.
+type Histogram struct {
+	Bounds []int
+	Counts []uint64
+	Sum    uint64
+}
+
+// Count returns the number of values
+func (h Histogram) Count() uint64 {
+	n := uint64(0)
+	for _, c := range h.Counts {
+		n += c
+	}
+	return n
+}
+
+func (h *Histogram) observe(v int) {
+	i := sort.SearchInts(h.Bounds, v)
+	h.Counts[i]++
+	h.Sum += uint64(v)
+}
+
+// TopicCount is the volume of PUBLISH of a topic, both directions together
+type TopicCount struct {
+	Topic    string
+	Messages uint64
+	Bytes    uint64
+}
+
+// Snapshot is a copy of the statistics, arrays are indexed by mqpp.Direction and packet type
+type Snapshot struct {
+	Packets         [directions][16]uint64
+	Bytes           [directions][16]uint64
+	RemainingLength [directions]Histogram
+	PublishQoS      [directions][3]uint64
+	Errors          [directions]map[error]uint64 // by the sentinels of Errors
+	Topics          []TopicCount                 // top N by bytes, descending
+
+	// Of connections wrapped by Conn only
+	Connections      int64                // open
+	ConnectionsTotal uint64               // ever wrapped
+	Inflight         [directions][3]int64 // QoS 1 and 2 messages published in a direction and not acknowledged yet
+}
+
+// Stats collects statistics of mqtt packets, it is safe for concurrent use
+type Stats struct {
+	opts Options
+
+	mu      sync.Mutex
+	packets [directions][16]uint64
+	bytes   [directions][16]uint64
+	remlen  [directions]Histogram
+	qos     [directions][3]uint64
+	errors  [directions][]uint64 // indexed like Errors
+	topics  map[string]*TopicCount
+
+	conns      int64
+	connsTotal uint64
+	inflight   [directions][3]int64
+}
+
+// New create a Stats with options
+func New(opts Options) *Stats {
+	if opts.TopN <= 0 {
+		opts.TopN = 10
+	}
+	if opts.MaxTopics < opts.TopN {
+		opts.MaxTopics = 1000
+		if opts.MaxTopics < opts.TopN {
+			opts.MaxTopics = opts.TopN
+		}
+	}
+	if opts.MaxPacketSize <= 0 {
+		opts.MaxPacketSize = 1 << 20
+	}
+	s := &Stats{opts: opts, topics: make(map[string]*TopicCount)}
+	for d := 0; d < directions; d++ {
+		s.remlen[d] = Histogram{Bounds: RemainingLengthBounds, Counts: make([]uint64, len(RemainingLengthBounds)+1)}
+		s.errors[d] = make([]uint64, len(Errors))
+	}
+	return s
+}
+
+// Packet records a whole packet, which is parsed to count PUBLISH and parse errors
+func (s *Stats) Packet(dir mqpp.Direction, raw []byte) {
+	s.packet(dir, raw)
+}
+
+// packet records raw and returns it parsed, nil if it's invalid
+func (s *Stats) packet(dir mqpp.Direction, raw []byte) mqpp.ControlPacket {
+	if len(raw) == 0 {
+		return nil
+	}
+	t := raw[0] >> 4
+	p, err := mqpp.Parse(raw)
+	pub, _ := p.(*mqpp.Publish)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	remlen, n := header(raw)
+	s.countLocked(dir, t, len(raw), remlen, n > 0)
+	if err != nil {
+		s.errorLocked(dir, err)
+		return nil
+	}
+	if pub != nil {
+		s.qos[dir][pub.QoS()]++
+		s.topicLocked(pub.TopicName(), len(raw))
+	}
+	return p
+}
+
+// oversized records a packet by its fixed header, without its bytes
+func (s *Stats) oversized(dir mqpp.Direction, t byte, size, remlen int) {
+	s.mu.Lock()
+	s.countLocked(dir, t, size, remlen, true)
+	s.mu.Unlock()
+}
+
+func (s *Stats) countLocked(dir mqpp.Direction, t byte, size, remlen int, hasRemlen bool) {
+	s.packets[dir][t]++
+	s.bytes[dir][t] += uint64(size)
+	if hasRemlen {
+		s.remlen[dir].observe(remlen)
+	}
+}
+
+// Error records an error of splitting or parsing a stream, errors other than Errors are ignored
+func (s *Stats) Error(dir mqpp.Direction, err error) {
+	s.mu.Lock()
+	s.errorLocked(dir, err)
+	s.mu.Unlock()
+}
+
+func (s *Stats) errorLocked(dir mqpp.Direction, err error) {
+	for i, e := range Errors {
+		if e == err {
+			s.errors[dir][i]++
+			return
+		}
+	}
+}
+
+func (s *Stats) topicLocked(topic string, n int) {
+	tc := s.topics[topic]
+	if tc == nil {
+		tc = &TopicCount{Topic: topic}
+		if len(s.topics) >= s.opts.MaxTopics {
+			var least *TopicCount
+			for _, c := range s.topics {
+				if least == nil || c.Bytes < least.Bytes {
+					least = c
+				}
+			}
+			delete(s.topics, least.Topic)
+			tc.Messages, tc.Bytes = least.Messages, least.Bytes
+		}
+		s.topics[topic] = tc
+	}
+	tc.Messages++
+	tc.Bytes += uint64(n)
+}
+
+// Snapshot returns a copy of the statistics
+func (s *Stats) Snapshot() Snapshot {
+	var snap Snapshot
+	s.mu.Lock()
+	snap.Packets, snap.Bytes, snap.PublishQoS = s.packets, s.bytes, s.qos
+	snap.Connections, snap.ConnectionsTotal, snap.Inflight = s.conns, s.connsTotal, s.inflight
+	for d := 0; d < directions; d++ {
+		snap.RemainingLength[d] = s.remlen[d]
+		snap.RemainingLength[d].Counts = append([]uint64(nil), s.remlen[d].Counts...)
+		snap.Errors[d] = make(map[error]uint64, len(Errors))
+		for i, e := range Errors {
+			snap.Errors[d][e] = s.errors[d][i]
+		}
+	}
+	snap.Topics = make([]TopicCount, 0, len(s.topics))
+	for _, tc := range s.topics {
+		snap.Topics = append(snap.Topics, *tc)
+	}
+	s.mu.Unlock()
+
+	sort.Slice(snap.Topics, func(i, j int) bool {
+		a, b := snap.Topics[i], snap.Topics[j]
+		return a.Bytes > b.Bytes || a.Bytes == b.Bytes && a.Topic < b.Topic
+	})
+	if len(snap.Topics) > s.opts.TopN {
+		snap.Topics = snap.Topics[:s.opts.TopN]
+	}
+	return snap
+}
+
+// header decodes the remaining length of a packet, n is the length of its fixed
+// header, 0 if more bytes are needed and -1 if the remaining length is malformed
+func header(raw []byte) (remlen, n int) {
+	mul := 1
+	for i := 1; i < len(raw); i++ {
+		if i > 4 {
+			return 0, -1
+		}
+		remlen += int(raw[i]&0x7f) * mul
+		if raw[i]&0x80 == 0 {
+			return remlen, i + 1
+		}
+		mul <<= 7
+	}
+	return 0, 0
+}
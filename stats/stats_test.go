@@ -0,0 +1,199 @@
+// Copyright (c) 2016 The MQPP Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stats
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"testing"
+
+	"github.com/abo/mqpp"
+)
+
+func stream(pkts ...mqpp.ControlPacket) []byte {
+	var buf bytes.Buffer
+	for _, p := range pkts {
+		p.WriteTo(&buf)
+	}
+	return buf.Bytes()
+}
+
+func TestSplitter(t *testing.T) {
+	pub0 := mqpp.MakePublish(false, 0, false, "a", 0, []byte("hello"))
+	pub1 := mqpp.MakePublish(false, 1, false, "b", 1, make([]byte, 200))
+	ack := mqpp.MakePuback(1)
+	data := stream(&pub0, &pub1, &pub1, &ack)
+	data = append(data, 0x60, 0x02, 0x00, 0x01) // PUBREL with invalid flags
+	data = append(data, 0x30, 0x05, 0x00)       // incomplete
+
+	st := New(Options{})
+	sp := st.Splitter(mqpp.NewSplitter(bytes.NewReader(data)), mqpp.ClientToServer)
+	n := 0
+	for sp.Scan() {
+		n++
+	}
+	sp.Scan()
+	if n != 5 || sp.Err() != mqpp.ErrIncompletePacket {
+		t.Fatalf("%d packets, %v", n, sp.Err())
+	}
+
+	snap := st.Snapshot()
+	rx := mqpp.ClientToServer
+	if snap.Packets[rx][mqpp.TPUBLISH] != 3 || snap.Packets[rx][mqpp.TPUBACK] != 1 || snap.Packets[rx][mqpp.TPUBREL] != 1 {
+		t.Fatalf("unexpected packets %v", snap.Packets[rx])
+	}
+	if snap.Bytes[rx][mqpp.TPUBLISH] != uint64(len(pub0.Bytes())+2*len(pub1.Bytes())) {
+		t.Fatalf("unexpected bytes %v", snap.Bytes[rx])
+	}
+	if snap.PublishQoS[rx] != [3]uint64{1, 2, 0} {
+		t.Fatalf("unexpected qos %v", snap.PublishQoS[rx])
+	}
+	if snap.Errors[rx][mqpp.ErrProtocolViolation] != 1 || snap.Errors[rx][mqpp.ErrIncompletePacket] != 1 || snap.Errors[rx][mqpp.ErrMalformedRemLen] != 0 {
+		t.Fatalf("unexpected errors %v", snap.Errors[rx])
+	}
+	h := snap.RemainingLength[rx]
+	// 8 of pub0, 205 of pub1, 2 of puback and pubrel
+	if h.Count() != 5 || h.Sum != 8+2*205+2+2 || h.Counts[1] != 2 || h.Counts[2] != 1 || h.Counts[5] != 2 {
+		t.Fatalf("unexpected histogram %+v", h)
+	}
+	if len(snap.Topics) != 2 || snap.Topics[0] != (TopicCount{"b", 2, uint64(2 * len(pub1.Bytes()))}) || snap.Topics[1].Topic != "a" {
+		t.Fatalf("unexpected topics %+v", snap.Topics)
+	}
+	if snap.Packets[mqpp.ServerToClient] != [16]uint64{} {
+		t.Fatalf("unexpected sent %v", snap.Packets[mqpp.ServerToClient])
+	}
+}
+
+func TestConn(t *testing.T) {
+	st := New(Options{})
+	c, s := net.Pipe()
+	conn := st.Conn(c, mqpp.ClientToServer)
+
+	pub := mqpp.MakePublish(false, 2, true, "t", 7, make([]byte, 300))
+	rec := mqpp.MakePubrec(7)
+	data := stream(&pub, &rec)
+	go func() {
+		// one byte at a time, then a malformed remaining length
+		for _, b := range data {
+			s.Write([]byte{b})
+		}
+		s.Write([]byte{0x30, 0xff, 0xff, 0xff, 0xff, 0x01})
+		s.Close()
+	}()
+	if _, err := io.ReadAll(conn); err != nil {
+		t.Fatal(err)
+	}
+
+	c, s = net.Pipe()
+	conn = st.Conn(c, mqpp.ClientToServer)
+	go io.Copy(io.Discard, s)
+	conn.Write(data)
+	conn.Write(data[:3])
+	conn.Write(data[3:])
+	conn.Close()
+
+	snap := st.Snapshot()
+	for _, dir := range []mqpp.Direction{mqpp.ClientToServer, mqpp.ServerToClient} {
+		n := uint64(1)
+		if dir == mqpp.ServerToClient {
+			n = 2
+		}
+		if snap.Packets[dir][mqpp.TPUBLISH] != n || snap.Packets[dir][mqpp.TPUBREC] != n || snap.PublishQoS[dir][2] != n {
+			t.Fatalf("%v: unexpected packets %v", dir, snap.Packets[dir])
+		}
+	}
+	if snap.Errors[mqpp.ClientToServer][mqpp.ErrMalformedRemLen] != 1 || snap.Errors[mqpp.ClientToServer][mqpp.ErrIncompletePacket] != 0 {
+		t.Fatalf("unexpected errors %v", snap.Errors[mqpp.ClientToServer])
+	}
+	if len(snap.Topics) != 1 || snap.Topics[0].Messages != 3 {
+		t.Fatalf("unexpected topics %+v", snap.Topics)
+	}
+}
+
+func TestConnOversized(t *testing.T) {
+	st := New(Options{MaxPacketSize: 64})
+	c, s := net.Pipe()
+	conn := st.Conn(c, mqpp.ClientToServer)
+	go io.Copy(io.Discard, s)
+
+	pub := mqpp.MakePublish(false, 2, false, "t", 7, make([]byte, 300))
+	rec := mqpp.MakePubrec(7)
+	data := stream(&pub, &rec)
+	conn.Write(data[:3])
+	conn.Write(data[3:100])
+	conn.Write(data[100:])
+	conn.Close()
+
+	out := mqpp.ServerToClient
+	snap := st.Snapshot()
+	if snap.Packets[out][mqpp.TPUBLISH] != 1 || snap.Bytes[out][mqpp.TPUBLISH] != uint64(len(pub.Bytes())) || snap.Packets[out][mqpp.TPUBREC] != 1 {
+		t.Fatalf("unexpected packets %v, bytes %v", snap.Packets[out], snap.Bytes[out])
+	}
+	if snap.PublishQoS[out][2] != 0 || len(snap.Topics) != 0 || snap.Errors[out][mqpp.ErrIncompletePacket] != 0 {
+		t.Fatalf("oversized publish parsed, %+v", snap)
+	}
+}
+
+func TestTopTopics(t *testing.T) {
+	st := New(Options{TopN: 2, MaxTopics: 3})
+	publish := func(topic string, size int) {
+		p := mqpp.MakePublish(false, 0, false, topic, 0, make([]byte, size))
+		st.Packet(mqpp.ServerToClient, p.Bytes())
+	}
+	publish("big", 1000)
+	publish("mid", 500)
+	publish("small", 10)
+	publish("new", 20) // replaces small, inherits its volume
+	publish("big", 1000)
+
+	snap := st.Snapshot()
+	if len(snap.Topics) != 2 || snap.Topics[0].Topic != "big" || snap.Topics[0].Messages != 2 || snap.Topics[1].Topic != "mid" {
+		t.Fatalf("unexpected topics %+v", snap.Topics)
+	}
+	st = New(Options{TopN: 3, MaxTopics: 3})
+	publish("big", 1000)
+	publish("mid", 500)
+	publish("small", 10)
+	publish("new", 20)
+	if snap := st.Snapshot(); snap.Topics[2].Topic != "new" || snap.Topics[2].Messages != 2 {
+		t.Fatalf("unexpected topics %+v", snap.Topics)
+	}
+}
+
+func TestConcurrent(t *testing.T) {
+	st := New(Options{})
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			p := mqpp.MakePublish(false, 1, false, fmt.Sprintf("t/%d", i), 1, nil)
+			for j := 0; j < 1000; j++ {
+				st.Packet(mqpp.Direction(j%2), p.Bytes())
+				if j%100 == 0 {
+					st.Snapshot()
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	snap := st.Snapshot()
+	if snap.Packets[mqpp.ClientToServer][mqpp.TPUBLISH] != 4000 || snap.Packets[mqpp.ServerToClient][mqpp.TPUBLISH] != 4000 || len(snap.Topics) != 8 {
+		t.Fatalf("unexpected %v %v", snap.Packets, snap.Topics)
+	}
+}
@@ -0,0 +1,206 @@
+// Copyright (c) 2016 The MQPP Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package store persists MQTT state shared by clients and brokers: retained
+// messages and sessions, in memory or backed by files.
+package store
+
+import (
+	"errors"
+	"strings"
+	"sync"
+
+	"github.com/abo/mqpp"
+)
+
+// ErrLimitExceeded - storing the message or session would exceed a count or size limit
+var ErrLimitExceeded = errors.New("mqpp/store: Limit Exceeded")
+
+// RetainedStore keeps the last retained message of every topic
+type RetainedStore interface {
+	// Store saves p as the retained message of its topic, a zero-length payload
+	// deletes the retained message of the topic instead.
+	Store(p *mqpp.Publish) error
+	// Match returns retained messages whose topic matches filter, which may contain wildcards
+	Match(filter string) ([]*mqpp.Publish, error)
+	// Close releases resources held by the store
+	Close() error
+}
+
+// RetainedLimits bounds a retained store, zero means unlimited
+type RetainedLimits struct {
+	MaxCount int // maximum number of retained messages
+	MaxBytes int // maximum total payload bytes
+}
+
+// topicNode is a level of the topic trie
+type topicNode struct {
+	children map[string]*topicNode
+	msg      *mqpp.Publish
+}
+
+// MemoryRetained is a RetainedStore holding messages in a topic trie
+type MemoryRetained struct {
+	limits RetainedLimits
+
+	mu    sync.RWMutex
+	root  topicNode
+	count int
+	bytes int
+}
+
+// NewMemoryRetained create an empty in-memory retained store
+func NewMemoryRetained(limits RetainedLimits) *MemoryRetained {
+	return &MemoryRetained{limits: limits}
+}
+
+// Store implements RetainedStore, the message is copied
+func (m *MemoryRetained) Store(p *mqpp.Publish) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.storeLocked(p)
+}
+
+func (m *MemoryRetained) storeLocked(p *mqpp.Publish) error {
+	levels := strings.Split(p.TopicName(), "/")
+	if len(p.Payload()) == 0 {
+		m.deleteLocked(&m.root, levels)
+		return nil
+	}
+
+	n := &m.root
+	for _, l := range levels {
+		if child, ok := n.children[l]; ok {
+			n = child
+			continue
+		}
+		if m.limits.MaxCount > 0 && m.count >= m.limits.MaxCount {
+			return ErrLimitExceeded
+		}
+		if n.children == nil {
+			n.children = make(map[string]*topicNode)
+		}
+		child := &topicNode{}
+		n.children[l] = child
+		n = child
+	}
+
+	count, bytes := m.count, m.bytes+len(p.Payload())
+	if n.msg != nil {
+		bytes -= len(n.msg.Payload())
+	} else {
+		count++
+	}
+	if (m.limits.MaxCount > 0 && count > m.limits.MaxCount) || (m.limits.MaxBytes > 0 && bytes > m.limits.MaxBytes) {
+		if n.msg == nil {
+			m.deleteLocked(&m.root, levels)
+		}
+		return ErrLimitExceeded
+	}
+
+	retained := mqpp.MakePublish(false, p.QoS(), true, p.TopicName(), 0, p.Payload())
+	n.msg = &retained
+	m.count, m.bytes = count, bytes
+	return nil
+}
+
+// deleteLocked removes the message of levels under n, and prunes empty nodes.
+// it returns whether n became empty.
+func (m *MemoryRetained) deleteLocked(n *topicNode, levels []string) bool {
+	if len(levels) == 0 {
+		if n.msg != nil {
+			m.count--
+			m.bytes -= len(n.msg.Payload())
+			n.msg = nil
+		}
+	} else if child, ok := n.children[levels[0]]; ok && m.deleteLocked(child, levels[1:]) {
+		delete(n.children, levels[0])
+	}
+	return n.msg == nil && len(n.children) == 0
+}
+
+// Match implements RetainedStore
+func (m *MemoryRetained) Match(filter string) ([]*mqpp.Publish, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var msgs []*mqpp.Publish
+	levels := strings.Split(filter, "/")
+	for name, child := range m.root.children {
+		// wildcards at the first level don't match topics begin with '$'
+		if strings.HasPrefix(name, "$") && (levels[0] == "+" || levels[0] == "#") {
+			continue
+		}
+		msgs = matchNode(child, name, levels, msgs)
+	}
+	return msgs, nil
+}
+
+// matchNode collects messages under n, whose level name is matched against the head of levels
+func matchNode(n *topicNode, name string, levels []string, msgs []*mqpp.Publish) []*mqpp.Publish {
+	switch levels[0] {
+	case "#":
+		return collectNode(n, msgs)
+	case "+":
+	default:
+		if levels[0] != name {
+			return msgs
+		}
+	}
+
+	rest := levels[1:]
+	if len(rest) == 0 {
+		if n.msg != nil {
+			msgs = append(msgs, n.msg)
+		}
+		return msgs
+	}
+	if rest[0] == "#" && n.msg != nil { // "a/#" matches "a" too
+		msgs = append(msgs, n.msg)
+	}
+	for childName, child := range n.children {
+		msgs = matchNode(child, childName, rest, msgs)
+	}
+	return msgs
+}
+
+// collectNode collects all messages under n, n included
+func collectNode(n *topicNode, msgs []*mqpp.Publish) []*mqpp.Publish {
+	if n.msg != nil {
+		msgs = append(msgs, n.msg)
+	}
+	for _, child := range n.children {
+		msgs = collectNode(child, msgs)
+	}
+	return msgs
+}
+
+// all returns every retained message
+func (m *MemoryRetained) all() []*mqpp.Publish {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return collectNode(&m.root, nil)
+}
+
+// Len returns the number of retained messages
+func (m *MemoryRetained) Len() int {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.count
+}
+
+// Close implements RetainedStore
+func (m *MemoryRetained) Close() error {
+	return nil
+}
@@ -0,0 +1,144 @@
+// Copyright (c) 2016 The MQPP Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package store
+
+import (
+	"io"
+	"os"
+	"sync"
+
+	"github.com/abo/mqpp"
+)
+
+// compactThreshold is the minimum number of stale records before a log file is compacted
+const compactThreshold = 1024
+
+// FileRetained is a RetainedStore kept in memory and logged to a file, so it
+// survives restarts. The file is a plain sequence of retained PUBLISH packets,
+// one with zero-length payload records a deletion. It's rewritten once stale
+// records outnumber live messages.
+type FileRetained struct {
+	mem  *MemoryRetained
+	path string
+
+	mu      sync.Mutex
+	f       *os.File
+	records int
+}
+
+// OpenFileRetained opens or creates the retained store at path. A partial record
+// at the end of file, left by a crash, is discarded.
+func OpenFileRetained(path string, limits RetainedLimits) (*FileRetained, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &FileRetained{mem: NewMemoryRetained(limits), path: path, f: f}
+	s := mqpp.NewSplitter(f)
+	s.Buffer(make([]byte, 4096), mqpp.MaxPacketSize)
+	var good int64
+	for s.Scan() {
+		p, err := mqpp.Parse(append([]byte(nil), s.Bytes()...))
+		pub, ok := p.(*mqpp.Publish)
+		if err != nil || !ok {
+			break
+		}
+		r.mem.Store(pub)
+		r.records++
+		good += int64(len(s.Bytes()))
+	}
+	if err := f.Truncate(good); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if _, err := f.Seek(good, io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return r, nil
+}
+
+// Store implements RetainedStore
+func (r *FileRetained) Store(p *mqpp.Publish) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if err := r.mem.Store(p); err != nil {
+		return err
+	}
+	record := mqpp.MakePublish(false, p.QoS(), true, p.TopicName(), 0, p.Payload())
+	if _, err := record.WriteTo(r.f); err != nil {
+		return err
+	}
+	r.records++
+	if stale := r.records - r.mem.Len(); stale > compactThreshold && stale > r.mem.Len() {
+		return r.compactLocked()
+	}
+	return nil
+}
+
+// compactLocked rewrites the file with live messages only, the new file replaces
+// the old one by rename so a crash leaves either of them intact.
+func (r *FileRetained) compactLocked() error {
+	tmp := r.path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	msgs := r.mem.all()
+	for _, p := range msgs {
+		if _, err := p.WriteTo(f); err != nil {
+			f.Close()
+			os.Remove(tmp)
+			return err
+		}
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, r.path); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	r.f.Close()
+	r.f = f
+	r.records = len(msgs)
+	return nil
+}
+
+// Match implements RetainedStore
+func (r *FileRetained) Match(filter string) ([]*mqpp.Publish, error) {
+	return r.mem.Match(filter)
+}
+
+// Len returns the number of retained messages
+func (r *FileRetained) Len() int {
+	return r.mem.Len()
+}
+
+// Close implements RetainedStore, it syncs and closes the file
+func (r *FileRetained) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.f.Sync(); err != nil {
+		r.f.Close()
+		return err
+	}
+	return r.f.Close()
+}
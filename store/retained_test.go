@@ -0,0 +1,120 @@
+// Copyright (c) 2016 The MQPP Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package store
+
+import (
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/abo/mqpp"
+)
+
+func retain(topic, payload string) *mqpp.Publish {
+	p := mqpp.MakePublish(false, mqpp.QosAtLeastOnce, true, topic, 1, []byte(payload))
+	return &p
+}
+
+func topics(t *testing.T, r RetainedStore, filter string) string {
+	msgs, err := r.Match(filter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ts []string
+	for _, p := range msgs {
+		ts = append(ts, p.TopicName())
+	}
+	sort.Strings(ts)
+	return strings.Join(ts, ",")
+}
+
+func TestMemoryRetainedMatch(t *testing.T) {
+	r := NewMemoryRetained(RetainedLimits{})
+	for _, topic := range []string{"a", "a/b", "a/b/c", "a/c", "/a", "$SYS/x", "b"} {
+		if err := r.Store(retain(topic, topic)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	r.Store(retain("b", ""))
+
+	cases := []struct{ filter, expect string }{
+		{"#", "/a,a,a/b,a/b/c,a/c"},
+		{"a/#", "a,a/b,a/b/c,a/c"},
+		{"a/+", "a/b,a/c"},
+		{"+/+", "/a,a/b,a/c"},
+		{"+/b/#", "a/b,a/b/c"},
+		{"$SYS/#", "$SYS/x"},
+		{"b", ""},
+		{"a/b/c/d", ""},
+	}
+	for _, c := range cases {
+		if actual := topics(t, r, c.filter); actual != c.expect {
+			t.Errorf("%s: expect %s, actual %s", c.filter, c.expect, actual)
+		}
+	}
+	if r.Len() != 6 {
+		t.Fatalf("expect 6 retained, actual %d", r.Len())
+	}
+}
+
+func TestMemoryRetainedLimits(t *testing.T) {
+	r := NewMemoryRetained(RetainedLimits{MaxCount: 2, MaxBytes: 10})
+	if r.Store(retain("a", "12345")) != nil || r.Store(retain("b", "12345")) != nil {
+		t.Fatal("expect stored within limits")
+	}
+	if err := r.Store(retain("c", "1")); err != ErrLimitExceeded {
+		t.Fatalf("expect count limit, actual %v", err)
+	}
+	if err := r.Store(retain("a", "123456")); err != ErrLimitExceeded {
+		t.Fatalf("expect size limit, actual %v", err)
+	}
+	if err := r.Store(retain("a", "1234")); err != nil {
+		t.Fatal(err)
+	}
+	if actual := topics(t, r, "#"); actual != "a,b" {
+		t.Fatalf("expect a,b, actual %s", actual)
+	}
+}
+
+func TestFileRetainedReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "retained")
+	r, err := OpenFileRetained(path, RetainedLimits{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3*compactThreshold; i++ {
+		r.Store(retain("a", "old"))
+	}
+	r.Store(retain("a", "new"))
+	r.Store(retain("b/c", "kept"))
+	r.Store(retain("d", "deleted"))
+	r.Store(retain("d", ""))
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if r, err = OpenFileRetained(path, RetainedLimits{}); err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if r.records > compactThreshold+r.Len() {
+		t.Fatalf("expect compacted file, actual %d records", r.records)
+	}
+	msgs, _ := r.Match("a")
+	if actual := topics(t, r, "#"); actual != "a,b/c" || len(msgs) != 1 || string(msgs[0].Payload()) != "new" {
+		t.Fatalf("expect a:new and b/c, actual %s", actual)
+	}
+}
@@ -0,0 +1,248 @@
+// Copyright (c) 2016 The MQPP Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package store
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"sort"
+	"sync"
+
+	"github.com/abo/mqpp"
+)
+
+// ErrCorrupt - a stored session can not be decoded
+var ErrCorrupt = errors.New("mqpp/store: Corrupt Session")
+
+// Session is the state of a client identifier kept across connections when clean session is not set
+type Session struct {
+	ClientID      string
+	Meta          map[string]string // application defined metadata
+	Subscriptions []mqpp.Subscription
+	Received      []uint16             // inbound QoS 2 packet identifiers waiting for PUBREL
+	Inflight      []mqpp.ControlPacket // outbound PUBLISH or PUBREL waiting for acknowledgement, in sending order
+	Pending       []mqpp.ControlPacket // outbound PUBLISH not sent yet
+}
+
+// SessionStore keeps sessions keyed by client identifier
+type SessionStore interface {
+	// Save stores a snapshot of s, replacing the previous one of its client identifier
+	Save(s *Session) error
+	// Load returns the session of clientID, ok is false if there is none
+	Load(clientID string) (s *Session, ok bool, err error)
+	// Delete removes the session of clientID
+	Delete(clientID string) error
+	// ClientIDs returns identifiers of all stored sessions
+	ClientIDs() ([]string, error)
+	// Close releases resources held by the store
+	Close() error
+}
+
+// MemorySessions is a SessionStore in memory, sessions are kept encoded so
+// callers can't modify a stored snapshot.
+type MemorySessions struct {
+	mu       sync.RWMutex
+	sessions map[string][]byte
+}
+
+// NewMemorySessions create an empty in-memory session store
+func NewMemorySessions() *MemorySessions {
+	return &MemorySessions{sessions: make(map[string][]byte)}
+}
+
+// Save implements SessionStore
+func (m *MemorySessions) Save(s *Session) error {
+	m.put(s.ClientID, encodeSession(s))
+	return nil
+}
+
+func (m *MemorySessions) put(clientID string, encoded []byte) {
+	m.mu.Lock()
+	m.sessions[clientID] = encoded
+	m.mu.Unlock()
+}
+
+// Load implements SessionStore
+func (m *MemorySessions) Load(clientID string) (*Session, bool, error) {
+	m.mu.RLock()
+	encoded, ok := m.sessions[clientID]
+	m.mu.RUnlock()
+	if !ok {
+		return nil, false, nil
+	}
+	s, err := decodeSession(encoded)
+	return s, err == nil, err
+}
+
+// Delete implements SessionStore
+func (m *MemorySessions) Delete(clientID string) error {
+	m.mu.Lock()
+	delete(m.sessions, clientID)
+	m.mu.Unlock()
+	return nil
+}
+
+// ClientIDs implements SessionStore, identifiers are sorted
+func (m *MemorySessions) ClientIDs() ([]string, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	ids := make([]string, 0, len(m.sessions))
+	for id := range m.sessions {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids, nil
+}
+
+// Len returns the number of stored sessions
+func (m *MemorySessions) Len() int {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return len(m.sessions)
+}
+
+// Close implements SessionStore
+func (m *MemorySessions) Close() error {
+	return nil
+}
+
+// encodeSession encodes s as:
+// client identifier, metadata count, (key, value)s, then four sections of raw
+// packets, each prefixed with its length in bytes: subscriptions as one SUBSCRIBE,
+// received identifiers as PUBRECs, inflight packets and pending packets.
+// strings are prefixed with uint16 length like MQTT strings, lengths are big endian.
+func encodeSession(s *Session) []byte {
+	var buf bytes.Buffer
+	writeString(&buf, s.ClientID)
+	keys := make([]string, 0, len(s.Meta))
+	for k := range s.Meta {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	binary.Write(&buf, binary.BigEndian, uint16(len(keys)))
+	for _, k := range keys {
+		writeString(&buf, k)
+		writeString(&buf, s.Meta[k])
+	}
+
+	var subs []mqpp.ControlPacket
+	if len(s.Subscriptions) > 0 {
+		p := mqpp.MakeSubscribe(0, s.Subscriptions)
+		subs = append(subs, p)
+	}
+	received := make([]mqpp.ControlPacket, len(s.Received))
+	for i, id := range s.Received {
+		received[i] = mqpp.MakePubrec(id)
+	}
+	for _, section := range [][]mqpp.ControlPacket{subs, received, s.Inflight, s.Pending} {
+		l := 0
+		for _, p := range section {
+			l += int(p.Length())
+		}
+		binary.Write(&buf, binary.BigEndian, uint32(l))
+		for _, p := range section {
+			buf.Write(p.Bytes())
+		}
+	}
+	return buf.Bytes()
+}
+
+func writeString(buf *bytes.Buffer, s string) {
+	binary.Write(buf, binary.BigEndian, uint16(len(s)))
+	buf.WriteString(s)
+}
+
+func decodeSession(data []byte) (*Session, error) {
+	r := bytes.NewReader(data)
+	s := &Session{}
+	var err error
+	if s.ClientID, err = readString(r); err != nil {
+		return nil, err
+	}
+	var n uint16
+	if err := binary.Read(r, binary.BigEndian, &n); err != nil {
+		return nil, ErrCorrupt
+	}
+	if n > 0 {
+		s.Meta = make(map[string]string, n)
+	}
+	for i := 0; i < int(n); i++ {
+		k, err := readString(r)
+		if err != nil {
+			return nil, err
+		}
+		if s.Meta[k], err = readString(r); err != nil {
+			return nil, err
+		}
+	}
+
+	var sections [4][]mqpp.ControlPacket
+	for i := range sections {
+		var l uint32
+		if err := binary.Read(r, binary.BigEndian, &l); err != nil || int64(l) > int64(r.Len()) {
+			return nil, ErrCorrupt
+		}
+		section := make([]byte, l)
+		r.Read(section)
+		if sections[i], err = readPackets(section); err != nil {
+			return nil, err
+		}
+	}
+	for _, p := range sections[0] {
+		sub, ok := p.(*mqpp.Subscribe)
+		if !ok {
+			return nil, ErrCorrupt
+		}
+		s.Subscriptions = append(s.Subscriptions, sub.Payload()...)
+	}
+	for _, p := range sections[1] {
+		rec, ok := p.(*mqpp.Pubrec)
+		if !ok {
+			return nil, ErrCorrupt
+		}
+		s.Received = append(s.Received, rec.PacketIdentifier())
+	}
+	s.Inflight, s.Pending = sections[2], sections[3]
+	return s, nil
+}
+
+func readString(r *bytes.Reader) (string, error) {
+	var l uint16
+	if err := binary.Read(r, binary.BigEndian, &l); err != nil || int(l) > r.Len() {
+		return "", ErrCorrupt
+	}
+	b := make([]byte, l)
+	r.Read(b)
+	return string(b), nil
+}
+
+// readPackets parses consecutive packets of data, which is not retained
+func readPackets(data []byte) ([]mqpp.ControlPacket, error) {
+	var pkts []mqpp.ControlPacket
+	s := mqpp.NewSplitter(bytes.NewReader(data))
+	s.Buffer(make([]byte, 4096), mqpp.MaxPacketSize)
+	for s.Scan() {
+		p, err := mqpp.Parse(append([]byte(nil), s.Bytes()...))
+		if err != nil {
+			return nil, ErrCorrupt
+		}
+		pkts = append(pkts, p)
+	}
+	if s.Err() != nil {
+		return nil, ErrCorrupt
+	}
+	return pkts, nil
+}
@@ -0,0 +1,246 @@
+// Copyright (c) 2016 The MQPP Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package store
+
+import (
+	"bufio"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// session log operations
+const (
+	opSave byte = iota + 1
+	opDelete
+)
+
+// maxRecordSize bounds the body of a session log record, a session encoding
+// to more is refused by Save, a larger length read is a corrupt record
+const maxRecordSize = 64 << 20
+
+// FileSessions is a SessionStore kept in memory and logged to an append-only
+// file, so sessions survive restarts. Each record is:
+// length of body(uint32), CRC-32 IEEE of body(uint32), body: operation byte
+// followed by encoded session on save or client identifier on delete.
+// Every record is synced before Save or Delete returns, a torn record at the end
+// of file left by a crash is discarded on open. The file is rewritten once stale
+// records outnumber sessions.
+type FileSessions struct {
+	mem  *MemorySessions
+	path string
+
+	mu      sync.Mutex
+	f       *os.File
+	records int
+}
+
+// OpenFileSessions opens or creates the session store at path
+func OpenFileSessions(path string) (*FileSessions, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	fs := &FileSessions{mem: NewMemorySessions(), path: path, f: f}
+	r := bufio.NewReader(f)
+	var good int64
+	for {
+		body, err := readRecord(r)
+		if err != nil {
+			break
+		}
+		if !fs.apply(body) {
+			break
+		}
+		fs.records++
+		good += int64(8 + len(body))
+	}
+	if err := f.Truncate(good); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if _, err := f.Seek(good, io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return fs, nil
+}
+
+func readRecord(r io.Reader) ([]byte, error) {
+	var header [8]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, err
+	}
+	l, sum := binary.BigEndian.Uint32(header[0:4]), binary.BigEndian.Uint32(header[4:8])
+	if l == 0 || l > maxRecordSize {
+		return nil, ErrCorrupt
+	}
+	body := make([]byte, l)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+	if crc32.ChecksumIEEE(body) != sum {
+		return nil, ErrCorrupt
+	}
+	return body, nil
+}
+
+// apply replays a record body into memory, it returns false for a record can't be decoded
+func (fs *FileSessions) apply(body []byte) bool {
+	switch body[0] {
+	case opSave:
+		s, err := decodeSession(body[1:])
+		if err != nil {
+			return false
+		}
+		fs.mem.put(s.ClientID, body[1:])
+	case opDelete:
+		fs.mem.Delete(string(body[1:]))
+	default:
+		return false
+	}
+	return true
+}
+
+func makeRecord(op byte, data []byte) []byte {
+	record := make([]byte, 9+len(data))
+	record[8] = op
+	copy(record[9:], data)
+	binary.BigEndian.PutUint32(record[0:4], uint32(1+len(data)))
+	binary.BigEndian.PutUint32(record[4:8], crc32.ChecksumIEEE(record[8:]))
+	return record
+}
+
+// appendLocked writes and syncs a record, on failure the file is truncated back
+// so a partial record doesn't hide the ones appended later
+func (fs *FileSessions) appendLocked(op byte, data []byte) error {
+	offset, err := fs.f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	if _, err = fs.f.Write(makeRecord(op, data)); err == nil {
+		err = fs.f.Sync()
+	}
+	if err != nil {
+		if terr := fs.f.Truncate(offset); terr == nil {
+			fs.f.Seek(offset, io.SeekStart)
+		}
+		return err
+	}
+	fs.records++
+	return nil
+}
+
+func (fs *FileSessions) maybeCompactLocked() error {
+	if stale := fs.records - fs.mem.Len(); stale > compactThreshold && stale > fs.mem.Len() {
+		return fs.compactLocked()
+	}
+	return nil
+}
+
+// compactLocked rewrites the file with a save record per session, the new file
+// replaces the old one by rename so a crash leaves either of them intact. The
+// directory is synced for the rename to survive a crash as well.
+func (fs *FileSessions) compactLocked() error {
+	tmp := fs.path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	records := 0
+	fs.mem.mu.RLock()
+	for _, encoded := range fs.mem.sessions {
+		if _, err = f.Write(makeRecord(opSave, encoded)); err != nil {
+			break
+		}
+		records++
+	}
+	fs.mem.mu.RUnlock()
+
+	if err == nil {
+		if err = f.Sync(); err == nil {
+			err = os.Rename(tmp, fs.path)
+		}
+	}
+	if err != nil {
+		// the old log is still complete and in use
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	fs.f.Close()
+	fs.f, fs.records = f, records
+	return syncDir(filepath.Dir(fs.path))
+}
+
+// syncDir syncs directory entries of dir, e.g. after a rename within it
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	err = d.Sync()
+	if cerr := d.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// Save implements SessionStore
+func (fs *FileSessions) Save(s *Session) error {
+	encoded := encodeSession(s)
+	if 1+len(encoded) > maxRecordSize {
+		return ErrLimitExceeded
+	}
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if err := fs.appendLocked(opSave, encoded); err != nil {
+		return err
+	}
+	fs.mem.put(s.ClientID, encoded)
+	return fs.maybeCompactLocked()
+}
+
+// Load implements SessionStore
+func (fs *FileSessions) Load(clientID string) (*Session, bool, error) {
+	return fs.mem.Load(clientID)
+}
+
+// Delete implements SessionStore
+func (fs *FileSessions) Delete(clientID string) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if err := fs.appendLocked(opDelete, []byte(clientID)); err != nil {
+		return err
+	}
+	fs.mem.Delete(clientID)
+	return fs.maybeCompactLocked()
+}
+
+// ClientIDs implements SessionStore
+func (fs *FileSessions) ClientIDs() ([]string, error) {
+	return fs.mem.ClientIDs()
+}
+
+// Close implements SessionStore
+func (fs *FileSessions) Close() error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	return fs.f.Close()
+}
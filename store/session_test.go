@@ -0,0 +1,105 @@
+// Copyright (c) 2016 The MQPP Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package store
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/abo/mqpp"
+)
+
+func makeSession(clientID string) *Session {
+	pub := mqpp.MakePublish(true, mqpp.QosExactlyOnce, false, "a/b", 3, []byte("inflight"))
+	pending := mqpp.MakePublish(false, mqpp.QosAtLeastOnce, true, "c", 0, []byte("pending"))
+	return &Session{
+		ClientID:      clientID,
+		Meta:          map[string]string{"protocol": "MQTT"},
+		Subscriptions: []mqpp.Subscription{{TopicFilter: "a/#", RequestedQoS: mqpp.QosExactlyOnce}, {TopicFilter: "c", RequestedQoS: mqpp.QosAtMostOnce}},
+		Received:      []uint16{7, 9},
+		Inflight:      []mqpp.ControlPacket{&pub, mqpp.MakePubrel(4)},
+		Pending:       []mqpp.ControlPacket{&pending},
+	}
+}
+
+func expectSession(t *testing.T, store SessionStore, expect *Session) {
+	actual, ok, err := store.Load(expect.ClientID)
+	if err != nil || !ok {
+		t.Fatalf("expect session %s, err: %v", expect.ClientID, err)
+	}
+	if actual.ClientID != expect.ClientID || !reflect.DeepEqual(actual.Meta, expect.Meta) ||
+		!reflect.DeepEqual(actual.Subscriptions, expect.Subscriptions) || !reflect.DeepEqual(actual.Received, expect.Received) {
+		t.Fatalf("expect %+v, actual %+v", expect, actual)
+	}
+	for i, packets := range [][2][]mqpp.ControlPacket{{expect.Inflight, actual.Inflight}, {expect.Pending, actual.Pending}} {
+		if len(packets[0]) != len(packets[1]) {
+			t.Fatalf("section %d: expect %d packets, actual %d", i, len(packets[0]), len(packets[1]))
+		}
+		for j := range packets[0] {
+			if string(packets[0][j].Bytes()) != string(packets[1][j].Bytes()) {
+				t.Fatalf("section %d no.%d: expect %v, actual %v", i, j, packets[0][j].Bytes(), packets[1][j].Bytes())
+			}
+		}
+	}
+}
+
+func TestMemorySessions(t *testing.T) {
+	m := NewMemorySessions()
+	s := makeSession("c1")
+	m.Save(s)
+	s.Received = nil // stored snapshot is not affected
+	expectSession(t, m, makeSession("c1"))
+
+	m.Delete("c1")
+	if _, ok, _ := m.Load("c1"); ok {
+		t.Fatal("expect session deleted")
+	}
+}
+
+func TestFileSessionsReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sessions")
+	fs, err := OpenFileSessions(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2*compactThreshold; i++ {
+		fs.Save(&Session{ClientID: "churn"})
+	}
+	fs.Save(makeSession("c1"))
+	fs.Save(makeSession("c2"))
+	fs.Delete("c2")
+	fs.Close()
+
+	// a torn record at the end is discarded
+	f, _ := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	f.Write(makeRecord(opSave, encodeSession(makeSession("torn")))[:20])
+	f.Close()
+
+	if fs, err = OpenFileSessions(path); err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Close()
+	expectSession(t, fs, makeSession("c1"))
+	if ids, _ := fs.ClientIDs(); !reflect.DeepEqual(ids, []string{"c1", "churn"}) {
+		t.Fatalf("expect c1 and churn, actual %v", ids)
+	}
+	if fs.records > compactThreshold+fs.mem.Len() {
+		t.Fatalf("expect compacted file, actual %d records", fs.records)
+	}
+	fs.Save(makeSession("after"))
+	expectSession(t, fs, makeSession("after"))
+}
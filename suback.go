@@ -24,19 +24,19 @@ type Suback struct {
 }
 
 func newSuback(data []byte) (*Suback, error) {
-	if len(data) < 1 || data[0] != (TSUBACK<<4) {
+	if len(data) < 1 || data[0]>>4 != TSUBACK {
 		return nil, ErrProtocolViolation
 	}
 
 	p := &Suback{endecBytes: data}
-	remlen, offset := p.remlen(1)
-	if offset <= 1 {
-		return nil, ErrMalformedRemLen
+	offset, pktLen, err := p.header()
+	if err != nil {
+		return nil, err
 	}
-	pktLen := offset + int(remlen)
-	if len(data) < pktLen {
+	if skip(offset, 2, pktLen) < 0 {
 		return nil, ErrProtocolViolation
 	}
+	p.endecBytes = data[:pktLen]
 	p.packetIDPos = offset
 	return p, nil
 }
@@ -31,26 +31,26 @@ type Subscription struct {
 }
 
 func newSubscribe(data []byte) (*Subscribe, error) {
-	if data[0] != (TSUBSCRIBE<<4 | 0x02) {
+	if len(data) < 1 || data[0]>>4 != TSUBSCRIBE {
 		return nil, ErrProtocolViolation
 	}
 
 	p := &Subscribe{endecBytes: data}
-	remlen, offset := p.remlen(1)
-	if offset <= 1 {
-		return nil, ErrMalformedRemLen
-	}
-	pktLen := offset + int(remlen)
-	if len(data) < pktLen {
-		return nil, ErrProtocolViolation
+	offset, pktLen, err := p.header()
+	if err != nil {
+		return nil, err
 	}
+	p.endecBytes = data[:pktLen]
+
 	p.packetIDPos = offset
-	_, offset = p.uint16(p.packetIDPos)
+	offset = skip(p.packetIDPos, 2, pktLen)
 	p.topicFilterPoss = []int{}
-	for offset < pktLen {
+	for offset >= 0 && offset < pktLen {
 		p.topicFilterPoss = append(p.topicFilterPoss, offset)
-		_, offset = p.string(offset)
-		_, offset = p.byte(offset)
+		offset = skip(p.skipString(offset, pktLen), 1, pktLen)
+	}
+	if offset < 0 {
+		return nil, ErrProtocolViolation
 	}
 
 	return p, nil
@@ -0,0 +1,127 @@
+// Copyright (c) 2016 The MQPP Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build ignore
+
+// gen writes the seed corpus of the fuzz targets, run in the package directory:
+//
+//	go run testdata/fuzz/gen.go
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/abo/mqpp"
+)
+
+// packets are the valid seeds per fuzz target, in a slice so the output is reproducible
+var packets = []struct {
+	name string
+	pkts []mqpp.ControlPacket
+}{
+	{"Connect", []mqpp.ControlPacket{
+		mqpp.MakeConnect(mqpp.ProtocolName, mqpp.ProtocolLevel, true, mqpp.QosExactlyOnce, false, 128, "clientIdentifier", "willTopic", []byte("willMessage"), "username", []byte("password")),
+		mqpp.MakeConnect(mqpp.ProtocolName, mqpp.ProtocolLevel, false, mqpp.QosAtMostOnce, true, 0, "", "", nil, "", nil),
+		mqpp.MakeConnect(mqpp.ProtocolName, mqpp.ProtocolLevel, false, mqpp.QosAtLeastOnce, false, 65535, "c", "", nil, "user", nil),
+	}},
+	{"Connack", []mqpp.ControlPacket{
+		mqpp.MakeConnack(false, mqpp.Accepted),
+		mqpp.MakeConnack(true, 5),
+	}},
+	{"Publish", []mqpp.ControlPacket{
+		mqpp.MakePublish(false, mqpp.QosAtMostOnce, true, "topicName", 0, []byte("payload")),
+		mqpp.MakePublish(true, mqpp.QosExactlyOnce, false, "a/b/c", 65535, nil),
+		mqpp.MakePublish(false, mqpp.QosAtLeastOnce, false, "", 1, bytes.Repeat([]byte{0xff}, 200)),
+	}},
+	{"Puback", []mqpp.ControlPacket{mqpp.MakePuback(123)}},
+	{"Pubrec", []mqpp.ControlPacket{mqpp.MakePubrec(126)}},
+	{"Pubrel", []mqpp.ControlPacket{mqpp.MakePubrel(127)}},
+	{"Pubcomp", []mqpp.ControlPacket{mqpp.MakePubcomp(124)}},
+	{"Subscribe", []mqpp.ControlPacket{
+		mqpp.MakeSubscribe(2, []mqpp.Subscription{{TopicFilter: "/topic/filter", RequestedQoS: mqpp.QosExactlyOnce}, {TopicFilter: "/topic/#", RequestedQoS: mqpp.QosAtMostOnce}}),
+		mqpp.MakeSubscribe(1, nil),
+	}},
+	{"Suback", []mqpp.ControlPacket{
+		mqpp.MakeSuback(65530, []byte{mqpp.QosAtLeastOnce, mqpp.QosAtMostOnce, mqpp.QosExactlyOnce, mqpp.SubackFailure}),
+		mqpp.MakeSuback(1, nil),
+	}},
+	{"Unsubscribe", []mqpp.ControlPacket{
+		mqpp.MakeUnsubscribe(65535, []string{"#", "/topic/a/aa"}),
+		mqpp.MakeUnsubscribe(1, []string{""}),
+	}},
+	{"Unsuback", []mqpp.ControlPacket{mqpp.MakeUnsuback(1)}},
+	{"Pingreq", []mqpp.ControlPacket{mqpp.MakePingreq()}},
+	{"Pingresp", []mqpp.ControlPacket{mqpp.MakePingresp()}},
+	{"Disconnect", []mqpp.ControlPacket{mqpp.MakeDisconnect()}},
+}
+
+// malformed are hand crafted edge cases, given to every target
+var malformed = [][]byte{
+	{},
+	{0x10},
+	{0x30, 0xff, 0xff, 0xff, 0xff, 0x7f}, // remaining length of 5 bytes
+	{0x30, 0xff, 0xff, 0xff, 0x80},       // unterminated remaining length
+	{0x10, 0x02, 0x00, 0x04},             // connect with truncated protocol name
+	{0x10, 0x0c, 0x00, 0x04, 'M', 'Q', 'T', 'T', 0x04, 0xc2, 0x00, 0x3c, 0x00, 0x00}, // connect missing username and password
+	{0x32, 0x03, 0x00, 0x01, 'a'},             // qos 1 publish without packet id
+	{0x30, 0x02, 0x00, 0x05},                  // publish with topic longer than packet
+	{0x82, 0x04, 0x00, 0x01, 0x00, 0x05},      // subscribe with truncated filter
+	{0x82, 0x05, 0x00, 0x01, 0x00, 0x01, 'a'}, // subscribe without requested qos
+	{0x90, 0x01, 0x00},                        // suback without packet id
+	{0xa2, 0x03, 0x00, 0x01, 0x00},            // unsubscribe with truncated filter
+	{0xa2, 0x01, 0x00},                        // unsubscribe without packet id
+	{0xf0, 0x00},                              // reserved type
+}
+
+func main() {
+	var all [][]byte
+	for _, target := range packets {
+		var seeds [][]byte
+		for _, p := range target.pkts {
+			b := p.Bytes()
+			seeds = append(seeds, b, b[:len(b)-1], b[:len(b)/2])
+			all = append(all, b)
+		}
+		write("Fuzz"+target.name, append(seeds, malformed...))
+	}
+	write("FuzzParse", append(all, malformed...))
+
+	stream := bytes.Join(all, nil)
+	corrupted := append([]byte(nil), stream...)
+	copy(corrupted[len(corrupted)/3:], []byte{0xff, 0xff, 0xff, 0xff, 0xff})
+	write("FuzzSplit", append([][]byte{stream, corrupted, stream[:len(stream)-3], append([]byte{0x00, 0x13}, stream...)}, malformed...))
+}
+
+func write(target string, seeds [][]byte) {
+	dir := filepath.Join("testdata", "fuzz", target)
+	// seeds are named by content, drop those of a previous run
+	if err := os.RemoveAll(dir); err != nil {
+		log.Fatal(err)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		log.Fatal(err)
+	}
+	for _, seed := range seeds {
+		content := fmt.Sprintf("go test fuzz v1\n[]byte(%q)\n", seed)
+		name := fmt.Sprintf("%x", sha256.Sum256([]byte(content)))[:16]
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			log.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,63 @@
+// Copyright (c) 2016 The MQPP Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mqpp
+
+import "strings"
+
+// MatchTopic reports whether topic name matches topic filter, the filter may contain
+// single level('+') and multi level('#') wildcards. Topics begin with '$' are not
+// matched by filters begin with a wildcard.
+func MatchTopic(filter, topic string) bool {
+	if len(topic) > 0 && topic[0] == '$' && len(filter) > 0 && (filter[0] == '+' || filter[0] == '#') {
+		return false
+	}
+
+	fs, ts := strings.Split(filter, "/"), strings.Split(topic, "/")
+	for i, f := range fs {
+		if f == "#" {
+			return true
+		}
+		if i >= len(ts) {
+			return false
+		}
+		if f != "+" && f != ts[i] {
+			return false
+		}
+	}
+	return len(fs) == len(ts)
+}
+
+// ValidTopicFilter reports whether filter is a valid topic filter: not empty,
+// '#' only as the last level, and wildcards occupy an entire level.
+func ValidTopicFilter(filter string) bool {
+	if len(filter) == 0 || strings.ContainsRune(filter, 0) {
+		return false
+	}
+	levels := strings.Split(filter, "/")
+	for i, l := range levels {
+		if strings.ContainsAny(l, "+#") && len(l) > 1 {
+			return false
+		}
+		if l == "#" && i != len(levels)-1 {
+			return false
+		}
+	}
+	return true
+}
+
+// ValidTopicName reports whether topic is a valid topic name: not empty and without wildcards.
+func ValidTopicName(topic string) bool {
+	return len(topic) > 0 && !strings.ContainsAny(topic, "+#\x00")
+}
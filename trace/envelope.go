@@ -0,0 +1,80 @@
+// Copyright (c) 2016 The MQPP Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package trace
+
+import (
+	"bytes"
+	"encoding/binary"
+
+	"github.com/abo/mqpp"
+)
+
+// envelopeMagic begins payloads wrapped in an envelope, 0xfe never appears in UTF-8 text
+const envelopeMagic = "\xfeTC\x01"
+
+// Wrap wraps payload in an envelope carrying tc, for MQTT 3.1.1 which has no
+// properties. The envelope is envelopeMagic, traceparent and tracestate as MQTT
+// UTF-8 strings, then the payload. An envelope payload already has is replaced.
+func Wrap(payload []byte, tc Context) []byte {
+	if _, inner, err := Unwrap(payload); err == nil {
+		payload = inner
+	}
+	tp, ts := tc.TraceParent(), tc.State
+	if len(ts) > 0xffff {
+		ts = ""
+	}
+	b := make([]byte, 0, len(envelopeMagic)+2+len(tp)+2+len(ts)+len(payload))
+	b = append(b, envelopeMagic...)
+	b = binary.BigEndian.AppendUint16(b, uint16(len(tp)))
+	b = append(b, tp...)
+	b = binary.BigEndian.AppendUint16(b, uint16(len(ts)))
+	b = append(b, ts...)
+	return append(b, payload...)
+}
+
+// Unwrap returns the trace context of an envelope and the payload within, the
+// payload is returned as is with ErrNoContext if it isn't wrapped.
+func Unwrap(payload []byte) (Context, []byte, error) {
+	if !bytes.HasPrefix(payload, []byte(envelopeMagic)) {
+		return Context{}, payload, ErrNoContext
+	}
+	tp, offset := propertyString(payload, len(envelopeMagic))
+	ts, offset := propertyString(payload, offset)
+	if offset < 0 {
+		return Context{}, payload, ErrNoContext
+	}
+	tc, err := ParseTraceParent(tp, ts)
+	if err != nil {
+		return Context{}, payload, ErrNoContext
+	}
+	return tc, payload[offset:], nil
+}
+
+// InjectPublish returns a copy of p whose payload is wrapped in an envelope carrying tc
+func InjectPublish(p *mqpp.Publish, tc Context) *mqpp.Publish {
+	q := mqpp.MakePublish(p.Dup(), p.QoS(), p.Retain(), p.TopicName(), p.PacketIdentifier(), Wrap(p.Payload(), tc))
+	return &q
+}
+
+// ExtractPublish returns the trace context in the envelope of p, and a copy of p
+// with the payload unwrapped. p itself is returned with ErrNoContext if it has no envelope.
+func ExtractPublish(p *mqpp.Publish) (Context, *mqpp.Publish, error) {
+	tc, payload, err := Unwrap(p.Payload())
+	if err != nil {
+		return Context{}, p, err
+	}
+	q := mqpp.MakePublish(p.Dup(), p.QoS(), p.Retain(), p.TopicName(), p.PacketIdentifier(), payload)
+	return tc, &q, nil
+}
@@ -0,0 +1,258 @@
+// Copyright (c) 2016 The MQPP Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package trace
+
+import (
+	"encoding/binary"
+
+	"github.com/abo/mqpp"
+)
+
+// UserPropertyID is the identifier of MQTT 5 user property
+const UserPropertyID = 0x26
+
+// names of the user properties carrying trace context
+const (
+	traceparentName = "traceparent"
+	tracestateName  = "tracestate"
+)
+
+// maxRemainingLength is the largest remaining length of MQTT
+const maxRemainingLength = 268435455
+
+// propertySizes are the sizes of MQTT 5 properties by identifier: fixed sizes,
+// or -1 for variable byte integer, -2 for binary data or string, -3 for string pair
+var propertySizes = map[byte]int{
+	0x01: 1, 0x02: 4, 0x03: -2, 0x08: -2, 0x09: -2, 0x0b: -1, 0x11: 4, 0x12: -2,
+	0x13: 2, 0x15: -2, 0x16: -2, 0x17: 1, 0x18: 4, 0x19: 1, 0x1a: -2, 0x1c: -2,
+	0x1f: -2, 0x21: 2, 0x22: 2, 0x23: 2, 0x24: 1, 0x25: 1, 0x26: -3, 0x27: 4,
+	0x28: 1, 0x29: 1, 0x2a: 1,
+}
+
+// UserProperty is a name and value pair of MQTT 5 user property
+type UserProperty struct {
+	Name  string
+	Value string
+}
+
+// UserProperties returns the user properties of props, the properties of a MQTT 5
+// packet without their length
+func UserProperties(props []byte) ([]UserProperty, error) {
+	var ups []UserProperty
+	for offset := 0; offset < len(props); {
+		end := nextProperty(props, offset)
+		if end < 0 {
+			return nil, mqpp.ErrProtocolViolation
+		}
+		if props[offset] == UserPropertyID {
+			name, o := propertyString(props, offset+1)
+			value, _ := propertyString(props, o)
+			ups = append(ups, UserProperty{Name: name, Value: value})
+		}
+		offset = end
+	}
+	return ups, nil
+}
+
+// AppendUserProperty appends a user property to props
+func AppendUserProperty(props []byte, name, value string) []byte {
+	props = append(props, UserPropertyID)
+	props = binary.BigEndian.AppendUint16(props, uint16(len(name)))
+	props = append(props, name...)
+	props = binary.BigEndian.AppendUint16(props, uint16(len(value)))
+	return append(props, value...)
+}
+
+// InjectProperties returns props with traceparent and tracestate user properties
+// of tc, replacing those props has
+func InjectProperties(props []byte, tc Context) ([]byte, error) {
+	out := make([]byte, 0, len(props)+64+len(tc.State))
+	for offset := 0; offset < len(props); {
+		end := nextProperty(props, offset)
+		if end < 0 {
+			return nil, mqpp.ErrProtocolViolation
+		}
+		if props[offset] == UserPropertyID {
+			if name, _ := propertyString(props, offset+1); name == traceparentName || name == tracestateName {
+				offset = end
+				continue
+			}
+		}
+		out = append(out, props[offset:end]...)
+		offset = end
+	}
+	out = AppendUserProperty(out, traceparentName, tc.TraceParent())
+	if tc.State != "" && len(tc.State) <= 0xffff {
+		out = AppendUserProperty(out, tracestateName, tc.State)
+	}
+	return out, nil
+}
+
+// ExtractProperties returns the trace context of traceparent and tracestate user properties
+func ExtractProperties(props []byte) (Context, error) {
+	ups, err := UserProperties(props)
+	if err != nil {
+		return Context{}, err
+	}
+	tp, ts, found := "", "", false
+	for _, up := range ups {
+		switch up.Name {
+		case traceparentName:
+			tp, found = up.Value, true
+		case tracestateName:
+			ts = up.Value
+		}
+	}
+	if !found {
+		return Context{}, ErrNoContext
+	}
+	return ParseTraceParent(tp, ts)
+}
+
+// InjectPublishV5 returns a copy of MQTT 5 PUBLISH raw, with user properties carrying tc
+func InjectPublishV5(raw []byte, tc Context) ([]byte, error) {
+	pv, err := parsePublishV5(raw)
+	if err != nil {
+		return nil, err
+	}
+	props, err := InjectProperties(raw[pv.propsPos:pv.payloadPos], tc)
+	if err != nil {
+		return nil, err
+	}
+
+	vh, payload := raw[pv.head:pv.lenPos], raw[pv.payloadPos:]
+	remlen := len(vh) + varintSize(len(props)) + len(props) + len(payload)
+	if remlen > maxRemainingLength {
+		return nil, mqpp.ErrProtocolViolation
+	}
+	out := make([]byte, 0, 1+varintSize(remlen)+remlen)
+	out = appendVarint(append(out, raw[0]), remlen)
+	out = appendVarint(append(out, vh...), len(props))
+	out = append(out, props...)
+	return append(out, payload...), nil
+}
+
+// ExtractPublishV5 returns the trace context in user properties of MQTT 5 PUBLISH raw
+func ExtractPublishV5(raw []byte) (Context, error) {
+	pv, err := parsePublishV5(raw)
+	if err != nil {
+		return Context{}, err
+	}
+	return ExtractProperties(raw[pv.propsPos:pv.payloadPos])
+}
+
+// publishV5 are the offsets of the parts of a MQTT 5 PUBLISH: the variable header
+// from head, the property length at lenPos, properties from propsPos to payloadPos
+type publishV5 struct {
+	head, lenPos, propsPos, payloadPos int
+}
+
+func parsePublishV5(raw []byte) (publishV5, error) {
+	if len(raw) < 2 || raw[0]>>4 != mqpp.TPUBLISH {
+		return publishV5{}, mqpp.ErrProtocolViolation
+	}
+	remlen, head := varint(raw, 1)
+	if head < 0 || head+remlen != len(raw) {
+		return publishV5{}, mqpp.ErrProtocolViolation
+	}
+	offset := head
+	if offset+2 > len(raw) {
+		return publishV5{}, mqpp.ErrProtocolViolation
+	}
+	offset += 2 + int(binary.BigEndian.Uint16(raw[offset:])) // topic name
+	if raw[0]>>1&0x03 > mqpp.QosAtMostOnce {
+		offset += 2 // packet identifier
+	}
+	if offset > len(raw) {
+		return publishV5{}, mqpp.ErrProtocolViolation
+	}
+	n, propsPos := varint(raw, offset)
+	if propsPos < 0 || propsPos+n > len(raw) {
+		return publishV5{}, mqpp.ErrProtocolViolation
+	}
+	return publishV5{head: head, lenPos: offset, propsPos: propsPos, payloadPos: propsPos + n}, nil
+}
+
+// nextProperty returns the end of the property at offset, -1 if it's malformed
+func nextProperty(props []byte, offset int) int {
+	size, ok := propertySizes[props[offset]]
+	offset++
+	switch {
+	case !ok:
+		return -1
+	case size > 0:
+		offset += size
+	case size == -1:
+		_, offset = varint(props, offset)
+	case size == -2:
+		_, offset = propertyString(props, offset)
+	case size == -3:
+		_, offset = propertyString(props, offset)
+		_, offset = propertyString(props, offset)
+	}
+	if offset > len(props) {
+		return -1
+	}
+	return offset
+}
+
+// propertyString reads a string or binary data with 2 bytes length, end is -1 if it's truncated
+func propertyString(b []byte, offset int) (s string, end int) {
+	if offset < 0 || offset+2 > len(b) {
+		return "", -1
+	}
+	end = offset + 2 + int(binary.BigEndian.Uint16(b[offset:]))
+	if end > len(b) {
+		return "", -1
+	}
+	return string(b[offset+2 : end]), end
+}
+
+// varint reads a variable byte integer, end is -1 if it's malformed or truncated
+func varint(b []byte, offset int) (n, end int) {
+	if offset < 0 {
+		return 0, -1
+	}
+	mul := 1
+	for i := offset; i < len(b) && i < offset+4; i++ {
+		n += int(b[i]&0x7f) * mul
+		if b[i]&0x80 == 0 {
+			return n, i + 1
+		}
+		mul <<= 7
+	}
+	return 0, -1
+}
+
+func varintSize(n int) int {
+	size := 1
+	for ; n > 0x7f; n >>= 7 {
+		size++
+	}
+	return size
+}
+
+func appendVarint(b []byte, n int) []byte {
+	for {
+		c := byte(n & 0x7f)
+		if n >>= 7; n > 0 {
+			c |= 0x80
+		}
+		b = append(b, c)
+		if n == 0 {
+			return b
+		}
+	}
+}
@@ -0,0 +1,162 @@
+// Copyright (c) 2016 The MQPP Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package trace defines hooks which trace mqtt packets as spans, and propagates
+// W3C trace context (https://www.w3.org/TR/trace-context/) with messages: in user
+// properties of MQTT 5 PUBLISH, or in an envelope around the payload of MQTT 3.1.1
+// PUBLISH.
+//
+// Hook and Span are small enough to be implemented with OpenTelemetry, or any
+// other tracer, without mqpp depending on it:
+//
+//	func (h otelHook) Start(ctx context.Context, op trace.Op, p mqpp.ControlPacket) (context.Context, trace.Span) {
+//	    if remote, ok := trace.RemoteFromContext(ctx); ok {
+//	        ctx = oteltrace.ContextWithRemoteSpanContext(ctx, toOtel(remote))
+//	    }
+//	    ctx, span := h.tracer.Start(ctx, op.String()+" "+mqpp.TypeName(p.Type()))
+//	    return ctx, otelSpan{span}
+//	}
+package trace
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+
+	"github.com/abo/mqpp"
+)
+
+var (
+	// ErrInvalidTraceParent - traceparent is not in the format of W3C trace context
+	ErrInvalidTraceParent = errors.New("mqpp/trace: Invalid Traceparent")
+	// ErrNoContext - there's no trace context to extract
+	ErrNoContext = errors.New("mqpp/trace: No Trace Context")
+)
+
+// Op is what's done with a packet
+type Op byte
+
+// Ops
+const (
+	Read Op = iota
+	Write
+)
+
+func (o Op) String() string {
+	if o == Read {
+		return "read"
+	}
+	return "write"
+}
+
+// Span is the tracing of a packet, it's ended once the packet is handled or written
+type Span interface {
+	// Context returns the trace context to propagate with a PUBLISH being written,
+	// a zero Context propagates nothing
+	Context() Context
+	End(err error)
+}
+
+// Hook starts spans of packets. The context of a PUBLISH carrying trace context
+// holds it as remote parent, see RemoteFromContext.
+type Hook interface {
+	Start(ctx context.Context, op Op, p mqpp.ControlPacket) (context.Context, Span)
+}
+
+// Context is a W3C trace context, State is the opaque tracestate
+type Context struct {
+	TraceID [16]byte
+	SpanID  [8]byte
+	Flags   byte
+	State   string
+}
+
+// IsValid reports whether trace and span ids are set
+func (c Context) IsValid() bool {
+	return c.TraceID != [16]byte{} && c.SpanID != [8]byte{}
+}
+
+// Sampled reports whether the sampled flag is set
+func (c Context) Sampled() bool {
+	return c.Flags&0x01 != 0
+}
+
+// TraceParent formats c as traceparent of version 00
+func (c Context) TraceParent() string {
+	return "00-" + hex.EncodeToString(c.TraceID[:]) + "-" + hex.EncodeToString(c.SpanID[:]) + "-" + hex.EncodeToString([]byte{c.Flags})
+}
+
+// ParseTraceParent parses traceparent, of version 00 or a later one. tracestate
+// is kept as is, it should be dropped if it's invalid.
+func ParseTraceParent(traceparent, tracestate string) (Context, error) {
+	s := traceparent
+	if len(s) < 55 || s[2] != '-' || s[35] != '-' || s[52] != '-' || !lowerHex(s[:2]) || s[:2] == "ff" ||
+		s[:2] == "00" && len(s) != 55 || len(s) > 55 && s[55] != '-' {
+		return Context{}, ErrInvalidTraceParent
+	}
+	var c Context
+	var flags [1]byte
+	if !lowerHex(s[3:35]) || !lowerHex(s[36:52]) || !lowerHex(s[53:55]) {
+		return Context{}, ErrInvalidTraceParent
+	}
+	hex.Decode(c.TraceID[:], []byte(s[3:35]))
+	hex.Decode(c.SpanID[:], []byte(s[36:52]))
+	hex.Decode(flags[:], []byte(s[53:55]))
+	if !c.IsValid() {
+		return Context{}, ErrInvalidTraceParent
+	}
+	c.Flags, c.State = flags[0], tracestate
+	return c, nil
+}
+
+func lowerHex(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if (s[i] < '0' || s[i] > '9') && (s[i] < 'a' || s[i] > 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+type remoteKey struct{}
+
+// ContextWithRemote returns a copy of ctx holding tc, the trace context a packet carries
+func ContextWithRemote(ctx context.Context, tc Context) context.Context {
+	return context.WithValue(ctx, remoteKey{}, tc)
+}
+
+// RemoteFromContext returns the trace context held by ctx
+func RemoteFromContext(ctx context.Context) (Context, bool) {
+	tc, ok := ctx.Value(remoteKey{}).(Context)
+	return tc, ok
+}
+
+type nopSpan struct{}
+
+func (nopSpan) Context() Context { return Context{} }
+func (nopSpan) End(error)        {}
+
+// Start starts the span of p with h, the trace context in the envelope of a
+// PUBLISH is held by ctx as remote parent. With a nil h the span does nothing.
+func Start(ctx context.Context, h Hook, op Op, p mqpp.ControlPacket) (context.Context, Span) {
+	if h == nil {
+		return ctx, nopSpan{}
+	}
+	if pub, ok := p.(*mqpp.Publish); ok {
+		if tc, _, err := Unwrap(pub.Payload()); err == nil {
+			ctx = ContextWithRemote(ctx, tc)
+		}
+	}
+	return h.Start(ctx, op, p)
+}
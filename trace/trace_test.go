@@ -0,0 +1,183 @@
+// Copyright (c) 2016 The MQPP Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package trace
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/abo/mqpp"
+)
+
+const (
+	traceparent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	tracestate  = "rojo=00f067aa0ba902b7,congo=t61rcWkgMzE"
+)
+
+func TestTraceParent(t *testing.T) {
+	tc, err := ParseTraceParent(traceparent, tracestate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !tc.IsValid() || !tc.Sampled() || tc.SpanID != [8]byte{0x00, 0xf0, 0x67, 0xaa, 0x0b, 0xa9, 0x02, 0xb7} || tc.State != tracestate {
+		t.Fatalf("unexpected %+v", tc)
+	}
+	if tc.TraceParent() != traceparent {
+		t.Fatalf("unexpected %s", tc.TraceParent())
+	}
+	if tc, err := ParseTraceParent("01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00-future", ""); err != nil || tc.Sampled() {
+		t.Fatalf("later version: %+v, %v", tc, err)
+	}
+
+	for _, s := range []string{
+		"",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-1",
+		"00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01x",
+		"00_4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e473g-00f067aa0ba902b7-01",
+	} {
+		if _, err := ParseTraceParent(s, ""); err != ErrInvalidTraceParent {
+			t.Fatalf("%q: unexpected %v", s, err)
+		}
+	}
+}
+
+func TestEnvelope(t *testing.T) {
+	tc, _ := ParseTraceParent(traceparent, tracestate)
+	wrapped := Wrap([]byte("payload"), tc)
+	got, payload, err := Unwrap(wrapped)
+	if err != nil || got != tc || string(payload) != "payload" {
+		t.Fatalf("unexpected %+v %q %v", got, payload, err)
+	}
+
+	other := tc
+	other.SpanID[0], other.State = 0xff, ""
+	if got, payload, err := Unwrap(Wrap(wrapped, other)); err != nil || got != other || string(payload) != "payload" {
+		t.Fatalf("rewrapped: unexpected %+v %q %v", got, payload, err)
+	}
+
+	for _, p := range [][]byte{nil, []byte("payload"), wrapped[:10], append([]byte(envelopeMagic), 0, 3, 'b', 'a', 'd', 0, 0)} {
+		if _, payload, err := Unwrap(p); err != ErrNoContext || !bytes.Equal(payload, p) {
+			t.Fatalf("%q: unexpected %q %v", p, payload, err)
+		}
+	}
+
+	pub := mqpp.MakePublish(true, 1, true, "a/b", 7, []byte("hello"))
+	injected := InjectPublish(&pub, tc)
+	got, extracted, err := ExtractPublish(injected)
+	if err != nil || got != tc {
+		t.Fatalf("unexpected %+v %v", got, err)
+	}
+	if !extracted.Dup() || extracted.QoS() != 1 || !extracted.Retain() || extracted.TopicName() != "a/b" || extracted.PacketIdentifier() != 7 ||
+		string(extracted.Payload()) != "hello" {
+		t.Fatalf("unexpected %v", extracted.Bytes())
+	}
+	if _, p, err := ExtractPublish(&pub); err != ErrNoContext || p != &pub {
+		t.Fatalf("unexpected %v", err)
+	}
+}
+
+// makePublishV5 makes a MQTT 5 PUBLISH of QoS 1 with props
+func makePublishV5(props []byte, payload string) []byte {
+	vh := []byte{0x00, 0x03, 'a', '/', 'b', 0x00, 0x07}
+	vh = append(appendVarint(vh, len(props)), props...)
+	vh = append(vh, payload...)
+	return append(appendVarint([]byte{0x32}, len(vh)), vh...)
+}
+
+func TestProperties(t *testing.T) {
+	tc, _ := ParseTraceParent(traceparent, tracestate)
+	props := []byte{0x01, 0x01, 0x02, 0x00, 0x00, 0x00, 0x3c, 0x0b, 0x81, 0x01, 0x03, 0x00, 0x01, 'j'}
+	props = AppendUserProperty(props, "k", "v")
+	props = AppendUserProperty(props, traceparentName, "00-11111111111111111111111111111111-2222222222222222-00")
+
+	injected, err := InjectProperties(props, tc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ups, err := UserProperties(injected)
+	if err != nil || len(ups) != 3 || ups[0] != (UserProperty{"k", "v"}) || ups[1] != (UserProperty{traceparentName, traceparent}) ||
+		ups[2] != (UserProperty{tracestateName, tracestate}) {
+		t.Fatalf("unexpected %v %v", ups, err)
+	}
+	if got, err := ExtractProperties(injected); err != nil || got != tc {
+		t.Fatalf("unexpected %+v %v", got, err)
+	}
+	if !bytes.HasPrefix(injected, props[:14]) {
+		t.Fatal("other properties not kept")
+	}
+	if _, err := ExtractProperties(props[:14]); err != ErrNoContext {
+		t.Fatalf("unexpected %v", err)
+	}
+	for _, bad := range [][]byte{{0x05}, {0x02, 0x00}, {0x26, 0x00, 0x01, 'k', 0x00}, {0x0b, 0x80, 0x80, 0x80, 0x80}} {
+		if _, err := UserProperties(bad); err != mqpp.ErrProtocolViolation {
+			t.Fatalf("%x: unexpected %v", bad, err)
+		}
+		if _, err := InjectProperties(bad, tc); err != mqpp.ErrProtocolViolation {
+			t.Fatalf("%x: unexpected %v", bad, err)
+		}
+	}
+
+	raw := makePublishV5(props[:14], "payload")
+	out, err := InjectPublishV5(raw, tc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := ExtractPublishV5(out); err != nil || got != tc {
+		t.Fatalf("unexpected %+v %v", got, err)
+	}
+	expect, _ := InjectProperties(props[:14], tc)
+	if !bytes.Equal(out, makePublishV5(expect, "payload")) {
+		t.Fatalf("unexpected %x", out)
+	}
+	for _, bad := range [][]byte{nil, {0x30}, {0x20, 0x00}, raw[:len(raw)-1], {0x32, 0x03, 0x00, 0x01, 'a'}} {
+		if _, err := InjectPublishV5(bad, tc); err != mqpp.ErrProtocolViolation {
+			t.Fatalf("%x: unexpected %v", bad, err)
+		}
+	}
+}
+
+type recordingHook struct {
+	ctx context.Context
+	op  Op
+}
+
+func (h *recordingHook) Start(ctx context.Context, op Op, p mqpp.ControlPacket) (context.Context, Span) {
+	h.ctx, h.op = ctx, op
+	return ctx, nopSpan{}
+}
+
+func TestStart(t *testing.T) {
+	tc, _ := ParseTraceParent(traceparent, "")
+	pub := mqpp.MakePublish(false, 0, false, "t", 0, Wrap(nil, tc))
+	if _, span := Start(context.Background(), nil, Read, &pub); span.Context().IsValid() {
+		t.Fatal("nil hook started a span")
+	}
+	h := &recordingHook{}
+	Start(context.Background(), h, Write, &pub)
+	if remote, ok := RemoteFromContext(h.ctx); !ok || remote != tc || h.op != Write {
+		t.Fatalf("unexpected remote %+v", remote)
+	}
+	Start(context.Background(), h, Read, mqpp.MakePuback(1))
+	if _, ok := RemoteFromContext(h.ctx); ok {
+		t.Fatal("remote context without publish")
+	}
+}
@@ -22,7 +22,7 @@ type Unsuback struct {
 }
 
 func newUnsuback(data []byte) (*Unsuback, error) {
-	if len(data) < 4 || data[0] != (TUNSUBACK<<4) || data[1] != 2 {
+	if len(data) < 4 || data[0]>>4 != TUNSUBACK || data[1] != 2 {
 		return nil, ErrProtocolViolation
 	}
 	return &Unsuback{endecBytes: data[0:4]}, nil
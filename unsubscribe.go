@@ -25,20 +25,27 @@ type Unsubscribe struct {
 }
 
 func newUnsubscribe(data []byte) (*Unsubscribe, error) {
-	if data[0] != (TUNSUBSCRIBE<<4 | 0x02) {
+	if len(data) < 1 || data[0]>>4 != TUNSUBSCRIBE {
 		return nil, ErrProtocolViolation
 	}
 
 	p := &Unsubscribe{endecBytes: data}
 	// 1) packet type
-	remlen, offset := p.remlen(1) // 2) remaining length
+	offset, pktLen, err := p.header() // 2) remaining length
+	if err != nil {
+		return nil, err
+	}
+	p.endecBytes = data[:pktLen]
+
 	p.packetIDPos = offset
-	pktLen := offset + int(remlen)
-	_, offset = p.uint16(p.packetIDPos) // 3) packet identifier
+	offset = skip(p.packetIDPos, 2, pktLen) // 3) packet identifier
 	p.topicFilterPoss = []int{}
-	for offset < pktLen {
+	for offset >= 0 && offset < pktLen {
 		p.topicFilterPoss = append(p.topicFilterPoss, offset)
-		_, offset = p.string(offset) // 4~N) topic filter
+		offset = p.skipString(offset, pktLen) // 4~N) topic filter
+	}
+	if offset < 0 {
+		return nil, ErrProtocolViolation
 	}
 
 	return p, nil
@@ -0,0 +1,221 @@
+// Copyright (c) 2016 The MQPP Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mqpp
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"testing"
+
+	"github.com/abo/mqpp/internal/vectors"
+)
+
+var vectorErrors = map[string]error{
+	vectors.OK:                       nil,
+	vectors.Incomplete:               ErrIncompletePacket,
+	vectors.MalformedRemainingLength: ErrMalformedRemLen,
+	vectors.ProtocolViolation:        ErrProtocolViolation,
+	vectors.ReservedType:             ErrReservedPacketType,
+}
+
+var parsers = map[byte]func([]byte) (ControlPacket, error){
+	TCONNECT:     parser(newConnect),
+	TCONNACK:     parser(newConnack),
+	TPUBLISH:     parser(newPublish),
+	TPUBACK:      parser(newPuback),
+	TPUBREC:      parser(newPubrec),
+	TPUBREL:      parser(newPubrel),
+	TPUBCOMP:     parser(newPubcomp),
+	TSUBSCRIBE:   parser(newSubscribe),
+	TSUBACK:      parser(newSuback),
+	TUNSUBSCRIBE: parser(newUnsubscribe),
+	TUNSUBACK:    parser(newUnsuback),
+	TPINGREQ:     parser(newPingreq),
+	TPINGRESP:    parser(newPingresp),
+	TDISCONNECT:  parser(newDisconnect),
+}
+
+func TestVectors(t *testing.T) {
+	files, _ := filepath.Glob("testdata/vectors/*.txt")
+	if len(files) == 0 {
+		t.Fatal("no vectors")
+	}
+	for _, file := range files {
+		vs, err := vectors.Load(file)
+		if err != nil {
+			t.Fatalf("%s: %v", file, err)
+		}
+		for _, v := range vs {
+			name := fmt.Sprintf("%s:%d %s", file, v.Line, v.Name)
+			if err := checkVector(v); err != nil {
+				t.Errorf("%s: %v", name, err)
+			}
+		}
+	}
+}
+
+func checkVector(v vectors.Vector) error {
+	for _, outcome := range []string{v.Parse, v.Lenient} {
+		if _, ok := vectorErrors[outcome]; !ok {
+			return fmt.Errorf("unknown outcome %s", outcome)
+		}
+	}
+
+	p, err := Parse(v.Bytes)
+	if err := checkOutcome("parse", v, v.Parse, p, err); err != nil {
+		return err
+	}
+	lenient, err := ParseLenient(v.Bytes)
+	if err := checkOutcome("lenient", v, v.Lenient, lenient, err); err != nil {
+		return err
+	}
+
+	// the parser of the type fails exactly when lenient parsing does, others refuse the type
+	for t, parse := range parsers {
+		p, err := parse(v.Bytes)
+		if t != v.Bytes[0]>>4 {
+			if err != ErrProtocolViolation {
+				return fmt.Errorf("parser of %s: expect %v, got %v", TypeName(t), ErrProtocolViolation, err)
+			}
+		} else if (err == nil) != (v.Lenient == vectors.OK) {
+			return fmt.Errorf("parser of %s: expect %s, got %v", TypeName(t), v.Lenient, err)
+		} else if err == nil {
+			if err := checkFields(v, p); err != nil {
+				return fmt.Errorf("parser of %s: %v", TypeName(t), err)
+			}
+		}
+	}
+
+	for _, lenient := range []bool{false, true} {
+		s := NewSplitter(bytes.NewReader(v.Bytes))
+		s.Lenient = lenient
+		if v.Split != vectors.Packet {
+			if expect, ok := vectorErrors[v.Split]; !ok || s.Scan() || s.Err() != expect {
+				return fmt.Errorf("split: expect %s, got %v", v.Split, s.Err())
+			}
+			continue
+		}
+		if !s.Scan() || !bytes.Equal(s.Bytes(), v.Bytes) {
+			return fmt.Errorf("split: expect a packet, got % x, %v", s.Bytes(), s.Err())
+		}
+		p, err := s.Packet()
+		outcome := v.Parse
+		if lenient {
+			outcome = v.Lenient
+		}
+		if err := checkOutcome("split", v, outcome, p, err); err != nil {
+			return err
+		}
+		if s.Scan() || s.Err() != nil {
+			return fmt.Errorf("split: expect the end, got % x, %v", s.Bytes(), s.Err())
+		}
+	}
+	return nil
+}
+
+func checkOutcome(name string, v vectors.Vector, outcome string, p ControlPacket, err error) error {
+	if expect := vectorErrors[outcome]; err != expect {
+		return fmt.Errorf("%s: expect %s, got %v", name, outcome, err)
+	}
+	if err == nil {
+		if err := checkFields(v, p); err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+	}
+	return nil
+}
+
+func checkFields(v vectors.Vector, p ControlPacket) error {
+	fields := vectorFields(p)
+	for name, value := range v.Fields {
+		actual, ok := fields[name]
+		if !ok {
+			return fmt.Errorf("no field %s in %s", name, TypeName(p.Type()))
+		}
+		expect, err := vectors.Values(value)
+		if err != nil {
+			return err
+		}
+		if len(expect) != 0 || len(actual) != 0 {
+			if !reflect.DeepEqual(expect, actual) {
+				return fmt.Errorf("%s: expect %q, got %q", name, expect, actual)
+			}
+		}
+	}
+	return nil
+}
+
+// vectorFields returns fields of p as words, named as in testdata/vectors
+func vectorFields(p ControlPacket) map[string][]string {
+	word := func(v interface{}) []string {
+		switch v := v.(type) {
+		case []byte:
+			return []string{string(v)}
+		default:
+			return []string{fmt.Sprint(v)}
+		}
+	}
+	fields := map[string][]string{"type": {TypeName(p.Type())}}
+	switch p := p.(type) {
+	case *Connect:
+		for name, v := range map[string]interface{}{
+			"protocol_name": p.ProtocolName(), "protocol_level": p.ProtocolLevel(), "clean_session": p.CleanSession(),
+			"will_flag": p.WillFlag(), "will_qos": p.WillQoS(), "will_retain": p.WillRetain(),
+			"username_flag": p.UsernameFlag(), "password_flag": p.PasswordFlag(), "keep_alive": p.KeepAlive(),
+			"client_id": p.ClientIdentifier(), "will_topic": p.WillTopic(), "will_message": p.WillMessage(),
+			"username": p.Username(), "password": p.Password(),
+		} {
+			fields[name] = word(v)
+		}
+	case *Connack:
+		fields["session_present"], fields["return_code"] = word(p.SessionPresent()), word(p.ReturnCode())
+	case *Publish:
+		for name, v := range map[string]interface{}{
+			"dup": p.Dup(), "qos": p.QoS(), "retain": p.Retain(), "topic": p.TopicName(),
+			"packet_id": p.PacketIdentifier(), "payload": p.Payload(),
+		} {
+			fields[name] = word(v)
+		}
+	case *Puback:
+		fields["packet_id"] = word(p.PacketIdentifier())
+	case *Pubrec:
+		fields["packet_id"] = word(p.PacketIdentifier())
+	case *Pubrel:
+		fields["packet_id"] = word(p.PacketIdentifier())
+	case *Pubcomp:
+		fields["packet_id"] = word(p.PacketIdentifier())
+	case *Unsuback:
+		fields["packet_id"] = word(p.PacketIdentifier())
+	case *Subscribe:
+		fields["packet_id"] = word(p.PacketIdentifier())
+		fields["filters"] = []string{}
+		for _, s := range p.Payload() {
+			fields["filters"] = append(fields["filters"], s.TopicFilter, strconv.Itoa(int(s.RequestedQoS)))
+		}
+	case *Suback:
+		fields["packet_id"] = word(p.PacketIdentifier())
+		fields["return_codes"] = []string{}
+		for _, code := range p.ReturnCodes() {
+			fields["return_codes"] = append(fields["return_codes"], strconv.Itoa(int(code)))
+		}
+	case *Unsubscribe:
+		fields["packet_id"] = word(p.PacketIdentifier())
+		fields["filters"] = p.Payload()
+	}
+	return fields
+}
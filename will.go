@@ -0,0 +1,112 @@
+// Copyright (c) 2016 The MQPP Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mqpp
+
+import (
+	"net"
+	"sync"
+)
+
+// CloseReason is why a network connection ended, it decides whether the will message is published
+type CloseReason byte
+
+// Close reasons, all but CloseDisconnect are abnormal
+const (
+	CloseDisconnect        CloseReason = iota // client sent DISCONNECT
+	CloseReadError                            // network error or connection closed by client
+	CloseKeepAliveTimeout                     // nothing received within one and a half times keep alive
+	CloseProtocolViolation                    // malformed or unexpected packet
+	CloseServer                               // server closed the connection, e.g. session taken over
+)
+
+var closeReasonNames = map[CloseReason]string{
+	CloseDisconnect:        "disconnect",
+	CloseReadError:         "read error",
+	CloseKeepAliveTimeout:  "keep alive timeout",
+	CloseProtocolViolation: "protocol violation",
+	CloseServer:            "closed by server",
+}
+
+func (r CloseReason) String() string {
+	if name, ok := closeReasonNames[r]; ok {
+		return name
+	}
+	return "unknown"
+}
+
+// Abnormal reports whether the will message should be published
+func (r CloseReason) Abnormal() bool {
+	return r != CloseDisconnect
+}
+
+// CloseReasonOf classifies the error which ended reading a connection
+func CloseReasonOf(err error) CloseReason {
+	switch err {
+	case ErrMalformedRemLen, ErrIncompletePacket, ErrProtocolViolation, ErrReservedPacketType:
+		return CloseProtocolViolation
+	}
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		return CloseKeepAliveTimeout
+	}
+	return CloseReadError
+}
+
+// MakeWill create the publish of will message in c, ok is false when will flag not set
+func MakeWill(c *Connect) (p Publish, ok bool) {
+	if !c.WillFlag() {
+		return Publish{}, false
+	}
+	return MakePublish(false, c.WillQoS(), c.WillRetain(), c.WillTopic(), 0, c.WillMessage()), true
+}
+
+// Will tracks the will message of a connection, and hands it out only when
+// the connection ended abnormally. It is safe for concurrent use.
+type Will struct {
+	mu      sync.Mutex
+	publish *Publish
+	ended   bool
+	reason  CloseReason
+}
+
+// NewWill create a Will from connect packet, it holds no message if will flag not set
+func NewWill(c *Connect) *Will {
+	w := &Will{}
+	if p, ok := MakeWill(c); ok {
+		w.publish = &p
+	}
+	return w
+}
+
+// End records how the connection ended, it returns the will message to publish
+// if reason is abnormal. Only the first call counts, later calls return nothing.
+func (w *Will) End(reason CloseReason) (*Publish, bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.ended {
+		return nil, false
+	}
+	w.ended, w.reason = true, reason
+	if w.publish == nil || !reason.Abnormal() {
+		return nil, false
+	}
+	return w.publish, true
+}
+
+// Reason returns how the connection ended, ok is false before End called
+func (w *Will) Reason() (reason CloseReason, ok bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.reason, w.ended
+}
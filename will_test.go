@@ -0,0 +1,110 @@
+// Copyright (c) 2016 The MQPP Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mqpp
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"testing"
+)
+
+func TestMakeWill(t *testing.T) {
+	cases := []struct {
+		willTopic   string
+		willMessage []byte
+		willQoS     byte
+		willRetain  bool
+		username    string
+		password    []byte
+	}{
+		{"", nil, QosAtMostOnce, false, "", nil},
+		{"", nil, QosAtMostOnce, false, "user", []byte("pwd")},
+		{"will/topic", []byte("bye"), QosAtMostOnce, false, "", nil},
+		{"will/topic", []byte("bye"), QosAtLeastOnce, true, "user", nil},
+		{"will/topic", []byte{}, QosExactlyOnce, false, "user", []byte("pwd")},
+		{"will/topic", []byte("bye"), QosExactlyOnce, true, "", []byte("pwd")},
+	}
+
+	for i, c := range cases {
+		connect := MakeConnect(ProtocolName, ProtocolLevel, c.willRetain, c.willQoS, true, 60, "cid", c.willTopic, c.willMessage, c.username, c.password)
+		parsed, err := newConnect(connect.Bytes())
+		if err != nil {
+			t.Fatalf("no.%d: %v", i, err)
+		}
+		if parsed.Username() != c.username || !bytes.Equal(parsed.Password(), c.password) {
+			t.Errorf("no.%d: expect credentials %s/%s, actual %s/%s", i, c.username, c.password, parsed.Username(), parsed.Password())
+		}
+
+		will, ok := MakeWill(parsed)
+		if ok != (c.willTopic != "") {
+			t.Fatalf("no.%d: expect will %v, actual %v", i, c.willTopic != "", ok)
+		}
+		if !ok {
+			if len(parsed.WillMessage()) != 0 || parsed.WillTopic() != "" {
+				t.Errorf("no.%d: expect no will fields, actual %s:%s", i, parsed.WillTopic(), parsed.WillMessage())
+			}
+			continue
+		}
+		if will.TopicName() != c.willTopic || !bytes.Equal(will.Payload(), c.willMessage) || will.QoS() != c.willQoS || will.Retain() != c.willRetain || will.Dup() {
+			t.Errorf("no.%d: expect %s:%s qos %d retain %v, actual %s:%s qos %d retain %v", i,
+				c.willTopic, c.willMessage, c.willQoS, c.willRetain, will.TopicName(), will.Payload(), will.QoS(), will.Retain())
+		}
+	}
+}
+
+func TestWillEnd(t *testing.T) {
+	connect := MakeConnect(ProtocolName, ProtocolLevel, false, QosAtLeastOnce, true, 60, "cid", "will", []byte("bye"), "", nil)
+
+	w := NewWill(&connect)
+	if p, ok := w.End(CloseDisconnect); ok || p != nil {
+		t.Fatal("expect no will after DISCONNECT")
+	}
+	if _, ok := w.End(CloseReadError); ok {
+		t.Fatal("expect only the first End counts")
+	}
+
+	for _, reason := range []CloseReason{CloseReadError, CloseKeepAliveTimeout, CloseProtocolViolation, CloseServer} {
+		w = NewWill(&connect)
+		if p, ok := w.End(reason); !ok || string(p.Payload()) != "bye" {
+			t.Fatalf("%v: expect will published", reason)
+		}
+		if r, ok := w.Reason(); !ok || r != reason {
+			t.Fatalf("expect reason %v, actual %v", reason, r)
+		}
+	}
+
+	noWill := MakeConnect(ProtocolName, ProtocolLevel, false, QosAtMostOnce, true, 60, "cid", "", nil, "", nil)
+	if _, ok := NewWill(&noWill).End(CloseReadError); ok {
+		t.Fatal("expect nothing without will flag")
+	}
+}
+
+func TestCloseReasonOf(t *testing.T) {
+	cases := map[error]CloseReason{
+		io.EOF:                 CloseReadError,
+		ErrMalformedRemLen:     CloseProtocolViolation,
+		ErrProtocolViolation:   CloseProtocolViolation,
+		os.ErrDeadlineExceeded: CloseKeepAliveTimeout,
+		io.ErrUnexpectedEOF:    CloseReadError,
+		ErrReservedPacketType:  CloseProtocolViolation,
+		ErrIncompletePacket:    CloseProtocolViolation,
+	}
+	for err, expect := range cases {
+		if actual := CloseReasonOf(err); actual != expect {
+			t.Errorf("%v: expect %v, actual %v", err, expect, actual)
+		}
+	}
+}
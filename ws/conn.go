@@ -0,0 +1,251 @@
+// Copyright (c) 2016 The MQPP Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package ws carries MQTT over WebSocket(RFC 6455) with subprotocol "mqtt".
+// Conn exposes the bytes of binary frames as a plain stream, so packets may span
+// or share frames and mqpp.NewSplitter works unchanged on it.
+package ws
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// WebSocket opcodes
+const (
+	opContinuation byte = 0x0
+	opText         byte = 0x1
+	opBinary       byte = 0x2
+	opClose        byte = 0x8
+	opPing         byte = 0x9
+	opPong         byte = 0xa
+)
+
+// maxControlPayload is the largest payload of a control frame
+const maxControlPayload = 125
+
+// ErrProtocol - the peer violated WebSocket framing rules
+var ErrProtocol = errors.New("mqpp/ws: WebSocket Protocol Error")
+
+// Conn is a net.Conn over a WebSocket connection, each Write is sent as one binary frame
+type Conn struct {
+	nc     net.Conn
+	br     *bufio.Reader
+	client bool // clients mask frames they send, servers must not
+
+	rmu        sync.Mutex
+	remaining  uint64 // payload bytes left in current data frame
+	masked     bool
+	mask       [4]byte
+	maskPos    int
+	fragmented bool // a data frame without FIN was received, continuation frames follow
+	closed     bool // close frame received
+
+	wmu        sync.Mutex
+	closeSent  bool
+	writeFrame []byte
+}
+
+func newConn(nc net.Conn, br *bufio.Reader, client bool) *Conn {
+	if br == nil {
+		br = bufio.NewReader(nc)
+	}
+	return &Conn{nc: nc, br: br, client: client}
+}
+
+// Read reads payload of binary frames, answering pings on the way, it returns
+// io.EOF once the peer closed the WebSocket.
+func (c *Conn) Read(b []byte) (int, error) {
+	c.rmu.Lock()
+	defer c.rmu.Unlock()
+
+	for c.remaining == 0 {
+		if c.closed {
+			return 0, io.EOF
+		}
+		if err := c.nextFrame(); err != nil {
+			return 0, err
+		}
+	}
+
+	if uint64(len(b)) > c.remaining {
+		b = b[:c.remaining]
+	}
+	n, err := c.br.Read(b)
+	if c.masked {
+		for i := 0; i < n; i++ {
+			b[i] ^= c.mask[c.maskPos&3]
+			c.maskPos++
+		}
+	}
+	c.remaining -= uint64(n)
+	return n, err
+}
+
+// nextFrame reads frame headers until a data frame begins, control frames are handled in place
+func (c *Conn) nextFrame() error {
+	var header [2]byte
+	if _, err := io.ReadFull(c.br, header[:]); err != nil {
+		return err
+	}
+	opcode := header[0] & 0x0f
+	masked := header[1]&0x80 != 0
+	if header[0]&0x70 != 0 || masked == c.client {
+		// no extension negotiated, and only frames from client are masked
+		return c.fail()
+	}
+
+	length := uint64(header[1] & 0x7f)
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(c.br, ext[:]); err != nil {
+			return err
+		}
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(c.br, ext[:]); err != nil {
+			return err
+		}
+		length = binary.BigEndian.Uint64(ext[:])
+	}
+	var mask [4]byte
+	if masked {
+		if _, err := io.ReadFull(c.br, mask[:]); err != nil {
+			return err
+		}
+	}
+
+	switch opcode {
+	case opBinary, opContinuation:
+		if (opcode == opContinuation) != c.fragmented {
+			// continuation frames, and only them, must follow a fragmented data frame
+			return c.fail()
+		}
+		c.fragmented = header[0]&0x80 == 0
+		c.remaining, c.masked, c.mask, c.maskPos = length, masked, mask, 0
+		return nil
+	case opPing, opPong, opClose:
+		if length > maxControlPayload || header[0]&0x80 == 0 {
+			return c.fail()
+		}
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(c.br, payload); err != nil {
+			return err
+		}
+		for i := range payload {
+			payload[i] ^= mask[i&3]
+		}
+		switch opcode {
+		case opPing:
+			if err := c.write(opPong, payload); err != net.ErrClosed {
+				return err
+			}
+		case opClose:
+			c.closed = true
+			c.write(opClose, payload)
+		}
+		return nil
+	default:
+		// MQTT packets must be sent in binary frames
+		return c.fail()
+	}
+}
+
+// fail sends close frame with protocol error status(1002)
+func (c *Conn) fail() error {
+	c.write(opClose, []byte{0x03, 0xea})
+	return ErrProtocol
+}
+
+func (c *Conn) write(opcode byte, payload []byte) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if c.closeSent {
+		return net.ErrClosed
+	}
+	if opcode == opClose {
+		c.closeSent = true
+	}
+
+	frame := c.writeFrame[:0]
+	frame = append(frame, 0x80|opcode)
+	maskBit := byte(0)
+	if c.client {
+		maskBit = 0x80
+	}
+	switch l := len(payload); {
+	case l <= 125:
+		frame = append(frame, maskBit|byte(l))
+	case l <= 65535:
+		frame = append(frame, maskBit|126, byte(l>>8), byte(l))
+	default:
+		frame = append(frame, maskBit|127)
+		frame = binary.BigEndian.AppendUint64(frame, uint64(l))
+	}
+	start := len(frame)
+	if c.client {
+		var mask [4]byte
+		if _, err := rand.Read(mask[:]); err != nil {
+			return err
+		}
+		frame = append(frame, mask[:]...)
+		start += 4
+		frame = append(frame, payload...)
+		for i := range payload {
+			frame[start+i] ^= mask[i&3]
+		}
+	} else {
+		frame = append(frame, payload...)
+	}
+	c.writeFrame = frame
+	_, err := c.nc.Write(frame)
+	return err
+}
+
+// Write sends b as one binary frame, it fails with net.ErrClosed once a close frame was sent
+func (c *Conn) Write(b []byte) (int, error) {
+	if err := c.write(opBinary, b); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// Close sends close frame with normal closure status(1000) and closes the connection
+func (c *Conn) Close() error {
+	c.write(opClose, []byte{0x03, 0xe8})
+	return c.nc.Close()
+}
+
+// LocalAddr returns the local network address
+func (c *Conn) LocalAddr() net.Addr { return c.nc.LocalAddr() }
+
+// RemoteAddr returns the remote network address
+func (c *Conn) RemoteAddr() net.Addr { return c.nc.RemoteAddr() }
+
+// SetDeadline sets read and write deadlines of the underlying connection
+func (c *Conn) SetDeadline(t time.Time) error { return c.nc.SetDeadline(t) }
+
+// SetReadDeadline sets read deadline of the underlying connection
+func (c *Conn) SetReadDeadline(t time.Time) error { return c.nc.SetReadDeadline(t) }
+
+// SetWriteDeadline sets write deadline of the underlying connection
+func (c *Conn) SetWriteDeadline(t time.Time) error { return c.nc.SetWriteDeadline(t) }
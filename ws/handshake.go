@@ -0,0 +1,202 @@
+// Copyright (c) 2016 The MQPP Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ws
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Subprotocol is the WebSocket subprotocol name of MQTT
+const Subprotocol = "mqtt"
+
+// keyGUID is appended to Sec-WebSocket-Key to compute Sec-WebSocket-Accept
+const keyGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// ErrHandshake - the WebSocket opening handshake failed
+var ErrHandshake = errors.New("mqpp/ws: Handshake Failed")
+
+func acceptKey(key string) string {
+	h := sha1.New()
+	h.Write([]byte(key + keyGUID))
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+// headerContains reports whether comma separated values of header name contain token, case-insensitively
+func headerContains(h http.Header, name, token string) bool {
+	for _, v := range h[http.CanonicalHeaderKey(name)] {
+		for _, s := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(s), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Handler returns an http.Handler upgrading requests to WebSocket with subprotocol
+// "mqtt", and serving each upgraded connection with serve, e.g. broker.ServeConn.
+func Handler(serve func(net.Conn)) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get("Sec-WebSocket-Key")
+		if r.Method != http.MethodGet || !headerContains(r.Header, "Connection", "upgrade") ||
+			!headerContains(r.Header, "Upgrade", "websocket") || key == "" {
+			http.Error(w, "websocket upgrade required", http.StatusBadRequest)
+			return
+		}
+		if r.Header.Get("Sec-WebSocket-Version") != "13" {
+			w.Header().Set("Sec-WebSocket-Version", "13")
+			http.Error(w, "unsupported websocket version", http.StatusUpgradeRequired)
+			return
+		}
+		if !headerContains(r.Header, "Sec-WebSocket-Protocol", Subprotocol) {
+			http.Error(w, "subprotocol mqtt required", http.StatusBadRequest)
+			return
+		}
+		hj, ok := w.(http.Hijacker)
+		if !ok {
+			http.Error(w, "websocket not supported", http.StatusInternalServerError)
+			return
+		}
+		nc, rw, err := hj.Hijack()
+		if err != nil {
+			return
+		}
+
+		rw.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n")
+		rw.WriteString("Sec-WebSocket-Accept: " + acceptKey(key) + "\r\n")
+		rw.WriteString("Sec-WebSocket-Protocol: " + Subprotocol + "\r\n\r\n")
+		if err := rw.Flush(); err != nil {
+			nc.Close()
+			return
+		}
+		serve(newConn(nc, rw.Reader, false))
+	})
+}
+
+// Dialer connects to WebSocket servers
+type Dialer struct {
+	// NetDial opens the TCP connection, default net.Dial
+	NetDial func(network, addr string) (net.Conn, error)
+	// TLSConfig is used for wss URLs
+	TLSConfig *tls.Config
+	// Header is added to the opening handshake request
+	Header http.Header
+}
+
+// Dial connects to a ws or wss URL with the default Dialer
+func Dial(rawurl string) (net.Conn, error) {
+	return (&Dialer{}).Dial(rawurl)
+}
+
+// Dial connects to a ws or wss URL and performs the opening handshake with subprotocol "mqtt"
+func (d *Dialer) Dial(rawurl string) (net.Conn, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	host := u.Host
+	switch u.Scheme {
+	case "ws":
+		if u.Port() == "" {
+			host = net.JoinHostPort(u.Hostname(), "80")
+		}
+	case "wss":
+		if u.Port() == "" {
+			host = net.JoinHostPort(u.Hostname(), "443")
+		}
+	default:
+		return nil, fmt.Errorf("mqpp/ws: unsupported scheme %q", u.Scheme)
+	}
+
+	netDial := d.NetDial
+	if netDial == nil {
+		netDial = net.Dial
+	}
+	nc, err := netDial("tcp", host)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme == "wss" {
+		cfg := d.TLSConfig
+		if cfg == nil {
+			cfg = &tls.Config{}
+		}
+		if cfg.ServerName == "" {
+			cfg = cfg.Clone()
+			cfg.ServerName = u.Hostname()
+		}
+		nc = tls.Client(nc, cfg)
+	}
+
+	c, err := d.handshake(nc, u)
+	if err != nil {
+		nc.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+func (d *Dialer) handshake(nc net.Conn, u *url.URL) (*Conn, error) {
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	key := base64.StdEncoding.EncodeToString(nonce)
+
+	req := &http.Request{
+		Method:     http.MethodGet,
+		URL:        u,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     make(http.Header),
+		Host:       u.Host,
+	}
+	for k, vs := range d.Header {
+		req.Header[k] = vs
+	}
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Sec-WebSocket-Key", key)
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	req.Header.Set("Sec-WebSocket-Protocol", Subprotocol)
+	if err := req.Write(nc); err != nil {
+		return nil, err
+	}
+
+	br := bufio.NewReader(nc)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols ||
+		!headerContains(resp.Header, "Upgrade", "websocket") ||
+		!headerContains(resp.Header, "Connection", "upgrade") ||
+		resp.Header.Get("Sec-WebSocket-Accept") != acceptKey(key) ||
+		resp.Header.Get("Sec-WebSocket-Protocol") != Subprotocol {
+		return nil, ErrHandshake
+	}
+	return newConn(nc, br, true), nil
+}
@@ -0,0 +1,190 @@
+// Copyright (c) 2016 The MQPP Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ws
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/abo/mqpp"
+	"github.com/abo/mqpp/broker"
+	"github.com/abo/mqpp/client"
+)
+
+func wsURL(srv *httptest.Server) string {
+	return "ws" + strings.TrimPrefix(srv.URL, "http")
+}
+
+func TestPacketsAcrossFrames(t *testing.T) {
+	received := make(chan mqpp.ControlPacket, 8)
+	srv := httptest.NewServer(Handler(func(c net.Conn) {
+		defer c.Close()
+		s := mqpp.NewSplitter(c)
+		s.Buffer(make([]byte, 4096), 1<<20)
+		for s.Scan() {
+			p, err := mqpp.Parse(append([]byte(nil), s.Bytes()...))
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			received <- p
+		}
+		close(received)
+	}))
+	defer srv.Close()
+
+	pkts := []mqpp.ControlPacket{
+		mqpp.MakeConnect(mqpp.ProtocolName, mqpp.ProtocolLevel, false, 0, true, 30, "ws", "", nil, "", nil),
+		mqpp.MakePublish(false, mqpp.QosAtLeastOnce, false, "t", 1, bytes.Repeat([]byte("x"), 70000)),
+		mqpp.MakePingreq(),
+		mqpp.MakeDisconnect(),
+	}
+	var stream []byte
+	for _, p := range pkts {
+		stream = append(stream, p.Bytes()...)
+	}
+
+	c, err := Dial(wsURL(srv))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// frames of 3 bytes then one large frame: packets both span and share frames
+	for i := 0; i < 30; i += 3 {
+		c.Write(stream[i : i+3])
+	}
+	c.Write(stream[30:])
+	c.Close()
+
+	for i, expect := range pkts {
+		select {
+		case p, ok := <-received:
+			if !ok {
+				t.Fatalf("no.%d: stream ended", i)
+			}
+			if !bytes.Equal(p.Bytes(), expect.Bytes()) {
+				t.Fatalf("no.%d: expect %v, actual %v", i, expect.Type(), p.Type())
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("no.%d: expect packet", i)
+		}
+	}
+}
+
+func TestBrokerOverWebSocket(t *testing.T) {
+	b := broker.New(broker.Options{})
+	defer b.Close()
+	srv := httptest.NewServer(Handler(b.ServeConn))
+	defer srv.Close()
+
+	ch := make(chan *mqpp.Publish, 1)
+	c := client.New(client.Options{
+		ClientID:       "ws",
+		Dial:           func() (net.Conn, error) { return Dial(wsURL(srv)) },
+		DefaultHandler: func(c *client.Client, p *mqpp.Publish) { ch <- p },
+	})
+	if err := c.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Disconnect()
+	c.Subscribe(nil, mqpp.Subscription{TopicFilter: "ws/#", RequestedQoS: mqpp.QosAtLeastOnce}).Wait()
+	c.Publish("ws/echo", mqpp.QosAtLeastOnce, false, []byte("over websocket")).Wait()
+
+	select {
+	case p := <-ch:
+		if string(p.Payload()) != "over websocket" {
+			t.Fatalf("unexpected payload %s", p.Payload())
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expect publish echoed")
+	}
+}
+
+func TestHandshakeRequiresSubprotocol(t *testing.T) {
+	srv := httptest.NewServer(Handler(func(c net.Conn) { c.Close() }))
+	defer srv.Close()
+
+	req, _ := http.NewRequest(http.MethodGet, srv.URL, nil)
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	req.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expect bad request without subprotocol, actual %d", resp.StatusCode)
+	}
+	if acceptKey("dGhlIHNhbXBsZSBub25jZQ==") != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Fatal("unexpected accept key of RFC 6455 example")
+	}
+}
+
+func TestFragmentation(t *testing.T) {
+	// masked frames with zero mask: opcode byte, payload
+	frame := func(b0 byte, payload string) []byte {
+		return append([]byte{b0, 0x80 | byte(len(payload)), 0, 0, 0, 0}, payload...)
+	}
+	serve := func(frames ...[]byte) (string, error) {
+		nc, s := net.Pipe()
+		defer nc.Close()
+		go func() {
+			for _, f := range frames {
+				nc.Write(f)
+			}
+		}()
+		go io.Copy(io.Discard, nc)
+		c := newConn(s, nil, false)
+		defer c.Close()
+		var read []byte
+		buf := make([]byte, 16)
+		for len(read) < 4 {
+			n, err := c.Read(buf)
+			read = append(read, buf[:n]...)
+			if err != nil {
+				return string(read), err
+			}
+		}
+		return string(read), nil
+	}
+
+	if read, err := serve(frame(opBinary, "ab"), frame(0x80|opContinuation, "cd")); err != nil || read != "abcd" {
+		t.Fatalf("expect abcd from fragmented frame, actual %q: %v", read, err)
+	}
+	if _, err := serve(frame(0x80|opContinuation, "abcd")); err != ErrProtocol {
+		t.Fatalf("expect continuation without fragmented frame fails, actual %v", err)
+	}
+	if _, err := serve(frame(opBinary, "ab"), frame(0x80|opBinary, "cd")); err != ErrProtocol {
+		t.Fatalf("expect data frame within fragmented frame fails, actual %v", err)
+	}
+}
+
+func TestWriteAfterClose(t *testing.T) {
+	nc, s := net.Pipe()
+	defer nc.Close()
+	go io.Copy(io.Discard, nc)
+	c := newConn(s, nil, false)
+	c.Close()
+	if _, err := c.Write([]byte("late")); err != net.ErrClosed {
+		t.Fatalf("expect net.ErrClosed, actual %v", err)
+	}
+}